@@ -0,0 +1,465 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	apiMaxWait        = flag.Duration("api_max_wait", 10*time.Second, "How long an API call may wait for its rate limit window to reset before failing instead")
+	allowPrivateHosts = flag.Bool("allow_private_hosts", false, "Let users point us at servers on loopback, private and link-local addresses, such as a local Mastodon instance for testing")
+)
+
+// api is the client every backend API call goes through. It tracks
+// the x-rate-limit-* headers for each token and endpoint so callers
+// share one budget, and coalesces identical requests that are in
+// flight at the same time.
+var api = &apiClient{
+	limits:   make(map[limitKey]*RateLimit),
+	inflight: make(map[string]*apiCall),
+	requests: make(map[statusKey]int),
+	routes:   make(map[string]bool),
+}
+
+type apiClient struct {
+	mu        sync.Mutex
+	limits    map[limitKey]*RateLimit
+	inflight  map[string]*apiCall // by request key
+	requests  map[statusKey]int
+	routes    map[string]bool // every endpoint seen, up to maxAPIRoutes
+	coalesced int
+}
+
+type limitKey struct {
+	token    string
+	endpoint string // route, from apiRoute
+}
+
+// maxAPIRoutes caps the endpoints the client tracks. Requests to
+// others are counted under "other".
+const maxAPIRoutes = 100
+
+// apiRoutes are the templates of the API paths we call that have
+// users, rooms or messages in them. A segment starting with ':'
+// matches any segment with the same suffix after its first dot.
+var apiRoutes = []string{
+	"/1/direct_messages/destroy/:id.json",
+	"/2/dm_conversations/with/:id/messages",
+	"/2/dm_events/:id",
+	"/2/users/by/username/:handle",
+	"/api/v1/accounts/:id/statuses",
+	"/api/v1/statuses/:id",
+	"/api/v1/statuses/:id/context",
+	"/_matrix/client/v3/profile/:user",
+	"/_matrix/client/v3/rooms/:room/event/:event",
+	"/_matrix/client/v3/rooms/:room/members",
+	"/_matrix/client/v3/rooms/:room/messages",
+	"/_matrix/client/v3/rooms/:room/redact/:event/:txn",
+	"/_matrix/client/v3/rooms/:room/send/m.room.message/:txn",
+	"/_matrix/client/v3/rooms/:room/state/m.room.encryption/",
+	"/_matrix/client/v1/media/download/:server/:media",
+	"/_matrix/media/v3/download/:server/:media",
+}
+
+// apiRouteSegmentRx matches the path segments that may appear in a
+// route as they are: words and NSIDs, and versions like 2, 1.1 and
+// v3.
+var apiRouteSegmentRx = regexp.MustCompile(`^([A-Za-z_.\-]*|v?[0-9](\.[0-9])?)$`)
+
+// apiRoute returns the template in apiRoutes that path matches, or
+// else path itself if it's made of words and versions, or else
+// "other". Routes are what rate limits and metrics are kept by, so
+// there's a bounded number of them and they don't name anyone.
+func apiRoute(path string) string {
+	segs := strings.Split(path, "/")
+routes:
+	for _, route := range apiRoutes {
+		tsegs := strings.Split(route, "/")
+		if len(tsegs) != len(segs) {
+			continue
+		}
+		for i, t := range tsegs {
+			if strings.HasPrefix(t, ":") {
+				suffix := ""
+				if j := strings.Index(t, "."); j >= 0 {
+					suffix = t[j:]
+				}
+				if !strings.HasSuffix(segs[i], suffix) {
+					continue routes
+				}
+			} else if t != segs[i] {
+				continue routes
+			}
+		}
+		return route
+	}
+	for _, seg := range segs {
+		if !apiRouteSegmentRx.MatchString(seg) {
+			return "other"
+		}
+	}
+	return path
+}
+
+// endpoint returns the endpoint that u is counted under.
+func (c *apiClient) endpoint(u *url.URL) string {
+	route := apiRoute(u.Path)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.routes[route] {
+		if len(c.routes) >= maxAPIRoutes {
+			return "other"
+		}
+		c.routes[route] = true
+	}
+	return route
+}
+
+// A statusKey counts the responses from an endpoint with one HTTP
+// status.
+type statusKey struct {
+	endpoint string
+	status   int
+}
+
+// A RateLimit is the most recently reported budget for one token on
+// one endpoint.
+type RateLimit struct {
+	User      string // account the token belongs to
+	Endpoint  string
+	Limit     int
+	Remaining int
+	Reset     time.Time
+}
+
+// An apiCall is a request in flight. Callers making the same
+// request wait on done and share its result.
+type apiCall struct {
+	done chan bool
+	body []byte
+	err  error
+}
+
+var errBodyTooBig = errors.New("API response too large")
+
+// Get does an OAuth-signed GET of urlBase with params on behalf of
+// a and returns the response body. A failed response is returned as
+// one of the typed errors from checkResponse. If maxBytes is
+// positive, larger bodies fail with errBodyTooBig.
+func (c *apiClient) Get(a *Account, urlBase string, params url.Values, maxBytes int64) ([]byte, error) {
+	u, err := url.Parse(urlBase)
+	if err != nil {
+		return nil, err
+	}
+	key := limitKey{token: a.Token, endpoint: c.endpoint(u)}
+	reqKey := fmt.Sprintf("%s %s?%s %d", a.Token, urlBase, params.Encode(), maxBytes)
+
+	c.mu.Lock()
+	if call, ok := c.inflight[reqKey]; ok {
+		c.coalesced++
+		c.mu.Unlock()
+		<-call.done
+		return call.body, call.err
+	}
+	call := &apiCall{done: make(chan bool)}
+	c.inflight[reqKey] = call
+	c.mu.Unlock()
+
+	call.body, call.err = c.do(a, key, func() (*http.Response, error) {
+		return a.signedGet(urlBase, params)
+	}, maxBytes)
+
+	c.mu.Lock()
+	delete(c.inflight, reqKey)
+	c.mu.Unlock()
+	close(call.done)
+	return call.body, call.err
+}
+
+// Do does an OAuth-signed request with another method, such as
+// POST, on behalf of a and returns the response body. Unlike Get,
+// identical requests aren't coalesced. If body is nil, params are
+// sent form-encoded in the body (for POST) or query string;
+// otherwise they go in the query string and body is sent as
+// contentType.
+func (c *apiClient) Do(a *Account, method, urlBase string, params url.Values, contentType string, body []byte) ([]byte, error) {
+	u, err := url.Parse(urlBase)
+	if err != nil {
+		return nil, err
+	}
+	key := limitKey{token: a.Token, endpoint: c.endpoint(u)}
+	return c.do(a, key, func() (*http.Response, error) {
+		return a.signedRequest(method, urlBase, params, contentType, body)
+	}, 0)
+}
+
+// DoPublicRequest sends req, which the caller has already
+// authorized, on behalf of a, with the same rate limit tracking as
+// Get. It's for backends that don't use Twitter's OAuth signing, on
+// servers that users name, such as Mastodon instances, so it goes
+// through publicClient.
+func (c *apiClient) DoPublicRequest(a *Account, req *http.Request, maxBytes int64) ([]byte, error) {
+	key := limitKey{token: a.Token, endpoint: c.endpoint(req.URL)}
+	return c.do(a, key, func() (*http.Response, error) {
+		return publicClient.Do(req)
+	}, maxBytes)
+}
+
+var errPrivateHost = errors.New("refusing to connect to a loopback, private or link-local address")
+
+// publicDialer is the dialer for hosts that users name. It won't
+// connect to our own machine or network, so they can't use us to
+// reach services that aren't meant to be public. The address is
+// checked as it's dialed, after DNS, so a host can't pass a check
+// and then resolve somewhere else.
+var publicDialer = &net.Dialer{
+	Timeout: 30 * time.Second,
+	Control: func(network, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+			return errPrivateHost
+		}
+		return nil
+	},
+}
+
+// publicClient is the HTTP client for hosts that users name. It
+// dials with publicDialer, so redirects are checked too.
+var publicClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext:         publicDialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// publicIP reports whether ip is an address publicClient may
+// connect to.
+func publicIP(ip net.IP) bool {
+	if *allowPrivateHosts {
+		return true
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// checkPublicHost returns errPrivateHost if host, a host name or
+// address, resolves to any address publicClient won't connect to.
+// It's for refusing such hosts up front, with a clearer error than
+// a failed request.
+func checkPublicHost(host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !publicIP(ip) {
+			return errPrivateHost
+		}
+	}
+	return nil
+}
+
+func (c *apiClient) do(a *Account, key limitKey, send func() (*http.Response, error), maxBytes int64) ([]byte, error) {
+	if err := c.waitForBudget(key); err != nil {
+		return nil, err
+	}
+	res, err := send()
+	if err != nil {
+		return nil, err
+	}
+	c.record(a, key, res)
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if maxBytes <= 0 {
+		return ioutil.ReadAll(res.Body)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxBytes+1))
+	if err == nil && int64(len(body)) > maxBytes {
+		return nil, errBodyTooBig
+	}
+	return body, err
+}
+
+// waitForBudget returns once a request for key may be made: at
+// once if the budget isn't known to be used up, or after the window
+// resets if that's within -api_max_wait. Otherwise it returns a
+// RateLimitError without spending a request. A request from a known
+// budget is taken out of it here, before it's sent, so concurrent
+// callers can't all spend the last one.
+func (c *apiClient) waitForBudget(key limitKey) error {
+	for {
+		c.mu.Lock()
+		rl, ok := c.limits[key]
+		if !ok || !time.Now().Before(rl.Reset) {
+			c.mu.Unlock()
+			return nil
+		}
+		if rl.Remaining > 0 {
+			rl.Remaining--
+			c.mu.Unlock()
+			return nil
+		}
+		reset := rl.Reset
+		c.mu.Unlock()
+
+		wait := reset.Sub(time.Now())
+		if wait > *apiMaxWait {
+			return &RateLimitError{
+				APIError: &APIError{StatusCode: 429, Code: twCodeRateLimit, Message: "rate limit budget used up"},
+				Reset:    reset,
+			}
+		}
+		time.Sleep(wait)
+	}
+}
+
+// record notes the rate limit headers and status of res. Within the
+// same window, the remaining budget only goes down: requests sent
+// after this one may have been counted by waitForBudget but not yet
+// by the server.
+func (c *apiClient) record(a *Account, key limitKey, res *http.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests[statusKey{key.endpoint, res.StatusCode}]++
+
+	remaining, err := headerInt(res.Header, "Remaining")
+	if err != nil {
+		if res.StatusCode != 429 {
+			return
+		}
+		remaining = 0
+	}
+	limit, _ := headerInt(res.Header, "Limit")
+	reset := rateLimitReset(res.Header)
+	old, ok := c.limits[key]
+	if ok && old.Reset.Equal(reset) && old.Remaining < remaining {
+		remaining = old.Remaining
+	}
+	if !ok {
+		// Tokens come and go, so before adding one, drop the
+		// limits whose windows are over.
+		now := time.Now()
+		for k, rl := range c.limits {
+			if now.After(rl.Reset) {
+				delete(c.limits, k)
+			}
+		}
+	}
+	c.limits[key] = &RateLimit{
+		User:      a.Username,
+		Endpoint:  key.endpoint,
+		Limit:     limit,
+		Remaining: remaining,
+		Reset:     reset,
+	}
+}
+
+// headerInt returns the first of the rate limit headers named
+// field that's set, in Twitter's spelling (X-Rate-Limit-), Mastodon's
+// (X-RateLimit-) or Bluesky's (RateLimit-).
+func headerInt(h http.Header, field string) (int, error) {
+	var err error
+	for _, prefix := range []string{"X-Rate-Limit-", "X-RateLimit-", "RateLimit-"} {
+		var n int
+		if n, err = strconv.Atoi(h.Get(prefix + field)); err == nil {
+			return n, nil
+		}
+	}
+	return 0, err
+}
+
+// Limits returns the known rate limits for user's token, or for all
+// tokens if user is empty, sorted by user and endpoint.
+func (c *apiClient) Limits(user string) []RateLimit {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []RateLimit
+	for _, rl := range c.limits {
+		if user == "" || rl.User == user {
+			list = append(list, *rl)
+		}
+	}
+	sort.Sort(rateLimitList(list))
+	return list
+}
+
+type rateLimitList []RateLimit
+
+func (l rateLimitList) Len() int      { return len(l) }
+func (l rateLimitList) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l rateLimitList) Less(i, j int) bool {
+	if l[i].User != l[j].User {
+		return l[i].User < l[j].User
+	}
+	return l[i].Endpoint < l[j].Endpoint
+}
+
+// writeMetrics writes the client's counters in the Prometheus text
+// format. Rate limits are reported as the lowest remaining budget
+// per endpoint, so no usernames are exposed.
+func (c *apiClient) writeMetrics(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# TYPE eight22er_api_requests_total counter\n")
+	var reqKeys []statusKey
+	for k := range c.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	sort.Slice(reqKeys, func(i, j int) bool {
+		if reqKeys[i].endpoint != reqKeys[j].endpoint {
+			return reqKeys[i].endpoint < reqKeys[j].endpoint
+		}
+		return reqKeys[i].status < reqKeys[j].status
+	})
+	for _, k := range reqKeys {
+		fmt.Fprintf(w, "eight22er_api_requests_total{endpoint=%q,status=\"%d\"} %d\n", k.endpoint, k.status, c.requests[k])
+	}
+
+	fmt.Fprintf(w, "# TYPE eight22er_api_requests_coalesced_total counter\n")
+	fmt.Fprintf(w, "eight22er_api_requests_coalesced_total %d\n", c.coalesced)
+
+	minRemaining := make(map[string]int)
+	now := time.Now()
+	for _, rl := range c.limits {
+		remaining := rl.Remaining
+		if now.After(rl.Reset) {
+			remaining = rl.Limit
+		}
+		if cur, ok := minRemaining[rl.Endpoint]; !ok || remaining < cur {
+			minRemaining[rl.Endpoint] = remaining
+		}
+	}
+	var endpoints []string
+	for ep := range minRemaining {
+		endpoints = append(endpoints, ep)
+	}
+	sort.Strings(endpoints)
+	fmt.Fprintf(w, "# TYPE eight22er_api_rate_limit_min_remaining gauge\n")
+	for _, ep := range endpoints {
+		fmt.Fprintf(w, "eight22er_api_rate_limit_min_remaining{endpoint=%q} %d\n", ep, minRemaining[ep])
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAPIRoute(t *testing.T) {
+	for path, want := range map[string]string{
+		"/1.1/direct_messages/events/list.json":                             "/1.1/direct_messages/events/list.json",
+		"/1/direct_messages/destroy/1234567.json":                           "/1/direct_messages/destroy/:id.json",
+		"/2/users/by/username/bradfitz":                                     "/2/users/by/username/:handle",
+		"/2/dm_conversations/with/42/messages":                              "/2/dm_conversations/with/:id/messages",
+		"/api/v1/statuses/110123456789/context":                             "/api/v1/statuses/:id/context",
+		"/api/v1/accounts/lookup":                                           "/api/v1/accounts/lookup",
+		"/_matrix/client/v3/rooms/!dm:example.org/send/m.room.message/7":    "/_matrix/client/v3/rooms/:room/send/m.room.message/:txn",
+		"/_matrix/client/v3/profile/@bob:example.org":                       "/_matrix/client/v3/profile/:user",
+		"/_matrix/client/v3/rooms/!dm:example.org/state/m.room.encryption/": "/_matrix/client/v3/rooms/:room/state/m.room.encryption/",
+		"/xrpc/chat.bsky.convo.getLog":                                      "/xrpc/chat.bsky.convo.getLog",
+		"/system/media_attachments/files/110/123/original/a.png":            "other",
+		"/1.1/ton/data/dm/123/456/photo.jpg":                                "other",
+		"/@alice":                                                           "other",
+	} {
+		if got := apiRoute(path); got != want {
+			t.Errorf("apiRoute(%q) = %q; want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An APIError is an error response from a backend's API.
+type APIError struct {
+	StatusCode int    // HTTP status
+	Code       int    // Twitter's error code, or 0
+	Message    string // the service's error message, or the HTTP status text
+	Service    string // name of the service for messages; "" means Twitter
+}
+
+func (e *APIError) Error() string {
+	if e.Code != 0 {
+		return fmt.Sprintf("%s API error %d (HTTP %d): %s", strings.ToLower(e.service()), e.Code, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s API error (HTTP %d): %s", strings.ToLower(e.service()), e.StatusCode, e.Message)
+}
+
+func (e *APIError) service() string {
+	if e.Service == "" {
+		return "Twitter"
+	}
+	return e.Service
+}
+
+// asAPIError returns the APIError inside err, if it's one of the
+// typed errors from checkResponse.
+func asAPIError(err error) *APIError {
+	switch e := err.(type) {
+	case *APIError:
+		return e
+	case *RevokedError:
+		return e.APIError
+	case *RateLimitError:
+		return e.APIError
+	case *SuspendedError:
+		return e.APIError
+	case *ServerError:
+		return e.APIError
+	}
+	return nil
+}
+
+// A RevokedError means the account's access token is no longer
+// valid, usually because the user revoked our app's access.
+type RevokedError struct{ *APIError }
+
+// A RateLimitError means the token has used up its requests for the
+// current window.
+type RateLimitError struct {
+	*APIError
+	Reset time.Time // when requests are allowed again
+}
+
+// A SuspendedError means the service suspended or locked the
+// account.
+type SuspendedError struct{ *APIError }
+
+// A ServerError means the service failed or is over capacity.
+type ServerError struct{ *APIError }
+
+// Twitter API error codes we treat specially.
+const (
+	twCodeNoUser       = 17
+	twCodeBadAuth      = 32
+	twCodeUserNotFound = 50
+	twCodeSuspended    = 64
+	twCodeRateLimit    = 88
+	twCodeBadToken     = 89
+	twCodeOverCapacity = 130
+	twCodeInternal     = 131
+	twCodeLocked       = 326
+)
+
+// checkResponse returns nil if res was successful, and otherwise
+// reads and closes its body and returns the matching typed error.
+func checkResponse(res *http.Response) error {
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	e := &APIError{StatusCode: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+	var errJSON struct {
+		Errors []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Error   string `json:"error"`
+		Message string `json:"message"` // with Error, from XRPC
+	}
+	if json.Unmarshal(body, &errJSON) == nil {
+		switch {
+		case len(errJSON.Errors) > 0:
+			e.Code = errJSON.Errors[0].Code
+			e.Message = errJSON.Errors[0].Message
+		case errJSON.Error != "" && errJSON.Message != "":
+			e.Message = errJSON.Error + ": " + errJSON.Message
+		case errJSON.Error != "":
+			e.Message = errJSON.Error
+		}
+	}
+
+	switch {
+	case res.StatusCode == 429 || e.Code == twCodeRateLimit:
+		return &RateLimitError{APIError: e, Reset: rateLimitReset(res.Header)}
+	case e.Code == twCodeSuspended || e.Code == twCodeLocked:
+		return &SuspendedError{e}
+	case res.StatusCode == http.StatusUnauthorized || e.Code == twCodeBadToken || e.Code == twCodeBadAuth:
+		return &RevokedError{e}
+	case res.StatusCode >= 500 || e.Code == twCodeOverCapacity || e.Code == twCodeInternal:
+		return &ServerError{e}
+	}
+	return e
+}
+
+// rateLimitReset returns the time from Twitter's x-rate-limit-reset
+// or Bluesky's ratelimit-reset header (Unix seconds), Mastodon's
+// x-ratelimit-reset (RFC 3339) or a standard Retry-After in seconds,
+// or 15 minutes from now (Twitter's window) if there isn't one.
+func rateLimitReset(h http.Header) time.Time {
+	if sec, err := strconv.ParseInt(h.Get("X-Rate-Limit-Reset"), 10, 64); err == nil {
+		return time.Unix(sec, 0)
+	}
+	if sec, err := strconv.ParseInt(h.Get("RateLimit-Reset"), 10, 64); err == nil {
+		return time.Unix(sec, 0)
+	}
+	if t, err := time.Parse(time.RFC3339, h.Get("X-RateLimit-Reset")); err == nil {
+		return t
+	}
+	if sec, err := strconv.Atoi(h.Get("Retry-After")); err == nil {
+		return time.Now().Add(time.Duration(sec) * time.Second)
+	}
+	return time.Now().Add(15 * time.Minute)
+}
+
+// errorText describes err for the user, for the protocols to wrap
+// in their own error responses.
+func errorText(err error) string {
+	switch e := err.(type) {
+	case *RevokedError:
+		return e.service() + " no longer accepts eight22er's access to your account; sign in again at https://eight22er.danga.com/"
+	case *SuspendedError:
+		return e.service() + " says your account is suspended or locked: " + oneLine(e.Message)
+	case *RateLimitError:
+		return fmt.Sprintf("%s rate limit hit; try again after %s", e.service(), e.Reset.UTC().Format("15:04 MST"))
+	case *ServerError:
+		return e.service() + " is having problems: " + oneLine(e.Message)
+	}
+	return oneLine(err.Error())
+}
+
+// refusedText describes err if it's the service refusing a message
+// we sent, as opposed to failing, and returns "" if not.
+func refusedText(err error) string {
+	switch e := err.(type) {
+	case *APIError:
+		if e.StatusCode >= 400 && e.StatusCode < 500 {
+			return e.service() + " refused the message: " + oneLine(e.Message)
+		}
+	case *RejectedError:
+		return oneLine(e.Reason)
+	}
+	return ""
+}
+
+// popError returns the text for a POP3 -ERR response describing err,
+// starting with an RFC 2449/3206 response code.
+func popError(err error) string {
+	switch err.(type) {
+	case *RevokedError:
+		return "[AUTH] " + errorText(err)
+	case *SuspendedError:
+		return "[SYS/PERM] " + errorText(err)
+	}
+	return "[SYS/TEMP] " + errorText(err)
+}
+
+// imapError returns the text for an IMAP NO response describing
+// err, starting with an RFC 5530 response code.
+func imapError(err error) string {
+	switch err.(type) {
+	case *RevokedError:
+		return "[AUTHENTICATIONFAILED] " + errorText(err)
+	case *SuspendedError:
+		return "[CONTACTADMIN] " + errorText(err)
+	}
+	return "[UNAVAILABLE] " + errorText(err)
+}
+
+// smtpError returns err as an SMTP response with an RFC 3463
+// enhanced status code: temporary for rate limits and outages,
+// permanent for revoked tokens, suspensions and messages the
+// service refuses.
+func smtpError(err error) error {
+	switch err.(type) {
+	case *RevokedError:
+		return smtpReply("535 5.7.8 " + errorText(err))
+	case *SuspendedError:
+		return smtpReply("554 5.7.1 " + errorText(err))
+	case *RateLimitError:
+		return smtpReply("451 4.7.0 " + errorText(err))
+	case *RejectedError:
+		return smtpReply("554 5.6.0 " + refusedText(err))
+	}
+	if text := refusedText(err); text != "" {
+		return smtpReply("554 5.7.1 " + text)
+	}
+	return smtpReply("451 4.3.0 " + errorText(err))
+}
+
+// jmapSendError returns the JMAP SetError type and description for
+// a failure to send an EmailSubmission. RFC 8621 has no type for a
+// temporary failure, so those are serverFail and worth retrying.
+func jmapSendError(err error) (typ, desc string) {
+	switch err.(type) {
+	case *RevokedError, *SuspendedError:
+		return "forbiddenToSend", errorText(err)
+	case *RateLimitError:
+		return "rateLimit", errorText(err)
+	}
+	if text := refusedText(err); text != "" {
+		return "forbiddenToSend", text
+	}
+	return "serverFail", errorText(err)
+}
+
+func oneLine(s string) string {
+	return strings.Replace(strings.Replace(s, "\r", " ", -1), "\n", " ", -1)
+}
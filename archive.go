@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var maxArchiveBytes = flag.Int64("max_archive_bytes", 1<<30, "Largest Twitter archive that can be uploaded to /import")
+
+// A twitterArchive is the data archive Twitter lets users download,
+// which has their whole DM history where the API only returns the
+// last month or so. It can be the zip file, a directory it was
+// unpacked into, or just its direct-messages.js.
+type twitterArchive struct {
+	files map[string]func() (io.ReadCloser, error) // by slash-separated path
+}
+
+var (
+	// archiveDMRx matches the files of one-to-one and group
+	// conversations, which big archives split into parts. Older
+	// archives call them direct-message.js.
+	archiveDMRx = regexp.MustCompile(`(^|/)direct-messages?(-group)?(-part\d+)?\.js$`)
+
+	// archiveMediaRx matches the photos and videos attached to
+	// DMs, named for the ID of their DM.
+	archiveMediaRx = regexp.MustCompile(`(^|/)direct_messages?(_group)?_media/(\d+)-([^/]+)$`)
+
+	archiveAccountRx = regexp.MustCompile(`(^|/)account\.js$`)
+)
+
+// openTwitterArchive opens the archive at name. Close the returned
+// io.Closer when done with it.
+func openTwitterArchive(name string) (*twitterArchive, io.Closer, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.IsDir() {
+		ar := &twitterArchive{files: make(map[string]func() (io.ReadCloser, error))}
+		err := filepath.Walk(name, func(p string, fi os.FileInfo, err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(name, p)
+			if err != nil {
+				return err
+			}
+			ar.files[filepath.ToSlash(rel)] = func() (io.ReadCloser, error) { return os.Open(p) }
+			return nil
+		})
+		return ar, ioutil.NopCloser(nil), err
+	}
+	if strings.HasSuffix(strings.ToLower(name), ".js") {
+		ar := &twitterArchive{files: map[string]func() (io.ReadCloser, error){
+			filepath.Base(name): func() (io.ReadCloser, error) { return os.Open(name) },
+		}}
+		return ar, ioutil.NopCloser(nil), nil
+	}
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return zipArchive(&zr.Reader), zr, nil
+}
+
+func zipArchive(zr *zip.Reader) *twitterArchive {
+	ar := &twitterArchive{files: make(map[string]func() (io.ReadCloser, error))}
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, "/") {
+			ar.files[f.Name] = f.Open
+		}
+	}
+	return ar
+}
+
+// readYTD decodes one of the archive's data files, which are
+// JavaScript assigning JSON to a window.YTD variable, as it reads
+// it. Files bigger uncompressed than -max_archive_bytes are refused,
+// so a small zip can't unpack into more than an upload could hold.
+func (ar *twitterArchive) readYTD(name string, v interface{}) error {
+	rc, err := ar.files[name]()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	lr := &io.LimitedReader{R: rc, N: *maxArchiveBytes + 1}
+	br := bufio.NewReader(lr)
+	js, err := br.ReadSlice('=')
+	if err != nil || !bytes.HasPrefix(bytes.TrimSpace(js), []byte("window.YTD.")) {
+		return fmt.Errorf("%s: not a Twitter archive data file", name)
+	}
+	err = json.NewDecoder(br).Decode(v)
+	if lr.N <= 0 {
+		return fmt.Errorf("%s: bigger than -max_archive_bytes", name)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// An archiveMessage is one DM in direct-messages.js. Group DMs have
+// no recipientId.
+type archiveMessage struct {
+	ID          string `json:"id"`
+	SenderID    string `json:"senderId"`
+	RecipientID string `json:"recipientId"`
+	Text        string `json:"text"`
+	CreatedAt   string `json:"createdAt"`
+	URLs        []struct {
+		URL      string `json:"url"`
+		Expanded string `json:"expanded"`
+		Display  string `json:"display"`
+	} `json:"urls"`
+	MediaURLs []string `json:"mediaUrls"`
+}
+
+type archiveConversation struct {
+	DMConversation struct {
+		ConversationID string `json:"conversationId"`
+		Messages       []struct {
+			MessageCreate *archiveMessage `json:"messageCreate"`
+		} `json:"messages"`
+	} `json:"dmConversation"`
+}
+
+// self returns the account the archive belongs to, from account.js,
+// or an empty User if it's just direct-messages.js.
+func (ar *twitterArchive) self() (User, error) {
+	for name := range ar.files {
+		if !archiveAccountRx.MatchString(name) {
+			continue
+		}
+		var accts []struct {
+			Account struct {
+				AccountID   string `json:"accountId"`
+				Username    string `json:"username"`
+				DisplayName string `json:"accountDisplayName"`
+			} `json:"account"`
+		}
+		if err := ar.readYTD(name, &accts); err != nil {
+			return User{}, err
+		}
+		if len(accts) > 0 {
+			id, _ := strconv.ParseInt(accts[0].Account.AccountID, 10, 64)
+			return User{ID: id, Handle: accts[0].Account.Username, Name: accts[0].Account.DisplayName}, nil
+		}
+	}
+	return User{}, nil
+}
+
+// DMs returns the DMs in the archive, which is self's. Their senders
+// and recipients are only IDs there, so they're looked up as a's;
+// users Twitter no longer has get placeholder handles that can't be
+// mailed. Media in the archive is kept for a, so it's attached
+// without fetching it again; media URLs that aren't on
+// Twitter's media hosts are dropped, since rendering would fetch
+// them with the account's token.
+func (ar *twitterArchive) DMs(a *Account, self User) ([]DM, error) {
+	var convs []archiveConversation
+	for name := range ar.files {
+		if !archiveDMRx.MatchString(name) {
+			continue
+		}
+		var part []archiveConversation
+		if err := ar.readYTD(name, &part); err != nil {
+			return nil, err
+		}
+		convs = append(convs, part...)
+	}
+	if len(convs) == 0 {
+		return nil, errors.New("no direct-messages.js in the archive")
+	}
+
+	var ids []string
+	for _, c := range convs {
+		for _, m := range c.DMConversation.Messages {
+			if m.MessageCreate != nil {
+				ids = append(ids, m.MessageCreate.SenderID, m.MessageCreate.RecipientID)
+			}
+		}
+	}
+	users, err := lookupUsers(a, ids)
+	if err != nil {
+		return nil, fmt.Errorf("looking up users: %v", err)
+	}
+	user := func(id string) User {
+		if u := users[id]; u.Handle != "" {
+			return u
+		}
+		n, _ := strconv.ParseInt(id, 10, 64)
+		return User{ID: n, Handle: "id-" + id, Name: "Twitter user " + id}
+	}
+
+	media := make(map[string][]string) // DM ID -> archive paths
+	for name := range ar.files {
+		if sm := archiveMediaRx.FindStringSubmatch(name); sm != nil {
+			media[sm[3]] = append(media[sm[3]], name)
+		}
+	}
+
+	var dms []DM
+	for _, c := range convs {
+		conv := c.DMConversation.ConversationID
+		group := !strings.Contains(conv, "-")
+		var members []string // in a group, who's sent to it
+		for _, m := range c.DMConversation.Messages {
+			if m.MessageCreate != nil && group {
+				members = append(members, m.MessageCreate.SenderID)
+			}
+		}
+		for _, m := range c.DMConversation.Messages {
+			am := m.MessageCreate
+			if am == nil {
+				continue // someone joining or leaving, or renaming a group
+			}
+			id, err := strconv.ParseInt(am.ID, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("conversation %s: bad DM id %q", conv, am.ID)
+			}
+			t, err := time.Parse(time.RFC3339, am.CreatedAt)
+			if err != nil {
+				return nil, fmt.Errorf("DM %d: bad createdAt %q", id, am.CreatedAt)
+			}
+			dm := DM{
+				ID:        id,
+				Text:      am.Text,
+				CreatedAt: t,
+				Sender:    user(am.SenderID),
+				Recipient: user(am.RecipientID),
+			}
+			if group {
+				// Like the other group chat backends: the
+				// recipient is us, or if we sent it, someone
+				// else in the group.
+				dm.Conversation = conv
+				dm.Recipient = self
+				if a.is(dm.Sender) {
+					for _, mid := range members {
+						if u := user(mid); !a.is(u) {
+							dm.Recipient = u
+							break
+						}
+					}
+				}
+			}
+			for _, u := range am.URLs {
+				if i := strings.Index(am.Text, u.URL); i >= 0 {
+					start := len([]rune(am.Text[:i]))
+					dm.Entities.URLs = append(dm.Entities.URLs, URLEntity{
+						URL:         u.URL,
+						ExpandedURL: u.Expanded,
+						DisplayURL:  u.Display,
+						Indices:     [2]int{start, start + len([]rune(u.URL))},
+					})
+				}
+			}
+			for _, u := range am.MediaURLs {
+				if !isTwitterMediaURL(u) {
+					continue
+				}
+				kind := "photo"
+				if strings.HasSuffix(strings.ToLower(path.Ext(u)), "mp4") {
+					kind = "video"
+				}
+				dm.Entities.Media = append(dm.Entities.Media, MediaEntity{Type: kind, MediaURLHTTPS: u})
+				ar.cacheMedia(a, u, am.ID, media[am.ID])
+			}
+			dms = append(dms, dm)
+		}
+	}
+	return dms, nil
+}
+
+// cacheMedia keeps the archive's copy of the media at URL u, one of
+// the files for DM id, as a's; see accountMediaFile.
+func (ar *twitterArchive) cacheMedia(a *Account, u, id string, files []string) {
+	if len(files) == 0 {
+		return
+	}
+	cacheFile := accountMediaFile(a.Username, u)
+	if _, err := os.Stat(cacheFile); err == nil {
+		return
+	}
+	file := files[0]
+	for _, f := range files {
+		if strings.HasSuffix(f, "/"+id+"-"+path.Base(u)) {
+			file = f
+		}
+	}
+	rc, err := ar.files[file]()
+	if err != nil {
+		log.Printf("import: %s: %v", file, err)
+		return
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, int64(*maxMediaBytes)+1))
+	if err != nil {
+		log.Printf("import: %s: %v", file, err)
+		return
+	}
+	if len(data) > *maxMediaBytes {
+		return // left as a link, like media too big to fetch
+	}
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0700); err != nil {
+		log.Printf("media cache: %v", err)
+	} else if err := ioutil.WriteFile(cacheFile, data, 0600); err != nil {
+		log.Printf("media cache: %v", err)
+	}
+}
+
+// importArchive adds the DMs in the archive to the account's store,
+// returning how many it had and how many of those were new. DMs
+// already synced, or deleted, are skipped by ID.
+func importArchive(a *Account, s MessageStore, ar *twitterArchive) (found, added int, err error) {
+	if name := backendFor(a).Name(); name != "twitter" {
+		return 0, 0, fmt.Errorf("%s is on %s, not Twitter", a.Username, name)
+	}
+	self, err := ar.self()
+	if err != nil {
+		return 0, 0, err
+	}
+	if self.Handle != "" && !a.is(self) {
+		return 0, 0, fmt.Errorf("this is @%s's archive, not %s's", self.Handle, a.Username)
+	}
+	if self.Handle == "" {
+		self = User{Handle: a.Username}
+	}
+	dms, err := ar.DMs(a, self)
+	if err != nil {
+		return 0, 0, err
+	}
+	added, err = s.Add(dms)
+	return len(dms), added, err
+}
+
+// importCommand imports a Twitter archive into a user's message
+// store. It can't while the server has the store open; upload the
+// archive to /import instead.
+func importCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: import user twitter-archive.zip|dir|direct-messages.js")
+	}
+	user := args[0]
+	if _, err := os.Stat(accountFile(user)); err != nil {
+		return fmt.Errorf("no account %q", user)
+	}
+	ar, closer, err := openTwitterArchive(args[1])
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	s, err := openMessageStore(user)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	found, added, err := importArchive(GetAccountNoAuth(user), s, ar)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d DMs in the archive, %d new\n", user, found, added)
+	return nil
+}
+
+// importFunc imports a Twitter archive zip, or its
+// direct-messages.js, uploaded as the "archive" field of a
+// multipart form. The account signs in with HTTP Basic auth or
+// username and password fields ahead of the archive, so nothing is
+// saved from the upload until it has.
+func importFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST a Twitter archive", http.StatusMethodNotAllowed)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, *maxArchiveBytes)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "bad upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	user, pass, basic := r.BasicAuth()
+	var part *multipart.Part
+	for part == nil {
+		p, err := mr.NextPart()
+		if err != nil {
+			http.Error(w, "no archive uploaded", http.StatusBadRequest)
+			return
+		}
+		switch p.FormName() {
+		case "archive":
+			part = p
+		case "username", "password":
+			if basic {
+				continue
+			}
+			v, _ := ioutil.ReadAll(io.LimitReader(p, 1<<10))
+			if p.FormName() == "username" {
+				user = string(v)
+			} else {
+				pass = string(v)
+			}
+		}
+	}
+	acct, err := GetAccount(user, pass)
+	if err != nil {
+		http.Error(w, "bad username or password", http.StatusForbidden)
+		return
+	}
+	f, err := ioutil.TempFile("", "eight22er-import-")
+	if err != nil {
+		http.Error(w, "can't save upload", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, part)
+	if err != nil {
+		http.Error(w, "bad upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var ar *twitterArchive
+	if filename := part.FileName(); strings.HasSuffix(strings.ToLower(filename), ".js") {
+		ar = &twitterArchive{files: map[string]func() (io.ReadCloser, error){
+			path.Base(filename): func() (io.ReadCloser, error) { return ioutil.NopCloser(io.NewSectionReader(f, 0, size)), nil },
+		}}
+	} else {
+		zr, err := zip.NewReader(f, size)
+		if err != nil {
+			http.Error(w, "not a zip file: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ar = zipArchive(zr)
+	}
+	s, err := syncer.Store(acct.Username)
+	if err != nil {
+		http.Error(w, "can't open message store", http.StatusInternalServerError)
+		return
+	}
+	found, added, err := importArchive(acct, s, ar)
+	if err != nil {
+		log.Printf("import: for %q: %v", acct.Username, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("import: %q: %d DMs in archive, %d new", acct.Username, found, added)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Imported %d DMs from your archive; %d were new.\n", found, added)
+}
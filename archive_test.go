@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/eight22er/faketwitter"
+)
+
+func TestArchiveFileTooBig(t *testing.T) {
+	defer func(n int64) { *maxArchiveBytes = n }(*maxArchiveBytes)
+	*maxArchiveBytes = 4 << 10
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("data/direct-messages.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("window.YTD.direct_messages.part0 = [" + strings.Repeat(" ", 1<<20) + "]"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() > int(*maxArchiveBytes) {
+		t.Fatalf("zip is %d bytes; want it smaller than the limit", buf.Len())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var convs []archiveConversation
+	err = zipArchive(zr).readYTD("data/direct-messages.js", &convs)
+	if err == nil || !strings.Contains(err.Error(), "max_archive_bytes") {
+		t.Errorf("readYTD = %v; want it refused as too big", err)
+	}
+
+	*maxArchiveBytes = 2 << 20
+	if err := zipArchive(zr).readYTD("data/direct-messages.js", &convs); err != nil {
+		t.Errorf("readYTD under the limit: %v", err)
+	}
+}
+
+// testArchive returns an archive of a zip file with the given files.
+func testArchive(t *testing.T, files map[string]string) *twitterArchive {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zipArchive(zr)
+}
+
+// archiveAccountJS is an account.js for the user.
+func archiveAccountJS(u faketwitter.User) string {
+	return fmt.Sprintf(`window.YTD.account.part0 = [{"account": {"accountId": "%d", "username": %q, "accountDisplayName": %q}}]`, u.ID, u.ScreenName, u.Name)
+}
+
+func TestArchiveImport(t *testing.T) {
+	testDB(t)
+	f := newFakeTwitter(t)
+	alice, _ := f.User("alice")
+	bob, _ := f.User("bob")
+	carol, _ := f.User("carol")
+	a := &Account{Username: "alice", Password: "pw", Backend: "twitter", Token: alice.Token, TokenSecret: alice.TokenSecret}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const photo = "https://ton.twitter.com/1.1/ton/data/dm/1500000000000000001/1500000000000000009/AbCd.jpg"
+	msg := func(id string, from, to int64, text, createdAt string, media ...string) string {
+		recipient := ""
+		if to != 0 {
+			recipient = fmt.Sprint(to)
+		}
+		m, _ := json.Marshal(map[string]interface{}{"messageCreate": map[string]interface{}{
+			"id": id, "senderId": fmt.Sprint(from), "recipientId": recipient,
+			"text": text, "createdAt": createdAt, "urls": []string{}, "mediaUrls": media,
+		}})
+		return string(m)
+	}
+	conv := func(id string, msgs ...string) string {
+		return fmt.Sprintf(`{"dmConversation": {"conversationId": %q, "messages": [%s]}}`, id, strings.Join(msgs, ","))
+	}
+	files := map[string]string{
+		"data/account.js": archiveAccountJS(alice),
+		"data/direct-messages.js": "window.YTD.direct_messages.part0 = [" + conv(fmt.Sprintf("%d-%d", alice.ID, bob.ID),
+			msg("1500000000000000002", alice.ID, bob.ID, "hi bob", "2022-01-01T10:01:00.000Z", "http://169.254.169.254/latest/meta-data/"),
+			msg("1500000000000000001", bob.ID, alice.ID, "hi alice https://t.co/AbCd", "2022-01-01T10:00:00.000Z", photo),
+		) + "]",
+		"data/direct-messages-group-part1.js": "window.YTD.direct_messages_group.part0 = [" + conv("1400000000000000000",
+			msg("1500000000000000004", alice.ID, 0, "me too", "2022-01-02T10:01:00.000Z"),
+			`{"joinConversation": {"initiatingUserId": "1"}}`,
+			msg("1500000000000000003", carol.ID, 0, "hi group", "2022-01-02T10:00:00.000Z"),
+		) + "]",
+		"data/direct_messages_media/1500000000000000001-AbCd.jpg": "JPEG DATA",
+	}
+
+	found, added, err := importArchive(a, store, testArchive(t, files))
+	if err != nil || found != 4 || added != 4 {
+		t.Fatalf("import = %d, %d, %v; want 4 found and added", found, added, err)
+	}
+	var got []string
+	for _, dm := range store.DMs() {
+		got = append(got, fmt.Sprintf("%d %s>%s %q %s", dm.ID, dm.Sender.Handle, dm.Recipient.Handle, dm.Conversation, dm.Text))
+	}
+	want := []string{
+		`1500000000000000004 alice>carol "1400000000000000000" me too`,
+		`1500000000000000003 carol>alice "1400000000000000000" hi group`,
+		`1500000000000000002 alice>bob "" hi bob`,
+		`1500000000000000001 bob>alice "" hi alice https://t.co/AbCd`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("imported DMs =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if dm, _ := store.Get(1500000000000000001); len(dm.Entities.Media) != 1 || dm.Entities.Media[0].MediaURLHTTPS != photo {
+		t.Errorf("DM with a photo has media %+v", dm.Entities.Media)
+	}
+	if dm, _ := store.Get(1500000000000000002); len(dm.Entities.Media) != 0 {
+		t.Errorf("media not on Twitter's hosts was kept: %+v", dm.Entities.Media)
+	}
+	if data, err := a.fetchMedia(photo); err != nil || string(data) != "JPEG DATA" {
+		t.Errorf("fetchMedia = %q, %v; want the archive's photo", data, err)
+	}
+	if _, err := os.Stat(mediaCacheFile(photo)); err == nil {
+		t.Errorf("the archive's photo is in the media cache for everyone")
+	}
+
+	found, added, err = importArchive(a, store, testArchive(t, files))
+	if err != nil || found != 4 || added != 0 {
+		t.Errorf("import again = %d, %d, %v; want 4 found and none added", found, added, err)
+	}
+
+	files["data/account.js"] = archiveAccountJS(bob)
+	if _, _, err := importArchive(a, store, testArchive(t, files)); err == nil || !strings.Contains(err.Error(), "@bob's archive") {
+		t.Errorf("importing bob's archive = %v; want it refused", err)
+	}
+	if n := len(store.DMs()); n != 4 {
+		t.Errorf("store has %d DMs after refusing bob's archive; want 4", n)
+	}
+}
+
+func TestImportFuncAuth(t *testing.T) {
+	testDB(t)
+	a := &Account{Username: "alice", Password: "pw", Backend: "twitter", Token: "t", TokenSecret: "s"}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	upload := func(query string, fields ...string) *httptest.ResponseRecorder {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for i := 0; i+1 < len(fields); i += 2 {
+			mw.WriteField(fields[i], fields[i+1])
+		}
+		fw, _ := mw.CreateFormFile("archive", "direct-messages.js")
+		fw.Write([]byte("window.YTD.direct_messages.part0 = []"))
+		mw.Close()
+		r := httptest.NewRequest("POST", "/import"+query, &buf)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		importFunc(w, r)
+		return w
+	}
+	if w := upload("", "username", "alice", "password", "wrong"); w.Code != http.StatusForbidden {
+		t.Errorf("import with the wrong password: %d %s", w.Code, w.Body)
+	}
+	if w := upload("?username=alice&password=pw"); w.Code != http.StatusForbidden {
+		t.Errorf("import with the password in the URL: %d %s", w.Code, w.Body)
+	}
+	// Signed in, it gets as far as finding no DMs.
+	if w := upload("", "username", "alice", "password", "pw"); !strings.Contains(w.Body.String(), "no direct-messages.js") {
+		t.Errorf("import: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A Backend is a messaging service eight22er proxies as mail. The
+// POP, SMTP and web servers only reach services through a Backend.
+type Backend interface {
+	// Name is the backend's name in account files and URLs.
+	Name() string
+
+	// Host is the host name of a's server, for Received headers.
+	Host(a *Account) string
+
+	// StartLogin begins signing a user in from the web and returns
+	// the URL to send their browser to. The service sends them on
+	// to callback when they're done.
+	StartLogin(r *http.Request, callback string) (string, error)
+
+	// FinishLogin completes a sign-in from the callback request,
+	// given the same callback StartLogin was. It returns an Account
+	// with just the username, credentials and instance set.
+	FinishLogin(r *http.Request, callback string) (*Account, error)
+
+	// Streams returns the names of a's message streams to sync,
+	// in a fixed order.
+	Streams(a *Account) []string
+
+	// Sync fetches the messages in stream that c doesn't cover
+	// yet, advancing c over the ones it returns.
+	Sync(a *Account, stream string, c *SyncCursor) ([]DM, error)
+
+	// Conversations returns a's recent conversations, most recent
+	// first.
+	Conversations(a *Account) ([]Conversation, error)
+
+	// Messages returns up to n of the most recent messages in the
+	// conversation with the given ID, newest first.
+	Messages(a *Account, conv string, n int) ([]DM, error)
+
+	// Send sends a message from a and returns what was stored:
+	// one DM, or one per recipient on services without group
+	// messages.
+	Send(a *Account, m *Outgoing) ([]DM, error)
+
+	// Delete deletes one of a's messages on the service.
+	Delete(a *Account, id int64) error
+
+	// UploadMedia uploads a file to attach to a message sent
+	// later, returning the service's ID for it.
+	UploadMedia(a *Account, filename string, data []byte) (string, error)
+
+	// ResolveUser returns the user a mail address's local part
+	// refers to. It's the inverse of MailAddress, whose local part
+	// for the account's own user must be its Username.
+	ResolveUser(a *Account, localpart string) (User, error)
+
+	// MailAddress returns the address mail from or to u uses.
+	MailAddress(u User) string
+
+	// FetchMedia downloads a photo or video URL from one of a's
+	// messages. It fails with errMediaTooBig if the file is
+	// larger than maxBytes.
+	FetchMedia(a *Account, u string, maxBytes int64) ([]byte, error)
+}
+
+// A Conversation is a thread of messages between an account and
+// one or more other users.
+type Conversation struct {
+	ID           string
+	Participants []User // not including the account itself
+	Latest       DM
+}
+
+// An Outgoing message is one being sent through a Backend.
+type Outgoing struct {
+	To        []User
+	InReplyTo int64 // ID of the DM being replied to, or 0
+	Text      string
+	MediaIDs  []string // from UploadMedia
+}
+
+// A RejectedError means a backend won't send a message as it is,
+// so there's no point trying again.
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string { return e.Reason }
+
+const defaultBackend = "twitter"
+
+// backends maps backend names to implementations.
+var backends = map[string]Backend{
+	"twitter":  twitterBackend{},
+	"mastodon": mastodonBackend{},
+	"matrix":   matrixBackend{},
+	"irc":      ircBackend{},
+	"bluesky":  blueskyBackend{},
+}
+
+// backendFor returns the backend a is on. Accounts that predate
+// backends, and a nil a, are Twitter's.
+func backendFor(a *Account) Backend {
+	if a != nil && a.Backend != "" {
+		if b, ok := backends[a.Backend]; ok {
+			return b
+		}
+	}
+	return backends[defaultBackend]
+}
+
+// timeEpoch is Twitter's snowflake epoch, in Unix milliseconds.
+// timeIDs count from it, as snowflakes do, so they fit in an int64
+// until 2080.
+const timeEpoch = 1288834974657
+
+// timeID returns a DM ID for a message from a service without
+// numeric IDs: its time in milliseconds since timeEpoch in the high
+// bits, like a Twitter snowflake, so IDs sort by time, and a hash of
+// key, which identifies the message, in the low 22.
+func timeID(t time.Time, key string) int64 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	ms := t.UnixNano()/int64(time.Millisecond) - timeEpoch
+	return ms<<22 | int64(h.Sum32()&(1<<22-1))
+}
+
+// storedDM returns one of a's synced DMs, for finding the message a
+// numeric ID refers to on a backend whose IDs aren't numbers.
+func storedDM(a *Account, id int64) (DM, bool) {
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		return DM{}, false
+	}
+	return store.Get(id)
+}
+
+// Backends that sign users in with credentials typed into our own
+// form, rather than a redirect to the service, check them in
+// StartLogin and park the account here under a random state until
+// FinishLogin claims it, so credentials never appear in a URL.
+var pendingLogins = struct {
+	sync.Mutex
+	m map[string]pendingLogin // by state
+}{m: make(map[string]pendingLogin)}
+
+type pendingLogin struct {
+	acct    *Account
+	created time.Time
+}
+
+const pendingLoginTTL = 10 * time.Minute
+
+// parkLogin holds a for claimLogin and returns the callback URL to
+// redirect to.
+func parkLogin(a *Account, callback string) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	state := fmt.Sprintf("%x", b[:])
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	for k, l := range pendingLogins.m {
+		if time.Since(l.created) > pendingLoginTTL {
+			delete(pendingLogins.m, k)
+		}
+	}
+	pendingLogins.m[state] = pendingLogin{a, time.Now()}
+	return callback + "&state=" + state, nil
+}
+
+// claimLogin returns the account parked for the callback request r.
+func claimLogin(r *http.Request) (*Account, error) {
+	state := r.FormValue("state")
+	pendingLogins.Lock()
+	defer pendingLogins.Unlock()
+	l, ok := pendingLogins.m[state]
+	delete(pendingLogins.m, state)
+	if !ok || time.Since(l.created) > pendingLoginTTL {
+		return nil, errors.New("sign-in expired; try again")
+	}
+	return l.acct, nil
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeID(t *testing.T) {
+	var last int64
+	for _, s := range []string{"2016-01-01T00:00:00Z", "2024-05-01T12:00:00Z", "2039-09-08T00:00:00Z", "2079-12-31T00:00:00Z"} {
+		at, _ := time.Parse(time.RFC3339, s)
+		id := timeID(at, "key")
+		if id <= last {
+			t.Errorf("timeID(%s) = %d, not after %d", s, id, last)
+		}
+		last = id
+	}
+}
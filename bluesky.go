@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var (
+	blueskyService      = flag.String("bluesky_service", "https://bsky.social", "Bluesky server to sign in at when a user doesn't name their own")
+	blueskyPLCDirectory = flag.String("bluesky_plc_directory", "https://plc.directory", "Directory that Bluesky's did:plc DIDs are resolved at")
+	blueskyChatService  = flag.String("bluesky_chat_service", "did:web:api.bsky.chat#bsky_chat", "atproto-proxy service that Bluesky chat requests go to")
+)
+
+// blueskyBackend is the Backend for Bluesky chat, through the
+// chat.bsky.convo API proxied by the account's PDS (its personal
+// data server, in Instance). Accounts sign in with an app password;
+// Token and TokenSecret hold the session's access and refresh JWTs,
+// which are refreshed and saved as they expire. Users name their
+// servers, so they're reached through publicClient.
+//
+// Bluesky handles are already domain names, so they're the local
+// part of mail addresses as they are. Message IDs aren't numbers, so
+// DM IDs come from timeID and the message ID is the DM's Ref.
+type blueskyBackend struct{}
+
+const blueskyMaxText = 1000 // characters in a chat message
+
+func (blueskyBackend) Name() string { return "bluesky" }
+
+func (blueskyBackend) Host(a *Account) string {
+	if a != nil {
+		if u, err := url.Parse(a.Instance); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return "bsky.social"
+}
+
+// A blueskySession is the response to createSession and
+// refreshSession.
+type blueskySession struct {
+	AccessJwt  string `json:"accessJwt"`
+	RefreshJwt string `json:"refreshJwt"`
+	Handle     string `json:"handle"`
+	DID        string `json:"did"`
+}
+
+// A didDoc is the part of an atproto DID document that we use.
+type didDoc struct {
+	AlsoKnownAs []string `json:"alsoKnownAs"` // at:// URIs of its handles
+	Service     []struct {
+		ID       string `json:"id"`
+		Endpoint string `json:"serviceEndpoint"`
+	} `json:"service"`
+}
+
+// pds returns the URL of the account's own PDS, or "" if the
+// document doesn't say.
+func (d *didDoc) pds() string {
+	for _, svc := range d.Service {
+		if svc.ID == "#atproto_pds" {
+			return strings.TrimRight(svc.Endpoint, "/")
+		}
+	}
+	return ""
+}
+
+// StartLogin creates a session with the handle and app password
+// from our sign-in form. The password is only taken from a POST
+// body, never the URL.
+func (blueskyBackend) StartLogin(r *http.Request, callback string) (string, error) {
+	service := *blueskyService
+	if s := strings.TrimSpace(r.FormValue("service")); s != "" {
+		var err error
+		if service, err = normalizeInstance(s); err != nil {
+			return "", err
+		}
+	}
+	ident := strings.TrimPrefix(strings.TrimSpace(r.FormValue("handle")), "@")
+	body, err := json.Marshal(map[string]string{
+		"identifier": ident,
+		"password":   r.PostFormValue("password"),
+	})
+	if err != nil {
+		return "", err
+	}
+	res, err := publicClient.Post(service+"/xrpc/com.atproto.server.createSession", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	if err := checkResponse(res); err != nil {
+		if e := asAPIError(err); e != nil {
+			e.Service = "Bluesky"
+		}
+		return "", err
+	}
+	defer res.Body.Close()
+	var sess blueskySession
+	if err := json.NewDecoder(res.Body).Decode(&sess); err != nil || sess.AccessJwt == "" {
+		return "", fmt.Errorf("bad createSession response: %v", err)
+	}
+	a := &Account{
+		Username:    strings.ToLower(sess.Handle),
+		Token:       sess.AccessJwt,
+		TokenSecret: sess.RefreshJwt,
+	}
+	if !userRx.MatchString(a.Username) || !strings.Contains(a.Username, ".") {
+		return "", fmt.Errorf("can't make a mail address for Bluesky handle %q", sess.Handle)
+	}
+	// Any server can say it signed in any handle, so the handle's
+	// own DID document has to name the server as its PDS. The
+	// default service is ours to trust, and may be an entryway that
+	// passes sign-ins on to the PDS.
+	if a.Instance, err = blueskyPDS(a.Username, sess.DID); err != nil {
+		return "", err
+	}
+	if service != *blueskyService && service != a.Instance {
+		return "", &RejectedError{fmt.Sprintf("%s's PDS is %s, not %s", a.Username, a.Instance, service)}
+	}
+	return parkLogin(a, callback)
+}
+
+// blueskyPDS resolves handle to its DID, and the DID to its document,
+// and returns the PDS the document names. It fails unless the handle
+// resolves to did and the document claims the handle back.
+func blueskyPDS(handle, did string) (string, error) {
+	got, err := resolveHandle(handle)
+	if err != nil {
+		return "", fmt.Errorf("can't resolve Bluesky handle %s: %v", handle, err)
+	}
+	if got != did {
+		return "", &RejectedError{fmt.Sprintf("Bluesky handle %s is %s, not %s", handle, got, did)}
+	}
+	var docURL string
+	switch {
+	case strings.HasPrefix(did, "did:plc:"):
+		docURL = strings.TrimRight(*blueskyPLCDirectory, "/") + "/" + did
+	case strings.HasPrefix(did, "did:web:"):
+		docURL = "https://" + strings.TrimPrefix(did, "did:web:") + "/.well-known/did.json"
+	default:
+		return "", &RejectedError{fmt.Sprintf("unsupported DID %q", did)}
+	}
+	body, err := publicGet(docURL, 64<<10)
+	if err != nil {
+		return "", fmt.Errorf("can't get %s's DID document: %v", did, err)
+	}
+	var doc didDoc
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return "", fmt.Errorf("bad DID document for %s: %v", did, err)
+	}
+	claimed := false
+	for _, aka := range doc.AlsoKnownAs {
+		claimed = claimed || strings.EqualFold(aka, "at://"+handle)
+	}
+	if !claimed || doc.pds() == "" {
+		return "", &RejectedError{fmt.Sprintf("%s's DID document doesn't name %s and a PDS", did, handle)}
+	}
+	return doc.pds(), nil
+}
+
+// resolveHandle returns the DID a Bluesky handle's domain names,
+// from DNS or else from its web server.
+func resolveHandle(handle string) (string, error) {
+	if txts, err := net.LookupTXT("_atproto." + handle); err == nil {
+		for _, txt := range txts {
+			if strings.HasPrefix(txt, "did=") {
+				return strings.TrimPrefix(txt, "did="), nil
+			}
+		}
+	}
+	body, err := publicGet("https://"+handle+"/.well-known/atproto-did", 1<<10)
+	if err != nil {
+		return "", err
+	}
+	did := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(did, "did:") {
+		return "", fmt.Errorf("no DID at %s", handle)
+	}
+	return did, nil
+}
+
+// publicGet fetches u through publicClient, reading at most maxBytes
+// of its body.
+func publicGet(u string, maxBytes int64) ([]byte, error) {
+	res, err := publicClient.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(res); err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(io.LimitReader(res.Body, maxBytes))
+}
+
+func (blueskyBackend) FinishLogin(r *http.Request, callback string) (*Account, error) {
+	return claimLogin(r)
+}
+
+// blueskyRefreshMu serializes session refreshes, since each one
+// uses up the refresh token it was given.
+var blueskyRefreshMu sync.Mutex
+
+// refresh gets a new session for a after its access token expired
+// and saves it. Another copy of the account may have refreshed
+// already, in which case its tokens from the account file are used.
+func (b blueskyBackend) refresh(a *Account, expired string) error {
+	blueskyRefreshMu.Lock()
+	defer blueskyRefreshMu.Unlock()
+	saved := GetAccountNoAuth(a.Username)
+	if saved.Token != "" && saved.Token != expired {
+		a.Token, a.TokenSecret = saved.Token, saved.TokenSecret
+		return nil
+	}
+	req, err := http.NewRequest("POST", strings.TrimRight(a.Instance, "/")+"/xrpc/com.atproto.server.refreshSession", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.TokenSecret)
+	body, err := api.DoPublicRequest(a, req, 0)
+	if e := asAPIError(err); e != nil {
+		e.Service = "Bluesky"
+		if e.StatusCode == 400 || e.StatusCode == 401 {
+			// The refresh token expired or was revoked too.
+			return &RevokedError{e}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	var sess blueskySession
+	if err := json.Unmarshal(body, &sess); err != nil || sess.AccessJwt == "" {
+		return fmt.Errorf("bad refreshSession response: %v", err)
+	}
+	a.Token, a.TokenSecret = sess.AccessJwt, sess.RefreshJwt
+	if saved.Password != "" {
+		saved.Token, saved.TokenSecret = a.Token, a.TokenSecret
+		return saved.Save()
+	}
+	return nil
+}
+
+// expiredToken reports whether err says the access token expired,
+// which XRPC servers report as a 400 or 401 ExpiredToken.
+func expiredToken(err error) bool {
+	e := asAPIError(err)
+	return e != nil && (e.StatusCode == 400 || e.StatusCode == 401) && strings.HasPrefix(e.Message, "ExpiredToken")
+}
+
+// xrpc calls a method on a's PDS, refreshing the session once if
+// the access token expired. Queries (GETs) take params; procedures
+// (POSTs) take in, sent as JSON. chat.bsky methods are proxied to
+// -bluesky_chat_service.
+func (b blueskyBackend) xrpc(a *Account, method, nsid string, params url.Values, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	u := strings.TrimRight(a.Instance, "/") + "/xrpc/" + nsid
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	for try := 0; ; try++ {
+		req, err := http.NewRequest(method, u, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if strings.HasPrefix(nsid, "chat.bsky.") {
+			req.Header.Set("Atproto-Proxy", *blueskyChatService)
+		}
+		res, err := api.DoPublicRequest(a, req, 0)
+		if expiredToken(err) && try == 0 {
+			if err := b.refresh(a, a.Token); err != nil {
+				return err
+			}
+			continue
+		}
+		if e := asAPIError(err); e != nil {
+			e.Service = "Bluesky"
+		}
+		if err != nil {
+			return err
+		}
+		if out == nil {
+			return nil
+		}
+		if err := json.Unmarshal(res, out); err != nil {
+			return fmt.Errorf("decoding %s: %v", nsid, err)
+		}
+		return nil
+	}
+}
+
+type bskyProfile struct {
+	DID         string `json:"did"`
+	Handle      string `json:"handle"`
+	DisplayName string `json:"displayName"`
+}
+
+func (p bskyProfile) user() User {
+	name := p.DisplayName
+	if name == "" {
+		name = p.Handle
+	}
+	return User{Handle: strings.ToLower(p.Handle), Name: name}
+}
+
+type bskyConvo struct {
+	ID          string          `json:"id"`
+	Rev         string          `json:"rev"`
+	Members     []bskyProfile   `json:"members"`
+	LastMessage json.RawMessage `json:"lastMessage"`
+}
+
+// bskyMessage is a chat.bsky.convo.defs#messageView, or, with just
+// an ID and rev, a deletedMessageView.
+type bskyMessage struct {
+	Type   string `json:"$type"`
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Text   string `json:"text"`
+	Sender struct {
+		DID string `json:"did"`
+	} `json:"sender"`
+	SentAt string `json:"sentAt"`
+}
+
+var (
+	blueskyDIDMu sync.Mutex
+	blueskyDIDs  = make(map[string]string) // account's DID by lowercase username
+)
+
+// did returns the account's own DID.
+func (b blueskyBackend) did(a *Account) (string, error) {
+	key := strings.ToLower(a.Username)
+	blueskyDIDMu.Lock()
+	did, ok := blueskyDIDs[key]
+	blueskyDIDMu.Unlock()
+	if ok {
+		return did, nil
+	}
+	var sess blueskySession
+	if err := b.xrpc(a, "GET", "com.atproto.server.getSession", nil, nil, &sess); err != nil {
+		return "", err
+	}
+	blueskyDIDMu.Lock()
+	blueskyDIDs[key] = sess.DID
+	blueskyDIDMu.Unlock()
+	return sess.DID, nil
+}
+
+var (
+	blueskyConvoMu sync.Mutex
+	blueskyConvos  = make(map[string]bskyConvo) // by username + " " + convo ID, for their members
+)
+
+// convo returns a conversation's members, fetching it if it hasn't
+// been seen yet.
+func (b blueskyBackend) convo(a *Account, id string) (bskyConvo, error) {
+	key := strings.ToLower(a.Username) + " " + id
+	blueskyConvoMu.Lock()
+	c, ok := blueskyConvos[key]
+	blueskyConvoMu.Unlock()
+	if ok {
+		return c, nil
+	}
+	var res struct {
+		Convo bskyConvo `json:"convo"`
+	}
+	if err := b.xrpc(a, "GET", "chat.bsky.convo.getConvo", url.Values{"convoId": {id}}, nil, &res); err != nil {
+		return c, err
+	}
+	b.remember(a, res.Convo)
+	return res.Convo, nil
+}
+
+func (blueskyBackend) remember(a *Account, c bskyConvo) {
+	blueskyConvoMu.Lock()
+	blueskyConvos[strings.ToLower(a.Username)+" "+c.ID] = c
+	blueskyConvoMu.Unlock()
+}
+
+// dm converts a message in c to a DM. It reports false for deleted
+// messages.
+func (blueskyBackend) dm(self string, c bskyConvo, raw json.RawMessage) (DM, bool, error) {
+	var m bskyMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return DM{}, false, err
+	}
+	if m.Type != "" && m.Type != "chat.bsky.convo.defs#messageView" {
+		return DM{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, m.SentAt)
+	if err != nil {
+		return DM{}, false, fmt.Errorf("chat message %s: bad sentAt %q", m.ID, m.SentAt)
+	}
+	dm := DM{
+		ID:           timeID(t, m.ID),
+		Text:         m.Text,
+		CreatedAt:    t,
+		Conversation: c.ID,
+		Ref:          m.ID,
+	}
+	var others []bskyProfile
+	for _, p := range c.Members {
+		switch {
+		case p.DID == m.Sender.DID:
+			dm.Sender = p.user()
+		case p.DID != self:
+			others = append(others, p)
+		}
+		if p.DID == self && m.Sender.DID != self {
+			dm.Recipient = p.user()
+		}
+	}
+	if dm.Sender.Handle == "" {
+		dm.Sender = User{Handle: m.Sender.DID, Name: m.Sender.DID}
+	}
+	if m.Sender.DID == self && len(others) > 0 {
+		dm.Recipient = others[0].user()
+	}
+	return dm, true, nil
+}
+
+func (blueskyBackend) Streams(a *Account) []string {
+	return []string{"chat"}
+}
+
+// Sync follows the chat log from the rev saved in c.Token. The first
+// sync has no rev yet, so it reads each conversation's messages
+// instead, as far back as -dm_max_pages pages, and starts the log
+// from the newest rev it saw. Conversations with older messages
+// than that are left in c.Backfill, and later syncs page back
+// through them until they reach the start.
+func (b blueskyBackend) Sync(a *Account, stream string, c *SyncCursor) ([]DM, error) {
+	self, err := b.did(a)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token == "" {
+		dms, err := b.firstSync(a, self, c)
+		c.Complete = len(c.Backfill) == 0
+		return dms, err
+	}
+
+	var got []DM
+	for pages := 0; *dmMaxPages == 0 || pages < *dmMaxPages; pages++ {
+		var res struct {
+			Logs []struct {
+				Type    string          `json:"$type"`
+				Rev     string          `json:"rev"`
+				ConvoID string          `json:"convoId"`
+				Message json.RawMessage `json:"message"`
+			} `json:"logs"`
+			Cursor string `json:"cursor"`
+		}
+		before := c.Token
+		if err := b.xrpc(a, "GET", "chat.bsky.convo.getLog", url.Values{"cursor": {c.Token}}, nil, &res); err != nil {
+			return keepSynced(a, c, got), err
+		}
+		for _, l := range res.Logs {
+			if l.Type != "chat.bsky.convo.defs#logCreateMessage" {
+				if l.Rev > c.Token {
+					c.Token = l.Rev
+				}
+				continue
+			}
+			conv, err := b.convo(a, l.ConvoID)
+			if err != nil {
+				return keepSynced(a, c, got), err
+			}
+			dm, ok, err := b.dm(self, conv, l.Message)
+			if err != nil {
+				return keepSynced(a, c, got), err
+			}
+			if ok {
+				got = append(got, dm)
+			}
+			if l.Rev > c.Token {
+				c.Token = l.Rev
+			}
+		}
+		if res.Cursor > c.Token {
+			c.Token = res.Cursor
+		}
+		if len(res.Logs) == 0 || c.Token == before {
+			break
+		}
+	}
+	dms := keepSynced(a, c, got)
+
+	older, err := b.backfill(a, self, c)
+	dms = append(dms, keepSynced(a, c, older)...)
+	sort.Sort(dmsByNewest(dms))
+	c.Complete = len(c.Backfill) == 0
+	return dms, err
+}
+
+// firstSync reads the newest messages in each of a's conversations
+// and starts c's log from the newest rev among them.
+func (b blueskyBackend) firstSync(a *Account, self string, c *SyncCursor) ([]DM, error) {
+	convs, err := b.listConvos(a)
+	if err != nil {
+		return nil, err
+	}
+	var got []DM
+	rev := ""
+	backfill := make(map[string]string)
+	for _, conv := range convs {
+		msgs, next, err := b.messages(a, self, conv, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, msgs...)
+		if next != "" {
+			backfill[conv.ID] = next
+		}
+		if conv.Rev > rev {
+			rev = conv.Rev
+		}
+	}
+	dms := keepSynced(a, c, got)
+	sort.Sort(dmsByNewest(dms))
+	c.Token = rev
+	if len(backfill) > 0 {
+		c.Backfill = backfill
+	}
+	return dms, nil
+}
+
+// backfill continues reading the history of each conversation in
+// c.Backfill, as far as -dm_max_pages pages a conversation, and
+// returns the messages it found. Conversations whose start it
+// reaches are dropped from c.Backfill; the rest are left to
+// continue from where this walk stopped.
+func (b blueskyBackend) backfill(a *Account, self string, c *SyncCursor) ([]DM, error) {
+	var ids []string
+	for id := range c.Backfill {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	var got []DM
+	for _, id := range ids {
+		conv, err := b.convo(a, id)
+		if e := asAPIError(err); e != nil && e.StatusCode == 400 {
+			// Left or deleted since.
+			delete(c.Backfill, id)
+			continue
+		}
+		if err != nil {
+			return got, err
+		}
+		dms, next, err := b.messages(a, self, conv, c.Backfill[id], 0)
+		if err != nil {
+			return got, err
+		}
+		got = append(got, dms...)
+		if next == "" {
+			delete(c.Backfill, id)
+		} else {
+			c.Backfill[id] = next
+		}
+	}
+	return got, nil
+}
+
+// listConvos returns a's conversations, as many pages of them as
+// -dm_max_pages allows.
+func (b blueskyBackend) listConvos(a *Account) ([]bskyConvo, error) {
+	var convs []bskyConvo
+	cursor := ""
+	for pages := 0; *dmMaxPages == 0 || pages < *dmMaxPages; pages++ {
+		params := url.Values{"limit": {"100"}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		var res struct {
+			Convos []bskyConvo `json:"convos"`
+			Cursor string      `json:"cursor"`
+		}
+		if err := b.xrpc(a, "GET", "chat.bsky.convo.listConvos", params, nil, &res); err != nil {
+			return nil, err
+		}
+		for _, c := range res.Convos {
+			b.remember(a, c)
+		}
+		convs = append(convs, res.Convos...)
+		if res.Cursor == "" || len(res.Convos) == 0 {
+			break
+		}
+		cursor = res.Cursor
+	}
+	return convs, nil
+}
+
+// messages pages back through conv's messages from cursor ("" for
+// the newest) and returns up to n of them, newest first, or if n is
+// 0, as many as -dm_max_pages pages hold. If it stopped at
+// -dm_max_pages, it also returns the cursor to continue from.
+func (b blueskyBackend) messages(a *Account, self string, conv bskyConvo, cursor string, n int) ([]DM, string, error) {
+	var dms []DM
+	for pages := 0; *dmMaxPages == 0 || pages < *dmMaxPages; pages++ {
+		params := url.Values{"convoId": {conv.ID}, "limit": {"100"}}
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+		var res struct {
+			Messages []json.RawMessage `json:"messages"`
+			Cursor   string            `json:"cursor"`
+		}
+		if err := b.xrpc(a, "GET", "chat.bsky.convo.getMessages", params, nil, &res); err != nil {
+			return nil, "", err
+		}
+		for _, raw := range res.Messages {
+			dm, ok, err := b.dm(self, conv, raw)
+			if err != nil {
+				return nil, "", err
+			}
+			if ok {
+				dms = append(dms, dm)
+			}
+			if n > 0 && len(dms) >= n {
+				return dms, "", nil
+			}
+		}
+		if res.Cursor == "" || len(res.Messages) == 0 {
+			return dms, "", nil
+		}
+		cursor = res.Cursor
+	}
+	return dms, cursor, nil
+}
+
+func (b blueskyBackend) Conversations(a *Account) ([]Conversation, error) {
+	self, err := b.did(a)
+	if err != nil {
+		return nil, err
+	}
+	list, err := b.listConvos(a)
+	if err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	for _, c := range list {
+		if len(c.LastMessage) == 0 {
+			continue
+		}
+		latest, ok, err := b.dm(self, c, c.LastMessage)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		conv := Conversation{ID: c.ID, Latest: latest}
+		for _, p := range c.Members {
+			if p.DID != self {
+				conv.Participants = append(conv.Participants, p.user())
+			}
+		}
+		convs = append(convs, conv)
+	}
+	sort.Sort(convsByNewest(convs))
+	return convs, nil
+}
+
+func (b blueskyBackend) Messages(a *Account, conv string, n int) ([]DM, error) {
+	self, err := b.did(a)
+	if err != nil {
+		return nil, err
+	}
+	c, err := b.convo(a, conv)
+	if err != nil {
+		return nil, err
+	}
+	dms, _, err := b.messages(a, self, c, "", n)
+	return dms, err
+}
+
+// Send sends the message in the conversation it replies to if every
+// recipient is in it, and otherwise in the conversation with exactly
+// the recipients, which Bluesky creates if needed.
+func (b blueskyBackend) Send(a *Account, out *Outgoing) ([]DM, error) {
+	if len(out.MediaIDs) > 0 {
+		return nil, &RejectedError{"Bluesky chat messages can't have attachments"}
+	}
+	text := strings.TrimSpace(out.Text)
+	if text == "" {
+		return nil, &RejectedError{"empty message"}
+	}
+	if utf8.RuneCountInString(text) > blueskyMaxText {
+		return nil, &RejectedError{fmt.Sprintf("Bluesky chat messages can't be longer than %d characters", blueskyMaxText)}
+	}
+	self, err := b.did(a)
+	if err != nil {
+		return nil, err
+	}
+
+	var conv bskyConvo
+	if orig, ok := storedDM(a, out.InReplyTo); ok && out.InReplyTo != 0 && orig.Conversation != "" {
+		if conv, err = b.convo(a, orig.Conversation); err != nil {
+			return nil, err
+		}
+		for _, to := range out.To {
+			in := false
+			for _, p := range conv.Members {
+				in = in || strings.EqualFold(p.Handle, to.Handle)
+			}
+			if !in {
+				conv = bskyConvo{}
+			}
+		}
+	}
+	if conv.ID == "" {
+		params := url.Values{"members": {self}}
+		for _, to := range out.To {
+			var p bskyProfile
+			if err := b.xrpc(a, "GET", "app.bsky.actor.getProfile", url.Values{"actor": {to.Handle}}, nil, &p); err != nil {
+				return nil, err
+			}
+			params.Add("members", p.DID)
+		}
+		var res struct {
+			Convo bskyConvo `json:"convo"`
+		}
+		if err := b.xrpc(a, "GET", "chat.bsky.convo.getConvoForMembers", params, nil, &res); err != nil {
+			return nil, err
+		}
+		conv = res.Convo
+		b.remember(a, conv)
+	}
+
+	in := map[string]interface{}{
+		"convoId": conv.ID,
+		"message": map[string]string{"text": text},
+	}
+	var res json.RawMessage
+	if err := b.xrpc(a, "POST", "chat.bsky.convo.sendMessage", nil, in, &res); err != nil {
+		return nil, err
+	}
+	dm, ok, err := b.dm(self, conv, res)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("sendMessage didn't return the message")
+	}
+	return []DM{dm}, nil
+}
+
+// Delete deletes the message for the account only; Bluesky has no
+// way to unsend.
+func (b blueskyBackend) Delete(a *Account, id int64) error {
+	dm, ok := storedDM(a, id)
+	if !ok || dm.Ref == "" || dm.Conversation == "" {
+		return fmt.Errorf("no Bluesky message for %d", id)
+	}
+	in := map[string]string{"convoId": dm.Conversation, "messageId": dm.Ref}
+	return b.xrpc(a, "POST", "chat.bsky.convo.deleteMessageForSelf", nil, in, nil)
+}
+
+func (blueskyBackend) UploadMedia(a *Account, filename string, data []byte) (string, error) {
+	return "", &RejectedError{"Bluesky chat messages can't have attachments"}
+}
+
+// ResolveUser looks up a handle. Unknown handles are a 400 from
+// XRPC, which is turned into a 404 for SMTP.
+func (b blueskyBackend) ResolveUser(a *Account, localpart string) (User, error) {
+	handle := strings.ToLower(localpart)
+	if !strings.Contains(handle, ".") {
+		return User{}, &RejectedError{fmt.Sprintf("%q isn't a Bluesky handle", localpart)}
+	}
+	var p bskyProfile
+	err := b.xrpc(a, "GET", "app.bsky.actor.getProfile", url.Values{"actor": {handle}}, nil, &p)
+	if e := asAPIError(err); e != nil && e.StatusCode == 400 {
+		e.StatusCode = 404
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return p.user(), nil
+}
+
+func (blueskyBackend) MailAddress(u User) string {
+	return u.Handle + "@eight22er.danga.com"
+}
+
+func (blueskyBackend) FetchMedia(a *Account, u string, maxBytes int64) ([]byte, error) {
+	return nil, fmt.Errorf("Bluesky chat has no media to fetch: %q", u)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBluesky is just enough of a PDS and its chat service for
+// eight22er. Revs are zero-padded counters, so they sort like real
+// ones, and message cursors are the index in a conversation to page
+// back from. It returns at most three messages a page, so history
+// walks take several pages.
+type fakeBluesky struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	profile map[string]bskyProfile // by DID
+	convos  map[string]*fakeConvo
+	log     []fakeLogEntry
+	rev     int
+	access  string // the current access token
+	refresh string
+	expired bool // access fails with ExpiredToken until refreshed
+}
+
+type fakeConvo struct {
+	members  []string      // DIDs
+	messages []bskyMessage // oldest first
+}
+
+type fakeLogEntry struct {
+	rev   string
+	convo string
+	msg   bskyMessage
+}
+
+const (
+	fakeBlueskySelf = "did:plc:alice"
+	fakeBlueskyPage = 3
+)
+
+func newFakeBluesky(t *testing.T) *fakeBluesky {
+	f := &fakeBluesky{
+		profile: map[string]bskyProfile{
+			fakeBlueskySelf: {DID: fakeBlueskySelf, Handle: "alice.test", DisplayName: "Alice"},
+			"did:plc:bob":   {DID: "did:plc:bob", Handle: "bob.test", DisplayName: "Bob"},
+		},
+		convos:  make(map[string]*fakeConvo),
+		access:  "access-1",
+		refresh: "refresh-1",
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	serveHost(t, "alice.test", f.Server)
+	plc := *blueskyPLCDirectory
+	t.Cleanup(func() { *blueskyPLCDirectory = plc })
+	*blueskyPLCDirectory = f.URL
+	return f
+}
+
+func (f *fakeBluesky) nextRev() string {
+	f.rev++
+	return fmt.Sprintf("%010d", f.rev)
+}
+
+// say adds a message from sender to the conversation id, creating
+// it with sender and alice if needed, and returns its ID.
+func (f *fakeBluesky) say(id, sender, text string, at time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sayLocked(id, sender, text, at)
+}
+
+func (f *fakeBluesky) sayLocked(id, sender, text string, at time.Time) string {
+	c := f.convos[id]
+	if c == nil {
+		c = &fakeConvo{members: []string{fakeBlueskySelf}}
+		if sender != fakeBlueskySelf {
+			c.members = append(c.members, sender)
+		}
+		f.convos[id] = c
+	}
+	var m bskyMessage
+	m.Type = "chat.bsky.convo.defs#messageView"
+	m.Rev = f.nextRev()
+	m.ID = "msg" + m.Rev
+	m.Text = text
+	m.Sender.DID = sender
+	m.SentAt = at.UTC().Format(time.RFC3339Nano)
+	c.messages = append(c.messages, m)
+	f.log = append(f.log, fakeLogEntry{m.Rev, id, m})
+	return m.ID
+}
+
+func (f *fakeBluesky) view(id string) map[string]interface{} {
+	c := f.convos[id]
+	var members []bskyProfile
+	for _, did := range c.members {
+		members = append(members, f.profile[did])
+	}
+	v := map[string]interface{}{"id": id, "members": members, "rev": ""}
+	if n := len(c.messages); n > 0 {
+		v["rev"] = c.messages[n-1].Rev
+		v["lastMessage"] = c.messages[n-1]
+	}
+	return v
+}
+
+func (f *fakeBluesky) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(code int, name, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": name, "message": msg})
+	}
+	session := func() map[string]interface{} {
+		return map[string]interface{}{
+			"accessJwt":  f.access,
+			"refreshJwt": f.refresh,
+			"handle":     "alice.test",
+			"did":        fakeBlueskySelf,
+		}
+	}
+
+	// The fake is also alice.test's web server and the PLC
+	// directory, with a DID document naming it as alice's PDS.
+	switch {
+	case r.Host == "alice.test" && r.URL.Path == "/.well-known/atproto-did":
+		fmt.Fprintln(w, fakeBlueskySelf)
+		return
+	case r.URL.Path == "/"+fakeBlueskySelf:
+		reply(map[string]interface{}{
+			"id":          fakeBlueskySelf,
+			"alsoKnownAs": []string{"at://alice.test"},
+			"service": []map[string]string{
+				{"id": "#atproto_pds", "type": "AtprotoPersonalDataServer", "serviceEndpoint": f.URL},
+			},
+		})
+		return
+	}
+
+	nsid := strings.TrimPrefix(r.URL.Path, "/xrpc/")
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	switch nsid {
+	case "com.atproto.server.createSession":
+		var in map[string]string
+		json.NewDecoder(r.Body).Decode(&in)
+		if in["identifier"] != "alice.test" || in["password"] != "app-password" {
+			fail(401, "AuthenticationRequired", "Invalid identifier or password")
+			return
+		}
+		reply(session())
+		return
+	case "com.atproto.server.refreshSession":
+		if auth != f.refresh {
+			fail(400, "ExpiredToken", "Token has been revoked")
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimPrefix(f.access, "access-"))
+		f.access = fmt.Sprintf("access-%d", n+1)
+		f.refresh = fmt.Sprintf("refresh-%d", n+1)
+		f.expired = false
+		reply(session())
+		return
+	}
+	if auth != f.access {
+		fail(401, "InvalidToken", "Bad token")
+		return
+	}
+	if f.expired {
+		fail(400, "ExpiredToken", "Token has expired")
+		return
+	}
+	if strings.HasPrefix(nsid, "chat.bsky.") && r.Header.Get("Atproto-Proxy") == "" {
+		fail(400, "InvalidRequest", "chat methods must be proxied")
+		return
+	}
+
+	switch nsid {
+	case "com.atproto.server.getSession":
+		reply(session())
+	case "chat.bsky.convo.listConvos":
+		convos := []interface{}{}
+		for id := range f.convos {
+			convos = append(convos, f.view(id))
+		}
+		reply(map[string]interface{}{"convos": convos})
+	case "chat.bsky.convo.getConvo":
+		if f.convos[r.FormValue("convoId")] == nil {
+			fail(400, "InvalidConvo", "Convo not found")
+			return
+		}
+		reply(map[string]interface{}{"convo": f.view(r.FormValue("convoId"))})
+	case "chat.bsky.convo.getMessages":
+		c := f.convos[r.FormValue("convoId")]
+		if c == nil {
+			fail(400, "InvalidConvo", "Convo not found")
+			return
+		}
+		from := len(c.messages)
+		if cur := r.FormValue("cursor"); cur != "" {
+			from, _ = strconv.Atoi(cur)
+		}
+		msgs := []bskyMessage{}
+		i := from - 1
+		for ; i >= 0 && len(msgs) < fakeBlueskyPage; i-- {
+			msgs = append(msgs, c.messages[i])
+		}
+		res := map[string]interface{}{"messages": msgs}
+		if i >= 0 {
+			res["cursor"] = strconv.Itoa(i + 1)
+		}
+		reply(res)
+	case "chat.bsky.convo.getLog":
+		type logView struct {
+			Type    string      `json:"$type"`
+			Rev     string      `json:"rev"`
+			ConvoID string      `json:"convoId"`
+			Message bskyMessage `json:"message"`
+		}
+		logs := []logView{}
+		cursor := r.FormValue("cursor")
+		for _, l := range f.log {
+			if l.rev > cursor {
+				logs = append(logs, logView{"chat.bsky.convo.defs#logCreateMessage", l.rev, l.convo, l.msg})
+				cursor = l.rev
+			}
+		}
+		reply(map[string]interface{}{"logs": logs, "cursor": cursor})
+	case "app.bsky.actor.getProfile":
+		for _, p := range f.profile {
+			if p.Handle == r.FormValue("actor") || p.DID == r.FormValue("actor") {
+				reply(p)
+				return
+			}
+		}
+		fail(400, "InvalidRequest", "Profile not found")
+	case "chat.bsky.convo.getConvoForMembers":
+		members := r.URL.Query()["members"]
+		for id, c := range f.convos {
+			if strings.Join(c.members, " ") == strings.Join(members, " ") {
+				reply(map[string]interface{}{"convo": f.view(id)})
+				return
+			}
+		}
+		id := fmt.Sprintf("convo%d", len(f.convos)+1)
+		f.convos[id] = &fakeConvo{members: members}
+		reply(map[string]interface{}{"convo": f.view(id)})
+	case "chat.bsky.convo.sendMessage":
+		var in struct {
+			ConvoID string `json:"convoId"`
+			Message struct {
+				Text string `json:"text"`
+			} `json:"message"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+		if f.convos[in.ConvoID] == nil {
+			fail(400, "InvalidConvo", "Convo not found")
+			return
+		}
+		f.sayLocked(in.ConvoID, fakeBlueskySelf, in.Message.Text, time.Now())
+		c := f.convos[in.ConvoID]
+		reply(c.messages[len(c.messages)-1])
+	default:
+		fail(404, "MethodNotImplemented", "no such method "+nsid)
+	}
+}
+
+// blueskyLogin signs in to f through the web handlers, as a user
+// would, and returns the saved account.
+func blueskyLogin(t *testing.T, f *fakeBluesky) *Account {
+	form := url.Values{"backend": {"bluesky"}, "service": {f.URL}, "handle": {"@alice.test"}, "password": {"app-password"}}
+	w := httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	cb, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || cb.Query().Get("state") == "" {
+		t.Fatalf("login redirected to %q", w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	cbFunc(w, httptest.NewRequest("GET", "/cb?"+cb.RawQuery, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	a := GetAccountNoAuth("alice.test")
+	if a.Backend != "bluesky" || a.Token != "access-1" || a.TokenSecret != "refresh-1" || a.Instance != f.URL {
+		t.Fatalf("saved account = %+v", a)
+	}
+	return a
+}
+
+func TestBlueskySyncBackfillsHistory(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+	defer func(n int) { *dmMaxPages = n }(*dmMaxPages)
+	*dmMaxPages = 1
+
+	f := newFakeBluesky(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		from := "did:plc:bob"
+		if i%2 == 1 {
+			from = fakeBlueskySelf
+		}
+		f.say("convo1", from, fmt.Sprintf("message %d", i), start.Add(time.Duration(i)*time.Minute))
+	}
+
+	a := blueskyLogin(t, f)
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &syncWorker{user: a.Username, store: store}
+
+	// One page of the conversation, then the rest of it.
+	if n, err := w.syncOnce(); err != nil || n != 3 {
+		t.Fatalf("first sync = %d, %v; want 3 DMs", n, err)
+	}
+	c := store.Cursor("chat")
+	if c.Complete || c.Backfill["convo1"] != "2" || c.Token != "0000000005" {
+		t.Fatalf("cursor after first sync = %+v", c)
+	}
+
+	// A new message comes in and the access token expires.
+	f.say("convo1", "did:plc:bob", "again", start.Add(time.Hour))
+	f.mu.Lock()
+	f.expired = true
+	f.mu.Unlock()
+	if n, err := w.syncOnce(); err != nil || n != 3 {
+		t.Fatalf("second sync = %d, %v; want 3 DMs", n, err)
+	}
+	if c := store.Cursor("chat"); !c.Complete || len(c.Backfill) != 0 || c.Token != "0000000006" {
+		t.Fatalf("cursor after second sync = %+v; want complete", c)
+	}
+	if a := GetAccountNoAuth("alice.test"); a.Token != "access-2" || a.TokenSecret != "refresh-2" {
+		t.Errorf("refreshed session wasn't saved: %q %q", a.Token, a.TokenSecret)
+	}
+
+	var got []string
+	for _, dm := range store.DMs() {
+		got = append(got, fmt.Sprintf("%s>%s %q", dm.Sender.Handle, dm.Recipient.Handle, dm.Text))
+	}
+	want := []string{`bob.test>alice.test "again"`}
+	for i := 4; i >= 0; i-- {
+		if i%2 == 1 {
+			want = append(want, fmt.Sprintf("alice.test>bob.test \"message %d\"", i))
+		} else {
+			want = append(want, fmt.Sprintf("bob.test>alice.test \"message %d\"", i))
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("synced:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestBlueskySendReply(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+
+	f := newFakeBluesky(t)
+	orig := f.say("convo1", "did:plc:bob", "question?", time.Now().Add(-time.Hour))
+	a := blueskyLogin(t, f)
+	store, _ := syncer.Store(a.Username)
+	if _, err := (&syncWorker{user: a.Username, store: store}).syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	stored := store.DMs()
+	if len(stored) != 1 || stored[0].Ref != orig {
+		t.Fatalf("stored %+v", stored)
+	}
+
+	b := blueskyBackend{}
+	bob, err := b.ResolveUser(a, "Bob.test")
+	if err != nil || bob.Handle != "bob.test" || bob.Name != "Bob" {
+		t.Fatalf("ResolveUser = %+v, %v", bob, err)
+	}
+	if _, err := b.ResolveUser(a, "nobody.test"); asAPIError(err) == nil || asAPIError(err).StatusCode != 404 {
+		t.Errorf("ResolveUser of an unknown handle = %v; want a 404", err)
+	}
+	sent, err := b.Send(a, &Outgoing{To: []User{bob}, Text: "answer", InReplyTo: stored[0].ID})
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("Send = %+v, %v", sent, err)
+	}
+	if sent[0].Conversation != "convo1" || sent[0].Text != "answer" || sent[0].Recipient.Handle != "bob.test" {
+		t.Errorf("sent DM = %+v", sent[0])
+	}
+
+	// Someone new gets a new conversation.
+	f.mu.Lock()
+	f.profile["did:plc:carol"] = bskyProfile{DID: "did:plc:carol", Handle: "carol.test"}
+	f.mu.Unlock()
+	sent, err = b.Send(a, &Outgoing{To: []User{{Handle: "carol.test"}}, Text: "hi", InReplyTo: stored[0].ID})
+	if err != nil || len(sent) != 1 || sent[0].Conversation == "convo1" {
+		t.Fatalf("Send to carol = %+v, %v", sent, err)
+	}
+}
+
+func TestBlueskyLoginChecksPDS(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+
+	newFakeBluesky(t) // alice.test's real PDS
+	evil := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"accessJwt":  "evil-access",
+			"refreshJwt": "evil-refresh",
+			"handle":     "alice.test",
+			"did":        fakeBlueskySelf,
+		})
+	}))
+	defer evil.Close()
+
+	form := url.Values{"backend": {"bluesky"}, "service": {evil.URL}, "handle": {"alice.test"}, "password": {"anything"}}
+	w := httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("login through a server that isn't alice.test's PDS: %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
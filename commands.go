@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bradfitz/eight22er/faketwitter"
+)
+
+// commands are the maintenance subcommands run as
+// "eight22er [flags] <command> [args]" instead of starting the
+// server.
+var commands = map[string]struct {
+	usage string
+	run   func(args []string) error
+}{
+	"fsck":    {"fsck [user ...]", fsckCommand},
+	"compact": {"compact [user ...]", compactCommand},
+	"export":  {"export [-format maildir|mbox] [-since uid -uidvalidity n] user dest", exportCommand},
+	"import":  {"import user twitter-archive.zip|dir|direct-messages.js", importCommand},
+
+	"faketwitter": {"faketwitter [-listen addr] [fixtures.json ...]", fakeTwitterCommand},
+	"popcheck":    {"popcheck [-tls] [-insecure] [-destructive] [host:port user password]", popCheckCommand},
+}
+
+func runCommand(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, commands[name].usage)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "unknown command %q; commands are:\n  %s\n", args[0], strings.Join(names, "\n  "))
+		return 2
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// storeUsers returns args, or if it's empty, every user with a
+// message log on disk.
+func storeUsers(args []string) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+	files, err := filepath.Glob(logStoreFile("*"))
+	if err != nil {
+		return nil, err
+	}
+	var users []string
+	for _, f := range files {
+		users = append(users, strings.TrimSuffix(filepath.Base(f), filepath.Ext(f)))
+	}
+	return users, nil
+}
+
+func fsckCommand(args []string) error {
+	users, err := storeUsers(args)
+	if err != nil {
+		return err
+	}
+	bad := 0
+	for _, user := range users {
+		s, err := openMessageStore(user)
+		if err != nil {
+			fmt.Printf("%s: %v\n", user, err)
+			bad++
+			continue
+		}
+		problems := s.Check()
+		s.Close()
+		for _, p := range problems {
+			fmt.Printf("%s: %v\n", user, p)
+		}
+		if len(problems) > 0 {
+			bad++
+		} else {
+			fmt.Printf("%s: ok\n", user)
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%d of %d stores have problems", bad, len(users))
+	}
+	return nil
+}
+
+func compactCommand(args []string) error {
+	users, err := storeUsers(args)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		s, err := openMessageStore(user)
+		if err != nil {
+			return fmt.Errorf("%s: %v", user, err)
+		}
+		err = s.Compact()
+		s.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", user, err)
+		}
+		fmt.Printf("%s: compacted\n", user)
+	}
+	return nil
+}
+
+// fakeTwitterCommand runs the fake Twitter API server from package
+// faketwitter until killed, so another eight22er can be pointed at
+// it.
+func fakeTwitterCommand(args []string) error {
+	fs := flag.NewFlagSet("faketwitter", flag.ContinueOnError)
+	listenAddr := fs.String("listen", "127.0.0.1:0", "Address to listen on")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", *listenAddr)
+	if err != nil {
+		return err
+	}
+	s := faketwitter.NewUnstartedServer()
+	s.Listener.Close()
+	s.Listener = ln
+	for _, file := range fs.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		err = s.Load(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	fmt.Printf("Fake Twitter API at %s; run eight22er with:\n", s.URL)
+	fmt.Printf("  -twitter_api_base=%s -twitter_upload_base=%s -twitter_consumer_key=%s -twitter_consumer_secret=%s\n",
+		s.URL, s.URL, faketwitter.ConsumerKey, faketwitter.ConsumerSecret)
+	for _, u := range s.Users() {
+		fmt.Printf("User %s (%d): token %s, secret %s\n", u.ScreenName, u.ID, u.Token, u.TokenSecret)
+	}
+	select {}
+}
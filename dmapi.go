@@ -0,0 +1,632 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	twitterAPIBase = flag.String("twitter_api_base", "https://api.twitter.com", "Base URL of the Twitter API, including for OAuth; point it at a test server to run without Twitter")
+	dmAPIVersion   = flag.String("dm_api", "2", `Twitter DM API version: "1" (direct_messages.json), "1.1" (direct_messages/events) or "2" (dm_events)`)
+)
+
+// A dmAPI fetches DMs from one version of Twitter's API and
+// normalises them into DMs.
+type dmAPI interface {
+	// streams returns the names of the DM streams a wants synced.
+	streams(a *Account) []string
+
+	// page returns up to count DMs from stream, newest first,
+	// starting at the page named by token ("" for the newest). It
+	// also returns the token for the next, older, page, or "" if
+	// this was the last. APIs that can filter by ID on the server
+	// skip DMs at or before sinceID.
+	page(a *Account, stream string, count int, sinceID int64, token string) (dms []DM, next string, err error)
+
+	// tokenBefore returns the page token for DMs older than id, or
+	// "" if the API can't start a page at an arbitrary ID.
+	tokenBefore(id int64) string
+
+	// send sends a DM and returns it as the API has it. It returns
+	// a DM with a zero ID if the DM was sent but can't be fetched
+	// back yet; the next sync gets it.
+	send(a *Account, to User, text string, mediaIDs []string) (DM, error)
+
+	// destroy deletes one of a's DMs.
+	destroy(a *Account, id int64) error
+
+	// user looks up a user by screen name.
+	user(a *Account, handle string) (User, error)
+}
+
+// dmAPIs maps -dm_api values to implementations.
+var dmAPIs = map[string]dmAPI{
+	"1":   v1DMAPI{},
+	"1.1": v11DMAPI{},
+	"2":   v2DMAPI{},
+}
+
+// currentDMAPI returns the dmAPI selected by -dm_api, which main
+// has checked is valid.
+func currentDMAPI() dmAPI {
+	return dmAPIs[*dmAPIVersion]
+}
+
+func apiURL(path string) string {
+	return strings.TrimRight(*twitterAPIBase, "/") + path
+}
+
+// v1DMAPI is the original REST API, with separate lists of
+// received and sent DMs paged by max_id.
+type v1DMAPI struct{}
+
+var v1Streams = map[string]string{
+	"received": "/1/direct_messages.json",
+	"sent":     "/1/direct_messages/sent.json",
+}
+
+func (v1DMAPI) streams(a *Account) []string {
+	if a.HideSent {
+		return []string{"received"}
+	}
+	return []string{"received", "sent"}
+}
+
+func (v1DMAPI) tokenBefore(id int64) string {
+	if id <= 1 {
+		return ""
+	}
+	return strconv.FormatInt(id-1, 10)
+}
+
+func (v v1DMAPI) page(a *Account, stream string, count int, sinceID int64, token string) ([]DM, string, error) {
+	path, ok := v1Streams[stream]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown DM stream %q", stream)
+	}
+	params := make(url.Values)
+	params.Set("count", strconv.Itoa(count))
+	if sinceID != 0 {
+		params.Set("since_id", strconv.FormatInt(sinceID, 10))
+	}
+	if token != "" {
+		params.Set("max_id", token)
+	}
+	body, err := api.Get(a, apiURL(path), params, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	dms, err := parseDMs(bytes.NewReader(body))
+	if err != nil || len(dms) == 0 {
+		return dms, "", err
+	}
+	oldest := dms[0].ID
+	for _, dm := range dms {
+		if dm.ID < oldest {
+			oldest = dm.ID
+		}
+	}
+	next := v.tokenBefore(oldest)
+	if oldest-1 <= sinceID {
+		next = ""
+	}
+	return dms, next, nil
+}
+
+func (v1DMAPI) send(a *Account, to User, text string, mediaIDs []string) (DM, error) {
+	if len(mediaIDs) > 0 {
+		return DM{}, &RejectedError{"the v1 Twitter API can't send photos or videos in DMs"}
+	}
+	params := make(url.Values)
+	params.Set("screen_name", to.Handle)
+	params.Set("text", text)
+	body, err := api.Do(a, "POST", apiURL("/1/direct_messages/new.json"), params, "", nil)
+	if err != nil {
+		return DM{}, err
+	}
+	var dm DM
+	if err := json.Unmarshal(body, &dm); err != nil {
+		return DM{}, fmt.Errorf("decoding sent DM: %v", err)
+	}
+	return dm, nil
+}
+
+func (v1DMAPI) destroy(a *Account, id int64) error {
+	_, err := api.Do(a, "POST", apiURL(fmt.Sprintf("/1/direct_messages/destroy/%d.json", id)), make(url.Values), "", nil)
+	return err
+}
+
+func (v1DMAPI) user(a *Account, handle string) (User, error) {
+	return showUser(a, "/1/users/show.json", handle)
+}
+
+// v11DMAPI is the v1.1 Account Activity style events API, which
+// returns sent and received DMs together in one list of events
+// with users given only by ID.
+type v11DMAPI struct{}
+
+func (v11DMAPI) streams(a *Account) []string { return []string{"events"} }
+func (v11DMAPI) tokenBefore(id int64) string { return "" }
+
+type v11Event struct {
+	Type             string `json:"type"`
+	ID               string `json:"id"`
+	CreatedTimestamp string `json:"created_timestamp"` // ms since epoch
+	MessageCreate    struct {
+		Target struct {
+			RecipientID string `json:"recipient_id"`
+		} `json:"target"`
+		SenderID    string `json:"sender_id"`
+		MessageData struct {
+			Text       string   `json:"text"`
+			Entities   Entities `json:"entities"`
+			Attachment struct {
+				Type  string      `json:"type"`
+				Media MediaEntity `json:"media"`
+			} `json:"attachment"`
+		} `json:"message_data"`
+	} `json:"message_create"`
+}
+
+func (v11DMAPI) page(a *Account, stream string, count int, sinceID int64, token string) ([]DM, string, error) {
+	if count > 50 {
+		count = 50
+	}
+	params := make(url.Values)
+	params.Set("count", strconv.Itoa(count))
+	if token != "" {
+		params.Set("cursor", token)
+	}
+	body, err := api.Get(a, apiURL("/1.1/direct_messages/events/list.json"), params, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var res struct {
+		Events     []v11Event `json:"events"`
+		NextCursor string     `json:"next_cursor"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, "", fmt.Errorf("decoding DM events: %v", err)
+	}
+
+	var userIDs []string
+	for _, ev := range res.Events {
+		userIDs = append(userIDs, ev.MessageCreate.SenderID, ev.MessageCreate.Target.RecipientID)
+	}
+	users, err := lookupUsers(a, userIDs)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var dms []DM
+	for _, ev := range res.Events {
+		if ev.Type != "message_create" {
+			continue
+		}
+		dm, err := ev.dm(users)
+		if err != nil {
+			return nil, "", err
+		}
+		dms = append(dms, dm)
+	}
+	return dms, res.NextCursor, nil
+}
+
+// dm converts a message_create event to a DM, taking the sender and
+// recipient from users.
+func (ev *v11Event) dm(users map[string]User) (DM, error) {
+	id, err := strconv.ParseInt(ev.ID, 10, 64)
+	if err != nil {
+		return DM{}, fmt.Errorf("DM event: bad id %q", ev.ID)
+	}
+	ms, err := strconv.ParseInt(ev.CreatedTimestamp, 10, 64)
+	if err != nil {
+		return DM{}, fmt.Errorf("DM event %s: bad created_timestamp %q", ev.ID, ev.CreatedTimestamp)
+	}
+	md := ev.MessageCreate.MessageData
+	dm := DM{
+		ID:        id,
+		Text:      md.Text,
+		CreatedAt: time.Unix(ms/1000, (ms%1000)*1e6).UTC(),
+		Sender:    users[ev.MessageCreate.SenderID],
+		Recipient: users[ev.MessageCreate.Target.RecipientID],
+		Entities:  md.Entities,
+	}
+	if md.Attachment.Type == "media" {
+		dm.Entities.Media = []MediaEntity{md.Attachment.Media}
+	}
+	return dm, nil
+}
+
+func (v11DMAPI) send(a *Account, to User, text string, mediaIDs []string) (DM, error) {
+	if len(mediaIDs) > 1 {
+		return DM{}, &RejectedError{"Twitter DMs can only carry one photo or video"}
+	}
+	data := map[string]interface{}{"text": text}
+	if len(mediaIDs) == 1 {
+		data["attachment"] = map[string]interface{}{
+			"type":  "media",
+			"media": map[string]string{"id": mediaIDs[0]},
+		}
+	}
+	reqBody, err := json.Marshal(map[string]interface{}{
+		"event": map[string]interface{}{
+			"type": "message_create",
+			"message_create": map[string]interface{}{
+				"target":       map[string]string{"recipient_id": strconv.FormatInt(to.ID, 10)},
+				"message_data": data,
+			},
+		},
+	})
+	if err != nil {
+		return DM{}, err
+	}
+	body, err := api.Do(a, "POST", apiURL("/1.1/direct_messages/events/new.json"), make(url.Values), "application/json", reqBody)
+	if err != nil {
+		return DM{}, err
+	}
+	var res struct {
+		Event v11Event `json:"event"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return DM{}, fmt.Errorf("decoding sent DM event: %v", err)
+	}
+	users, err := lookupUsers(a, []string{res.Event.MessageCreate.SenderID, res.Event.MessageCreate.Target.RecipientID})
+	if err != nil {
+		return DM{}, err
+	}
+	return res.Event.dm(users)
+}
+
+func (v11DMAPI) destroy(a *Account, id int64) error {
+	return destroyEvent(a, id)
+}
+
+func (v11DMAPI) user(a *Account, handle string) (User, error) {
+	return showUser(a, "/1.1/users/show.json", handle)
+}
+
+// destroyEvent deletes a DM through the v1.1 events API, which is
+// also the only way to delete one found through v2.
+func destroyEvent(a *Account, id int64) error {
+	params := make(url.Values)
+	params.Set("id", strconv.FormatInt(id, 10))
+	_, err := api.Do(a, "DELETE", apiURL("/1.1/direct_messages/events/destroy.json"), params, "", nil)
+	return err
+}
+
+// showUser looks up a user by screen name with the v1 or v1.1
+// users/show endpoint at path.
+func showUser(a *Account, path, handle string) (User, error) {
+	params := make(url.Values)
+	params.Set("screen_name", handle)
+	body, err := api.Get(a, apiURL(path), params, 0)
+	if err != nil {
+		return User{}, err
+	}
+	var u User
+	if err := json.Unmarshal(body, &u); err != nil {
+		return User{}, fmt.Errorf("decoding users/show: %v", err)
+	}
+	userCacheMu.Lock()
+	userCache[strconv.FormatInt(u.ID, 10)] = u
+	userCacheMu.Unlock()
+	return u, nil
+}
+
+var (
+	userCacheMu sync.Mutex
+	userCache   = make(map[string]User) // by ID
+)
+
+// lookupUsers resolves Twitter user IDs to Users, using
+// users/lookup for any that aren't cached.
+func lookupUsers(a *Account, ids []string) (map[string]User, error) {
+	found := make(map[string]User)
+	var missing []string
+	userCacheMu.Lock()
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		if u, ok := userCache[id]; ok {
+			found[id] = u
+		} else if _, dup := found[id]; !dup {
+			found[id] = User{}
+			missing = append(missing, id)
+		}
+	}
+	userCacheMu.Unlock()
+
+	for len(missing) > 0 {
+		batch := missing
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		missing = missing[len(batch):]
+		params := make(url.Values)
+		params.Set("user_id", strings.Join(batch, ","))
+		body, err := api.Get(a, apiURL("/1.1/users/lookup.json"), params, 0)
+		if isNoSuchUser(err) {
+			// None of the batch exist any more.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var users []User
+		if err := json.Unmarshal(body, &users); err != nil {
+			return nil, fmt.Errorf("decoding users/lookup: %v", err)
+		}
+		userCacheMu.Lock()
+		for _, u := range users {
+			id := strconv.FormatInt(u.ID, 10)
+			userCache[id] = u
+			found[id] = u
+		}
+		userCacheMu.Unlock()
+	}
+	return found, nil
+}
+
+// v2DMAPI is the v2 dm_events API, which like v1.1 returns sent and
+// received DMs together, but includes users and media inline.
+type v2DMAPI struct{}
+
+func (v2DMAPI) streams(a *Account) []string { return []string{"events"} }
+func (v2DMAPI) tokenBefore(id int64) string { return "" }
+
+type v2Event struct {
+	ID             string `json:"id"`
+	EventType      string `json:"event_type"`
+	Text           string `json:"text"`
+	SenderID       string `json:"sender_id"`
+	ConversationID string `json:"dm_conversation_id"`
+	CreatedAt      string `json:"created_at"`
+	Attachments    struct {
+		MediaKeys []string `json:"media_keys"`
+	} `json:"attachments"`
+}
+
+type v2User struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+}
+
+type v2Media struct {
+	MediaKey string `json:"media_key"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+	Variants []struct {
+		BitRate     int    `json:"bit_rate"`
+		ContentType string `json:"content_type"`
+		URL         string `json:"url"`
+	} `json:"variants"`
+}
+
+// v2EventParams returns the query parameters that ask for
+// dm_events with everything needed to make DMs of them.
+func v2EventParams() url.Values {
+	params := make(url.Values)
+	params.Set("dm_event.fields", "id,text,event_type,created_at,dm_conversation_id,sender_id,attachments")
+	params.Set("expansions", "sender_id,attachments.media_keys")
+	params.Set("user.fields", "username,name")
+	params.Set("media.fields", "url,type,variants")
+	return params
+}
+
+type v2Includes struct {
+	Users []v2User  `json:"users"`
+	Media []v2Media `json:"media"`
+}
+
+func (v v2DMAPI) page(a *Account, stream string, count int, sinceID int64, token string) ([]DM, string, error) {
+	if count > 100 {
+		count = 100
+	}
+	params := v2EventParams()
+	params.Set("max_results", strconv.Itoa(count))
+	params.Set("event_types", "MessageCreate")
+	if token != "" {
+		params.Set("pagination_token", token)
+	}
+	body, err := api.Get(a, apiURL("/2/dm_events"), params, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var res struct {
+		Data     []v2Event  `json:"data"`
+		Includes v2Includes `json:"includes"`
+		Meta     struct {
+			NextToken string `json:"next_token"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return nil, "", fmt.Errorf("decoding dm_events: %v", err)
+	}
+	dms, err := v.dms(a, res.Data, res.Includes)
+	if err != nil {
+		return nil, "", err
+	}
+	return dms, res.Meta.NextToken, nil
+}
+
+// dms returns the DMs among events, whose users and media are in
+// includes.
+func (v2DMAPI) dms(a *Account, events []v2Event, includes v2Includes) ([]DM, error) {
+	users := make(map[string]User)
+	for _, u := range includes.Users {
+		id, _ := strconv.ParseInt(u.ID, 10, 64)
+		users[u.ID] = User{ID: id, Handle: u.Username, Name: u.Name}
+	}
+	media := make(map[string]MediaEntity)
+	for _, m := range includes.Media {
+		me := MediaEntity{Type: m.Type, MediaURLHTTPS: m.URL}
+		for _, v := range m.Variants {
+			me.VideoInfo.Variants = append(me.VideoInfo.Variants, VideoVariant{
+				ContentType: v.ContentType,
+				Bitrate:     v.BitRate,
+				URL:         v.URL,
+			})
+		}
+		media[m.MediaKey] = me
+	}
+
+	// One-to-one conversation IDs are the two participants' user
+	// IDs joined by a dash; the recipient is whichever isn't the
+	// sender. Users not in includes are looked up.
+	var unknown []string
+	recipientIDs := make([]string, len(events))
+	for i, ev := range events {
+		for _, id := range strings.Split(ev.ConversationID, "-") {
+			if id != ev.SenderID && strings.Contains(ev.ConversationID, "-") {
+				recipientIDs[i] = id
+			}
+		}
+		for _, id := range []string{ev.SenderID, recipientIDs[i]} {
+			if _, ok := users[id]; !ok && id != "" {
+				unknown = append(unknown, id)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		more, err := lookupUsers(a, unknown)
+		if err != nil {
+			return nil, err
+		}
+		for id, u := range more {
+			users[id] = u
+		}
+	}
+
+	var dms []DM
+	for i, ev := range events {
+		if ev.EventType != "MessageCreate" {
+			continue
+		}
+		id, err := strconv.ParseInt(ev.ID, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("dm_event %d: bad id %q", i+1, ev.ID)
+		}
+		t, err := time.Parse(time.RFC3339, ev.CreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("dm_event %s: bad created_at %q", ev.ID, ev.CreatedAt)
+		}
+		dm := DM{
+			ID:        id,
+			Text:      ev.Text,
+			CreatedAt: t,
+			Sender:    users[ev.SenderID],
+			Recipient: users[recipientIDs[i]],
+		}
+		for _, key := range ev.Attachments.MediaKeys {
+			if m, ok := media[key]; ok {
+				dm.Entities.Media = append(dm.Entities.Media, m)
+			}
+		}
+		dms = append(dms, dm)
+	}
+	return dms, nil
+}
+
+func (v v2DMAPI) send(a *Account, to User, text string, mediaIDs []string) (DM, error) {
+	if len(mediaIDs) > 1 {
+		return DM{}, &RejectedError{"Twitter DMs can only carry one photo or video"}
+	}
+	req := map[string]interface{}{"text": text}
+	var atts []map[string]string
+	for _, id := range mediaIDs {
+		atts = append(atts, map[string]string{"media_id": id})
+	}
+	if len(atts) > 0 {
+		req["attachments"] = atts
+	}
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return DM{}, err
+	}
+	path := fmt.Sprintf("/2/dm_conversations/with/%d/messages", to.ID)
+	body, err := api.Do(a, "POST", apiURL(path), make(url.Values), "application/json", reqBody)
+	if err != nil {
+		return DM{}, err
+	}
+	var res struct {
+		Data struct {
+			EventID string `json:"dm_event_id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return DM{}, fmt.Errorf("decoding sent dm_event: %v", err)
+	}
+	if _, err := strconv.ParseInt(res.Data.EventID, 10, 64); err != nil {
+		return DM{}, fmt.Errorf("sent dm_event: bad id %q", res.Data.EventID)
+	}
+	// v2 only returns the new event's ID, so fetch the rest. If
+	// that fails, the DM was still sent, and the next sync gets it.
+	dm, err := v.event(a, res.Data.EventID)
+	if err != nil {
+		log.Printf("dm_events: fetching sent DM %s for %q: %v", res.Data.EventID, a.Username, err)
+		return DM{}, nil
+	}
+	return dm, nil
+}
+
+// event returns the DM with the given dm_event ID.
+func (v v2DMAPI) event(a *Account, id string) (DM, error) {
+	body, err := api.Get(a, apiURL("/2/dm_events/"+id), v2EventParams(), 0)
+	if err != nil {
+		return DM{}, err
+	}
+	var res struct {
+		Data     v2Event    `json:"data"`
+		Includes v2Includes `json:"includes"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return DM{}, fmt.Errorf("decoding dm_event: %v", err)
+	}
+	dms, err := v.dms(a, []v2Event{res.Data}, res.Includes)
+	if err != nil {
+		return DM{}, err
+	}
+	if len(dms) != 1 {
+		return DM{}, fmt.Errorf("dm_event %s isn't a message", id)
+	}
+	return dms[0], nil
+}
+
+func (v2DMAPI) destroy(a *Account, id int64) error {
+	return destroyEvent(a, id)
+}
+
+func (v2DMAPI) user(a *Account, handle string) (User, error) {
+	params := make(url.Values)
+	params.Set("user.fields", "username,name")
+	body, err := api.Get(a, apiURL("/2/users/by/username/"+url.QueryEscape(handle)), params, 0)
+	if err != nil {
+		return User{}, err
+	}
+	var res struct {
+		Data v2User `json:"data"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return User{}, fmt.Errorf("decoding users/by/username: %v", err)
+	}
+	id, err := strconv.ParseInt(res.Data.ID, 10, 64)
+	if err != nil {
+		return User{}, &APIError{StatusCode: 404, Message: fmt.Sprintf("no Twitter user %q", handle)}
+	}
+	u := User{ID: id, Handle: res.Data.Username, Name: res.Data.Name}
+	userCacheMu.Lock()
+	userCache[res.Data.ID] = u
+	userCacheMu.Unlock()
+	return u, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// An entity is a span of a DM's text that Twitter annotated as a
+// link, @mention or hashtag.
+type entity struct {
+	start, end int // rune offsets into the text
+	kind       string
+	value      string // expanded URL, screen name or hashtag text
+	display    string // for links, the display URL
+}
+
+type entityList []entity
+
+func (l entityList) Len() int           { return len(l) }
+func (l entityList) Less(i, j int) bool { return l[i].start < l[j].start }
+func (l entityList) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+func (d DM) entities() entityList {
+	var ents entityList
+	for _, u := range d.Entities.URLs {
+		if u.ExpandedURL == "" {
+			continue
+		}
+		display := u.DisplayURL
+		if display == "" {
+			display = u.ExpandedURL
+		}
+		ents = append(ents, entity{start: u.Indices[0], end: u.Indices[1], kind: "url", value: u.ExpandedURL, display: display})
+	}
+	for _, m := range d.Entities.Mentions {
+		if m.ScreenName != "" {
+			ents = append(ents, entity{start: m.Indices[0], end: m.Indices[1], kind: "mention", value: m.ScreenName})
+		}
+	}
+	for _, h := range d.Entities.Hashtags {
+		if h.Text != "" {
+			ents = append(ents, entity{start: h.Indices[0], end: h.Indices[1], kind: "hashtag", value: h.Text})
+		}
+	}
+	sort.Sort(ents)
+	return ents
+}
+
+// A segment is a piece of rendered DM text. Link is empty for plain
+// text. Break marks a line break.
+type segment struct {
+	Text  string
+	Link  string
+	Break bool
+	isURL bool // Link is a URL from the text, not one we made up
+}
+
+// segments splits the DM's text into plain and linked segments
+// using its entities. Twitter's HTML escaping of the text is undone.
+func (d DM) segments() []segment {
+	text := []rune(d.Text)
+	var segs []segment
+	plain := func(rs []rune) {
+		for i, line := range strings.Split(html.UnescapeString(string(rs)), "\n") {
+			if i > 0 {
+				segs = append(segs, segment{Break: true})
+			}
+			if line = strings.TrimRight(line, "\r"); line != "" {
+				segs = append(segs, segment{Text: line})
+			}
+		}
+	}
+	pos := 0
+	for _, e := range d.entities() {
+		if e.start < pos || e.end < e.start || e.end > len(text) {
+			continue
+		}
+		plain(text[pos:e.start])
+		orig := html.UnescapeString(string(text[e.start:e.end]))
+		switch e.kind {
+		case "url":
+			segs = append(segs, segment{Text: e.display, Link: e.value, isURL: true})
+		case "mention":
+			segs = append(segs, segment{Text: orig, Link: "https://twitter.com/" + url.QueryEscape(e.value)})
+		case "hashtag":
+			segs = append(segs, segment{Text: orig, Link: "https://twitter.com/search?q=" + url.QueryEscape("#"+e.value)})
+		}
+		pos = e.end
+	}
+	plain(text[pos:])
+	return segs
+}
+
+// ExpandedText returns the DM's text with t.co links replaced by the
+// URLs they point to.
+func (d DM) ExpandedText() string {
+	var buf bytes.Buffer
+	for _, s := range d.segments() {
+		switch {
+		case s.Break:
+			buf.WriteString("\n")
+		case s.isURL:
+			buf.WriteString(s.Link)
+		default:
+			buf.WriteString(s.Text)
+		}
+	}
+	return buf.String()
+}
+
+var dmHTMLTemplate = template.Must(template.New("dm").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"></head><body>
+<p>{{range .}}{{if .Break}}<br>
+{{else if .Link}}<a href="{{.Link}}">{{.Text}}</a>{{else}}{{.Text}}{{end}}{{end}}</p>
+</body></html>
+`))
+
+// HTML returns the DM's text as an HTML document with clickable
+// links, mentions and hashtags.
+func (d DM) HTML() string {
+	var buf bytes.Buffer
+	if err := dmHTMLTemplate.Execute(&buf, d.segments()); err != nil {
+		return ""
+	}
+	return buf.String()
+}
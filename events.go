@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var eventBacklog = flag.Int("event_backlog", 200, "Number of recent events kept per account for /events clients catching up")
+
+// An Event is a change to an account's messages. They're published
+// on the events bus, which wakes IMAP IDLE sessions and feeds the
+// /events endpoint and webhooks.
+type Event struct {
+	Seq   int64     `json:"seq"`  // increases with each event this process publishes
+	Type  string    `json:"type"` // "new", "flags" or "delete"
+	User  string    `json:"user"`
+	ID    int64     `json:"id,string"`
+	UID   uint32    `json:"uid,omitempty"`   // the message's IMAP UID
+	DM    *DM       `json:"dm,omitempty"`    // for "new"
+	Flags []string  `json:"flags,omitempty"` // for "flags"
+	Time  time.Time `json:"time"`
+}
+
+// events is the bus that message stores publish their changes to.
+var events = &eventBus{
+	subs:   make(map[*Subscription]bool),
+	recent: make(map[string][]Event),
+	lost:   make(map[string]int64),
+}
+
+type eventBus struct {
+	mu     sync.Mutex
+	seq    int64
+	subs   map[*Subscription]bool
+	recent map[string][]Event // by lowercase username, oldest first
+	lost   map[string]int64   // by lowercase username: the latest Seq dropped from recent
+}
+
+// A Subscription receives one account's events, or with an empty
+// user, everyone's. If C is full, events are dropped rather than
+// hold up the publisher; subscribers that can't miss any catch up
+// with Since.
+type Subscription struct {
+	C    chan Event
+	user string // lowercase
+}
+
+func (b *eventBus) Subscribe(user string, buffer int) *Subscription {
+	s := &Subscription{C: make(chan Event, buffer), user: strings.ToLower(user)}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs[s] = true
+	return s
+}
+
+func (b *eventBus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, s)
+}
+
+// Publish numbers ev, keeps it for Since, and sends it to the
+// subscribers that want it.
+func (b *eventBus) Publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	ev.Seq = b.seq
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	user := strings.ToLower(ev.User)
+	recent := append(b.recent[user], ev)
+	if len(recent) > *eventBacklog {
+		b.lost[user] = recent[len(recent)-*eventBacklog-1].Seq
+		recent = recent[len(recent)-*eventBacklog:]
+	}
+	b.recent[user] = recent
+	for s := range b.subs {
+		if s.user != "" && s.user != user {
+			continue
+		}
+		select {
+		case s.C <- ev:
+		default:
+		}
+	}
+}
+
+// Seq returns the number of the latest event.
+func (b *eventBus) Seq() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.seq
+}
+
+// Since returns the account's kept events numbered after seq. A seq
+// from the future must be from before a restart, so it gets them
+// all.
+func (b *eventBus) Since(user string, seq int64) []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if seq > b.seq {
+		seq = 0
+	}
+	var evs []Event
+	for _, ev := range b.recent[strings.ToLower(user)] {
+		if ev.Seq > seq {
+			evs = append(evs, ev)
+		}
+	}
+	return evs
+}
+
+// Kept reports whether Since(user, seq) returns every one of the
+// account's events after seq, none of them having been dropped from
+// the backlog since.
+func (b *eventBus) Kept(user string, seq int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return seq <= b.seq && seq >= b.lost[strings.ToLower(user)]
+}
+
+// publishingStore is a MessageStore that publishes its changes on
+// the events bus. syncer.Store hands these out, so every change made
+// while serving, whether by syncing, sending or a mail client, gets
+// published.
+type publishingStore struct {
+	MessageStore
+	user string
+	mu   sync.Mutex // serializes Add, so it can tell which DMs were new
+}
+
+func (s *publishingStore) Add(dms []DM) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := s.MessageStore.UIDNext()
+	n, err := s.MessageStore.Add(dms)
+	if n == 0 {
+		return n, err
+	}
+	seen := make(map[int64]bool)
+	for i := range dms {
+		dm := dms[i]
+		uid := s.UID(dm.ID)
+		if uid < next || seen[dm.ID] {
+			continue
+		}
+		seen[dm.ID] = true
+		events.Publish(Event{Type: "new", User: s.user, ID: dm.ID, UID: uid, DM: &dm})
+	}
+	return n, err
+}
+
+func (s *publishingStore) Delete(id int64) error {
+	uid := s.UID(id)
+	if err := s.MessageStore.Delete(id); err != nil || uid == 0 {
+		return err
+	}
+	events.Publish(Event{Type: "delete", User: s.user, ID: id, UID: uid})
+	return nil
+}
+
+func (s *publishingStore) SetFlags(id int64, flags []string) error {
+	if err := s.MessageStore.SetFlags(id, flags); err != nil {
+		return err
+	}
+	events.Publish(Event{Type: "flags", User: s.user, ID: id, UID: s.UID(id), Flags: flags})
+	return nil
+}
+
+// eventsMaxWait is the longest an /events long poll waits, and how
+// often an event stream gets a keepalive comment.
+const eventsMaxWait = 2 * time.Minute
+
+// eventsFunc serves an account's events. Clients that accept
+// text/event-stream get a Server-Sent Events stream, resuming after
+// Last-Event-ID. Others get a JSON long poll, which answers as soon
+// as there are events numbered after "since", or with none after
+// "wait" seconds; its "next" is the since for the following poll.
+// Without a since, both start from now. EventSource can't sign in,
+// so the feed's user and token parameters also work; see
+// tokenAccount.
+func eventsFunc(w http.ResponseWriter, r *http.Request) {
+	acct, err := requestAccount(r)
+	if err != nil {
+		if acct = tokenAccount(r); acct == nil {
+			http.Error(w, "bad username or password", http.StatusForbidden)
+			return
+		}
+	}
+	syncer.Touch(acct)
+	sub := events.Subscribe(acct.Username, 16)
+	defer events.Unsubscribe(sub)
+
+	sinceStr := r.FormValue("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		sinceStr = id
+	}
+	since, err := strconv.ParseInt(sinceStr, 10, 64)
+	if err != nil {
+		since = events.Seq()
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamEvents(w, r, acct, sub, since)
+		return
+	}
+
+	wait := eventsMaxWait
+	if sec, err := strconv.Atoi(r.FormValue("wait")); err == nil && sec >= 0 && time.Duration(sec)*time.Second < wait {
+		wait = time.Duration(sec) * time.Second
+	}
+	evs := events.Since(acct.Username, since)
+	if len(evs) == 0 {
+		select {
+		case <-sub.C:
+			evs = events.Since(acct.Username, since)
+		case <-time.After(wait):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	next := since
+	if len(evs) > 0 {
+		next = evs[len(evs)-1].Seq
+	} else if next > events.Seq() {
+		next = events.Seq()
+	}
+	if evs == nil {
+		evs = []Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"events": evs,
+		"next":   strconv.FormatInt(next, 10),
+	})
+}
+
+// streamEvents sends the account's events after since as a
+// Server-Sent Events stream until the client goes away.
+func streamEvents(w http.ResponseWriter, r *http.Request, acct *Account, sub *Subscription, since int64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, ": eight22er events for %s\n\n", acct.Username)
+	flusher.Flush()
+	keepalive := time.NewTicker(eventsMaxWait)
+	defer keepalive.Stop()
+	for {
+		for _, ev := range events.Since(acct.Username, since) {
+			data, err := json.Marshal(ev)
+			if err != nil {
+				log.Printf("events: encoding %d for %q: %v", ev.Seq, acct.Username, err)
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.Seq, ev.Type, data)
+			since = ev.Seq
+		}
+		flusher.Flush()
+		select {
+		case <-sub.C:
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An export is the part of an account's message store to archive:
+// its DMs from UID since on, in UID order, rendered as POP serves
+// them.
+type export struct {
+	store MessageStore
+	acct  *Account
+	dms   []DM
+}
+
+// newExport returns the export of the DMs with UIDs of at least
+// since. If uidValidity is non-zero and the store's UIDVALIDITY has
+// changed, the UIDs an earlier export recorded mean nothing now, and
+// it fails.
+func newExport(s MessageStore, a *Account, since, uidValidity uint32) (*export, error) {
+	if uidValidity != 0 && uidValidity != s.UIDValidity() {
+		return nil, fmt.Errorf("UIDVALIDITY is now %d, not %d; export everything again", s.UIDValidity(), uidValidity)
+	}
+	e := &export{store: s, acct: a}
+	for _, dm := range s.DMs() {
+		if s.UID(dm.ID) >= since {
+			e.dms = append(e.dms, dm)
+		}
+	}
+	sort.Slice(e.dms, func(i, j int) bool { return s.UID(e.dms[i].ID) < s.UID(e.dms[j].ID) })
+	return e, nil
+}
+
+// message returns the DM as a mail message with LF line endings, as
+// files on Unix have. It's taken from the render cache if it's
+// there, but the cache isn't filled, so exporting leaves the store
+// as it was.
+func (e *export) message(dm DM) string {
+	msg, ok := e.store.Rendered(dm.ID, e.acct.renderKey())
+	if !ok {
+		msg = []byte(dm.RFC822(e.acct))
+	}
+	return strings.Replace(string(msg), "\r\n", "\n", -1)
+}
+
+func (e *export) hasFlag(dm DM, flag string) bool {
+	for _, f := range e.store.Flags(dm.ID) {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// maildirInfo maps IMAP system flags to the letters for them in
+// Maildir filenames, in the alphabetical order they go in.
+var maildirInfo = []struct {
+	flag   string
+	letter byte
+}{
+	{`\Draft`, 'D'},
+	{`\Flagged`, 'F'},
+	{`\Answered`, 'R'},
+	{`\Seen`, 'S'},
+	{`\Deleted`, 'T'},
+}
+
+// maildirName returns the DM's filename in a Maildir's cur
+// directory. The part before the colon is fixed for the DM, and the
+// part after has its flags.
+func (e *export) maildirName(dm DM) string {
+	var flags []byte
+	for _, f := range maildirInfo {
+		if e.hasFlag(dm, f.flag) {
+			flags = append(flags, f.letter)
+		}
+	}
+	return fmt.Sprintf("%d.U%dI%d.eight22er.danga.com:2,%s", dm.CreatedAt.Unix(), e.store.UID(dm.ID), dm.ID, flags)
+}
+
+// writeMaildir writes the DMs into a Maildir at dir, creating it if
+// necessary. Each message is written to tmp and renamed into cur. A
+// DM already there from an earlier export is renamed if its flags
+// changed, rather than written again.
+func (e *export) writeMaildir(dir string) error {
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	have := make(map[string]string) // unique part -> filename
+	for _, sub := range []string{"cur", "new"} {
+		names, err := filepath.Glob(filepath.Join(dir, sub, "*"))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			have[strings.SplitN(filepath.Base(name), ":", 2)[0]] = name
+		}
+	}
+	for _, dm := range e.dms {
+		name := e.maildirName(dm)
+		dst := filepath.Join(dir, "cur", name)
+		if old, ok := have[strings.SplitN(name, ":", 2)[0]]; ok {
+			if old != dst {
+				if err := os.Rename(old, dst); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		tmp := filepath.Join(dir, "tmp", strings.SplitN(name, ":", 2)[0])
+		if err := ioutil.WriteFile(tmp, []byte(e.message(dm)), 0600); err != nil {
+			return err
+		}
+		os.Chtimes(tmp, dm.CreatedAt, dm.CreatedAt)
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMaildirTar writes the DMs to w as a tar file of a Maildir
+// named dir, for downloading.
+func (e *export) writeMaildirTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, sub := range []string{"", "cur/", "new/", "tmp/"} {
+		if err := tw.WriteHeader(&tar.Header{Name: dir + "/" + sub, Typeflag: tar.TypeDir, Mode: 0700, ModTime: now}); err != nil {
+			return err
+		}
+	}
+	for _, dm := range e.dms {
+		msg := e.message(dm)
+		hdr := &tar.Header{
+			Name:    dir + "/cur/" + e.maildirName(dm),
+			Mode:    0600,
+			Size:    int64(len(msg)),
+			ModTime: dm.CreatedAt,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, msg); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// writeMbox writes the DMs to w in mboxrd format: each message
+// follows a "From " line, lines starting with any number of ">"s
+// and then "From " get one more ">", and a blank line ends it.
+// Flags go in the Status and X-Status headers mail readers use.
+func (e *export) writeMbox(w io.Writer) error {
+	b := backendFor(e.acct)
+	for _, dm := range e.dms {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "From %s %s\n", b.MailAddress(dm.Sender), dm.CreatedAt.UTC().Format(time.ANSIC))
+		msg := e.message(dm)
+		status := "O"
+		if e.hasFlag(dm, `\Seen`) {
+			status = "RO"
+		}
+		var xstatus string
+		for _, f := range []struct{ flag, letter string }{{`\Answered`, "A"}, {`\Flagged`, "F"}, {`\Deleted`, "D"}, {`\Draft`, "T"}} {
+			if e.hasFlag(dm, f.flag) {
+				xstatus += f.letter
+			}
+		}
+		head, body := msg, ""
+		if i := strings.Index(msg, "\n\n"); i >= 0 {
+			head, body = msg[:i+1], msg[i+1:]
+		}
+		buf.WriteString(head)
+		fmt.Fprintf(&buf, "Status: %s\n", status)
+		if xstatus != "" {
+			fmt.Fprintf(&buf, "X-Status: %s\n", xstatus)
+		}
+		for _, line := range strings.SplitAfter(body, "\n") {
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				buf.WriteByte('>')
+			}
+			buf.WriteString(line)
+		}
+		if !strings.HasSuffix(body, "\n") {
+			buf.WriteByte('\n')
+		}
+		buf.WriteByte('\n')
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCommand writes an account's DMs to a Maildir directory or
+// appends them to an mbox file ("-" for stdout). It reports the
+// -since and -uidvalidity to pass next time to export only what's
+// new.
+func exportCommand(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "maildir", "Export format: maildir or mbox (mboxrd)")
+	since := fs.Uint("since", 0, "Only export DMs with at least this UID")
+	uidValidity := fs.Uint("uidvalidity", 0, "If non-zero, the UIDVALIDITY -since came from; the export fails if it's changed")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: export [-format maildir|mbox] [-since uid -uidvalidity n] user dest")
+	}
+	user, dest := fs.Arg(0), fs.Arg(1)
+	if _, err := os.Stat(logStoreFile(user)); err != nil {
+		return fmt.Errorf("no messages stored for %q", user)
+	}
+	s, err := openMessageStore(user)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	e, err := newExport(s, GetAccountNoAuth(user), uint32(*since), uint32(*uidValidity))
+	if err != nil {
+		return err
+	}
+	switch *format {
+	case "maildir":
+		err = e.writeMaildir(dest)
+	case "mbox":
+		if dest == "-" {
+			err = e.writeMbox(os.Stdout)
+			break
+		}
+		var f *os.File
+		if f, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600); err != nil {
+			return err
+		}
+		err = e.writeMbox(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	default:
+		return fmt.Errorf("unknown -format %q", *format)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "%s: exported %d DMs; next time use -since=%d -uidvalidity=%d\n",
+		user, len(e.dms), s.UIDNext(), s.UIDValidity())
+	return nil
+}
+
+// exportFunc serves an account's DMs as an mbox file, or a tar file
+// of a Maildir, with the same since and uidvalidity parameters as
+// the export command. The ones for the next export come back in the
+// X-Eight22er-UIDNext and X-Eight22er-UIDValidity headers. It's
+// signed in to like /ratelimits; see requestAccount.
+func exportFunc(w http.ResponseWriter, r *http.Request) {
+	acct, err := requestAccount(r)
+	if err != nil {
+		http.Error(w, "bad username or password", http.StatusForbidden)
+		return
+	}
+	var since, uidValidity uint64
+	if v := r.FormValue("since"); v != "" {
+		if since, err = strconv.ParseUint(v, 10, 32); err != nil {
+			http.Error(w, "bad since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.FormValue("uidvalidity"); v != "" {
+		if uidValidity, err = strconv.ParseUint(v, 10, 32); err != nil {
+			http.Error(w, "bad uidvalidity", http.StatusBadRequest)
+			return
+		}
+	}
+	s, err := syncer.Store(acct.Username)
+	if err != nil {
+		http.Error(w, "can't open message store", http.StatusInternalServerError)
+		return
+	}
+	e, err := newExport(s, acct, uint32(since), uint32(uidValidity))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	name := strings.ToLower(acct.Username)
+	w.Header().Set("X-Eight22er-UIDNext", strconv.FormatUint(uint64(s.UIDNext()), 10))
+	w.Header().Set("X-Eight22er-UIDValidity", strconv.FormatUint(uint64(s.UIDValidity()), 10))
+	switch format := r.FormValue("format"); format {
+	case "mbox":
+		w.Header().Set("Content-Type", "application/mbox")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".mbox"))
+		err = e.writeMbox(w)
+	case "", "maildir":
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"-maildir.tar"))
+		err = e.writeMaildirTar(w, name)
+	default:
+		http.Error(w, "unknown format "+strconv.Quote(format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("export: for %q: %v", acct.Username, err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportTestStore returns an account's store with three DMs, the
+// second of which is \Seen and has lines an mbox must quote.
+func exportTestStore(t *testing.T) (MessageStore, *Account) {
+	testDB(t)
+	a := &Account{Username: "alice.irc.example", Password: "pw", Token: "t", Backend: "irc", Instance: "ircs://irc.example:6697"}
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var dms []DM
+	for i, text := range []string{"hi alice", "From the start\n>From quoted\nok", "see you"} {
+		at := start.Add(time.Duration(i) * time.Hour)
+		dms = append(dms, DM{ID: timeID(at, fmt.Sprint(i)), Text: text, CreatedAt: at, Sender: User{Handle: "bob"}, Recipient: User{Handle: "alice"}})
+	}
+	if _, err := s.Add(dms); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetFlags(dms[1].ID, []string{`\Seen`, `\Flagged`}); err != nil {
+		t.Fatal(err)
+	}
+	return s, a
+}
+
+var mboxFromRx = regexp.MustCompile(`^From \S+ \w{3} \w{3} [ \d]\d \d\d:\d\d:\d\d \d{4}$`)
+
+// parseMbox splits an mboxrd file into its messages, undoing the
+// quoting of "From " lines.
+func parseMbox(t *testing.T, mbox string) []string {
+	var msgs []string
+	var cur *bytes.Buffer
+	lines := strings.SplitAfter(mbox, "\n")
+	for i, line := range lines {
+		if mboxFromRx.MatchString(strings.TrimSuffix(line, "\n")) && (i == 0 || lines[i-1] == "\n") {
+			if cur != nil {
+				msgs = append(msgs, strings.TrimSuffix(cur.String(), "\n"))
+			}
+			cur = new(bytes.Buffer)
+			continue
+		}
+		if cur == nil {
+			t.Fatalf("mbox doesn't start with a From line: %q", line)
+		}
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		cur.WriteString(line)
+	}
+	if cur != nil {
+		msgs = append(msgs, strings.TrimSuffix(cur.String(), "\n"))
+	}
+	return msgs
+}
+
+func TestExportMbox(t *testing.T) {
+	s, a := exportTestStore(t)
+	e, err := newExport(s, a, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.writeMbox(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n>From the start\n>>From quoted\n") {
+		t.Errorf("mbox doesn't quote the From lines:\n%s", buf.String())
+	}
+
+	msgs := parseMbox(t, buf.String())
+	if len(msgs) != len(e.dms) {
+		t.Fatalf("mbox has %d messages; want %d", len(msgs), len(e.dms))
+	}
+	for i, msg := range msgs {
+		m, err := mail.ReadMessage(strings.NewReader(msg))
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		body, _ := ioutil.ReadAll(m.Body)
+		want, err := mail.ReadMessage(strings.NewReader(e.message(e.dms[i])))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantBody, _ := ioutil.ReadAll(want.Body)
+		if string(body) != string(wantBody) {
+			t.Errorf("message %d body =\n%s\nwant\n%s", i, body, wantBody)
+		}
+		if got, want := m.Header.Get("Message-Id"), want.Header.Get("Message-Id"); got != want {
+			t.Errorf("message %d Message-Id = %q; want %q", i, got, want)
+		}
+		status, xstatus := "O", ""
+		if i == 1 {
+			status, xstatus = "RO", "F"
+		}
+		if m.Header.Get("Status") != status || m.Header.Get("X-Status") != xstatus {
+			t.Errorf("message %d Status %q, X-Status %q; want %q, %q", i, m.Header.Get("Status"), m.Header.Get("X-Status"), status, xstatus)
+		}
+	}
+}
+
+func TestExportMaildirTar(t *testing.T) {
+	s, a := exportTestStore(t)
+	e, err := newExport(s, a, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := e.writeMaildirTar(&buf, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[hdr.Name] = string(data)
+	}
+	for _, dir := range []string{"alice/", "alice/cur/", "alice/new/", "alice/tmp/"} {
+		if _, ok := files[dir]; !ok {
+			t.Errorf("tar has no %s", dir)
+		}
+	}
+	for i, dm := range e.dms {
+		name := "alice/cur/" + e.maildirName(dm)
+		flags := ""
+		if i == 1 {
+			flags = "FS"
+		}
+		if !strings.HasSuffix(name, ":2,"+flags) {
+			t.Errorf("message %d is named %s; want flags %q", i, name, flags)
+		}
+		if got, ok := files[name]; !ok || got != e.message(dm) || strings.Contains(got, "\r") {
+			t.Errorf("tar's %s = %q; want the message with LF line endings", name, got)
+		}
+	}
+}
+
+func TestExportSince(t *testing.T) {
+	s, a := exportTestStore(t)
+	all, err := newExport(s, a, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := s.UID(all.dms[1].ID)
+	e, err := newExport(s, a, since, s.UIDValidity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.dms) != 2 || e.dms[0].ID != all.dms[1].ID {
+		t.Errorf("export since UID %d has %d DMs; want the last 2", since, len(e.dms))
+	}
+	if _, err := newExport(s, a, since, s.UIDValidity()+1); err == nil {
+		t.Error("export with a stale UIDVALIDITY succeeded")
+	}
+}
+
+func TestExportFuncAuth(t *testing.T) {
+	_, a := exportTestStore(t)
+	w := httptest.NewRecorder()
+	exportFunc(w, httptest.NewRequest("GET", "/export?format=mbox&username="+a.Username+"&password="+a.Password, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("export with the password in the URL: %d", w.Code)
+	}
+
+	form := url.Values{"username": {a.Username}, "password": {a.Password}, "format": {"mbox"}}
+	r := httptest.NewRequest("POST", "/export", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	exportFunc(w, r)
+	if w.Code != http.StatusOK || len(parseMbox(t, w.Body.String())) != 3 {
+		t.Errorf("POSTed export: %d %q", w.Code, w.Body)
+	}
+}
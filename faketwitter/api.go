@@ -0,0 +1,547 @@
+package faketwitter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveAPI handles a request signed by u.
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request, u User) {
+	p := r.URL.Path
+	switch {
+	case p == "/1/direct_messages.json" && r.Method == "GET":
+		s.serveV1List(w, r, u, false)
+	case p == "/1/direct_messages/sent.json" && r.Method == "GET":
+		s.serveV1List(w, r, u, true)
+	case p == "/1/direct_messages/new.json" && r.Method == "POST":
+		s.serveV1New(w, r, u)
+	case strings.HasPrefix(p, "/1/direct_messages/destroy/") && r.Method == "POST":
+		id, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(p, "/1/direct_messages/destroy/"), ".json"), 10, 64)
+		s.serveV1Destroy(w, r, u, id)
+	case (p == "/1/users/show.json" || p == "/1.1/users/show.json") && r.Method == "GET":
+		s.serveUsersShow(w, r)
+	case p == "/1.1/users/lookup.json" && r.Method == "GET":
+		s.serveUsersLookup(w, r)
+	case p == "/1.1/direct_messages/events/list.json" && r.Method == "GET":
+		s.serveEventsList(w, r, u)
+	case p == "/1.1/direct_messages/events/new.json" && r.Method == "POST":
+		s.serveEventsNew(w, r, u)
+	case p == "/1.1/direct_messages/events/destroy.json" && r.Method == "DELETE":
+		id, _ := strconv.ParseInt(r.FormValue("id"), 10, 64)
+		if _, ok := s.deleteDM(u, id); !ok {
+			writeError(w, http.StatusNotFound, 34, "Sorry, that page does not exist.")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case p == "/2/dm_events" && r.Method == "GET":
+		s.serveDMEvents(w, r, u)
+	case strings.HasPrefix(p, "/2/dm_events/") && r.Method == "GET":
+		id, _ := strconv.ParseInt(strings.TrimPrefix(p, "/2/dm_events/"), 10, 64)
+		s.serveDMEvent(w, r, u, id)
+	case strings.HasPrefix(p, "/2/dm_conversations/with/") && strings.HasSuffix(p, "/messages") && r.Method == "POST":
+		id, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(p, "/2/dm_conversations/with/"), "/messages"), 10, 64)
+		s.serveV2New(w, r, u, id)
+	case strings.HasPrefix(p, "/2/users/by/username/") && r.Method == "GET":
+		s.serveUserByUsername(w, strings.TrimPrefix(p, "/2/users/by/username/"))
+	case p == "/1.1/media/upload.json" && r.Method == "POST":
+		s.serveUpload(w, r, u)
+	case strings.HasPrefix(p, "/media/") && r.Method == "GET":
+		s.serveMedia(w, r, u, strings.TrimPrefix(p, "/media/"))
+	default:
+		writeError(w, http.StatusNotFound, 34, "Sorry, that page does not exist.")
+	}
+}
+
+// visible returns the DMs u sent or received and hasn't deleted,
+// newest first. The caller must hold s.mu.
+func (s *Server) visible(u User) []*DM {
+	var dms []*DM
+	for _, dm := range s.dms {
+		if (dm.SenderID == u.ID || dm.RecipientID == u.ID) && !s.deleted[[2]int64{dm.ID, u.ID}] {
+			dms = append(dms, dm)
+		}
+	}
+	sort.Slice(dms, func(i, j int) bool { return dms[i].ID > dms[j].ID })
+	return dms
+}
+
+// deleteDM removes the DM with id from u's view, as Twitter does;
+// the other participant still sees it.
+func (s *Server) deleteDM(u User, id int64) (DM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, dm := range s.visible(u) {
+		if dm.ID == id {
+			s.deleted[[2]int64{id, u.ID}] = true
+			return *dm, true
+		}
+	}
+	return DM{}, false
+}
+
+// send adds a DM from u to the user with toID, checking it the way
+// Twitter does, or writes the error and returns nil.
+func (s *Server) send(w http.ResponseWriter, u User, toID int64, text, mediaID string) *DM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.userByID(toID) == nil {
+		writeError(w, http.StatusForbidden, 150, "You cannot send messages to users who are not following you.")
+		return nil
+	}
+	if strings.TrimSpace(text) == "" && mediaID == "" {
+		writeError(w, http.StatusBadRequest, 151, "There was an error sending your message: text is required.")
+		return nil
+	}
+	if len([]rune(text)) > 10000 {
+		writeError(w, http.StatusForbidden, 354, "The text of your direct message is over the max character limit.")
+		return nil
+	}
+	if mediaID != "" {
+		if m := s.media[mediaID]; m == nil || m.owner != u.ID {
+			writeError(w, http.StatusBadRequest, 324, "The validation of media ids failed.")
+			return nil
+		}
+	}
+	return s.addDM(&DM{SenderID: u.ID, RecipientID: toID, Text: text, CreatedAt: time.Now(), MediaID: mediaID})
+}
+
+// intParam returns r's integer parameter name, or def if it's
+// missing, clamped to [1, max].
+func intParam(r *http.Request, name string, def, max int) int {
+	n, err := strconv.Atoi(r.FormValue(name))
+	if err != nil {
+		return def
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > max {
+		n = max
+	}
+	return n
+}
+
+func userJSON(u *User) map[string]interface{} {
+	if u == nil {
+		return map[string]interface{}{}
+	}
+	return map[string]interface{}{
+		"id":          u.ID,
+		"id_str":      fmt.Sprint(u.ID),
+		"screen_name": u.ScreenName,
+		"name":        u.Name,
+	}
+}
+
+// mediaJSON returns the v1 media entity for an upload, which
+// Twitter always calls a photo in DMs we can send.
+func mediaJSON(r *http.Request, id string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":              json.Number(id),
+		"id_str":          id,
+		"type":            "photo",
+		"media_url_https": "http://" + r.Host + "/media/" + id,
+		"url":             "https://t.co/" + id,
+		"indices":         []int{0, 0},
+	}
+}
+
+// entitiesJSON returns the entities for dm, which are only ever its
+// attachment.
+func entitiesJSON(r *http.Request, dm *DM) map[string]interface{} {
+	ents := map[string]interface{}{
+		"urls":          []interface{}{},
+		"user_mentions": []interface{}{},
+		"hashtags":      []interface{}{},
+	}
+	if dm.MediaID != "" {
+		ents["media"] = []interface{}{mediaJSON(r, dm.MediaID)}
+	}
+	return ents
+}
+
+// v1JSON returns dm in the v1 direct_messages form. The caller must
+// hold s.mu.
+func (s *Server) v1JSON(r *http.Request, dm *DM) map[string]interface{} {
+	sender, recipient := s.userByID(dm.SenderID), s.userByID(dm.RecipientID)
+	return map[string]interface{}{
+		"id":                    dm.ID,
+		"id_str":                fmt.Sprint(dm.ID),
+		"text":                  dm.Text,
+		"created_at":            dm.CreatedAt.Format(time.RubyDate),
+		"sender_id":             dm.SenderID,
+		"recipient_id":          dm.RecipientID,
+		"sender_screen_name":    sender.ScreenName,
+		"recipient_screen_name": recipient.ScreenName,
+		"sender":                userJSON(sender),
+		"recipient":             userJSON(recipient),
+		"entities":              entitiesJSON(r, dm),
+	}
+}
+
+func (s *Server) serveV1List(w http.ResponseWriter, r *http.Request, u User, sent bool) {
+	count := intParam(r, "count", 20, 200)
+	sinceID, _ := strconv.ParseInt(r.FormValue("since_id"), 10, 64)
+	maxID, _ := strconv.ParseInt(r.FormValue("max_id"), 10, 64)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []interface{}{}
+	for _, dm := range s.visible(u) {
+		if sent != (dm.SenderID == u.ID) || dm.ID <= sinceID || maxID != 0 && dm.ID > maxID {
+			continue
+		}
+		if len(list) == count {
+			break
+		}
+		list = append(list, s.v1JSON(r, dm))
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) serveV1New(w http.ResponseWriter, r *http.Request, u User) {
+	s.mu.Lock()
+	to := s.userByName(r.FormValue("screen_name"))
+	if id, err := strconv.ParseInt(r.FormValue("user_id"), 10, 64); err == nil {
+		to = s.userByID(id)
+	}
+	s.mu.Unlock()
+	if to == nil {
+		writeError(w, http.StatusNotFound, 34, "Sorry, that page does not exist.")
+		return
+	}
+	dm := s.send(w, u, to.ID, r.FormValue("text"), "")
+	if dm == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.v1JSON(r, dm))
+}
+
+func (s *Server) serveV1Destroy(w http.ResponseWriter, r *http.Request, u User, id int64) {
+	dm, ok := s.deleteDM(u, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, 34, "Sorry, that page does not exist.")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, s.v1JSON(r, &dm))
+}
+
+func (s *Server) serveUsersShow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByName(r.FormValue("screen_name"))
+	if id, err := strconv.ParseInt(r.FormValue("user_id"), 10, 64); err == nil {
+		u = s.userByID(id)
+	}
+	if u == nil {
+		writeError(w, http.StatusNotFound, 50, "User not found.")
+		return
+	}
+	writeJSON(w, http.StatusOK, userJSON(u))
+}
+
+func (s *Server) serveUsersLookup(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := []interface{}{}
+	for _, id := range strings.Split(r.FormValue("user_id"), ",") {
+		n, _ := strconv.ParseInt(id, 10, 64)
+		if u := s.userByID(n); u != nil {
+			list = append(list, userJSON(u))
+		}
+	}
+	for _, name := range strings.Split(r.FormValue("screen_name"), ",") {
+		if u := s.userByName(name); u != nil && name != "" {
+			list = append(list, userJSON(u))
+		}
+	}
+	if len(list) == 0 {
+		writeError(w, http.StatusNotFound, 17, "No user matches for specified terms.")
+		return
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// page returns up to count of u's DMs, newest first, starting at
+// the one with the ID in token, and the token for the next page.
+// The caller must hold s.mu.
+func (s *Server) page(u User, token string, count int) ([]*DM, string) {
+	dms := s.visible(u)
+	if start, err := strconv.ParseInt(token, 10, 64); err == nil {
+		for len(dms) > 0 && dms[0].ID > start {
+			dms = dms[1:]
+		}
+	}
+	next := ""
+	if len(dms) > count {
+		next = fmt.Sprint(dms[count].ID)
+		dms = dms[:count]
+	}
+	return dms, next
+}
+
+func (s *Server) eventJSON(r *http.Request, dm *DM) map[string]interface{} {
+	data := map[string]interface{}{
+		"text":     dm.Text,
+		"entities": entitiesJSON(r, dm),
+	}
+	if dm.MediaID != "" {
+		data["attachment"] = map[string]interface{}{"type": "media", "media": mediaJSON(r, dm.MediaID)}
+	}
+	return map[string]interface{}{
+		"type":              "message_create",
+		"id":                fmt.Sprint(dm.ID),
+		"created_timestamp": fmt.Sprint(dm.CreatedAt.UnixNano() / 1e6),
+		"message_create": map[string]interface{}{
+			"target":       map[string]string{"recipient_id": fmt.Sprint(dm.RecipientID)},
+			"sender_id":    fmt.Sprint(dm.SenderID),
+			"message_data": data,
+		},
+	}
+}
+
+func (s *Server) serveEventsList(w http.ResponseWriter, r *http.Request, u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dms, next := s.page(u, r.FormValue("cursor"), intParam(r, "count", 20, 50))
+	events := []interface{}{}
+	for _, dm := range dms {
+		events = append(events, s.eventJSON(r, dm))
+	}
+	res := map[string]interface{}{"events": events}
+	if next != "" {
+		res["next_cursor"] = next
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (s *Server) serveEventsNew(w http.ResponseWriter, r *http.Request, u User) {
+	var req struct {
+		Event struct {
+			Type          string `json:"type"`
+			MessageCreate struct {
+				Target struct {
+					RecipientID string `json:"recipient_id"`
+				} `json:"target"`
+				MessageData struct {
+					Text       string `json:"text"`
+					Attachment struct {
+						Media struct {
+							ID string `json:"id"`
+						} `json:"media"`
+					} `json:"attachment"`
+				} `json:"message_data"`
+			} `json:"message_create"`
+		} `json:"event"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Event.Type != "message_create" {
+		writeError(w, http.StatusBadRequest, 214, "event.type: invalid or missing")
+		return
+	}
+	mc := req.Event.MessageCreate
+	to, _ := strconv.ParseInt(mc.Target.RecipientID, 10, 64)
+	dm := s.send(w, u, to, mc.MessageData.Text, mc.MessageData.Attachment.Media.ID)
+	if dm == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{"event": s.eventJSON(r, dm)})
+}
+
+// conversationID returns the v2 ID of the one-to-one conversation
+// between two users: their IDs, lower first, joined by a dash.
+func conversationID(a, b int64) string {
+	if a > b {
+		a, b = b, a
+	}
+	return fmt.Sprintf("%d-%d", a, b)
+}
+
+// v2Events returns dms as v2 dm_events, and the users and media
+// r's expansions ask to include. The caller must hold s.mu.
+func (s *Server) v2Events(r *http.Request, dms []*DM) (data, users, media []interface{}) {
+	expansions := "," + r.FormValue("expansions") + ","
+	data, users, media = []interface{}{}, []interface{}{}, []interface{}{}
+	seen := make(map[int64]bool)
+	for _, dm := range dms {
+		ev := map[string]interface{}{
+			"id":                 fmt.Sprint(dm.ID),
+			"event_type":         "MessageCreate",
+			"text":               dm.Text,
+			"sender_id":          fmt.Sprint(dm.SenderID),
+			"dm_conversation_id": conversationID(dm.SenderID, dm.RecipientID),
+			"created_at":         dm.CreatedAt.Format("2006-01-02T15:04:05.000Z"),
+		}
+		if dm.MediaID != "" {
+			key := "3_" + dm.MediaID
+			ev["attachments"] = map[string]interface{}{"media_keys": []string{key}}
+			if strings.Contains(expansions, ",attachments.media_keys,") {
+				media = append(media, map[string]interface{}{
+					"media_key": key,
+					"type":      "photo",
+					"url":       "http://" + r.Host + "/media/" + dm.MediaID,
+				})
+			}
+		}
+		if strings.Contains(expansions, ",sender_id,") && !seen[dm.SenderID] {
+			seen[dm.SenderID] = true
+			sender := s.userByID(dm.SenderID)
+			users = append(users, map[string]string{
+				"id":       fmt.Sprint(sender.ID),
+				"username": sender.ScreenName,
+				"name":     sender.Name,
+			})
+		}
+		data = append(data, ev)
+	}
+	return data, users, media
+}
+
+func (s *Server) serveDMEvents(w http.ResponseWriter, r *http.Request, u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dms, next := s.page(u, r.FormValue("pagination_token"), intParam(r, "max_results", 100, 100))
+	data, users, media := s.v2Events(r, dms)
+	meta := map[string]interface{}{"result_count": len(data)}
+	if next != "" {
+		meta["next_token"] = next
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data":     data,
+		"includes": map[string]interface{}{"users": users, "media": media},
+		"meta":     meta,
+	})
+}
+
+// serveDMEvent looks up one of u's dm_events by ID.
+func (s *Server) serveDMEvent(w http.ResponseWriter, r *http.Request, u User, id int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, dm := range s.visible(u) {
+		if dm.ID == id {
+			data, users, media := s.v2Events(r, []*DM{dm})
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"data":     data[0],
+				"includes": map[string]interface{}{"users": users, "media": media},
+			})
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, 0, "Could not find dm_event with id: ["+fmt.Sprint(id)+"].")
+}
+
+func (s *Server) serveV2New(w http.ResponseWriter, r *http.Request, u User, to int64) {
+	var req struct {
+		Text        string `json:"text"`
+		Attachments []struct {
+			MediaID string `json:"media_id"`
+		} `json:"attachments"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Attachments) > 1 {
+		writeError(w, http.StatusBadRequest, 0, "Invalid Request: one or more parameters to your request was invalid.")
+		return
+	}
+	mediaID := ""
+	if len(req.Attachments) == 1 {
+		mediaID = req.Attachments[0].MediaID
+	}
+	dm := s.send(w, u, to, req.Text, mediaID)
+	if dm == nil {
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"data": map[string]string{
+			"dm_conversation_id": conversationID(dm.SenderID, dm.RecipientID),
+			"dm_event_id":        fmt.Sprint(dm.ID),
+		},
+	})
+}
+
+// serveUserByUsername looks up a user like v2 does, which reports
+// a missing user with HTTP 200 and an errors list.
+func (s *Server) serveUserByUsername(w http.ResponseWriter, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userByName(name)
+	if u == nil {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"errors": []interface{}{map[string]string{
+				"value":         name,
+				"detail":        fmt.Sprintf("Could not find user with username: [%s].", name),
+				"title":         "Not Found Error",
+				"resource_type": "user",
+				"parameter":     "username",
+				"type":          "https://api.twitter.com/2/problems/resource-not-found",
+			}},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"data": map[string]string{
+			"id":       fmt.Sprint(u.ID),
+			"username": u.ScreenName,
+			"name":     u.Name,
+		},
+	})
+}
+
+// serveUpload handles the simple, one-request form of media/upload.
+func (s *Server) serveUpload(w http.ResponseWriter, r *http.Request, u User) {
+	f, _, err := r.FormFile("media")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 38, "media parameter is missing.")
+		return
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, 0, err.Error())
+		return
+	}
+	ct := http.DetectContentType(data)
+	if !strings.HasPrefix(ct, "image/") {
+		writeError(w, http.StatusBadRequest, 0, "media type unrecognized.")
+		return
+	}
+	s.mu.Lock()
+	id := fmt.Sprint(s.newID())
+	s.media[id] = &upload{owner: u.ID, contentType: ct, data: data}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"media_id":           json.Number(id),
+		"media_id_string":    id,
+		"size":               len(data),
+		"expires_after_secs": 86400,
+		"image":              map[string]interface{}{"image_type": ct},
+	})
+}
+
+// serveMedia serves an attachment to either participant of a DM
+// carrying it, as Twitter's OAuth-protected DM media URLs do.
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request, u User, id string) {
+	s.mu.Lock()
+	m := s.media[id]
+	allowed := m != nil && m.owner == u.ID
+	for _, dm := range s.visible(u) {
+		if dm.MediaID == id {
+			allowed = true
+		}
+	}
+	s.mu.Unlock()
+	if !allowed {
+		writeError(w, http.StatusNotFound, 34, "Sorry, that page does not exist.")
+		return
+	}
+	w.Header().Set("Content-Type", m.contentType)
+	w.Write(m.data)
+}
@@ -0,0 +1,546 @@
+// Package faketwitter is a fake of the parts of Twitter's API that
+// eight22er uses: OAuth 1.0a sign-in, the v1, v1.1 and v2 DM
+// endpoints, user lookups and media upload. It keeps its users and
+// DMs in memory, so tests can script them, and can be told to fail
+// requests the ways Twitter does.
+//
+// Point eight22er's -twitter_api_base and -twitter_upload_base flags
+// at the server's URL, and its consumer key flags at ConsumerKey and
+// ConsumerSecret.
+package faketwitter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The app credentials the server accepts.
+const (
+	ConsumerKey    = "fake-consumer-key"
+	ConsumerSecret = "fake-consumer-secret"
+)
+
+// A User is a Twitter account on the fake server.
+type User struct {
+	ID          int64
+	ScreenName  string
+	Name        string
+	Token       string // access token the server issues on sign-in
+	TokenSecret string
+}
+
+// A DM is a direct message on the fake server.
+type DM struct {
+	ID          int64
+	SenderID    int64
+	RecipientID int64
+	Text        string
+	CreatedAt   time.Time
+	MediaID     string // attached upload, or ""
+}
+
+// A Failure is an error the server returns in place of handling a
+// request.
+type Failure int
+
+const (
+	RateLimited   Failure = iota + 1 // HTTP 429, error 88, with rate limit headers
+	Unauthorized                     // HTTP 401, error 89, as for a revoked token
+	MalformedJSON                    // HTTP 200 with a truncated JSON body
+)
+
+var failureNames = map[string]Failure{
+	"rate_limit":     RateLimited,
+	"unauthorized":   Unauthorized,
+	"malformed_json": MalformedJSON,
+}
+
+func (f Failure) String() string {
+	for name, g := range failureNames {
+		if g == f {
+			return name
+		}
+	}
+	return fmt.Sprintf("Failure(%d)", int(f))
+}
+
+// A Server is a fake Twitter API server listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	// ResetAfter is how long a RateLimited failure tells the
+	// client to wait. The default is Twitter's 15 minute window.
+	// Set it before making requests.
+	ResetAfter time.Duration
+
+	mu          sync.Mutex
+	lastID      int64
+	users       []*User
+	dms         []*DM
+	deleted     map[[2]int64]bool // DM ID and user ID, for DMs deleted from that user's view
+	media       map[string]*upload
+	reqTokens   map[string]*requestToken
+	authorizeAs string
+	failures    map[string][]Failure // by path; "" for any
+	requests    []string
+}
+
+type upload struct {
+	owner       int64
+	contentType string
+	data        []byte
+}
+
+// A requestToken is the temporary credential for a sign-in in
+// progress.
+type requestToken struct {
+	secret   string
+	callback string
+	verifier string // set once a user has authorized it
+	userID   int64
+}
+
+// NewServer starts and returns a new Server with no users. The
+// caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server but doesn't start it,
+// so that the caller can change its Listener first. The caller
+// should call Start, then Close when finished.
+func NewUnstartedServer() *Server {
+	s := &Server{
+		lastID:    1000000,
+		deleted:   make(map[[2]int64]bool),
+		media:     make(map[string]*upload),
+		reqTokens: make(map[string]*requestToken),
+		failures:  make(map[string][]Failure),
+	}
+	s.Server = httptest.NewUnstartedServer(s)
+	return s
+}
+
+func (s *Server) newID() int64 {
+	s.lastID++
+	return s.lastID
+}
+
+// AddUser adds a user and returns it with its ID and access token
+// credentials filled in.
+func (s *Server) AddUser(screenName, name string) User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.addUser(User{ScreenName: screenName, Name: name})
+}
+
+func (s *Server) addUser(u User) *User {
+	if u.ID == 0 {
+		u.ID = s.newID()
+	} else if u.ID > s.lastID {
+		s.lastID = u.ID
+	}
+	if u.Token == "" {
+		u.Token = fmt.Sprintf("%d-%s", u.ID, randHex(16))
+	}
+	if u.TokenSecret == "" {
+		u.TokenSecret = randHex(20)
+	}
+	s.users = append(s.users, &u)
+	return &u
+}
+
+// User returns the user with the given screen name.
+func (s *Server) User(screenName string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.userByName(screenName); u != nil {
+		return *u, true
+	}
+	return User{}, false
+}
+
+// Users returns every user on the server, in the order they were
+// added.
+func (s *Server) Users() []User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	users := make([]User, len(s.users))
+	for i, u := range s.users {
+		users[i] = *u
+	}
+	return users
+}
+
+func (s *Server) userByName(screenName string) *User {
+	for _, u := range s.users {
+		if strings.EqualFold(u.ScreenName, screenName) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Server) userByID(id int64) *User {
+	for _, u := range s.users {
+		if u.ID == id {
+			return u
+		}
+	}
+	return nil
+}
+
+// AddDM adds a DM sent now from one user to another, by screen
+// name, and returns it. It panics if either user doesn't exist.
+func (s *Server) AddDM(from, to, text string) DM {
+	return s.AddDMAt(from, to, text, time.Now())
+}
+
+// AddDMAt is AddDM for a DM sent at t.
+func (s *Server) AddDMAt(from, to, text string, t time.Time) DM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dm, err := s.addDMByName(from, to, text, t)
+	if err != nil {
+		panic("faketwitter: " + err.Error())
+	}
+	return *dm
+}
+
+func (s *Server) addDMByName(from, to, text string, t time.Time) (*DM, error) {
+	sender, recipient := s.userByName(from), s.userByName(to)
+	if sender == nil {
+		return nil, fmt.Errorf("no user %q", from)
+	}
+	if recipient == nil {
+		return nil, fmt.Errorf("no user %q", to)
+	}
+	return s.addDM(&DM{SenderID: sender.ID, RecipientID: recipient.ID, Text: text, CreatedAt: t}), nil
+}
+
+func (s *Server) addDM(dm *DM) *DM {
+	dm.ID = s.newID()
+	dm.CreatedAt = dm.CreatedAt.UTC()
+	s.dms = append(s.dms, dm)
+	return dm
+}
+
+// DMs returns every DM on the server, oldest first, including ones
+// users have deleted.
+func (s *Server) DMs() []DM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dms := make([]DM, len(s.dms))
+	for i, dm := range s.dms {
+		dms[i] = *dm
+	}
+	return dms
+}
+
+// AuthorizeAs sets the user who approves sign-ins at the authorize
+// page. By default it's the first user added. A screen_name
+// parameter on the authorize URL overrides it.
+func (s *Server) AuthorizeAs(screenName string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authorizeAs = screenName
+}
+
+// Fail makes the next request for path, such as "/2/dm_events",
+// fail with f instead of being handled. An empty path matches the
+// next request for any path. Failures queued for the same path
+// are used in order.
+func (s *Server) Fail(path string, f Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], f)
+}
+
+func (s *Server) nextFailure(path string) Failure {
+	for _, p := range []string{path, ""} {
+		if q := s.failures[p]; len(q) > 0 {
+			s.failures[p] = q[1:]
+			return q[0]
+		}
+	}
+	return 0
+}
+
+// Requests returns the method and path of every request the server
+// has received, in order, such as "GET /2/dm_events".
+func (s *Server) Requests() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// Load adds the users, DMs and failures in a JSON fixture read from
+// r, in the form:
+//
+//	{
+//	  "users": [{"screen_name": "alice", "name": "Alice"}, {"screen_name": "bob", "id": 42}],
+//	  "dms": [{"from": "bob", "to": "alice", "text": "hi", "created_at": "2012-03-01T10:00:00Z"}],
+//	  "failures": [{"path": "/2/dm_events", "failure": "rate_limit"}]
+//	}
+//
+// Users may also give their "token" and "token_secret". Failures
+// are "rate_limit", "unauthorized" or "malformed_json".
+func (s *Server) Load(r io.Reader) error {
+	var fx struct {
+		Users []struct {
+			ID          int64  `json:"id"`
+			ScreenName  string `json:"screen_name"`
+			Name        string `json:"name"`
+			Token       string `json:"token"`
+			TokenSecret string `json:"token_secret"`
+		} `json:"users"`
+		DMs []struct {
+			From      string    `json:"from"`
+			To        string    `json:"to"`
+			Text      string    `json:"text"`
+			CreatedAt time.Time `json:"created_at"`
+		} `json:"dms"`
+		Failures []struct {
+			Path    string `json:"path"`
+			Failure string `json:"failure"`
+		} `json:"failures"`
+	}
+	if err := json.NewDecoder(r).Decode(&fx); err != nil {
+		return fmt.Errorf("faketwitter: bad fixture: %v", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range fx.Users {
+		if u.ScreenName == "" {
+			return fmt.Errorf("faketwitter: fixture user without a screen_name")
+		}
+		s.addUser(User{ID: u.ID, ScreenName: u.ScreenName, Name: u.Name, Token: u.Token, TokenSecret: u.TokenSecret})
+	}
+	for _, dm := range fx.DMs {
+		t := dm.CreatedAt
+		if t.IsZero() {
+			t = time.Now()
+		}
+		if _, err := s.addDMByName(dm.From, dm.To, dm.Text, t); err != nil {
+			return fmt.Errorf("faketwitter: fixture DM: %v", err)
+		}
+	}
+	for _, f := range fx.Failures {
+		fail, ok := failureNames[f.Failure]
+		if !ok {
+			return fmt.Errorf("faketwitter: unknown fixture failure %q", f.Failure)
+		}
+		s.failures[f.Path] = append(s.failures[f.Path], fail)
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+	f := s.nextFailure(r.URL.Path)
+	s.mu.Unlock()
+	if f != 0 {
+		s.fail(w, f)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/oauth/request_token":
+		s.serveRequestToken(w, r)
+		return
+	case "/oauth/authorize":
+		s.serveAuthorize(w, r)
+		return
+	case "/oauth/access_token":
+		s.serveAccessToken(w, r)
+		return
+	}
+	u, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+	s.serveAPI(w, r, u)
+}
+
+func (s *Server) fail(w http.ResponseWriter, f Failure) {
+	switch f {
+	case RateLimited:
+		reset := s.ResetAfter
+		if reset == 0 {
+			reset = 15 * time.Minute
+		}
+		w.Header().Set("X-Rate-Limit-Limit", "15")
+		w.Header().Set("X-Rate-Limit-Remaining", "0")
+		w.Header().Set("X-Rate-Limit-Reset", fmt.Sprint(time.Now().Add(reset).Unix()))
+		writeError(w, 429, 88, "Rate limit exceeded")
+	case Unauthorized:
+		writeError(w, http.StatusUnauthorized, 89, "Invalid or expired token.")
+	case MalformedJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, `{"data": [{"id": "12`)
+	}
+}
+
+// serveRequestToken issues temporary credentials to the app, signed
+// with just its consumer secret.
+func (s *Server) serveRequestToken(w http.ResponseWriter, r *http.Request) {
+	params := oauthParams(r)
+	if params.Get("oauth_consumer_key") != ConsumerKey || !checkSignature(r, params, "") {
+		writeError(w, http.StatusUnauthorized, 32, "Could not authenticate you.")
+		return
+	}
+	callback := params.Get("oauth_callback")
+	if callback == "" {
+		writeError(w, http.StatusBadRequest, 0, "oauth_callback is required")
+		return
+	}
+	s.mu.Lock()
+	token := "rt-" + randHex(16)
+	rt := &requestToken{secret: randHex(20), callback: callback}
+	s.reqTokens[token] = rt
+	s.mu.Unlock()
+	writeForm(w, url.Values{
+		"oauth_token":              {token},
+		"oauth_token_secret":       {rt.secret},
+		"oauth_callback_confirmed": {"true"},
+	})
+}
+
+// serveAuthorize stands in for the page where the user approves the
+// app, approving it at once and sending the browser back to the
+// app's callback.
+func (s *Server) serveAuthorize(w http.ResponseWriter, r *http.Request) {
+	token := r.FormValue("oauth_token")
+	s.mu.Lock()
+	rt := s.reqTokens[token]
+	name := r.FormValue("screen_name")
+	if name == "" {
+		name = s.authorizeAs
+	}
+	var u *User
+	if name != "" {
+		u = s.userByName(name)
+	} else if len(s.users) > 0 {
+		u = s.users[0]
+	}
+	if rt != nil && u != nil {
+		rt.verifier = randHex(16)
+		rt.userID = u.ID
+	}
+	s.mu.Unlock()
+
+	switch {
+	case rt == nil:
+		http.Error(w, "This page is no longer valid.", http.StatusForbidden)
+	case u == nil:
+		http.Error(w, "No one to sign in as.", http.StatusNotFound)
+	case rt.callback == "oob":
+		fmt.Fprintf(w, "PIN: %s\n", rt.verifier)
+	default:
+		sep := "?"
+		if strings.Contains(rt.callback, "?") {
+			sep = "&"
+		}
+		http.Redirect(w, r, rt.callback+sep+url.Values{
+			"oauth_token":    {token},
+			"oauth_verifier": {rt.verifier},
+		}.Encode(), http.StatusFound)
+	}
+}
+
+// serveAccessToken trades an authorized request token and its
+// verifier for the user's access token. Like Twitter, it doesn't
+// check the signature: eight22er signs this request with the
+// consumer secret in place of the request token secret.
+func (s *Server) serveAccessToken(w http.ResponseWriter, r *http.Request) {
+	params := oauthParams(r)
+	if params.Get("oauth_consumer_key") != ConsumerKey {
+		writeError(w, http.StatusUnauthorized, 32, "Could not authenticate you.")
+		return
+	}
+	token := params.Get("oauth_token")
+	s.mu.Lock()
+	rt := s.reqTokens[token]
+	var u *User
+	if rt != nil && rt.verifier != "" && rt.verifier == params.Get("oauth_verifier") {
+		delete(s.reqTokens, token)
+		u = s.userByID(rt.userID)
+	}
+	s.mu.Unlock()
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, 0, "Invalid request token.")
+		return
+	}
+	writeForm(w, url.Values{
+		"oauth_token":        {u.Token},
+		"oauth_token_secret": {u.TokenSecret},
+		"user_id":            {fmt.Sprint(u.ID)},
+		"screen_name":        {u.ScreenName},
+	})
+}
+
+// authenticate returns the user whose access token signed r, or
+// writes Twitter's error and returns false.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (User, bool) {
+	params := oauthParams(r)
+	s.mu.Lock()
+	var u *User
+	for _, cand := range s.users {
+		if cand.Token == params.Get("oauth_token") {
+			u = cand
+		}
+	}
+	var user User
+	if u != nil {
+		user = *u
+	}
+	s.mu.Unlock()
+	if u == nil {
+		writeError(w, http.StatusUnauthorized, 89, "Invalid or expired token.")
+		return User{}, false
+	}
+	if params.Get("oauth_consumer_key") != ConsumerKey || !checkSignature(r, params, user.TokenSecret) {
+		writeError(w, http.StatusUnauthorized, 32, "Could not authenticate you.")
+		return User{}, false
+	}
+	return user, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error in Twitter's v1.1 form. Code 0 is left
+// out of it.
+func writeError(w http.ResponseWriter, status, code int, message string) {
+	e := map[string]interface{}{"message": message}
+	if code != 0 {
+		e["code"] = code
+	}
+	writeJSON(w, status, map[string]interface{}{"errors": []interface{}{e}})
+}
+
+func writeForm(w http.ResponseWriter, v url.Values) {
+	w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	io.WriteString(w, v.Encode())
+}
+
+func randHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,107 @@
+package faketwitter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// oauthParams returns the parameters r was signed with: its query,
+// its form-encoded body, and the oauth_* values from its
+// Authorization header.
+func oauthParams(r *http.Request) url.Values {
+	p := make(url.Values)
+	for k, vs := range r.URL.Query() {
+		p[k] = append(p[k], vs...)
+	}
+	if r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		r.ParseForm()
+		for k, vs := range r.PostForm {
+			p[k] = append(p[k], vs...)
+		}
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "OAuth ") {
+		return p
+	}
+	for _, kv := range strings.Split(auth[len("OAuth "):], ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			continue
+		}
+		k, v := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+		if uq, err := strconv.Unquote(v); err == nil {
+			v = uq
+		}
+		if uv, err := url.PathUnescape(v); err == nil {
+			v = uv
+		}
+		if k != "realm" {
+			p[k] = append(p[k], v)
+		}
+	}
+	return p
+}
+
+// checkSignature reports whether params carries a valid HMAC-SHA1
+// signature of r, per section 3.4 of RFC 5849, by the consumer and
+// a token with tokenSecret.
+func checkSignature(r *http.Request, params url.Values, tokenSecret string) bool {
+	if params.Get("oauth_signature_method") != "HMAC-SHA1" {
+		return false
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	type pair struct{ k, v string }
+	var pairs []pair
+	for k, vs := range params {
+		if k == "oauth_signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, pair{encode(k), encode(v)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k != pairs[j].k {
+			return pairs[i].k < pairs[j].k
+		}
+		return pairs[i].v < pairs[j].v
+	})
+	var norm []string
+	for _, p := range pairs {
+		norm = append(norm, p.k+"="+p.v)
+	}
+	base := strings.ToUpper(r.Method) + "&" +
+		encode(scheme+"://"+strings.ToLower(r.Host)+r.URL.Path) + "&" +
+		encode(strings.Join(norm, "&"))
+
+	h := hmac.New(sha1.New, []byte(encode(ConsumerSecret)+"&"+encode(tokenSecret)))
+	h.Write([]byte(base))
+	want := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return hmac.Equal([]byte(want), []byte(params.Get("oauth_signature")))
+}
+
+// encode percent-encodes s as section 3.6 of RFC 5849 requires.
+func encode(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// feedEntries is how many of the newest DMs the Atom feed has.
+const feedEntries = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Link    []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomPerson  `xml:"author"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// feedID returns an Atom id for something of the account's: a tag
+// URI ending in name, which for entries is the DM's UIDL, so feed
+// readers and POP clients agree on which DM is which.
+func feedID(a *Account, name string) string {
+	return fmt.Sprintf("tag:eight22er.danga.com,2012:%s/%s", strings.ToLower(a.Username), name)
+}
+
+// mailHTML returns the inside of the body of a rendered message's
+// text/html part, which is the DM as the mail path shows it.
+func mailHTML(raw string) string {
+	var find func(p *mimePart) *mimePart
+	find = func(p *mimePart) *mimePart {
+		if typ, subtype, _ := p.mediaType(); typ == "text" && subtype == "html" {
+			return p
+		}
+		for _, sub := range p.parts {
+			if found := find(sub); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	p := find(parseMIME(raw))
+	if p == nil {
+		return ""
+	}
+	data, err := ioutil.ReadAll(transferDecoder(p.header.Get("Content-Transfer-Encoding"), strings.NewReader(p.body)))
+	if err != nil {
+		return ""
+	}
+	s := strings.Replace(string(data), "\r\n", "\n", -1)
+	if i := strings.Index(s, "<body>"); i >= 0 {
+		s = s[i+len("<body>"):]
+	}
+	if i := strings.LastIndex(s, "</body>"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// tokenAccount returns the account named by r's user parameter if
+// its token parameter is the account's feed token, from the config
+// page, or nil. It's for clients that can only be given a URL, like
+// feed readers and EventSource, so never need the password.
+func tokenAccount(r *http.Request) *Account {
+	q := r.URL.Query()
+	user, token := q.Get("user"), q.Get("token")
+	acct := GetAccountNoAuth(user)
+	if acct.Token == "" || acct.FeedToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(acct.FeedToken)) != 1 {
+		return nil
+	}
+	return acct
+}
+
+// feedFunc serves an account's newest DMs as an Atom feed. Feed
+// readers can't sign in, so it takes the account's feed token; see
+// tokenAccount.
+func feedFunc(w http.ResponseWriter, r *http.Request) {
+	acct := tokenAccount(r)
+	if acct == nil {
+		http.Error(w, "bad user or feed token", http.StatusForbidden)
+		return
+	}
+	syncer.Touch(acct)
+	dms, err := syncer.DMs(acct)
+	if err != nil {
+		http.Error(w, "can't read messages", http.StatusInternalServerError)
+		return
+	}
+	store, err := syncer.Store(acct.Username)
+	if err != nil {
+		http.Error(w, "can't open message store", http.StatusInternalServerError)
+		return
+	}
+	if len(dms) > feedEntries {
+		dms = dms[:feedEntries]
+	}
+
+	b := backendFor(acct)
+	self := fmt.Sprintf("%s/feed?%s", baseURL(r), url.Values{"user": {r.URL.Query().Get("user")}, "token": {acct.FeedToken}}.Encode())
+	feed := &atomFeed{
+		ID:     feedID(acct, "dms"),
+		Title:  fmt.Sprintf("DMs for %s on %s", acct.Username, b.Name()),
+		Author: atomPerson{Name: acct.Username},
+		Link:   []atomLink{{Rel: "self", Href: self}},
+	}
+	updated := time.Unix(0, 0)
+	for _, dm := range dms {
+		if dm.CreatedAt.After(updated) {
+			updated = dm.CreatedAt
+		}
+		when := dm.CreatedAt.UTC().Format(time.RFC3339)
+		name := dm.Sender.Name
+		if name == "" {
+			name = dm.Sender.Handle
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        feedID(acct, dm.UIDL()),
+			Title:     dm.Subject(),
+			Published: when,
+			Updated:   when,
+			Author:    atomPerson{Name: name, Email: b.MailAddress(dm.Sender)},
+			Content:   atomContent{Type: "html", Body: mailHTML(renderDM(store, acct, dm))},
+		})
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(feed); err != nil {
+		http.Error(w, "can't make feed", http.StatusInternalServerError)
+		return
+	}
+	// Not Last-Modified: imported or deleted DMs change the feed
+	// without changing its newest entry.
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", "private, no-cache")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(buf.Bytes())))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
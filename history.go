@@ -0,0 +1,249 @@
+package main
+
+import (
+	"flag"
+	"sort"
+)
+
+var (
+	dmPageSize = flag.Int("dm_page_size", 200, "Number of DMs to request per API call when paging through history")
+	dmMaxPages = flag.Int("dm_max_pages", 20, "Maximum number of pages to walk back through a DM stream in one sync; 0 means no limit")
+)
+
+// streamNames returns the DM streams the account wants, in a fixed
+// order. Which streams exist depends on -dm_api.
+func (a *Account) streamNames() []string {
+	return currentDMAPI().streams(a)
+}
+
+// A pageSource is an API that returns a DM stream a page at a
+// time, newest first. See dmAPI for the methods.
+type pageSource interface {
+	page(a *Account, stream string, count int, sinceID int64, token string) (dms []DM, next string, err error)
+	tokenBefore(id int64) string
+}
+
+// A DMPager walks backwards through one of an account's DM streams
+// a page at a time, newest first. Paging stops at SinceID
+// (exclusive), at the start of the history, or after MaxPages
+// pages.
+type DMPager struct {
+	a      *Account
+	api    pageSource
+	stream string
+
+	PageSize int    // DMs per request
+	MaxPages int    // 0 means no limit
+	SinceID  int64  // only return DMs newer than this; 0 for all
+	Token    string // API page token to fetch next; "" for newest
+
+	pages int
+	done  bool
+}
+
+// Pager returns a DMPager over the named Twitter DM stream,
+// configured from the command-line flags.
+func (a *Account) Pager(stream string) *DMPager {
+	return newPager(currentDMAPI(), a, stream)
+}
+
+func newPager(src pageSource, a *Account, stream string) *DMPager {
+	return &DMPager{
+		a:        a,
+		api:      src,
+		stream:   stream,
+		PageSize: *dmPageSize,
+		MaxPages: *dmMaxPages,
+	}
+}
+
+// Next returns the next page of DMs. It returns an empty slice and
+// nil error once the pager is exhausted.
+func (p *DMPager) Next() ([]DM, error) {
+	for {
+		if p.done || (p.MaxPages > 0 && p.pages >= p.MaxPages) {
+			return nil, nil
+		}
+		dms, next, err := p.api.page(p.a, p.stream, p.PageSize, p.SinceID, p.Token)
+		if err != nil {
+			return nil, err
+		}
+		p.pages++
+		p.Token = next
+		if next == "" {
+			p.done = true
+		}
+		// Not every API filters by since_id, so drop what
+		// we've already seen here. Reaching it means we're
+		// caught up.
+		var page []DM
+		for _, dm := range dms {
+			if dm.ID > p.SinceID {
+				page = append(page, dm)
+			} else {
+				p.done = true
+			}
+		}
+		// A page can come back empty without being the last
+		// when the API returns things other than DMs, which
+		// the source filters out.
+		if len(page) > 0 || p.done {
+			return page, nil
+		}
+	}
+}
+
+// Done reports whether the pager reached SinceID or the start of
+// the stream, as opposed to stopping at MaxPages.
+func (p *DMPager) Done() bool {
+	return p.done
+}
+
+// A SyncCursor records how much of one DM stream has been fetched.
+type SyncCursor struct {
+	NewestID int64  // newest DM seen; incremental syncs fetch after it
+	OldestID int64  // oldest DM seen while walking back through history
+	Token    string // API page token to resume the history walk from
+	Complete bool   // the history walk reached the start of the stream
+
+	// An incremental sync that stopped at MaxPages leaves a gap
+	// between the DMs it got and GapSinceID, the NewestID before
+	// it. Later syncs fill it in from GapToken.
+	GapSinceID int64
+	GapToken   string
+
+	// Backfill has the page tokens to continue history walks from,
+	// by conversation, for backends that walk each conversation's
+	// history on its own. The walk is Complete once it's empty.
+	Backfill map[string]string `json:",omitempty"`
+}
+
+// clone returns a copy of c that doesn't share its Backfill map.
+func (c SyncCursor) clone() SyncCursor {
+	if c.Backfill != nil {
+		m := make(map[string]string, len(c.Backfill))
+		for k, v := range c.Backfill {
+			m[k] = v
+		}
+		c.Backfill = m
+	}
+	return c
+}
+
+// keepSynced returns the DMs in got that a wants, moving c's newest
+// and oldest IDs to cover them. It's for backends that sync without
+// a DMPager.
+func keepSynced(a *Account, c *SyncCursor, got []DM) []DM {
+	var dms []DM
+	for _, dm := range got {
+		if a.HideSent && dm.Sent(a) {
+			continue
+		}
+		dms = append(dms, dm)
+		if dm.ID > c.NewestID {
+			c.NewestID = dm.ID
+		}
+		if c.OldestID == 0 || dm.ID < c.OldestID {
+			c.OldestID = dm.ID
+		}
+	}
+	return dms
+}
+
+// SyncStream fetches the DMs in stream that haven't been fetched
+// before: first anything newer than the cursor c, then, if the
+// history walk isn't complete, the next batch of older DMs. c is
+// advanced to cover what was returned; the caller persists it once
+// the DMs are safely stored.
+func (a *Account) SyncStream(stream string, c *SyncCursor) ([]DM, error) {
+	return syncStream(currentDMAPI(), a, stream, c)
+}
+
+// syncStream is SyncStream for any pageSource.
+func syncStream(src pageSource, a *Account, stream string, c *SyncCursor) ([]DM, error) {
+	var got []DM
+	walk := func(p *DMPager) error {
+		for {
+			dms, err := p.Next()
+			if err != nil {
+				return err
+			}
+			if len(dms) == 0 {
+				return nil
+			}
+			got = append(got, dms...)
+		}
+	}
+
+	newGap := false
+	if c.NewestID != 0 {
+		p := newPager(src, a, stream)
+		p.SinceID = c.NewestID
+		if err := walk(p); err != nil {
+			return got, err
+		}
+		if !p.Done() {
+			// Too many new DMs to reach our old newest one
+			// within MaxPages. Fill the gap in later syncs
+			// rather than pretend we have it. A gap left by
+			// an earlier sync is now below this one, so it's
+			// walked again from here down.
+			if c.GapSinceID == 0 {
+				c.GapSinceID = c.NewestID
+			}
+			c.GapToken = p.Token
+			newGap = true
+		}
+	}
+	for _, dm := range got {
+		if dm.ID > c.NewestID {
+			c.NewestID = dm.ID
+		}
+	}
+	if c.GapSinceID != 0 && !newGap {
+		p := newPager(src, a, stream)
+		p.SinceID = c.GapSinceID
+		p.Token = c.GapToken
+		if err := walk(p); err != nil {
+			return got, err
+		}
+		if p.Done() {
+			c.GapSinceID, c.GapToken = 0, ""
+		} else {
+			c.GapToken = p.Token
+		}
+	}
+
+	if !c.Complete {
+		p := newPager(src, a, stream)
+		p.Token = c.Token
+		if p.Token == "" && c.OldestID != 0 {
+			// Cursors saved before page tokens were recorded.
+			// APIs that can't start at an ID walk from the
+			// newest again and the store drops the duplicates.
+			p.Token = p.api.tokenBefore(c.OldestID)
+		}
+		for {
+			dms, err := p.Next()
+			if err != nil {
+				return got, err
+			}
+			if len(dms) == 0 {
+				break
+			}
+			for _, dm := range dms {
+				if dm.ID > c.NewestID {
+					c.NewestID = dm.ID
+				}
+				if c.OldestID == 0 || dm.ID < c.OldestID {
+					c.OldestID = dm.ID
+				}
+			}
+			got = append(got, dms...)
+			c.Token = p.Token
+		}
+		c.Complete = p.Done()
+	}
+	sort.Sort(dmsByNewest(got))
+	return got, nil
+}
@@ -0,0 +1,986 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+type imapState int
+
+const (
+	imapNotAuthState imapState = iota
+	imapAuthState
+	imapSelectedState
+)
+
+// imapCommands maps each command to the least state it's allowed
+// in; commands for logging in are only allowed before it.
+var imapCommands = map[string]imapState{
+	"CAPABILITY": imapNotAuthState, "NOOP": imapNotAuthState, "LOGOUT": imapNotAuthState,
+	"STARTTLS": imapNotAuthState, "LOGIN": imapNotAuthState, "AUTHENTICATE": imapNotAuthState,
+	"SELECT": imapAuthState, "EXAMINE": imapAuthState, "CREATE": imapAuthState, "DELETE": imapAuthState,
+	"RENAME": imapAuthState, "SUBSCRIBE": imapAuthState, "UNSUBSCRIBE": imapAuthState,
+	"LIST": imapAuthState, "LSUB": imapAuthState, "STATUS": imapAuthState, "APPEND": imapAuthState,
+	"CHECK": imapSelectedState, "CLOSE": imapSelectedState, "UNSELECT": imapSelectedState,
+	"EXPUNGE": imapSelectedState, "SEARCH": imapSelectedState, "FETCH": imapSelectedState,
+	"STORE": imapSelectedState, "COPY": imapSelectedState, "UID": imapSelectedState,
+	"IDLE": imapAuthState,
+}
+
+// imapIdleTimeout is RFC 3501's minimum autologout timer.
+const imapIdleTimeout = 30 * time.Minute
+
+// imapConvFolder is the parent of the per-conversation folders.
+const imapConvFolder = "Conversations"
+
+// imapSystemFlags are the flags in FLAGS responses. Clients may also
+// set their own keywords, which the store keeps like the rest.
+var imapSystemFlags = []string{`\Seen`, `\Answered`, `\Flagged`, `\Deleted`, `\Draft`}
+
+type IMAPServer struct {
+	ln  net.Listener
+	tls *tls.Config // for STARTTLS on connections that aren't TLS already; nil to not offer it
+}
+
+func NewIMAPServer(ln net.Listener, config *tls.Config) *IMAPServer {
+	return &IMAPServer{ln: ln, tls: config}
+}
+
+func (s *IMAPServer) run() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			log.Fatalf("IMAP accept error, shutting down: %v", err)
+			return
+		}
+		conn := &imapConn{s: s}
+		conn.setConn(c)
+		go conn.serve()
+	}
+}
+
+// An imapMailbox is a folder as clients see it: INBOX, with every
+// DM, or one conversation's folder under imapConvFolder.
+type imapMailbox struct {
+	name string // in modified UTF-7
+	conv string // conversation ID; "" for INBOX
+}
+
+// An imapMsg is a message in the selected mailbox.
+type imapMsg struct {
+	seq int
+	uid uint32
+	dm  DM
+
+	// Cached while a command works on the message; see forget.
+	raw  string
+	part *mimePart
+}
+
+type imapConn struct {
+	net.Conn
+	s     *IMAPServer
+	br    *bufio.Reader
+	bw    *bufio.Writer
+	tr    *textproto.Reader
+	state imapState
+	acct  *Account
+	store MessageStore
+
+	sel       imapMailbox // when in the selected state
+	readOnly  bool        // selected with EXAMINE
+	msgs      []*imapMsg  // the selected mailbox's, by sequence number
+	flagsSent map[uint32]string
+}
+
+// setConn makes c talk over nc, as it does again after STARTTLS.
+func (c *imapConn) setConn(nc net.Conn) {
+	c.Conn = nc
+	c.br = bufio.NewReader(nc)
+	c.bw = bufio.NewWriter(nc)
+	c.tr = textproto.NewReader(c.br)
+}
+
+func (c *imapConn) send(s string) {
+	c.bw.WriteString(s)
+	c.bw.WriteString("\r\n")
+	c.bw.Flush()
+}
+
+func (c *imapConn) untagged(s string) {
+	c.send("* " + s)
+}
+
+// reply sends a command's tagged completion: OK, NO or BAD.
+func (c *imapConn) reply(tag, status, text string) {
+	log.Printf("IMAP sent: %s %s %s", tag, status, text)
+	c.send(tag + " " + status + " " + text)
+}
+
+// literal reads a literal the client sent as part of a command,
+// and the rest of the command line after it.
+func (c *imapConn) literal(n int, sync bool) (string, string, error) {
+	if n > maxIMAPLiteral {
+		if !sync {
+			// The client sent it anyway; skip it.
+			if _, err := io.CopyN(ioutil.Discard, c.br, int64(n)); err != nil {
+				return "", "", err
+			}
+			c.tr.ReadLine()
+		}
+		return "", "", errIMAPLiteral
+	}
+	if sync {
+		c.send("+ go ahead")
+	}
+	return readLiteral(c.br, n, c.tr.ReadLine)
+}
+
+var errIMAPLiteral = errors.New("literal too big")
+
+func (c *imapConn) capabilities() string {
+	caps := []string{"IMAP4rev1", "IDLE", "LITERAL+", "SASL-IR", "UIDPLUS", "UNSELECT"}
+	if c.state == imapNotAuthState {
+		caps = append(caps, "AUTH=PLAIN")
+		if c.canStartTLS() {
+			caps = append(caps, "STARTTLS")
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+func (c *imapConn) canStartTLS() bool {
+	_, isTLS := c.Conn.(*tls.Conn)
+	return c.s.tls != nil && !isTLS
+}
+
+func (c *imapConn) serve() error {
+	defer c.Close()
+
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		log.Printf("New IMAP TLS connnection from %q", c.RemoteAddr())
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("TLS handshake error from %q: %v", c.RemoteAddr(), err)
+			return err
+		}
+	} else {
+		log.Printf("New IMAP raw connnection from %q", c.RemoteAddr())
+	}
+	c.untagged("OK [CAPABILITY " + c.capabilities() + "] IMAP4rev1 eight22er here, ready to proxy your DMs, yo")
+
+	for {
+		c.SetReadDeadline(time.Now().Add(imapIdleTimeout))
+		line, err := c.tr.ReadLine()
+		if err != nil {
+			log.Printf("Error reading from IMAP connection: %v", err)
+			return err
+		}
+		p := &imapParser{line: line, literal: c.literal}
+		tag, err := p.next()
+		if err != nil || tag.kind != imapAtom || tag.s == "*" || tag.s == "+" {
+			c.untagged("BAD missing tag")
+			continue
+		}
+		cmdArg, err := p.next()
+		if err != nil || cmdArg.kind != imapAtom {
+			c.reply(tag.s, "BAD", "missing command")
+			continue
+		}
+		cmd := strings.ToUpper(cmdArg.s)
+		if cmd == "LOGIN" || cmd == "AUTHENTICATE" {
+			log.Printf("IMAP got %s %s", tag.s, cmd)
+		} else {
+			log.Printf("IMAP got line: %q", line)
+		}
+		args, err := p.rest()
+		if err == errIMAPLiteral {
+			c.reply(tag.s, "BAD", "literal too big")
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(net.Error); ok || err == io.EOF {
+				return err
+			}
+			c.reply(tag.s, "BAD", err.Error())
+			continue
+		}
+		least, ok := imapCommands[cmd]
+		switch {
+		case !ok:
+			c.reply(tag.s, "BAD", "unknown command")
+			continue
+		case c.state < least:
+			c.reply(tag.s, "BAD", cmd+" isn't allowed in this state")
+			continue
+		case least == imapNotAuthState && c.state != imapNotAuthState &&
+			(cmd == "STARTTLS" || cmd == "LOGIN" || cmd == "AUTHENTICATE"):
+			c.reply(tag.s, "BAD", "already logged in")
+			continue
+		}
+		if err := c.command(tag.s, cmd, args); err != nil {
+			return err
+		}
+	}
+}
+
+// command runs one command. A non-nil error means the connection is
+// done.
+func (c *imapConn) command(tag, cmd string, args []imapArg) error {
+	switch cmd {
+	case "CAPABILITY":
+		c.untagged("CAPABILITY " + c.capabilities())
+		c.reply(tag, "OK", "CAPABILITY completed")
+	case "NOOP", "CHECK":
+		if c.state == imapSelectedState {
+			c.update()
+		}
+		c.reply(tag, "OK", cmd+" completed")
+	case "IDLE":
+		return c.idle(tag)
+	case "LOGOUT":
+		c.untagged("BYE eight22er logging out")
+		c.reply(tag, "OK", "LOGOUT completed")
+		return io.EOF
+	case "STARTTLS":
+		return c.startTLS(tag)
+	case "LOGIN":
+		if len(args) != 2 {
+			c.reply(tag, "BAD", "LOGIN needs a user name and password")
+			return nil
+		}
+		acct, err := GetAccount(args[0].s, args[1].s)
+		c.login(tag, acct, err)
+	case "AUTHENTICATE":
+		return c.authenticate(tag, args)
+	case "SELECT", "EXAMINE":
+		c.selectMailbox(tag, cmd, args)
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		c.reply(tag, "NO", "[CANNOT] folders here are made from your conversations")
+	case "COPY":
+		c.reply(tag, "NO", "[CANNOT] messages can't be copied between folders here")
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		// Every folder is always subscribed.
+		c.reply(tag, "OK", cmd+" completed")
+	case "LIST", "LSUB":
+		c.list(tag, cmd, args)
+	case "STATUS":
+		c.status(tag, args)
+	case "CLOSE", "UNSELECT":
+		if cmd == "CLOSE" && !c.readOnly {
+			if err := c.expunge(nil, true); err != nil {
+				log.Printf("IMAP: expunging for %q: %v", c.acct.Username, err)
+			}
+		}
+		c.state, c.msgs = imapAuthState, nil
+		c.reply(tag, "OK", cmd+" completed")
+	case "EXPUNGE":
+		c.expungeCommand(tag, nil)
+	case "SEARCH":
+		c.search(tag, args, false)
+	case "FETCH":
+		c.fetchCommand(tag, args, false)
+	case "STORE":
+		c.storeCommand(tag, args, false)
+	case "UID":
+		if len(args) == 0 {
+			c.reply(tag, "BAD", "UID needs a command")
+			return nil
+		}
+		sub, rest := strings.ToUpper(args[0].s), args[1:]
+		switch sub {
+		case "SEARCH":
+			c.search(tag, rest, true)
+		case "FETCH":
+			c.fetchCommand(tag, rest, true)
+		case "STORE":
+			c.storeCommand(tag, rest, true)
+		case "COPY":
+			c.reply(tag, "NO", "[CANNOT] messages can't be copied between folders here")
+		case "EXPUNGE":
+			if len(rest) != 1 {
+				c.reply(tag, "BAD", "UID EXPUNGE needs a UID set")
+				return nil
+			}
+			set, err := parseSeqSet(rest[0].s)
+			if err != nil {
+				c.reply(tag, "BAD", err.Error())
+				return nil
+			}
+			c.expungeCommand(tag, set)
+		default:
+			c.reply(tag, "BAD", "unknown UID command")
+		}
+	}
+	return nil
+}
+
+// startTLS upgrades the connection to TLS, per RFC 3501 section
+// 6.2.1. A non-nil error means the connection is unusable.
+func (c *imapConn) startTLS(tag string) error {
+	if !c.canStartTLS() {
+		c.reply(tag, "NO", "STARTTLS not available")
+		return nil
+	}
+	if c.br.Buffered() > 0 {
+		// Anything pipelined after STARTTLS arrived in the
+		// clear and mustn't be treated as if it came over TLS.
+		c.reply(tag, "BAD", "STARTTLS must be the last command sent in the clear")
+		return errors.New("client pipelined after STARTTLS")
+	}
+	c.reply(tag, "OK", "begin TLS negotiation now")
+	tlsConn := tls.Server(c.Conn, c.s.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("STARTTLS handshake error from %q: %v", c.RemoteAddr(), err)
+		return err
+	}
+	c.setConn(tlsConn)
+	return nil
+}
+
+// authenticate logs in with SASL PLAIN, with the initial response
+// either in the command (RFC 4959) or after a "+" continuation. A
+// non-nil error means the connection is unusable.
+func (c *imapConn) authenticate(tag string, args []imapArg) error {
+	if len(args) == 0 || len(args) > 2 {
+		c.reply(tag, "BAD", "AUTHENTICATE needs a mechanism")
+		return nil
+	}
+	if !strings.EqualFold(args[0].s, "PLAIN") {
+		c.reply(tag, "NO", "unsupported SASL mechanism")
+		return nil
+	}
+	resp := ""
+	if len(args) == 2 {
+		resp = args[1].s
+	} else {
+		c.send("+ ")
+		line, err := c.tr.ReadLine()
+		if err != nil {
+			return err
+		}
+		resp = strings.TrimSpace(line)
+	}
+	if resp == "*" {
+		c.reply(tag, "BAD", "AUTHENTICATE cancelled")
+		return nil
+	}
+	if resp == "=" {
+		resp = ""
+	}
+	dec, err := base64.StdEncoding.DecodeString(resp)
+	v := strings.Split(string(dec), "\x00")
+	if err != nil || len(v) != 3 || (v[0] != "" && v[0] != v[1]) {
+		c.reply(tag, "BAD", "bad SASL PLAIN response")
+		return nil
+	}
+	acct, err := GetAccount(v[1], v[2])
+	c.login(tag, acct, err)
+	return nil
+}
+
+// login finishes logging in to acct, whose credentials were checked
+// with the result err, and enters the authenticated state.
+func (c *imapConn) login(tag string, acct *Account, err error) {
+	if err != nil || acct.Password == "" {
+		time.Sleep(time.Second)
+		c.reply(tag, "NO", "[AUTHENTICATIONFAILED] bad user name or password")
+		return
+	}
+	switch err := syncer.Err(acct.Username); err.(type) {
+	case *RevokedError, *SuspendedError:
+		syncer.Touch(acct)
+		c.reply(tag, "NO", imapError(err))
+		return
+	}
+	store, err := syncer.Store(acct.Username)
+	if err != nil {
+		c.reply(tag, "NO", imapError(err))
+		return
+	}
+	c.acct, c.store = acct, store
+	c.state = imapAuthState
+	syncer.Touch(acct)
+	c.reply(tag, "OK", "[CAPABILITY "+c.capabilities()+"] logged in")
+}
+
+// mailboxes returns INBOX and a folder for each conversation, named
+// for the other people in it.
+func (c *imapConn) mailboxes() ([]imapMailbox, error) {
+	dms, err := syncer.DMs(c.acct)
+	if err != nil {
+		return nil, err
+	}
+	boxes := []imapMailbox{{name: "INBOX"}}
+	for _, mb := range conversationFolders(c.acct, dms) {
+		boxes = append(boxes, imapMailbox{name: imapConvFolder + "/" + imapUTF7(mb.name), conv: mb.conv})
+	}
+	return boxes, nil
+}
+
+// conversationFolders returns a folder for each of the conversations
+// dms belong to, named for the other people in it, sorted by name.
+// Names are unique but not encoded for IMAP. JMAP's mailboxes are
+// the same folders.
+func conversationFolders(a *Account, dms []DM) []imapMailbox {
+	people := make(map[string]map[string]bool) // conversation ID -> handles
+	for _, dm := range dms {
+		conv := dm.ConversationID(a)
+		if people[conv] == nil {
+			people[conv] = make(map[string]bool)
+		}
+		for _, u := range []User{dm.Sender, dm.Recipient} {
+			if u.Handle != "" && !a.is(u) {
+				people[conv][strings.ToLower(u.Handle)] = true
+			}
+		}
+	}
+	var convs []imapMailbox
+	for conv, handles := range people {
+		var names []string
+		for h := range handles {
+			names = append(names, h)
+		}
+		sort.Strings(names)
+		name := strings.Join(names, ", ")
+		if name == "" {
+			name = conv
+		}
+		convs = append(convs, imapMailbox{name: imapFolderSafe(name), conv: conv})
+	}
+	sort.Slice(convs, func(i, j int) bool {
+		if convs[i].name != convs[j].name {
+			return convs[i].name < convs[j].name
+		}
+		return convs[i].conv < convs[j].conv
+	})
+	used := make(map[string]bool)
+	for i, mb := range convs {
+		name := mb.name
+		for n := 2; used[name]; n++ {
+			name = fmt.Sprintf("%s (%d)", mb.name, n)
+		}
+		used[name] = true
+		convs[i].name = name
+	}
+	return convs
+}
+
+// imapFolderSafe replaces the characters that can't appear in a
+// folder name under imapConvFolder.
+func imapFolderSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' || r == '*' || r == '%' {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// findMailbox returns the named mailbox, or false with a NO already
+// sent.
+func (c *imapConn) findMailbox(tag, name string) (imapMailbox, bool) {
+	if strings.EqualFold(name, "INBOX") {
+		return imapMailbox{name: "INBOX"}, true
+	}
+	boxes, err := c.mailboxes()
+	if err != nil {
+		c.reply(tag, "NO", imapError(err))
+		return imapMailbox{}, false
+	}
+	for _, mb := range boxes {
+		if mb.name == name {
+			return mb, true
+		}
+	}
+	c.reply(tag, "NO", "[NONEXISTENT] no such folder")
+	return imapMailbox{}, false
+}
+
+// load returns the mailbox's messages in UID order.
+func (c *imapConn) load(mb imapMailbox) ([]*imapMsg, error) {
+	dms, err := syncer.DMs(c.acct)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []*imapMsg
+	for _, dm := range dms {
+		if mb.conv != "" && dm.ConversationID(c.acct) != mb.conv {
+			continue
+		}
+		if uid := c.store.UID(dm.ID); uid != 0 {
+			msgs = append(msgs, &imapMsg{uid: uid, dm: dm})
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].uid < msgs[j].uid })
+	for i, m := range msgs {
+		m.seq = i + 1
+	}
+	return msgs, nil
+}
+
+func (c *imapConn) selectMailbox(tag, cmd string, args []imapArg) {
+	// A failed SELECT leaves no mailbox selected.
+	c.state, c.msgs = imapAuthState, nil
+	if len(args) != 1 {
+		c.reply(tag, "BAD", cmd+" needs a folder name")
+		return
+	}
+	if strings.EqualFold(args[0].s, imapConvFolder) {
+		c.reply(tag, "NO", "[CANNOT] "+imapConvFolder+" only holds other folders")
+		return
+	}
+	mb, ok := c.findMailbox(tag, args[0].s)
+	if !ok {
+		return
+	}
+	msgs, err := c.load(mb)
+	if err != nil {
+		c.reply(tag, "NO", imapError(err))
+		return
+	}
+	c.sel, c.msgs, c.readOnly = mb, msgs, cmd == "EXAMINE"
+	c.flagsSent = make(map[uint32]string)
+	c.state = imapSelectedState
+
+	c.untagged("FLAGS (" + strings.Join(imapSystemFlags, " ") + ")")
+	c.untagged(fmt.Sprintf("%d EXISTS", len(msgs)))
+	c.untagged("0 RECENT")
+	for _, m := range msgs {
+		if !c.hasFlag(m, `\Seen`) {
+			c.untagged(fmt.Sprintf("OK [UNSEEN %d] first unseen message", m.seq))
+			break
+		}
+	}
+	if c.readOnly {
+		c.untagged("OK [PERMANENTFLAGS ()] read-only")
+	} else {
+		c.untagged("OK [PERMANENTFLAGS (" + strings.Join(imapSystemFlags, " ") + ` \*)] flags are kept`)
+	}
+	c.untagged(fmt.Sprintf("OK [UIDVALIDITY %d] UIDs valid", c.store.UIDValidity()))
+	c.untagged(fmt.Sprintf("OK [UIDNEXT %d] predicted next UID", c.store.UIDNext()))
+	if c.readOnly {
+		c.reply(tag, "OK", "[READ-ONLY] EXAMINE completed")
+	} else {
+		c.reply(tag, "OK", "[READ-WRITE] SELECT completed")
+	}
+}
+
+func (c *imapConn) list(tag, cmd string, args []imapArg) {
+	if len(args) != 2 {
+		c.reply(tag, "BAD", cmd+" needs a reference and a folder pattern")
+		return
+	}
+	ref, pattern := args[0].s, args[1].s
+	if pattern == "" {
+		c.untagged(cmd + ` (\Noselect) "/" ""`)
+		c.reply(tag, "OK", cmd+" completed")
+		return
+	}
+	if ref != "" && !strings.HasSuffix(ref, "/") {
+		ref += "/"
+	}
+	pattern = ref + pattern
+	boxes, err := c.mailboxes()
+	if err != nil {
+		c.reply(tag, "NO", imapError(err))
+		return
+	}
+	if len(boxes) > 1 && imapMatch(pattern, imapConvFolder) {
+		c.untagged(fmt.Sprintf(`%s (\Noselect \HasChildren) "/" %s`, cmd, imapQuote(imapConvFolder)))
+	}
+	for _, mb := range boxes {
+		if imapMatch(pattern, mb.name) || mb.name == "INBOX" && imapMatch(strings.ToUpper(pattern), "INBOX") {
+			c.untagged(fmt.Sprintf(`%s (\HasNoChildren) "/" %s`, cmd, imapQuote(mb.name)))
+		}
+	}
+	c.reply(tag, "OK", cmd+" completed")
+}
+
+func (c *imapConn) status(tag string, args []imapArg) {
+	if len(args) != 2 || args[1].kind != imapList {
+		c.reply(tag, "BAD", "STATUS needs a folder name and a list of items")
+		return
+	}
+	mb, ok := c.findMailbox(tag, args[0].s)
+	if !ok {
+		return
+	}
+	msgs, err := c.load(mb)
+	if err != nil {
+		c.reply(tag, "NO", imapError(err))
+		return
+	}
+	var out []string
+	for _, item := range args[1].list {
+		switch name := strings.ToUpper(item.s); name {
+		case "MESSAGES":
+			out = append(out, fmt.Sprintf("MESSAGES %d", len(msgs)))
+		case "RECENT":
+			out = append(out, "RECENT 0")
+		case "UIDNEXT":
+			out = append(out, fmt.Sprintf("UIDNEXT %d", c.store.UIDNext()))
+		case "UIDVALIDITY":
+			out = append(out, fmt.Sprintf("UIDVALIDITY %d", c.store.UIDValidity()))
+		case "UNSEEN":
+			n := 0
+			for _, m := range msgs {
+				if !c.hasFlag(m, `\Seen`) {
+					n++
+				}
+			}
+			out = append(out, fmt.Sprintf("UNSEEN %d", n))
+		default:
+			c.reply(tag, "BAD", "unknown STATUS item "+item.s)
+			return
+		}
+	}
+	c.untagged(fmt.Sprintf("STATUS %s (%s)", imapQuote(mb.name), strings.Join(out, " ")))
+	c.reply(tag, "OK", "STATUS completed")
+}
+
+// update reloads the selected mailbox and tells the client what
+// other sessions, POP and syncing changed since it last looked:
+// messages removed, messages added and flags changed. New messages
+// always have higher UIDs, so they go at the end.
+func (c *imapConn) update() {
+	msgs, err := c.load(c.sel)
+	if err != nil {
+		log.Printf("IMAP: reloading %q for %q: %v", c.sel.name, c.acct.Username, err)
+		return
+	}
+	now := make(map[uint32]*imapMsg)
+	for _, m := range msgs {
+		now[m.uid] = m
+	}
+	for i := len(c.msgs) - 1; i >= 0; i-- {
+		if now[c.msgs[i].uid] == nil {
+			c.untagged(fmt.Sprintf("%d EXPUNGE", i+1))
+			c.msgs = append(c.msgs[:i], c.msgs[i+1:]...)
+		}
+	}
+	maxUID, added := c.maxUID(), false
+	for _, m := range msgs {
+		if m.uid > maxUID {
+			c.msgs = append(c.msgs, m)
+			added = true
+		}
+	}
+	for i, m := range c.msgs {
+		m.seq = i + 1
+	}
+	if added {
+		c.untagged(fmt.Sprintf("%d EXISTS", len(c.msgs)))
+	}
+	for _, m := range c.msgs {
+		if sent, ok := c.flagsSent[m.uid]; ok && sent != strings.Join(c.flags(m), " ") {
+			c.untagged(fmt.Sprintf("%d FETCH (FLAGS %s)", m.seq, c.flagList(m)))
+		}
+	}
+}
+
+// idle waits for the client's DONE, per RFC 2177, telling it about
+// changes to the selected mailbox as soon as they're published. A
+// non-nil error means the connection is done.
+func (c *imapConn) idle(tag string) error {
+	sub := events.Subscribe(c.acct.Username, 16)
+	defer events.Unsubscribe(sub)
+	// Idling counts as using the account, so it keeps syncing.
+	syncer.Touch(c.acct)
+	c.send("+ idling")
+
+	done := make(chan error, 1)
+	go func() {
+		c.SetReadDeadline(time.Now().Add(imapIdleTimeout))
+		line, err := c.tr.ReadLine()
+		if err == nil && !strings.EqualFold(strings.TrimSpace(line), "DONE") {
+			err = fmt.Errorf("got %q instead of DONE", line)
+		}
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			if err != nil {
+				c.reply(tag, "BAD", err.Error())
+				return err
+			}
+			c.reply(tag, "OK", "IDLE terminated")
+			return nil
+		case <-sub.C:
+			// One reload covers a burst of events.
+			for len(sub.C) > 0 {
+				<-sub.C
+			}
+			if c.state == imapSelectedState {
+				c.update()
+			}
+		}
+	}
+}
+
+// maxUID returns the highest UID in the selected mailbox, what "*"
+// means in a UID set.
+func (c *imapConn) maxUID() uint32 {
+	if len(c.msgs) == 0 {
+		return 0
+	}
+	return c.msgs[len(c.msgs)-1].uid
+}
+
+// selected returns the messages in set, which has sequence numbers
+// or, if uid, UIDs.
+func (c *imapConn) selected(set seqSet, uid bool) []*imapMsg {
+	var msgs []*imapMsg
+	for _, m := range c.msgs {
+		if uid && set.contains(m.uid, c.maxUID()) || !uid && set.contains(uint32(m.seq), uint32(len(c.msgs))) {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+// message returns m rendered as a mail message, as POP serves it.
+func (c *imapConn) message(m *imapMsg) string {
+	if m.raw == "" {
+		m.raw = renderDM(c.store, c.acct, m.dm)
+	}
+	return m.raw
+}
+
+func (c *imapConn) parsed(m *imapMsg) *mimePart {
+	if m.part == nil {
+		m.part = parseMIME(c.message(m))
+	}
+	return m.part
+}
+
+// header returns the decoded value of one of m's headers.
+func (c *imapConn) header(m *imapMsg, name string) string {
+	v := c.parsed(m).header.Get(name)
+	if dec, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return dec
+	}
+	return v
+}
+
+// forget drops what c.message and c.parsed cached for m, so a big
+// FETCH or SEARCH doesn't hold every message in memory.
+func (m *imapMsg) forget() {
+	m.raw, m.part = "", nil
+}
+
+func (c *imapConn) flags(m *imapMsg) []string {
+	return c.store.Flags(m.dm.ID)
+}
+
+func (c *imapConn) hasFlag(m *imapMsg, flag string) bool {
+	for _, f := range c.flags(m) {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlags stores m's flags, with system flags in their usual case
+// and without duplicates.
+func (c *imapConn) setFlags(m *imapMsg, flags []string) error {
+	var out []string
+	seen := make(map[string]bool)
+	for _, f := range flags {
+		for _, sys := range imapSystemFlags {
+			if strings.EqualFold(f, sys) {
+				f = sys
+			}
+		}
+		if !seen[strings.ToLower(f)] {
+			seen[strings.ToLower(f)] = true
+			out = append(out, f)
+		}
+	}
+	return c.store.SetFlags(m.dm.ID, out)
+}
+
+// flagList returns m's flags as an IMAP list, remembering what the
+// client was told so update can report changes.
+func (c *imapConn) flagList(m *imapMsg) string {
+	flags := c.flags(m)
+	c.flagsSent[m.uid] = strings.Join(flags, " ")
+	return "(" + strings.Join(flags, " ") + ")"
+}
+
+func (c *imapConn) fetchCommand(tag string, args []imapArg, uid bool) {
+	if len(args) != 2 {
+		c.reply(tag, "BAD", "FETCH needs a message set and items")
+		return
+	}
+	set, err := parseSeqSet(args[0].s)
+	if err != nil {
+		c.reply(tag, "BAD", err.Error())
+		return
+	}
+	items, err := fetchItems(args[1])
+	if err != nil {
+		c.reply(tag, "BAD", err.Error())
+		return
+	}
+	for _, m := range c.selected(set, uid) {
+		c.fetch(m, items, uid)
+		m.forget()
+	}
+	c.reply(tag, "OK", "FETCH completed")
+}
+
+func (c *imapConn) storeCommand(tag string, args []imapArg, uid bool) {
+	if len(args) < 3 {
+		c.reply(tag, "BAD", "STORE needs a message set, an item and flags")
+		return
+	}
+	if c.readOnly {
+		c.reply(tag, "NO", "folder is read-only")
+		return
+	}
+	set, err := parseSeqSet(args[0].s)
+	if err != nil {
+		c.reply(tag, "BAD", err.Error())
+		return
+	}
+	item := strings.ToUpper(args[1].s)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		c.reply(tag, "BAD", "unknown STORE item "+args[1].s)
+		return
+	}
+	var flags []string
+	for _, a := range args[2:] {
+		list := []imapArg{a}
+		if a.kind == imapList {
+			list = a.list
+		}
+		for _, f := range list {
+			if f.kind != imapAtom {
+				c.reply(tag, "BAD", "flags must be atoms")
+				return
+			}
+			if !strings.EqualFold(f.s, `\Recent`) {
+				flags = append(flags, f.s)
+			}
+		}
+	}
+	for _, m := range c.selected(set, uid) {
+		var next []string
+		switch item {
+		case "FLAGS":
+			next = flags
+		case "+FLAGS":
+			next = append(c.flags(m), flags...)
+		case "-FLAGS":
+			for _, f := range c.flags(m) {
+				drop := false
+				for _, g := range flags {
+					drop = drop || strings.EqualFold(f, g)
+				}
+				if !drop {
+					next = append(next, f)
+				}
+			}
+		}
+		if err := c.setFlags(m, next); err != nil {
+			c.reply(tag, "NO", imapError(err))
+			return
+		}
+		if !silent {
+			resp := "FLAGS " + c.flagList(m)
+			if uid {
+				resp = fmt.Sprintf("UID %d %s", m.uid, resp)
+			}
+			c.untagged(fmt.Sprintf("%d FETCH (%s)", m.seq, resp))
+		} else {
+			c.flagsSent[m.uid] = strings.Join(c.flags(m), " ")
+		}
+	}
+	c.reply(tag, "OK", "STORE completed")
+}
+
+func (c *imapConn) search(tag string, args []imapArg, uid bool) {
+	if len(args) >= 2 && strings.EqualFold(args[0].s, "CHARSET") {
+		if cs := strings.ToUpper(args[1].s); cs != "UTF-8" && cs != "US-ASCII" {
+			c.reply(tag, "NO", "[BADCHARSET (UTF-8 US-ASCII)] unsupported charset")
+			return
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		c.reply(tag, "BAD", "SEARCH needs criteria")
+		return
+	}
+	key, err := c.parseSearch(&args)
+	if err != nil {
+		c.reply(tag, "BAD", err.Error())
+		return
+	}
+	out := "SEARCH"
+	for _, m := range c.msgs {
+		if key(m) {
+			if uid {
+				out += fmt.Sprintf(" %d", m.uid)
+			} else {
+				out += fmt.Sprintf(" %d", m.seq)
+			}
+		}
+		m.forget()
+	}
+	c.untagged(out)
+	c.reply(tag, "OK", "SEARCH completed")
+}
+
+// expunge removes the selected mailbox's \Deleted messages, or only
+// those whose UIDs are in uids if it's not nil, and tells the client
+// unless silent. Like POP's DELE, it only tombstones them in our
+// store; the DMs themselves stay on the backend. They leave every
+// folder they were in.
+func (c *imapConn) expunge(uids seqSet, silent bool) error {
+	for i := len(c.msgs) - 1; i >= 0; i-- {
+		m := c.msgs[i]
+		if !c.hasFlag(m, `\Deleted`) || uids != nil && !uids.contains(m.uid, c.maxUID()) {
+			continue
+		}
+		if err := c.store.Delete(m.dm.ID); err != nil {
+			return err
+		}
+		if !silent {
+			c.untagged(fmt.Sprintf("%d EXPUNGE", i+1))
+		}
+		c.msgs = append(c.msgs[:i], c.msgs[i+1:]...)
+	}
+	for i, m := range c.msgs {
+		m.seq = i + 1
+	}
+	return nil
+}
+
+func (c *imapConn) expungeCommand(tag string, uids seqSet) {
+	if c.readOnly {
+		c.reply(tag, "NO", "folder is read-only")
+		return
+	}
+	if err := c.expunge(uids, false); err != nil {
+		log.Printf("IMAP: expunging for %q: %v", c.acct.Username, err)
+		c.reply(tag, "NO", imapError(err))
+		return
+	}
+	c.reply(tag, "OK", "EXPUNGE completed")
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIMAPParser(t *testing.T) {
+	tests := []struct {
+		line, more string // more is what follows line on the connection
+		want       string
+	}{
+		{`a1 LOGIN "al\"ice" pw`, "", `a1 LOGIN "al"ice" pw`},
+		{`a2 FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>)`, "", `a2 FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>)`},
+		{`a3 LOGIN {5}`, "alice {3+}\r\nx y\r\n", `a3 LOGIN "alice" "x y"`},
+		{`a4 SEARCH ({3}`, "a b)\r\n", `a4 SEARCH ("a b")`},
+		{`a5 SELECT {0}`, "\r\n", `a5 SELECT ""`},
+	}
+	for _, tt := range tests {
+		br := bufio.NewReader(strings.NewReader(tt.more))
+		tr := textproto.NewReader(br)
+		var syncs []bool
+		p := &imapParser{line: tt.line, literal: func(n int, sync bool) (string, string, error) {
+			syncs = append(syncs, sync)
+			return readLiteral(br, n, tr.ReadLine)
+		}}
+		args, err := p.rest()
+		if err != nil {
+			t.Errorf("%q: %v", tt.line, err)
+			continue
+		}
+		if got := imapArgString(args); got != tt.want {
+			t.Errorf("%q parsed as %s; want %s", tt.line, got, tt.want)
+		}
+		if tt.line == "a3 LOGIN {5}" && !reflect.DeepEqual(syncs, []bool{true, false}) {
+			t.Errorf("literal syncs = %v; want {5} to sync and {3+} not to", syncs)
+		}
+	}
+
+	for _, line := range []string{`a1 LOGIN "alice`, `a1 FETCH (FLAGS`, `a1 LOGIN {5} x`, `a1 LOGIN {-1}`, `a1 LOGIN {x}`} {
+		p := &imapParser{line: line, literal: func(int, bool) (string, string, error) {
+			t.Errorf("%q read a literal", line)
+			return "", "", nil
+		}}
+		if args, err := p.rest(); err != errIMAPSyntax {
+			t.Errorf("%q = %s, %v; want a syntax error", line, imapArgString(args), err)
+		}
+	}
+}
+
+// imapArgString formats args the way a client would have sent them,
+// with strings quoted and no escaping.
+func imapArgString(args []imapArg) string {
+	var s []string
+	for _, a := range args {
+		switch a.kind {
+		case imapList:
+			s = append(s, "("+imapArgString(a.list)+")")
+		case imapString:
+			s = append(s, `"`+a.s+`"`)
+		default:
+			s = append(s, a.s)
+		}
+	}
+	return strings.Join(s, " ")
+}
+
+func TestSeqSet(t *testing.T) {
+	const max = 5
+	tests := []struct {
+		set  string
+		want []uint32 // of 1 to max
+	}{
+		{"1", []uint32{1}},
+		{"*", []uint32{5}},
+		{"2:4", []uint32{2, 3, 4}},
+		{"4:2", []uint32{2, 3, 4}},
+		{"3:*", []uint32{3, 4, 5}},
+		{"*:4", []uint32{4, 5}},
+		{"1,3,5", []uint32{1, 3, 5}},
+		{"1:2,4:*", []uint32{1, 2, 4, 5}},
+		{"7:9", nil},
+	}
+	for _, tt := range tests {
+		set, err := parseSeqSet(tt.set)
+		if err != nil {
+			t.Errorf("parseSeqSet(%q): %v", tt.set, err)
+			continue
+		}
+		var got []uint32
+		for n := uint32(1); n <= max; n++ {
+			if set.contains(n, max) {
+				got = append(got, n)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q contains %v; want %v", tt.set, got, tt.want)
+		}
+	}
+	for _, s := range []string{"", "0", "1:", "a", "1,,2", "1:2:3", "4294967296"} {
+		if _, err := parseSeqSet(s); err == nil {
+			t.Errorf("parseSeqSet(%q) succeeded; want an error", s)
+		}
+	}
+}
+
+// imapSession logs in to an IMAP connection over a pipe as an IRC
+// account with three DMs: from bob, carol and bob again.
+func imapSession(t *testing.T) (cmd func(line string) string) {
+	testDB(t)
+	acct := &Account{Username: "alice.irc.example", Password: "pw", Token: "t", Backend: "irc", Instance: "ircs://irc.example:6697"}
+	if err := acct.Save(); err != nil {
+		t.Fatal(err)
+	}
+	store, err := syncer.Store(acct.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := User{Handle: "alice"}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var dms []DM
+	for i, m := range []struct{ from, text string }{{"bob", "hi alice"}, {"carol", "lunch?"}, {"bob", "see you there"}} {
+		at := start.Add(time.Duration(i) * time.Hour)
+		dms = append(dms, DM{ID: timeID(at, fmt.Sprint(i)), Text: m.text, CreatedAt: at, Sender: User{Handle: m.from}, Recipient: self})
+	}
+	if _, err := store.Add(dms); err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		conn := &imapConn{s: NewIMAPServer(nil, nil)}
+		conn.setConn(server)
+		done <- conn.serve()
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	c := textproto.NewConn(client)
+	if line, err := c.ReadLine(); err != nil || !strings.HasPrefix(line, "* OK ") {
+		t.Fatalf("greeting = %q, %v", line, err)
+	}
+
+	// The user name is a synchronizing literal and the password a
+	// LITERAL+ one.
+	if err := c.PrintfLine("a1 LOGIN {%d}", len(acct.Username)); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := c.ReadLine(); err != nil || !strings.HasPrefix(line, "+") {
+		t.Fatalf("literal continuation = %q, %v", line, err)
+	}
+	if err := c.PrintfLine("%s {2+}\r\npw", acct.Username); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := c.ReadLine(); err != nil || !strings.HasPrefix(line, "a1 OK ") {
+		t.Fatalf("LOGIN = %q, %v", line, err)
+	}
+
+	n := 1
+	return func(line string) string {
+		t.Helper()
+		n++
+		tag := fmt.Sprintf("a%d", n)
+		if err := c.PrintfLine("%s %s", tag, line); err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for {
+			l, err := c.ReadLine()
+			if err != nil {
+				t.Fatalf("%s: %v", line, err)
+			}
+			if strings.HasPrefix(l, tag+" ") {
+				if !strings.HasPrefix(l, tag+" OK ") {
+					t.Fatalf("%s: %s", line, l)
+				}
+				return strings.Join(out, "\r\n")
+			}
+			out = append(out, l)
+		}
+	}
+}
+
+func TestIMAPFetchSequenceSets(t *testing.T) {
+	cmd := imapSession(t)
+	if got := cmd("SELECT INBOX"); !strings.Contains(got, "* 3 EXISTS") {
+		t.Fatalf("SELECT = %s", got)
+	}
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"FETCH 2:* (UID)", []string{"* 2 FETCH (UID 2)", "* 3 FETCH (UID 3)"}},
+		{"FETCH *:2 (UID)", []string{"* 2 FETCH (UID 2)", "* 3 FETCH (UID 3)"}},
+		{"FETCH 1,3 (UID)", []string{"* 1 FETCH (UID 1)", "* 3 FETCH (UID 3)"}},
+		{"UID FETCH 3:1 (FLAGS)", []string{`* 1 FETCH (UID 1 FLAGS ())`, `* 2 FETCH (UID 2 FLAGS ())`, `* 3 FETCH (UID 3 FLAGS ())`}},
+		{"UID FETCH 9:* (UID)", []string{"* 3 FETCH (UID 3)"}},
+		{"UID FETCH 7 (UID)", nil},
+	}
+	for _, tt := range tests {
+		got := cmd(tt.line)
+		if want := strings.Join(tt.want, "\r\n"); got != want {
+			t.Errorf("%s =\n%s\nwant\n%s", tt.line, got, want)
+		}
+	}
+}
+
+func TestIMAPFetchBodySection(t *testing.T) {
+	cmd := imapSession(t)
+	cmd("SELECT INBOX")
+
+	got := cmd("FETCH 2 (BODY.PEEK[HEADER.FIELDS (FROM SUBJECT)])")
+	if !strings.HasPrefix(got, "* 2 FETCH (BODY[HEADER.FIELDS (FROM SUBJECT)] {") ||
+		!strings.Contains(got, "\r\nFrom: <carol@eight22er.danga.com>\r\n") || !strings.Contains(got, "\r\nSubject: lunch?\r\n") ||
+		strings.Contains(got, "\r\nTo:") || strings.Contains(got, "FLAGS") {
+		t.Errorf("header fields =\n%s", got)
+	}
+
+	got = cmd("FETCH 1 (BODY.PEEK[1.MIME] BODY.PEEK[1])")
+	if !strings.Contains(got, "BODY[1.MIME] {") || !strings.Contains(got, "Content-Type: text/plain; charset=utf-8") {
+		t.Errorf("part 1 MIME header missing:\n%s", got)
+	}
+	if !strings.Contains(got, "BODY[1] {8}\r\nhi alice") {
+		t.Errorf("part 1 body missing:\n%s", got)
+	}
+
+	got = cmd("FETCH 3 (BODY.PEEK[1]<4.3>)")
+	if want := "* 3 FETCH (BODY[1]<4> {3}\r\nyou)"; got != want {
+		t.Errorf("partial fetch = %q; want %q", got, want)
+	}
+
+	got = cmd("FETCH 3 (BODY.PEEK[3])")
+	if want := "* 3 FETCH (BODY[3] {0}\r\n)"; got != want {
+		t.Errorf("missing section = %q; want %q", got, want)
+	}
+
+	// Without PEEK, fetching a body sets \Seen.
+	if got := cmd("FETCH 3 (BODY[TEXT])"); !strings.Contains(got, `FLAGS (\Seen)`) {
+		t.Errorf("BODY[TEXT] didn't set \\Seen:\n%s", got)
+	}
+}
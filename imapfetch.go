@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// imapDateLayout is the format of IMAP's date-time, used for
+// INTERNALDATE.
+const imapDateLayout = "02-Jan-2006 15:04:05 -0700"
+
+// A mimePart is one part of a rendered message, keeping the exact
+// bytes of its header and body for FETCH BODY[section].
+type mimePart struct {
+	header    textproto.MIMEHeader
+	rawHeader string // including the blank line that ends it
+	body      string
+	parts     []*mimePart // for multiparts
+}
+
+func parseMIME(raw string) *mimePart {
+	p := &mimePart{rawHeader: raw}
+	if strings.HasPrefix(raw, "\r\n") {
+		p.rawHeader, p.body = "\r\n", raw[2:]
+	} else if i := strings.Index(raw, "\r\n\r\n"); i >= 0 {
+		p.rawHeader, p.body = raw[:i+4], raw[i+4:]
+	}
+	p.header, _ = textproto.NewReader(bufio.NewReader(strings.NewReader(p.rawHeader))).ReadMIMEHeader()
+	mt, params, _ := mime.ParseMediaType(p.header.Get("Content-Type"))
+	if !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+		return p
+	}
+	// Per RFC 2046 section 5.1.1, the CRLF before each
+	// delimiter line belongs to the delimiter.
+	delim := "--" + params["boundary"]
+	start := -1
+	for off := 0; off < len(p.body); {
+		j := strings.Index(p.body[off:], delim)
+		if j < 0 {
+			break
+		}
+		j += off
+		off = j + len(delim)
+		if j != 0 && !strings.HasSuffix(p.body[:j], "\r\n") {
+			continue
+		}
+		if start >= 0 {
+			end := j
+			if end > start && end >= 2 {
+				end -= 2
+			}
+			p.parts = append(p.parts, parseMIME(p.body[start:end]))
+		}
+		if strings.HasPrefix(p.body[off:], "--") {
+			break
+		}
+		eol := strings.Index(p.body[off:], "\r\n")
+		if eol < 0 {
+			break
+		}
+		start = off + eol + 2
+		off = start
+	}
+	return p
+}
+
+// mediaType returns the part's content type and parameters, with
+// RFC 2045's default for parts that don't say.
+func (p *mimePart) mediaType() (typ, subtype string, params map[string]string) {
+	mt, params, err := mime.ParseMediaType(p.header.Get("Content-Type"))
+	if err != nil || !strings.Contains(mt, "/") {
+		mt, params = "text/plain", map[string]string{"charset": "us-ascii"}
+	}
+	v := strings.SplitN(mt, "/", 2)
+	return v[0], v[1], params
+}
+
+// imapParams formats MIME parameters as an IMAP list.
+func imapParams(params map[string]string) string {
+	if len(params) == 0 {
+		return "NIL"
+	}
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var v []string
+	for _, k := range keys {
+		v = append(v, imapQuote(strings.ToUpper(k)), imapQuote(params[k]))
+	}
+	return "(" + strings.Join(v, " ") + ")"
+}
+
+// structure returns the part's BODY, or with ext, BODYSTRUCTURE, per
+// RFC 3501 section 7.4.2.
+func (p *mimePart) structure(ext bool) string {
+	typ, subtype, params := p.mediaType()
+	if len(p.parts) > 0 {
+		var buf bytes.Buffer
+		buf.WriteString("(")
+		for _, sub := range p.parts {
+			buf.WriteString(sub.structure(ext))
+		}
+		buf.WriteString(" " + imapQuote(strings.ToUpper(subtype)))
+		if ext {
+			buf.WriteString(" " + imapParams(params) + " NIL NIL NIL")
+		}
+		buf.WriteString(")")
+		return buf.String()
+	}
+	enc := p.header.Get("Content-Transfer-Encoding")
+	if enc == "" {
+		enc = "7bit"
+	}
+	s := fmt.Sprintf("(%s %s %s NIL NIL %s %d",
+		imapQuote(strings.ToUpper(typ)), imapQuote(strings.ToUpper(subtype)), imapParams(params),
+		imapQuote(strings.ToUpper(enc)), len(p.body))
+	if typ == "text" {
+		lines := strings.Count(p.body, "\n")
+		if p.body != "" && !strings.HasSuffix(p.body, "\n") {
+			lines++
+		}
+		s += " " + strconv.Itoa(lines)
+	}
+	if ext {
+		disp := "NIL"
+		if d, dparams, err := mime.ParseMediaType(p.header.Get("Content-Disposition")); err == nil {
+			disp = fmt.Sprintf("(%s %s)", imapQuote(strings.ToUpper(d)), imapParams(dparams))
+		}
+		s += " NIL " + disp + " NIL NIL"
+	}
+	return s + ")"
+}
+
+// envelope returns the message's ENVELOPE, per RFC 3501 section
+// 7.4.2.
+func (p *mimePart) envelope() string {
+	h := p.header
+	addrs := func(key string) string {
+		list, err := mail.ParseAddressList(h.Get(key))
+		if err != nil || len(list) == 0 {
+			return "NIL"
+		}
+		var buf bytes.Buffer
+		buf.WriteString("(")
+		for _, a := range list {
+			local, host := a.Address, ""
+			if i := strings.LastIndex(local, "@"); i >= 0 {
+				local, host = local[:i], local[i+1:]
+			}
+			fmt.Fprintf(&buf, "(%s NIL %s %s)", imapNString(encodeWord(a.Name)), imapNString(local), imapNString(host))
+		}
+		buf.WriteString(")")
+		return buf.String()
+	}
+	from := addrs("From")
+	sender, replyTo := addrs("Sender"), addrs("Reply-To")
+	if sender == "NIL" {
+		sender = from
+	}
+	if replyTo == "NIL" {
+		replyTo = from
+	}
+	return fmt.Sprintf("(%s %s %s %s %s %s %s %s %s %s)",
+		imapNString(h.Get("Date")), imapNString(h.Get("Subject")),
+		from, sender, replyTo, addrs("To"), addrs("Cc"), addrs("Bcc"),
+		imapNString(h.Get("In-Reply-To")), imapNString(h.Get("Message-Id")))
+}
+
+// section returns the bytes of a BODY[section], such as "",
+// "HEADER.FIELDS (FROM TO)" or "1.MIME", or false if the message
+// has no such section.
+func (p *mimePart) section(spec string) (string, bool) {
+	part, top := p, true
+	for spec != "" {
+		i := strings.IndexByte(spec, '.')
+		num := spec
+		if i >= 0 {
+			num = spec[:i]
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			break
+		}
+		switch {
+		case n >= 1 && n <= len(part.parts):
+			part = part.parts[n-1]
+		case n == 1 && len(part.parts) == 0:
+			// A single-part message's body is part 1.
+		default:
+			return "", false
+		}
+		top = false
+		if i < 0 {
+			spec = ""
+		} else {
+			spec = spec[i+1:]
+		}
+	}
+	fields := ""
+	if i := strings.IndexByte(spec, ' '); i >= 0 {
+		spec, fields = spec[:i], strings.Trim(spec[i+1:], "()")
+	}
+	switch strings.ToUpper(spec) {
+	case "":
+		if top {
+			return part.rawHeader + part.body, true
+		}
+		return part.body, true
+	case "HEADER":
+		return part.rawHeader, true
+	case "TEXT":
+		return part.body, true
+	case "MIME":
+		if top {
+			return "", false
+		}
+		return part.rawHeader, true
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		want := make(map[string]bool)
+		for _, f := range strings.Fields(fields) {
+			want[textproto.CanonicalMIMEHeaderKey(strings.Trim(f, `"`))] = true
+		}
+		not := strings.HasSuffix(strings.ToUpper(spec), ".NOT")
+		var buf bytes.Buffer
+		keep := false
+		for _, line := range strings.SplitAfter(part.rawHeader, "\r\n") {
+			if line == "\r\n" || line == "" {
+				break
+			}
+			if line[0] != ' ' && line[0] != '\t' {
+				key := line
+				if i := strings.IndexByte(line, ':'); i >= 0 {
+					key = line[:i]
+				}
+				keep = want[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(key))] != not
+			}
+			if keep {
+				buf.WriteString(line)
+			}
+		}
+		buf.WriteString("\r\n")
+		return buf.String(), true
+	}
+	return "", false
+}
+
+// fetch sends the FETCH response for m with the requested items,
+// which have been checked by fetchItems. It marks the message \Seen
+// if a body was fetched without PEEK.
+func (c *imapConn) fetch(m *imapMsg, items []string, uid bool) {
+	var out []string
+	if uid {
+		out = append(out, fmt.Sprintf("UID %d", m.uid))
+	}
+	setSeen := false
+	for _, item := range items {
+		name := strings.ToUpper(item)
+		switch name {
+		case "UID":
+			if !uid {
+				out = append(out, fmt.Sprintf("UID %d", m.uid))
+			}
+		case "FLAGS":
+		case "INTERNALDATE":
+			out = append(out, "INTERNALDATE "+imapQuote(m.dm.CreatedAt.In(c.acct.Location()).Format(imapDateLayout)))
+		case "RFC822.SIZE":
+			out = append(out, fmt.Sprintf("RFC822.SIZE %d", len(c.message(m))))
+		case "ENVELOPE":
+			out = append(out, "ENVELOPE "+c.parsed(m).envelope())
+		case "BODY", "BODYSTRUCTURE":
+			out = append(out, name+" "+c.parsed(m).structure(name == "BODYSTRUCTURE"))
+		case "RFC822":
+			out = append(out, "RFC822 "+imapLiteral(c.message(m)))
+			setSeen = true
+		case "RFC822.HEADER":
+			out = append(out, "RFC822.HEADER "+imapLiteral(c.parsed(m).rawHeader))
+		case "RFC822.TEXT":
+			out = append(out, "RFC822.TEXT "+imapLiteral(c.parsed(m).body))
+			setSeen = true
+		default:
+			// BODY[section]<partial> or BODY.PEEK[...].
+			peek := strings.HasPrefix(name, "BODY.PEEK[")
+			open, close := strings.IndexByte(item, '['), strings.LastIndexByte(item, ']')
+			spec := item[open+1 : close]
+			data, ok := c.parsed(m).section(spec)
+			if !ok {
+				data = ""
+			}
+			resp := "BODY[" + spec + "]"
+			if partial := item[close+1:]; partial != "" {
+				v := strings.SplitN(strings.Trim(partial, "<>"), ".", 2)
+				start, _ := strconv.Atoi(v[0])
+				if start > len(data) {
+					start = len(data)
+				}
+				data = data[start:]
+				if len(v) == 2 {
+					if n, _ := strconv.Atoi(v[1]); n < len(data) {
+						data = data[:n]
+					}
+				}
+				resp += fmt.Sprintf("<%d>", start)
+			}
+			out = append(out, resp+" "+imapLiteral(data))
+			setSeen = setSeen || !peek
+		}
+	}
+	wantFlags := false
+	for _, item := range items {
+		if strings.EqualFold(item, "FLAGS") {
+			wantFlags = true
+		}
+	}
+	if setSeen && !c.readOnly && !c.hasFlag(m, `\Seen`) {
+		c.setFlags(m, append(c.flags(m), `\Seen`))
+		wantFlags = true
+	}
+	if wantFlags {
+		out = append(out, "FLAGS "+c.flagList(m))
+	}
+	c.untagged(fmt.Sprintf("%d FETCH (%s)", m.seq, strings.Join(out, " ")))
+}
+
+// fetchItems expands FETCH's data items and macros, and checks
+// them.
+func fetchItems(arg imapArg) ([]string, error) {
+	var items []string
+	if arg.kind == imapList {
+		for _, a := range arg.list {
+			if a.kind != imapAtom {
+				return nil, errIMAPSyntax
+			}
+			items = append(items, a.s)
+		}
+	} else {
+		switch strings.ToUpper(arg.s) {
+		case "ALL":
+			items = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			items = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			items = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			items = []string{arg.s}
+		}
+	}
+	for _, item := range items {
+		switch name := strings.ToUpper(item); name {
+		case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY", "BODYSTRUCTURE",
+			"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		default:
+			if !strings.HasPrefix(name, "BODY[") && !strings.HasPrefix(name, "BODY.PEEK[") {
+				return nil, fmt.Errorf("unknown FETCH item %q", item)
+			}
+			close := strings.LastIndexByte(name, ']')
+			if close < 0 {
+				return nil, fmt.Errorf("bad FETCH item %q", item)
+			}
+			if partial := name[close+1:]; partial != "" {
+				v := strings.SplitN(strings.Trim(partial, "<>"), ".", 2)
+				if !strings.HasPrefix(partial, "<") || !strings.HasSuffix(partial, ">") || len(v) != 2 {
+					return nil, fmt.Errorf("bad partial in %q", item)
+				}
+				for _, n := range v {
+					if _, err := strconv.ParseUint(n, 10, 32); err != nil {
+						return nil, fmt.Errorf("bad partial in %q", item)
+					}
+				}
+			}
+		}
+	}
+	return items, nil
+}
+
+// imapLiteral returns s as an IMAP literal.
+func imapLiteral(s string) string {
+	return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+}
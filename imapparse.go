@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// maxIMAPLiteral is the largest literal we accept from a client.
+// We take no APPENDs, so literals are only ever names and
+// passwords.
+const maxIMAPLiteral = 64 << 10
+
+type imapArgKind int
+
+const (
+	imapAtom imapArgKind = iota // including NIL, numbers and flags
+	imapString
+	imapList
+)
+
+// An imapArg is one argument of a client command, per RFC 3501
+// section 4: an atom, a quoted string or literal, or a
+// parenthesized list.
+type imapArg struct {
+	kind imapArgKind
+	s    string
+	list []imapArg
+}
+
+// str returns the argument as a string, for arguments that may be
+// an atom or a string.
+func (a imapArg) str() (string, bool) {
+	return a.s, a.kind != imapList
+}
+
+var errIMAPSyntax = errors.New("syntax error")
+
+// An imapParser splits command lines into arguments. Literals are
+// read from the connection, which continues the command on the line
+// after them.
+type imapParser struct {
+	line string
+	pos  int
+	// literal returns the n bytes of a literal and the line that
+	// follows it; sync is whether the client waits for a "+".
+	literal func(n int, sync bool) (data, next string, err error)
+}
+
+func (p *imapParser) done() bool {
+	return p.pos >= len(p.line)
+}
+
+// next returns the next argument, or errIMAPSyntax.
+func (p *imapParser) next() (imapArg, error) {
+	if p.done() {
+		return imapArg{}, errIMAPSyntax
+	}
+	switch p.line[p.pos] {
+	case '(':
+		p.pos++
+		var list []imapArg
+		for {
+			if p.done() {
+				return imapArg{}, errIMAPSyntax
+			}
+			if p.line[p.pos] == ')' {
+				p.pos++
+				p.space()
+				return imapArg{kind: imapList, list: list}, nil
+			}
+			arg, err := p.next()
+			if err != nil {
+				return imapArg{}, err
+			}
+			list = append(list, arg)
+		}
+	case '"':
+		var buf bytes.Buffer
+		for p.pos++; p.pos < len(p.line); p.pos++ {
+			switch c := p.line[p.pos]; c {
+			case '\\':
+				p.pos++
+				if p.pos < len(p.line) {
+					buf.WriteByte(p.line[p.pos])
+				}
+			case '"':
+				p.pos++
+				p.space()
+				return imapArg{kind: imapString, s: buf.String()}, nil
+			default:
+				buf.WriteByte(c)
+			}
+		}
+		return imapArg{}, errIMAPSyntax
+	case '{':
+		end := strings.IndexByte(p.line[p.pos:], '}')
+		if end < 0 || p.pos+end != len(p.line)-1 {
+			return imapArg{}, errIMAPSyntax
+		}
+		spec := p.line[p.pos+1 : p.pos+end]
+		sync := !strings.HasSuffix(spec, "+")
+		n, err := strconv.Atoi(strings.TrimSuffix(spec, "+"))
+		if err != nil || n < 0 {
+			return imapArg{}, errIMAPSyntax
+		}
+		data, next, err := p.literal(n, sync)
+		if err != nil {
+			return imapArg{}, err
+		}
+		p.line, p.pos = next, 0
+		p.space()
+		return imapArg{kind: imapString, s: data}, nil
+	}
+	start, depth := p.pos, 0
+	for ; p.pos < len(p.line); p.pos++ {
+		c := p.line[p.pos]
+		if depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '"' || c == '{') {
+			break
+		}
+		// Brackets in BODY[HEADER.FIELDS (A B)] are part of
+		// the atom, spaces and all.
+		if c == '[' {
+			depth++
+		} else if c == ']' && depth > 0 {
+			depth--
+		}
+	}
+	if p.pos == start {
+		return imapArg{}, errIMAPSyntax
+	}
+	arg := imapArg{kind: imapAtom, s: p.line[start:p.pos]}
+	p.space()
+	return arg, nil
+}
+
+// space skips the space between arguments.
+func (p *imapParser) space() {
+	if p.pos < len(p.line) && p.line[p.pos] == ' ' {
+		p.pos++
+	}
+}
+
+// rest returns all remaining arguments.
+func (p *imapParser) rest() ([]imapArg, error) {
+	var args []imapArg
+	for !p.done() {
+		arg, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readLiteral reads a literal of n bytes and the rest of its
+// command line from r.
+func readLiteral(r io.Reader, n int, readLine func() (string, error)) (data, next string, err error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", "", err
+	}
+	next, err = readLine()
+	return string(buf), next, err
+}
+
+// A seqRange is an inclusive range of message numbers or UIDs, in
+// either order. 0 stands for "*".
+type seqRange struct{ lo, hi uint32 }
+
+// A seqSet is an RFC 3501 sequence-set, such as "1:4,7,9:*".
+type seqSet []seqRange
+
+func parseSeqSet(s string) (seqSet, error) {
+	var set seqSet
+	for _, part := range strings.Split(s, ",") {
+		lohi := strings.SplitN(part, ":", 2)
+		var r seqRange
+		for i, v := range lohi {
+			n := uint32(0)
+			if v != "*" {
+				u, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || u == 0 {
+					return nil, fmt.Errorf("bad sequence set %q", s)
+				}
+				n = uint32(u)
+			}
+			if i == 0 {
+				r.lo, r.hi = n, n
+			} else {
+				r.hi = n
+			}
+		}
+		set = append(set, r)
+	}
+	return set, nil
+}
+
+// contains reports whether n is in the set, where "*" stands for
+// max, the largest number in use.
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		lo, hi := r.lo, r.hi
+		if lo == 0 {
+			lo = max
+		}
+		if hi == 0 {
+			hi = max
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+		if lo <= n && n <= hi {
+			return true
+		}
+	}
+	return false
+}
+
+// imapUTF7 encodes a mailbox name in the modified UTF-7 of RFC 3501
+// section 5.1.3.
+func imapUTF7(s string) string {
+	var buf bytes.Buffer
+	var run []rune
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		var b []byte
+		for _, u := range utf16.Encode(run) {
+			b = append(b, byte(u>>8), byte(u))
+		}
+		enc := base64.StdEncoding.EncodeToString(b)
+		enc = strings.TrimRight(enc, "=")
+		buf.WriteString("&" + strings.Replace(enc, "/", ",", -1) + "-")
+		run = run[:0]
+	}
+	for _, r := range s {
+		if r >= 0x20 && r <= 0x7e {
+			flush()
+			if r == '&' {
+				buf.WriteString("&-")
+			} else {
+				buf.WriteRune(r)
+			}
+			continue
+		}
+		run = append(run, r)
+	}
+	flush()
+	return buf.String()
+}
+
+// imapMatch reports whether name matches a LIST pattern, where "*"
+// matches anything and "%" anything but the hierarchy delimiter.
+func imapMatch(pattern, name string) bool {
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*', '%':
+		for i := 0; i <= len(name); i++ {
+			if imapMatch(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && pattern[0] == '%' && name[i] == '/' {
+				return false
+			}
+		}
+		return false
+	}
+	return name != "" && pattern[0] == name[0] && imapMatch(pattern[1:], name[1:])
+}
+
+// imapQuote returns s as an IMAP quoted string, or as a literal if
+// it can't be quoted.
+func imapQuote(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c >= 0x80 || c == 0 {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return `"` + strings.Replace(s, `"`, `\"`, -1) + `"`
+}
+
+// imapNString is imapQuote, with NIL for the empty string.
+func imapNString(s string) string {
+	if s == "" {
+		return "NIL"
+	}
+	return imapQuote(s)
+}
+
+// A searchKey tests one message against a SEARCH criterion.
+type searchKey func(m *imapMsg) bool
+
+// parseSearch parses a SEARCH command's criteria, which all have to
+// match, consuming them from args.
+func (c *imapConn) parseSearch(args *[]imapArg) (searchKey, error) {
+	var keys []searchKey
+	for len(*args) > 0 {
+		k, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return func(m *imapMsg) bool {
+		for _, k := range keys {
+			if !k(m) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (c *imapConn) parseSearchKey(args *[]imapArg) (searchKey, error) {
+	pop := func() (imapArg, error) {
+		if len(*args) == 0 {
+			return imapArg{}, errors.New("missing search argument")
+		}
+		a := (*args)[0]
+		*args = (*args)[1:]
+		return a, nil
+	}
+	popStr := func() (string, error) {
+		a, err := pop()
+		if err != nil {
+			return "", err
+		}
+		s, ok := a.str()
+		if !ok {
+			return "", errors.New("search argument must be a string")
+		}
+		return s, nil
+	}
+	popDate := func() (time.Time, error) {
+		s, err := popStr()
+		if err != nil {
+			return time.Time{}, err
+		}
+		return time.ParseInLocation("2-Jan-2006", s, c.acct.Location())
+	}
+	flag := func(f string, want bool) searchKey {
+		return func(m *imapMsg) bool { return c.hasFlag(m, f) == want }
+	}
+	text := func(get func(m *imapMsg) string) (searchKey, error) {
+		s, err := popStr()
+		if err != nil {
+			return nil, err
+		}
+		s = strings.ToLower(s)
+		return func(m *imapMsg) bool { return strings.Contains(strings.ToLower(get(m)), s) }, nil
+	}
+	header := func(name string) func(m *imapMsg) string {
+		return func(m *imapMsg) string { return c.header(m, name) }
+	}
+	day := func(m *imapMsg) time.Time {
+		t := m.dm.CreatedAt.In(c.acct.Location())
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	}
+
+	a, err := pop()
+	if err != nil {
+		return nil, err
+	}
+	if a.kind == imapList {
+		sub := a.list
+		return c.parseSearch(&sub)
+	}
+	switch key := strings.ToUpper(a.s); key {
+	case "ALL", "OLD":
+		return func(*imapMsg) bool { return true }, nil
+	case "NEW", "RECENT":
+		// We never report messages as \Recent.
+		return func(*imapMsg) bool { return false }, nil
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		return flag(`\`+strings.Title(strings.ToLower(key)), true), nil
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return flag(`\`+strings.Title(strings.ToLower(key[2:])), false), nil
+	case "KEYWORD", "UNKEYWORD":
+		kw, err := popStr()
+		if err != nil {
+			return nil, err
+		}
+		return flag(kw, key == "KEYWORD"), nil
+	case "FROM", "TO", "CC", "BCC", "SUBJECT":
+		return text(header(strings.Title(strings.ToLower(key))))
+	case "HEADER":
+		name, err := popStr()
+		if err != nil {
+			return nil, err
+		}
+		return text(header(name))
+	case "BODY":
+		return text(func(m *imapMsg) string { return m.dm.ExpandedText() })
+	case "TEXT":
+		return text(func(m *imapMsg) string { return c.message(m) + "\n" + m.dm.ExpandedText() })
+	case "BEFORE", "SENTBEFORE", "ON", "SENTON", "SINCE", "SENTSINCE":
+		// Our messages' Date headers are their internal
+		// dates.
+		d, err := popDate()
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimPrefix(key, "SENT")
+		return func(m *imapMsg) bool {
+			t := day(m)
+			switch key {
+			case "BEFORE":
+				return t.Before(d)
+			case "ON":
+				return t.Equal(d)
+			}
+			return !t.Before(d)
+		}, nil
+	case "LARGER", "SMALLER":
+		s, err := popStr()
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *imapMsg) bool {
+			if key == "LARGER" {
+				return len(c.message(m)) > n
+			}
+			return len(c.message(m)) < n
+		}, nil
+	case "NOT":
+		k, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *imapMsg) bool { return !k(m) }, nil
+	case "OR":
+		k1, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		k2, err := c.parseSearchKey(args)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *imapMsg) bool { return k1(m) || k2(m) }, nil
+	case "UID":
+		s, err := popStr()
+		if err != nil {
+			return nil, err
+		}
+		set, err := parseSeqSet(s)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *imapMsg) bool { return set.contains(m.uid, c.maxUID()) }, nil
+	default:
+		set, err := parseSeqSet(a.s)
+		if err != nil {
+			return nil, fmt.Errorf("unknown search key %q", a.s)
+		}
+		return func(m *imapMsg) bool { return set.contains(uint32(m.seq), uint32(len(c.msgs))) }, nil
+	}
+}
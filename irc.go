@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ircBackend is the Backend for IRC, bouncer style. While an
+// account is active it keeps a connection to its network that
+// records private messages, and highlights in the channels it
+// joins, straight into its message store, and mail sent over SMTP
+// goes out as PRIVMSGs on the same connection. IRC keeps no
+// history, so nothing said while the connection is down is seen.
+//
+// The account's Instance is an ircs:// (or irc://) URL for the
+// server and Token its SASL PLAIN password. The nick is also the
+// SASL account name, so the server vouches for it, and the username
+// is the nick and the server's host name joined by a dot. Handles
+// are nick@host, with mail addresses nick.host@ as for Mastodon, and
+// channels work the same way: mail to #chan.host@ is said in #chan.
+type ircBackend struct{}
+
+const (
+	ircDialTimeout  = 30 * time.Second
+	ircReadTimeout  = 4 * time.Minute // a PING goes out after this long without a line
+	ircMaxLineBytes = 400             // of PRIVMSG text, leaving room for the prefix the server adds
+)
+
+// ircSendGap is how long to wait between lines sent to a server.
+var ircSendGap = 500 * time.Millisecond
+
+var (
+	ircNickRx    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_\-]{0,29}$`)
+	ircChannelRx = regexp.MustCompile(`^[#&][^\s,\x07]{1,49}$`)
+	ircFormatRx  = regexp.MustCompile(`\x03(\d{1,2}(,\d{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]`)
+)
+
+func (ircBackend) Name() string { return "irc" }
+
+func (ircBackend) Host(a *Account) string {
+	if h := ircHost(a); h != "" {
+		return h
+	}
+	return "irc"
+}
+
+// ircHost returns the host name of a's server, without the port.
+func ircHost(a *Account) string {
+	if a == nil {
+		return ""
+	}
+	u, err := url.Parse(a.Instance)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// ircNick returns the nick a's username was made from.
+func ircNick(a *Account) string {
+	return strings.SplitN(a.Username, ".", 2)[0]
+}
+
+func ircUser(name, host string) User {
+	return User{Handle: name + "@" + host, Name: name}
+}
+
+// ircServerURL turns what a user typed for their IRC server into an
+// ircs:// URL with a port. Plain irc:// would send the SASL password
+// in the clear, so it's only allowed in -dev mode, and servers on
+// our own network are refused as for Mastodon instances.
+func ircServerURL(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = "ircs://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Hostname() == "" || (u.Scheme != "ircs" && u.Scheme != "irc") {
+		return "", fmt.Errorf("bad IRC server %q", s)
+	}
+	if u.Scheme == "irc" && !*dev {
+		return "", fmt.Errorf("bad IRC server %q: only TLS (ircs://) servers are supported", s)
+	}
+	if err := checkPublicHost(u.Hostname()); err != nil {
+		return "", fmt.Errorf("bad IRC server %q: %v", s, err)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6697"
+		if u.Scheme == "irc" {
+			port = "6667"
+		}
+	}
+	return u.Scheme + "://" + net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// StartLogin checks the server, nick and SASL credentials from our
+// sign-in form by connecting with them. The password is only taken
+// from a POST body, never the URL.
+func (ircBackend) StartLogin(r *http.Request, callback string) (string, error) {
+	server, err := ircServerURL(r.FormValue("server"))
+	if err != nil {
+		return "", err
+	}
+	nick := strings.TrimSpace(r.FormValue("nick"))
+	if !ircNickRx.MatchString(nick) {
+		return "", fmt.Errorf("can't use %q as an IRC nick", nick)
+	}
+	a := &Account{
+		Token:    r.PostFormValue("password"),
+		Instance: server,
+	}
+	if a.Token == "" {
+		return "", errors.New("no SASL password given")
+	}
+	a.Username = nick + "." + ircHost(a)
+	if !userRx.MatchString(a.Username) {
+		return "", fmt.Errorf("can't make a mail address for %s", a.Username)
+	}
+	for _, ch := range strings.FieldsFunc(r.FormValue("channels"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !ircChannelRx.MatchString(ch) {
+			return "", fmt.Errorf("%q isn't an IRC channel", ch)
+		}
+		a.Channels = append(a.Channels, ch)
+	}
+
+	s, err := dialIRC(a)
+	if err != nil {
+		return "", err
+	}
+	s.send("QUIT :signed in to eight22er")
+	s.conn.Close()
+	return parkLogin(a, callback)
+}
+
+func (ircBackend) FinishLogin(r *http.Request, callback string) (*Account, error) {
+	return claimLogin(r)
+}
+
+// An ircMessage is one line from an IRC server.
+type ircMessage struct {
+	Tags    map[string]string // IRCv3 message tags
+	Prefix  string
+	Command string
+	Params  []string // the trailing parameter last, without its ':'
+}
+
+func parseIRCLine(line string) ircMessage {
+	var m ircMessage
+	if strings.HasPrefix(line, "@") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return m
+		}
+		m.Tags = make(map[string]string)
+		for _, tag := range strings.Split(line[1:i], ";") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) == 2 {
+				m.Tags[kv[0]] = kv[1]
+			} else {
+				m.Tags[kv[0]] = ""
+			}
+		}
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		i := strings.Index(line, " ")
+		if i < 0 {
+			return m
+		}
+		m.Prefix = line[1:i]
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	for line != "" {
+		if strings.HasPrefix(line, ":") {
+			m.Params = append(m.Params, line[1:])
+			break
+		}
+		i := strings.Index(line, " ")
+		if i < 0 {
+			i = len(line)
+		}
+		if m.Command == "" {
+			m.Command = strings.ToUpper(line[:i])
+		} else {
+			m.Params = append(m.Params, line[:i])
+		}
+		line = strings.TrimLeft(line[i:], " ")
+	}
+	return m
+}
+
+// nick returns the nick of the message's sender.
+func (m ircMessage) nick() string {
+	return strings.SplitN(m.Prefix, "!", 2)[0]
+}
+
+func (m ircMessage) param(i int) string {
+	if i < len(m.Params) {
+		return m.Params[i]
+	}
+	return ""
+}
+
+func ircError(status int, m ircMessage) *APIError {
+	return &APIError{StatusCode: status, Message: m.Command + " " + m.param(len(m.Params)-1), Service: "IRC"}
+}
+
+// An ircSession is one registered connection to a server.
+type ircSession struct {
+	conn net.Conn
+	br   *bufio.Reader
+	nick string // current nick, which may differ from the account's
+
+	wmu       sync.Mutex
+	lastWrite time.Time
+}
+
+// send writes a line, spacing lines out by ircSendGap so the server
+// doesn't kick us for flooding.
+func (s *ircSession) send(format string, args ...interface{}) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if d := ircSendGap - time.Since(s.lastWrite); d > 0 {
+		time.Sleep(d)
+	}
+	s.lastWrite = time.Now()
+	s.conn.SetWriteDeadline(time.Now().Add(ircDialTimeout))
+	_, err := fmt.Fprintf(s.conn, format+"\r\n", args...)
+	return err
+}
+
+func (s *ircSession) read(timeout time.Duration) (ircMessage, error) {
+	s.conn.SetReadDeadline(time.Now().Add(timeout))
+	line, err := s.br.ReadString('\n')
+	if err != nil {
+		return ircMessage{}, err
+	}
+	return parseIRCLine(strings.TrimRight(line, "\r\n")), nil
+}
+
+// dialIRC connects to a's server and registers, authenticating with
+// SASL PLAIN as the account named by its nick. Servers without SASL
+// are refused, since anyone could take the nick there. Connections
+// are made with publicDialer, and over TLS outside -dev mode,
+// whatever the saved URL says.
+func dialIRC(a *Account) (*ircSession, error) {
+	u, err := url.Parse(a.Instance)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if u.Scheme == "irc" && *dev {
+		conn, err = publicDialer.Dial("tcp", u.Host)
+	} else {
+		conn, err = tls.DialWithDialer(publicDialer, "tcp", u.Host, &tls.Config{ServerName: u.Hostname()})
+	}
+	if err != nil {
+		return nil, err
+	}
+	s := &ircSession{conn: conn, br: bufio.NewReader(conn), nick: ircNick(a)}
+	if err := s.register(a); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ircSession) register(a *Account) error {
+	s.send("CAP LS 302")
+	s.send("NICK %s", s.nick)
+	s.send("USER %s 0 * :eight22er", ircNick(a))
+	var caps []string
+	loggedIn, authed := false, false
+	for {
+		m, err := s.read(ircDialTimeout)
+		if err != nil {
+			return err
+		}
+		switch m.Command {
+		case "PING":
+			s.send("PONG :%s", m.param(0))
+		case "CAP":
+			switch m.param(1) {
+			case "LS":
+				caps = append(caps, strings.Fields(m.param(len(m.Params)-1))...)
+				if m.param(2) == "*" {
+					continue // more to come
+				}
+				var req []string
+				for _, c := range caps {
+					name := strings.SplitN(c, "=", 2)[0]
+					switch {
+					case name == "server-time":
+						req = append(req, name)
+					case name == "sasl" && (c == "sasl" || strings.Contains(c, "PLAIN")):
+						req = append(req, name)
+					}
+				}
+				if !strings.Contains(" "+strings.Join(req, " ")+" ", " sasl ") {
+					s.send("QUIT")
+					return &RejectedError{"the IRC server doesn't support SASL PLAIN"}
+				}
+				s.send("CAP REQ :%s", strings.Join(req, " "))
+			case "ACK":
+				s.send("AUTHENTICATE PLAIN")
+			case "NAK":
+				s.send("QUIT")
+				return ircError(400, m)
+			}
+		case "AUTHENTICATE":
+			if m.param(0) != "+" {
+				continue
+			}
+			payload := base64.StdEncoding.EncodeToString([]byte("\x00" + ircNick(a) + "\x00" + a.Token))
+			for len(payload) >= 400 {
+				s.send("AUTHENTICATE %s", payload[:400])
+				payload = payload[400:]
+			}
+			if payload == "" {
+				payload = "+"
+			}
+			s.send("AUTHENTICATE %s", payload)
+		case "900": // RPL_LOGGEDIN
+			if !strings.EqualFold(m.param(2), ircNick(a)) {
+				s.send("QUIT")
+				return &RevokedError{&APIError{StatusCode: 401, Message: fmt.Sprintf("logged in as %q, not %q", m.param(2), ircNick(a)), Service: "IRC"}}
+			}
+			loggedIn = true
+		case "903": // RPL_SASLSUCCESS
+			if !loggedIn {
+				s.send("QUIT")
+				return &RevokedError{ircError(401, m)}
+			}
+			authed = true
+			s.send("CAP END")
+		case "902", "904", "905", "906": // SASL failed
+			s.send("QUIT")
+			return &RevokedError{ircError(401, m)}
+		case "433": // ERR_NICKNAMEINUSE; SASL proved the account is ours
+			s.nick += "_"
+			s.send("NICK %s", s.nick)
+		case "465": // ERR_YOUREBANNEDCREEP
+			return &SuspendedError{ircError(403, m)}
+		case "ERROR":
+			return ircError(503, m)
+		case "001": // RPL_WELCOME
+			if !authed {
+				s.send("QUIT")
+				return &RevokedError{ircError(401, m)}
+			}
+			s.nick = m.param(0)
+			return nil
+		}
+	}
+}
+
+// An ircClient keeps an account's connection up while the account
+// is active, reconnecting with backoff when it drops.
+type ircClient struct {
+	user string
+
+	mu       sync.Mutex
+	acct     *Account
+	sess     *ircSession   // nil while disconnected
+	ready    chan struct{} // closed when sess is set
+	err      error         // why the last connection failed
+	lastUsed time.Time
+}
+
+var ircClients = struct {
+	sync.Mutex
+	m map[string]*ircClient // by lowercase username
+}{m: make(map[string]*ircClient)}
+
+// ircClientFor returns a's client, starting it if it isn't running,
+// and marks the account as active.
+func ircClientFor(a *Account) *ircClient {
+	key := strings.ToLower(a.Username)
+	ircClients.Lock()
+	defer ircClients.Unlock()
+	c, ok := ircClients.m[key]
+	if !ok {
+		c = &ircClient{user: a.Username, acct: a, ready: make(chan struct{}), lastUsed: time.Now()}
+		ircClients.m[key] = c
+		go c.run()
+	}
+	c.mu.Lock()
+	c.acct = a
+	c.lastUsed = time.Now()
+	c.mu.Unlock()
+	return c
+}
+
+// idle reports whether the account hasn't been used for -sync_idle,
+// when its connection is dropped like its sync worker is stopped.
+func (c *ircClient) idle() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Since(c.lastUsed) > *syncIdle
+}
+
+func (c *ircClient) run() {
+	backoff := 10 * time.Second
+	for {
+		ircClients.Lock()
+		if c.idle() {
+			delete(ircClients.m, strings.ToLower(c.user))
+			ircClients.Unlock()
+			return
+		}
+		ircClients.Unlock()
+
+		c.mu.Lock()
+		a := c.acct
+		c.mu.Unlock()
+		s, err := dialIRC(a)
+		if err == nil {
+			backoff = 10 * time.Second
+			c.mu.Lock()
+			c.sess, c.err = s, nil
+			close(c.ready)
+			c.mu.Unlock()
+			err = c.serve(a, s)
+			s.conn.Close()
+			c.mu.Lock()
+			c.sess, c.ready = nil, make(chan struct{})
+			c.mu.Unlock()
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("irc: %q: %v", c.user, err)
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > *syncMaxInterval {
+			backoff = *syncMaxInterval
+		}
+	}
+}
+
+// Err returns why the account isn't connected, or nil if it is or
+// hasn't failed yet.
+func (c *ircClient) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil {
+		return nil
+	}
+	return c.err
+}
+
+// session returns the connected session, waiting up to timeout for
+// one.
+func (c *ircClient) session(timeout time.Duration) (*ircSession, error) {
+	c.mu.Lock()
+	s, ready := c.sess, c.ready
+	c.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+	select {
+	case <-ready:
+	case <-time.After(timeout):
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess != nil {
+		return c.sess, nil
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return nil, &ServerError{&APIError{StatusCode: 503, Message: "not connected yet", Service: "IRC"}}
+}
+
+// serve reads from a registered session until it fails or the
+// account goes idle.
+func (c *ircClient) serve(a *Account, s *ircSession) error {
+	for _, ch := range a.Channels {
+		s.send("JOIN %s", ch)
+	}
+	pinged := false
+	for {
+		m, err := s.read(ircReadTimeout)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			if c.idle() {
+				s.send("QUIT")
+				return nil
+			}
+			if pinged {
+				return errors.New("ping timeout")
+			}
+			s.send("PING :eight22er")
+			pinged = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		pinged = false
+		switch m.Command {
+		case "PING":
+			s.send("PONG :%s", m.param(0))
+		case "NICK":
+			if strings.EqualFold(m.nick(), s.nick) {
+				s.nick = m.param(0)
+			}
+		case "PRIVMSG":
+			if dm, ok := ircDM(a, s.nick, m); ok {
+				c.record(dm)
+			}
+		case "ERROR":
+			return ircError(503, m)
+		}
+	}
+}
+
+func (c *ircClient) record(dm DM) {
+	store, err := syncer.Store(c.user)
+	if err == nil {
+		_, err = store.Add([]DM{dm})
+	}
+	if err != nil {
+		log.Printf("irc: %q: storing message from %s: %v", c.user, dm.Sender.Handle, err)
+	}
+}
+
+// ircDM returns a PRIVMSG as a DM if it's to us, or mentions us in
+// a channel by the account's nick or the one we ended up with.
+func ircDM(a *Account, nick string, m ircMessage) (DM, bool) {
+	target, text, from := m.param(0), m.param(1), m.nick()
+	host := ircHost(a)
+	if strings.HasPrefix(text, "\x01") {
+		ctcp := strings.Trim(text, "\x01")
+		if !strings.HasPrefix(ctcp, "ACTION ") {
+			return DM{}, false
+		}
+		text = "* " + from + " " + strings.TrimPrefix(ctcp, "ACTION ")
+	}
+	text = ircFormatRx.ReplaceAllString(text, "")
+
+	var conv string
+	switch {
+	case strings.EqualFold(target, nick):
+	case ircChannelRx.MatchString(target) && (mentions(text, nick) || mentions(text, ircNick(a))):
+		conv = strings.ToLower(target) + "@" + host
+	default:
+		return DM{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, m.Tags["time"])
+	if err != nil {
+		t = time.Now()
+	}
+	return DM{
+		ID:           timeID(t, from+"\x00"+target+"\x00"+text),
+		Text:         text,
+		CreatedAt:    t,
+		Sender:       ircUser(from, host),
+		Recipient:    ircUser(ircNick(a), host),
+		Conversation: conv,
+	}, true
+}
+
+// mentions reports whether text has nick in it as a word.
+func mentions(text, nick string) bool {
+	text, nick = strings.ToLower(text), strings.ToLower(nick)
+	for i := 0; ; {
+		j := strings.Index(text[i:], nick)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(nick)
+		if (start == 0 || !isNickByte(text[start-1])) && (end == len(text) || !isNickByte(text[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+func isNickByte(b byte) bool {
+	return 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '_' || b == '-'
+}
+
+// Streams has no streams to fetch: the connection stores messages
+// as they arrive. Syncing just keeps it running.
+func (ircBackend) Streams(a *Account) []string {
+	return []string{"irc"}
+}
+
+func (ircBackend) Sync(a *Account, stream string, c *SyncCursor) ([]DM, error) {
+	c.Complete = true
+	return nil, ircClientFor(a).Err()
+}
+
+// Conversations and Messages come from the store, as IRC has no
+// history to ask for.
+func (ircBackend) Conversations(a *Account) ([]Conversation, error) {
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	seen := make(map[string]bool)
+	for _, dm := range store.DMs() {
+		id := dm.ConversationID(a)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		conv := Conversation{ID: id, Latest: dm}
+		if dm.Conversation != "" {
+			conv.Participants = []User{{Handle: dm.Conversation, Name: strings.SplitN(dm.Conversation, "@", 2)[0]}}
+		} else {
+			conv.Participants = []User{dm.Partner(a)}
+		}
+		convs = append(convs, conv)
+	}
+	return convs, nil
+}
+
+func (ircBackend) Messages(a *Account, conv string, n int) ([]DM, error) {
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		return nil, err
+	}
+	var dms []DM
+	for _, dm := range store.DMs() {
+		if dm.ConversationID(a) == conv && (n == 0 || len(dms) < n) {
+			dms = append(dms, dm)
+		}
+	}
+	return dms, nil
+}
+
+// Send says the message to each recipient, a line at a time. A
+// reply to a highlight goes back to its channel, addressed to the
+// person who said it.
+func (ircBackend) Send(a *Account, out *Outgoing) ([]DM, error) {
+	if len(out.MediaIDs) > 0 {
+		return nil, &RejectedError{"IRC messages can't have attachments"}
+	}
+	var lines []string
+	// A lone CR or a NUL would end the PRIVMSG early on some
+	// servers, and what follows would be read as a command.
+	text := strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "").Replace(out.Text)
+	for _, line := range strings.Split(text, "\n") {
+		for line = strings.TrimRight(line, " \t"); line != ""; {
+			n := len(line)
+			if n > ircMaxLineBytes {
+				n = ircMaxLineBytes
+				for n > 0 && !utf8.RuneStart(line[n]) {
+					n--
+				}
+			}
+			lines = append(lines, line[:n])
+			line = line[n:]
+		}
+	}
+	if len(lines) == 0 {
+		return nil, &RejectedError{"empty message"}
+	}
+	s, err := ircClientFor(a).session(ircDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	host := ircHost(a)
+	orig, _ := storedDM(a, out.InReplyTo)
+	var sent []DM
+	for _, to := range out.To {
+		target := strings.SplitN(to.Handle, "@", 2)[0]
+		dm := DM{
+			Text:      strings.Join(lines, "\n"),
+			CreatedAt: time.Now(),
+			Sender:    ircUser(ircNick(a), host),
+			Recipient: to,
+		}
+		say := lines
+		if out.InReplyTo != 0 && orig.Conversation != "" && strings.EqualFold(orig.Sender.Handle, to.Handle) {
+			target = strings.SplitN(orig.Conversation, "@", 2)[0]
+			dm.Conversation = orig.Conversation
+			say = append([]string{orig.Sender.Name + ": " + lines[0]}, lines[1:]...)
+		} else if ircChannelRx.MatchString(target) {
+			dm.Conversation = strings.ToLower(to.Handle)
+		}
+		for _, line := range say {
+			if err := s.send("PRIVMSG %s :%s", target, line); err != nil {
+				return sent, err
+			}
+		}
+		dm.ID = timeID(dm.CreatedAt, dm.Sender.Name+"\x00"+target+"\x00"+dm.Text)
+		sent = append(sent, dm)
+	}
+	return sent, nil
+}
+
+func (ircBackend) Delete(a *Account, id int64) error {
+	return &RejectedError{"IRC messages can't be deleted"}
+}
+
+func (ircBackend) UploadMedia(a *Account, filename string, data []byte) (string, error) {
+	return "", &RejectedError{"IRC messages can't have attachments"}
+}
+
+// ResolveUser accepts nicks and channels on the account's own
+// network.
+func (ircBackend) ResolveUser(a *Account, localpart string) (User, error) {
+	host := ircHost(a)
+	suffix := "." + host
+	if len(localpart) <= len(suffix) || !strings.EqualFold(localpart[len(localpart)-len(suffix):], suffix) {
+		return User{}, &RejectedError{fmt.Sprintf("%q isn't on %s; use nick%s", localpart, host, suffix)}
+	}
+	name := localpart[:len(localpart)-len(suffix)]
+	if !ircNickRx.MatchString(name) && !ircChannelRx.MatchString(name) {
+		return User{}, &RejectedError{fmt.Sprintf("%q isn't an IRC nick or channel", name)}
+	}
+	return ircUser(name, host), nil
+}
+
+func (ircBackend) MailAddress(u User) string {
+	return strings.Replace(u.Handle, "@", ".", 1) + "@eight22er.danga.com"
+}
+
+func (ircBackend) FetchMedia(a *Account, u string, maxBytes int64) ([]byte, error) {
+	return nil, fmt.Errorf("IRC has no media to fetch: %q", u)
+}
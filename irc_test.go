@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIRC is an IRC server that does just enough registration and
+// SASL PLAIN for eight22er, and records what its clients say.
+type fakeIRC struct {
+	ln   net.Listener
+	said chan string // lines from clients after registration
+
+	mu      sync.Mutex
+	conns   []net.Conn
+	cur     net.Conn // the most recently registered client
+	account string   // if set, the account RPL_LOGGEDIN names instead of the one authenticated
+}
+
+func newFakeIRC(t *testing.T) *fakeIRC {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeIRC{ln: ln, said: make(chan string, 100)}
+	go f.serve()
+	t.Cleanup(f.close)
+	return f
+}
+
+func (f *fakeIRC) URL() string { return "irc://" + f.ln.Addr().String() }
+
+func (f *fakeIRC) close() {
+	f.ln.Close()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+}
+
+func (f *fakeIRC) serve() {
+	for {
+		c, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns = append(f.conns, c)
+		f.mu.Unlock()
+		go f.handle(c)
+	}
+}
+
+func (f *fakeIRC) handle(c net.Conn) {
+	defer c.Close()
+	send := func(format string, args ...interface{}) {
+		fmt.Fprintf(c, format+"\r\n", args...)
+	}
+	br := bufio.NewReader(c)
+	nick, registered := "*", false
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		m := parseIRCLine(line)
+		if m.Command == "QUIT" {
+			return
+		}
+		if registered {
+			if m.Command == "PING" {
+				send(":fake PONG fake :%s", m.param(0))
+			} else {
+				f.said <- line
+			}
+			continue
+		}
+		switch m.Command {
+		case "NICK":
+			nick = m.param(0)
+		case "CAP":
+			switch m.param(0) {
+			case "LS":
+				send(":fake CAP * LS :multi-prefix sasl=PLAIN,EXTERNAL server-time")
+			case "REQ":
+				send(":fake CAP %s ACK :%s", nick, m.param(1))
+			case "END":
+				registered = true
+				f.mu.Lock()
+				f.cur = c
+				f.mu.Unlock()
+				send(":fake 001 %s :Welcome", nick)
+			}
+		case "AUTHENTICATE":
+			if m.param(0) == "PLAIN" {
+				send("AUTHENTICATE +")
+				continue
+			}
+			creds, _ := base64.StdEncoding.DecodeString(m.param(0))
+			if string(creds) != "\x00alice\x00hunter2" {
+				send(":fake 904 %s :SASL authentication failed", nick)
+				continue
+			}
+			f.mu.Lock()
+			account := f.account
+			f.mu.Unlock()
+			if account == "" {
+				account = "alice"
+			}
+			send(":fake 900 %s %s!u@h %s :You are now logged in as %s", nick, nick, account, account)
+			send(":fake 903 %s :SASL authentication successful", nick)
+		}
+	}
+}
+
+func (f *fakeIRC) setAccount(account string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.account = account
+}
+
+// push sends a line to the most recently registered client.
+func (f *fakeIRC) push(line string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fmt.Fprintf(f.cur, "%s\r\n", line)
+}
+
+// next returns the next line a client said, failing the test if
+// there isn't one soon.
+func (f *fakeIRC) next(t *testing.T) string {
+	t.Helper()
+	select {
+	case line := <-f.said:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the client to say something")
+		return ""
+	}
+}
+
+func TestIRCBouncer(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+	defer func(v bool) { *dev = v }(*dev)
+	*dev = true
+	defer func(d time.Duration) { ircSendGap = d }(ircSendGap)
+	ircSendGap = 0
+
+	f := newFakeIRC(t)
+	form := url.Values{"backend": {"irc"}, "server": {f.URL()}, "nick": {"alice"}, "password": {"wrong"}, "channels": {"#ops"}}
+	w := httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("login with the wrong password: %d %s", w.Code, w.Body)
+	}
+	form.Set("password", "hunter2")
+	f.setAccount("mallory")
+	w = httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("login logged in as another account: %d %s", w.Code, w.Body)
+	}
+	f.setAccount("")
+	w = httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	cb, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	cbFunc(w, httptest.NewRequest("GET", "/cb?"+cb.RawQuery, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	a := GetAccountNoAuth("alice.127.0.0.1")
+	if a.Backend != "irc" || a.Token != "hunter2" || a.Instance != f.URL() {
+		t.Fatalf("saved account = %+v", a)
+	}
+	t.Cleanup(func() {
+		ircClients.Lock()
+		defer ircClients.Unlock()
+		if c, ok := ircClients.m[strings.ToLower(a.Username)]; ok {
+			c.mu.Lock()
+			c.lastUsed = time.Time{}
+			c.mu.Unlock()
+			delete(ircClients.m, strings.ToLower(a.Username))
+		}
+	})
+
+	if _, err := ircClientFor(a).session(5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.next(t); got != "JOIN #ops" {
+		t.Fatalf("client said %q; want JOIN #ops", got)
+	}
+
+	f.push("@time=2024-05-01T12:00:00.000Z :bob!b@example PRIVMSG alice :hi there")
+	f.push(":dave!d@example PRIVMSG #ops :nothing for alicebot")
+	f.push("@time=2024-05-01T12:01:00.000Z :carol!c@example PRIVMSG #ops :alice: \x02ping\x02")
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(store.DMs()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	dms := store.DMs()
+	var got []string
+	for _, dm := range dms {
+		got = append(got, fmt.Sprintf("%s>%s %s %q", dm.Sender.Handle, dm.Recipient.Handle, dm.Conversation, dm.Text))
+	}
+	want := []string{
+		`carol@127.0.0.1>alice@127.0.0.1 #ops@127.0.0.1 "alice: ping"`,
+		`bob@127.0.0.1>alice@127.0.0.1  "hi there"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("stored:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	b := ircBackend{}
+	bob, err := b.ResolveUser(a, "bob.127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Send(a, &Outgoing{To: []User{bob}, Text: "one\rQUIT :bye\r\ntwo"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"PRIVMSG bob :one", "PRIVMSG bob :QUIT :bye", "PRIVMSG bob :two"} {
+		if got := f.next(t); got != want {
+			t.Errorf("client said %q; want %q", got, want)
+		}
+	}
+	sent, err := b.Send(a, &Outgoing{To: []User{dms[0].Sender}, Text: "pong", InReplyTo: dms[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := f.next(t); got != "PRIVMSG #ops :carol: pong" {
+		t.Errorf("reply said %q", got)
+	}
+	if len(sent) != 1 || sent[0].Conversation != "#ops@127.0.0.1" {
+		t.Errorf("sent = %+v", sent)
+	}
+}
+
+func TestIRCServerURL(t *testing.T) {
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = false
+	defer func(v bool) { *dev = v }(*dev)
+	*dev = false
+
+	for _, in := range []string{"irc://irc.example.org", "127.0.0.1", "ircs://10.0.0.1:6697", "http://irc.example.org"} {
+		if u, err := ircServerURL(in); err == nil {
+			t.Errorf("ircServerURL(%q) = %q; want an error", in, u)
+		}
+	}
+}
@@ -0,0 +1,767 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JMAP (RFC 8620), with the Mail and Submission capabilities of
+// RFC 8621, is served on the web listener: the session resource at
+// /.well-known/jmap and the API, push, upload and download endpoints
+// under /jmap/. Clients sign in with HTTP Basic auth and the same
+// password as POP and IMAP. Mailboxes are IMAP's folders, and
+// EmailSubmission sends DMs the way SMTP does.
+
+const (
+	jmapCore       = "urn:ietf:params:jmap:core"
+	jmapMail       = "urn:ietf:params:jmap:mail"
+	jmapSubmission = "urn:ietf:params:jmap:submission"
+)
+
+// jmapMethodCaps maps the type part of method names to the
+// capability a request has to be using to call them.
+var jmapMethodCaps = map[string]string{
+	"Core":            jmapCore,
+	"Mailbox":         jmapMail,
+	"Thread":          jmapMail,
+	"Email":           jmapMail,
+	"Identity":        jmapSubmission,
+	"EmailSubmission": jmapSubmission,
+}
+
+// Limits advertised in the session's core capability.
+const (
+	jmapMaxRequest = 10 << 20
+	jmapMaxCalls   = 64
+	jmapMaxObjects = 500 // per get or set
+)
+
+// What's kept in memory per account for JMAP between requests.
+const (
+	jmapMaxUploads     = 32
+	jmapMaxDrafts      = 100
+	jmapMaxSubmissions = 100
+)
+
+// jmapBoot identifies this process in state strings. Events are
+// numbered afresh each time the server starts, so a state from
+// before a restart can't be compared with one from after.
+var jmapBoot = strconv.FormatInt(time.Now().Unix(), 36)
+
+// jmapMethods maps method names to their implementations, which
+// decode their own arguments.
+var jmapMethods map[string]func(x *jmapReq, args json.RawMessage) (interface{}, error)
+
+func init() {
+	jmapMethods = map[string]func(x *jmapReq, args json.RawMessage) (interface{}, error){
+		"Core/echo":           jmapEcho,
+		"Mailbox/get":         (*jmapReq).mailboxGet,
+		"Mailbox/changes":     (*jmapReq).mailboxChanges,
+		"Mailbox/query":       (*jmapReq).mailboxQuery,
+		"Thread/get":          (*jmapReq).threadGet,
+		"Thread/changes":      (*jmapReq).threadChanges,
+		"Email/get":           (*jmapReq).emailGet,
+		"Email/changes":       (*jmapReq).emailChanges,
+		"Email/query":         (*jmapReq).emailQuery,
+		"Email/queryChanges":  (*jmapReq).emailQueryChanges,
+		"Email/set":           (*jmapReq).emailSet,
+		"Email/import":        (*jmapReq).emailImport,
+		"Identity/get":        (*jmapReq).identityGet,
+		"EmailSubmission/get": (*jmapReq).submissionGet,
+		"EmailSubmission/set": (*jmapReq).submissionSet,
+	}
+}
+
+// A jmapError is a method-level error, or as a SetError, the reason
+// one object couldn't be created, updated or destroyed.
+type jmapError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+
+	NotFound          []string `json:"notFound,omitempty"`          // blobNotFound
+	InvalidRecipients []string `json:"invalidRecipients,omitempty"` // invalidRecipients
+}
+
+func (e *jmapError) Error() string { return e.Type + ": " + e.Description }
+
+func jmapErrorf(typ, format string, args ...interface{}) *jmapError {
+	return &jmapError{Type: typ, Description: fmt.Sprintf(format, args...)}
+}
+
+// jmapInvalid returns an invalidProperties SetError for the named
+// properties.
+func jmapInvalid(desc string, props ...string) *jmapError {
+	return &jmapError{Type: "invalidProperties", Description: desc, Properties: props}
+}
+
+// jmapID returns s as a JMAP Id, which may only contain letters,
+// digits, "-" and "_", starting with prefix so Ids for different
+// things don't collide.
+func jmapID(prefix, s string) string {
+	return prefix + base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func jmapAccountID(a *Account) string {
+	return jmapID("a", strings.ToLower(a.Username))
+}
+
+// jmapState returns the account's current state string: the number
+// of its latest event, which changes whenever its messages do.
+func jmapState(user string) string {
+	var seq int64
+	if evs := events.Since(user, 0); len(evs) > 0 {
+		seq = evs[len(evs)-1].Seq
+	}
+	return jmapBoot + "-" + strconv.FormatInt(seq, 10)
+}
+
+// parseJMAPState returns the event number in a state string from
+// this process.
+func parseJMAPState(s string) (int64, bool) {
+	if !strings.HasPrefix(s, jmapBoot+"-") {
+		return 0, false
+	}
+	seq, err := strconv.ParseInt(s[len(jmapBoot)+1:], 10, 64)
+	return seq, err == nil
+}
+
+// jmapAuth returns the request's account, from Basic auth. If there
+// isn't one, it replies 401 and returns nil.
+func jmapAuth(w http.ResponseWriter, r *http.Request) *Account {
+	user, pass, _ := r.BasicAuth()
+	acct, err := GetAccount(user, pass)
+	if err != nil || acct.Password == "" {
+		w.Header().Set("WWW-Authenticate", `Basic realm="eight22er"`)
+		http.Error(w, "bad username or password", http.StatusUnauthorized)
+		return nil
+	}
+	syncer.Touch(acct)
+	return acct
+}
+
+func jmapWrite(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// jmapProblem replies with a request-level error, as an RFC 7807
+// problem details object.
+func jmapProblem(w http.ResponseWriter, status int, typ, detail string, extra ...string) {
+	p := map[string]interface{}{
+		"type":   "urn:ietf:params:jmap:error:" + typ,
+		"status": status,
+		"detail": detail,
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		p[extra[i]] = extra[i+1]
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func jmapSessionFunc(w http.ResponseWriter, r *http.Request) {
+	acct := jmapAuth(w, r)
+	if acct == nil {
+		return
+	}
+	id := jmapAccountID(acct)
+	base := baseURL(r)
+	eventSource := base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}"
+	if acct.FeedToken != "" {
+		// For EventSource, which can't send Basic auth.
+		eventSource += "&" + url.Values{"user": {acct.Username}, "token": {acct.FeedToken}}.Encode()
+	}
+	jmapWrite(w, http.StatusOK, map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			jmapCore: map[string]interface{}{
+				"maxSizeUpload":         *smtpMaxBytes,
+				"maxConcurrentUpload":   4,
+				"maxSizeRequest":        jmapMaxRequest,
+				"maxConcurrentRequests": 4,
+				"maxCallsInRequest":     jmapMaxCalls,
+				"maxObjectsInGet":       jmapMaxObjects,
+				"maxObjectsInSet":       jmapMaxObjects,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			jmapMail:       map[string]interface{}{},
+			jmapSubmission: map[string]interface{}{},
+		},
+		"accounts": map[string]interface{}{
+			id: map[string]interface{}{
+				"name":       acct.Username,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					jmapMail: map[string]interface{}{
+						"maxMailboxesPerEmail":       nil,
+						"maxMailboxDepth":            2,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": *smtpMaxBytes,
+						"emailQuerySortOptions":      []string{"receivedAt", "sentAt", "size", "subject"},
+						"mayCreateTopLevelMailbox":   false,
+					},
+					jmapSubmission: map[string]interface{}{
+						"maxDelayedSend":       0,
+						"submissionExtensions": map[string]interface{}{},
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{jmapMail: id, jmapSubmission: id},
+		"username":        acct.Username,
+		"apiUrl":          base + "/jmap/api",
+		"downloadUrl":     base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		"uploadUrl":       base + "/jmap/upload/{accountId}/",
+		"eventSourceUrl":  eventSource,
+		"state":           jmapBoot,
+	})
+}
+
+// A jmapAccount is what's kept in memory for an account between
+// JMAP requests: uploaded blobs, drafts and submissions. None of it
+// survives a restart; only DMs go in the message store.
+type jmapAccount struct {
+	mu          sync.Mutex
+	next        int // for numbering blobs, drafts and submissions
+	blobs       []*jmapBlob
+	drafts      map[string]*jmapDraft // by Email id
+	submissions []*jmapEmailSubmission
+}
+
+type jmapBlob struct {
+	id   string
+	typ  string
+	data []byte
+}
+
+// A jmapDraft is an Email created with Email/set or Email/import, to
+// be sent with EmailSubmission/set.
+type jmapDraft struct {
+	id       string
+	raw      string
+	keywords map[string]bool
+	created  time.Time
+}
+
+var jmapAccounts = struct {
+	sync.Mutex
+	m map[string]*jmapAccount // by lowercase username
+}{m: make(map[string]*jmapAccount)}
+
+func jmapAccountFor(user string) *jmapAccount {
+	key := strings.ToLower(user)
+	jmapAccounts.Lock()
+	defer jmapAccounts.Unlock()
+	ja, ok := jmapAccounts.m[key]
+	if !ok {
+		ja = &jmapAccount{drafts: make(map[string]*jmapDraft)}
+		jmapAccounts.m[key] = ja
+	}
+	return ja
+}
+
+// newID returns a new Id for one of the account's blobs, drafts or
+// submissions, starting with prefix. ja.mu must be held.
+func (ja *jmapAccount) newID(prefix string) string {
+	ja.next++
+	return prefix + strconv.Itoa(ja.next)
+}
+
+// addBlob keeps an upload, forgetting the oldest if there are too
+// many.
+func (ja *jmapAccount) addBlob(typ string, data []byte) *jmapBlob {
+	ja.mu.Lock()
+	defer ja.mu.Unlock()
+	b := &jmapBlob{id: ja.newID("U"), typ: typ, data: data}
+	ja.blobs = append(ja.blobs, b)
+	if len(ja.blobs) > jmapMaxUploads {
+		ja.blobs = ja.blobs[len(ja.blobs)-jmapMaxUploads:]
+	}
+	return b
+}
+
+func (ja *jmapAccount) blob(id string) (*jmapBlob, bool) {
+	ja.mu.Lock()
+	defer ja.mu.Unlock()
+	for _, b := range ja.blobs {
+		if b.id == id {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// A jmapReq is one API request's view of an account.
+type jmapReq struct {
+	acct      *Account
+	store     MessageStore
+	ja        *jmapAccount
+	accountID string
+	using     map[string]bool
+	created   map[string]string // creation ID -> Id
+	responses []jmapResponse
+	extra     []jmapResponse // implicit responses to add after the current method's
+
+	msgs []*jmapMsg // loaded on first use, newest first
+	byID map[string]*jmapMsg
+}
+
+// A jmapResponse is one of the Invocations in a response.
+type jmapResponse struct {
+	name   string
+	args   json.RawMessage
+	callID string
+}
+
+func (r jmapResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{r.name, r.args, r.callID})
+}
+
+func newJMAPReq(acct *Account) (*jmapReq, error) {
+	store, err := syncer.Store(acct.Username)
+	if err != nil {
+		return nil, err
+	}
+	return &jmapReq{
+		acct:      acct,
+		store:     store,
+		ja:        jmapAccountFor(acct.Username),
+		accountID: jmapAccountID(acct),
+		using:     map[string]bool{jmapCore: true},
+		created:   make(map[string]string),
+	}, nil
+}
+
+func jmapAPIFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "JMAP requests are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	acct := jmapAuth(w, r)
+	if acct == nil {
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, jmapMaxRequest+1))
+	if err != nil {
+		return
+	}
+	if len(body) > jmapMaxRequest {
+		jmapProblem(w, http.StatusRequestEntityTooLarge, "limit", "request too large", "limit", "maxSizeRequest")
+		return
+	}
+	if !json.Valid(body) {
+		jmapProblem(w, http.StatusBadRequest, "notJSON", "request isn't JSON")
+		return
+	}
+	var req struct {
+		Using       []string            `json:"using"`
+		MethodCalls [][]json.RawMessage `json:"methodCalls"`
+		CreatedIDs  map[string]string   `json:"createdIds"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Using == nil || req.MethodCalls == nil {
+		jmapProblem(w, http.StatusBadRequest, "notRequest", "request isn't a JMAP Request object")
+		return
+	}
+	if len(req.MethodCalls) > jmapMaxCalls {
+		jmapProblem(w, http.StatusBadRequest, "limit", "too many method calls", "limit", "maxCallsInRequest")
+		return
+	}
+	x, err := newJMAPReq(acct)
+	if err != nil {
+		log.Printf("JMAP: opening store for %q: %v", acct.Username, err)
+		http.Error(w, "can't open message store", http.StatusServiceUnavailable)
+		return
+	}
+	for _, c := range req.Using {
+		switch c {
+		case jmapCore, jmapMail, jmapSubmission:
+			x.using[c] = true
+		default:
+			jmapProblem(w, http.StatusBadRequest, "unknownCapability", fmt.Sprintf("unknown capability %q", c))
+			return
+		}
+	}
+	for k, v := range req.CreatedIDs {
+		x.created[k] = v
+	}
+	for _, call := range req.MethodCalls {
+		var name, callID string
+		if len(call) != 3 || json.Unmarshal(call[0], &name) != nil || json.Unmarshal(call[2], &callID) != nil {
+			jmapProblem(w, http.StatusBadRequest, "notRequest", "method calls are [name, arguments, method call id]")
+			return
+		}
+		x.call(name, call[1], callID)
+	}
+	res := map[string]interface{}{
+		"methodResponses": x.responses,
+		"sessionState":    jmapBoot,
+	}
+	if req.CreatedIDs != nil {
+		res["createdIds"] = x.created
+	}
+	jmapWrite(w, http.StatusOK, res)
+}
+
+// call runs one method call, adding its responses.
+func (x *jmapReq) call(name string, args json.RawMessage, callID string) {
+	res, err := x.run(name, args)
+	if err != nil {
+		e, ok := err.(*jmapError)
+		if !ok {
+			log.Printf("JMAP: %s for %q: %v", name, x.acct.Username, err)
+			e = jmapErrorf("serverFail", "%s", oneLine(err.Error()))
+		}
+		x.respond("error", e, callID)
+	} else {
+		x.respond(name, res, callID)
+	}
+	extra := x.extra
+	x.extra = nil
+	for _, r := range extra {
+		r.callID = callID
+		x.responses = append(x.responses, r)
+	}
+}
+
+func (x *jmapReq) run(name string, raw json.RawMessage) (interface{}, error) {
+	m, ok := jmapMethods[name]
+	if !ok || !x.using[jmapMethodCaps[strings.SplitN(name, "/", 2)[0]]] {
+		return nil, jmapErrorf("unknownMethod", "unknown method %q", name)
+	}
+	args, err := x.resolve(raw)
+	if err != nil {
+		return nil, err
+	}
+	if name != "Core/echo" {
+		var acct struct {
+			AccountID *string `json:"accountId"`
+		}
+		json.Unmarshal(args, &acct)
+		switch {
+		case acct.AccountID == nil:
+			return nil, jmapErrorf("invalidArguments", "missing accountId")
+		case *acct.AccountID != x.accountID:
+			return nil, jmapErrorf("accountNotFound", "no such account")
+		}
+	}
+	return m(x, args)
+}
+
+// respond adds a response for the current method call. Results are
+// kept encoded, for result references to look into.
+func (x *jmapReq) respond(name string, res interface{}, callID string) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("JMAP: encoding %s for %q: %v", name, x.acct.Username, err)
+		name, b = "error", []byte(`{"type":"serverFail"}`)
+	}
+	x.responses = append(x.responses, jmapResponse{name, b, callID})
+}
+
+// also adds an implicit response, such as the Email/set that
+// EmailSubmission/set's onSuccessUpdateEmail makes, after the
+// current method's.
+func (x *jmapReq) also(name string, res interface{}) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return
+	}
+	x.extra = append(x.extra, jmapResponse{name: name, args: b})
+}
+
+// resolve replaces arguments whose names start with "#", which are
+// ResultReferences (RFC 8620 section 3.7), with the values they
+// refer to in earlier responses.
+func (x *jmapReq) resolve(raw json.RawMessage) (json.RawMessage, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &args); err != nil || args == nil {
+		return nil, jmapErrorf("invalidArguments", "arguments must be an object")
+	}
+	refs := false
+	for k, v := range args {
+		if !strings.HasPrefix(k, "#") {
+			continue
+		}
+		refs = true
+		if _, dup := args[k[1:]]; dup {
+			return nil, jmapErrorf("invalidArguments", "both %s and %s given", k[1:], k)
+		}
+		var ref struct {
+			ResultOf string `json:"resultOf"`
+			Name     string `json:"name"`
+			Path     string `json:"path"`
+		}
+		if err := json.Unmarshal(v, &ref); err != nil {
+			return nil, jmapErrorf("invalidResultReference", "bad reference for %s", k)
+		}
+		var val interface{}
+		found := false
+		for _, r := range x.responses {
+			if r.callID != ref.ResultOf || r.name != ref.Name {
+				continue
+			}
+			var doc interface{}
+			json.Unmarshal(r.args, &doc)
+			val, found = jmapPointer(doc, ref.Path)
+			break
+		}
+		if !found {
+			return nil, jmapErrorf("invalidResultReference", "no %s result %q with %s", ref.Name, ref.ResultOf, ref.Path)
+		}
+		b, _ := json.Marshal(val)
+		delete(args, k)
+		args[k[1:]] = b
+	}
+	if !refs {
+		return raw, nil
+	}
+	return json.Marshal(args)
+}
+
+// jmapPointer evaluates a JSON Pointer with JMAP's "*" extension,
+// which maps the rest of the path over an array, flattening the
+// arrays it finds.
+func jmapPointer(v interface{}, path string) (interface{}, bool) {
+	if path == "" {
+		return v, true
+	}
+	if !strings.HasPrefix(path, "/") {
+		return nil, false
+	}
+	tok, rest := path[1:], ""
+	if i := strings.Index(tok, "/"); i >= 0 {
+		tok, rest = tok[:i], tok[i:]
+	}
+	tok = strings.Replace(strings.Replace(tok, "~1", "/", -1), "~0", "~", -1)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		child, ok := v[tok]
+		if !ok {
+			return nil, false
+		}
+		return jmapPointer(child, rest)
+	case []interface{}:
+		if tok == "*" {
+			out := []interface{}{}
+			for _, e := range v {
+				r, ok := jmapPointer(e, rest)
+				if !ok {
+					return nil, false
+				}
+				if list, isList := r.([]interface{}); isList {
+					out = append(out, list...)
+				} else {
+					out = append(out, r)
+				}
+			}
+			return out, true
+		}
+		i, err := strconv.Atoi(tok)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return jmapPointer(v[i], rest)
+	}
+	return nil, false
+}
+
+// decodeArgs decodes a method's arguments into v, rejecting ones it
+// doesn't know.
+func decodeArgs(raw json.RawMessage, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return jmapErrorf("invalidArguments", "%v", err)
+	}
+	return nil
+}
+
+// ref returns the Id an Id argument refers to: itself, or for
+// "#" and a creation ID, the Id of the object created with it.
+func (x *jmapReq) ref(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if real, ok := x.created[id[1:]]; ok {
+			return real
+		}
+	}
+	return id
+}
+
+func jmapEcho(x *jmapReq, args json.RawMessage) (interface{}, error) {
+	return args, nil
+}
+
+// jmapEventSourceFunc pushes StateChange objects to the client as
+// Server-Sent Events whenever the account's messages change. Since
+// EventSource can't send Basic auth, the feed's user and token
+// parameters also work; see tokenAccount.
+func jmapEventSourceFunc(w http.ResponseWriter, r *http.Request) {
+	acct := tokenAccount(r)
+	if acct != nil {
+		syncer.Touch(acct)
+	} else if acct = jmapAuth(w, r); acct == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	want := make(map[string]bool)
+	for _, t := range strings.Split(r.FormValue("types"), ",") {
+		want[strings.TrimSpace(t)] = true
+	}
+	wants := func(t string) bool { return want["*"] || want[t] || len(want) == 1 && want[""] }
+	closeAfter := r.FormValue("closeafter") == "state"
+	sub := events.Subscribe(acct.Username, 16)
+	defer events.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, ": eight22er JMAP push\n\n")
+	flusher.Flush()
+	var pings <-chan time.Time
+	if ping, err := strconv.Atoi(r.FormValue("ping")); err == nil && ping > 0 {
+		t := time.NewTicker(time.Duration(ping) * time.Second)
+		defer t.Stop()
+		pings = t.C
+	}
+	id := jmapAccountID(acct)
+	for {
+		select {
+		case ev := <-sub.C:
+			delivery := ev.Type == "new" && ev.DM != nil && !ev.DM.Sent(acct)
+		drain:
+			for {
+				select {
+				case ev := <-sub.C:
+					delivery = delivery || ev.Type == "new" && ev.DM != nil && !ev.DM.Sent(acct)
+				default:
+					break drain
+				}
+			}
+			state := jmapState(acct.Username)
+			changed := make(map[string]string)
+			for _, t := range []string{"Email", "Mailbox", "Thread"} {
+				if wants(t) {
+					changed[t] = state
+				}
+			}
+			if delivery && wants("EmailDelivery") {
+				changed["EmailDelivery"] = state
+			}
+			if len(changed) == 0 {
+				continue
+			}
+			data, _ := json.Marshal(map[string]interface{}{
+				"@type":   "StateChange",
+				"changed": map[string]interface{}{id: changed},
+			})
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", data)
+			flusher.Flush()
+			if closeAfter {
+				return
+			}
+		case <-pings:
+			io.WriteString(w, "event: ping\ndata: {}\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// jmapPathAccount checks that the account ID in an upload or
+// download URL, after prefix, is the signed in account's, and
+// returns the rest of the path.
+func jmapPathAccount(w http.ResponseWriter, r *http.Request, prefix string, acct *Account) (string, bool) {
+	rest := strings.TrimPrefix(r.URL.Path, prefix)
+	parts := strings.SplitN(rest, "/", 2)
+	if parts[0] != jmapAccountID(acct) {
+		http.Error(w, "no such account", http.StatusNotFound)
+		return "", false
+	}
+	if len(parts) == 1 {
+		return "", true
+	}
+	return parts[1], true
+}
+
+func jmapUploadFunc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "uploads are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	acct := jmapAuth(w, r)
+	if acct == nil {
+		return
+	}
+	if _, ok := jmapPathAccount(w, r, "/jmap/upload/", acct); !ok {
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(*smtpMaxBytes)+1))
+	if err != nil {
+		return
+	}
+	if len(data) > *smtpMaxBytes {
+		jmapProblem(w, http.StatusRequestEntityTooLarge, "limit", "upload too large", "limit", "maxSizeUpload")
+		return
+	}
+	typ := r.Header.Get("Content-Type")
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	b := jmapAccountFor(acct.Username).addBlob(typ, data)
+	jmapWrite(w, http.StatusCreated, map[string]interface{}{
+		"accountId": jmapAccountID(acct),
+		"blobId":    b.id,
+		"type":      b.typ,
+		"size":      len(b.data),
+	})
+}
+
+func jmapDownloadFunc(w http.ResponseWriter, r *http.Request) {
+	acct := jmapAuth(w, r)
+	if acct == nil {
+		return
+	}
+	rest, ok := jmapPathAccount(w, r, "/jmap/download/", acct)
+	if !ok {
+		return
+	}
+	parts := strings.SplitN(rest, "/", 2)
+	x, err := newJMAPReq(acct)
+	if err != nil {
+		http.Error(w, "can't open message store", http.StatusServiceUnavailable)
+		return
+	}
+	data, typ, ok := x.blob(parts[0])
+	if !ok {
+		http.Error(w, "no such blob", http.StatusNotFound)
+		return
+	}
+	if t := r.FormValue("accept"); t != "" {
+		typ = t
+	}
+	w.Header().Set("Content-Type", typ)
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	if len(parts) == 2 && parts[1] != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.Replace(parts[1], `"`, "", -1)))
+	}
+	w.Write(data)
+}
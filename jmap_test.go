@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jmapTestAccount signs in to a fake Mastodon instance and seeds its
+// store with a DM from bob and a later one from carol.
+func jmapTestAccount(t *testing.T) (*Account, *fakeMastodon) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+
+	f := newFakeMastodon(t)
+	a := mastodonLogin(t, f)
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	self := User{Handle: "alice@127.0.0.1", Name: "Alice"}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := store.Add([]DM{
+		{ID: timeID(start, "1"), Ref: "AbC1", Text: "hi alice", CreatedAt: start, Sender: User{Handle: "bob@remote.example", Name: "Bob"}, Recipient: self},
+		{ID: timeID(start.Add(time.Hour), "2"), Ref: "AbC2", Text: "lunch today?", CreatedAt: start.Add(time.Hour), Sender: User{Handle: "carol@remote.example", Name: "Carol"}, Recipient: self},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return a, f
+}
+
+// jmapPost sends a JMAP request as a and returns its method
+// responses.
+func jmapPost(t *testing.T, a *Account, using []string, calls ...[]interface{}) [][]json.RawMessage {
+	t.Helper()
+	body, _ := json.Marshal(map[string]interface{}{"using": using, "methodCalls": calls})
+	r := httptest.NewRequest("POST", "/jmap/api", strings.NewReader(string(body)))
+	r.SetBasicAuth(a.Username, a.Password)
+	w := httptest.NewRecorder()
+	jmapAPIFunc(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("JMAP request: %d %s", w.Code, w.Body)
+	}
+	var res struct {
+		MethodResponses [][]json.RawMessage `json:"methodResponses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.MethodResponses
+}
+
+// jmapResult decodes the arguments of the response named name.
+func jmapResult(t *testing.T, responses [][]json.RawMessage, name string, v interface{}) {
+	t.Helper()
+	for _, r := range responses {
+		var got string
+		json.Unmarshal(r[0], &got)
+		if got == name {
+			if err := json.Unmarshal(r[1], v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no %s in responses %s", name, responses)
+}
+
+func TestJMAPSession(t *testing.T) {
+	a, _ := jmapTestAccount(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/.well-known/jmap", nil)
+	r.SetBasicAuth(a.Username, "wrong")
+	jmapSessionFunc(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("session with the wrong password: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	jmapSessionFunc(w, httptest.NewRequest("GET", "/.well-known/jmap?username="+a.Username+"&password="+a.Password, nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("session with the password in the URL: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.SetBasicAuth(a.Username, a.Password)
+	jmapSessionFunc(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("session: %d %s", w.Code, w.Body)
+	}
+	var s struct {
+		Capabilities    map[string]json.RawMessage `json:"capabilities"`
+		Accounts        map[string]json.RawMessage `json:"accounts"`
+		PrimaryAccounts map[string]string          `json:"primaryAccounts"`
+		Username        string                     `json:"username"`
+		APIURL          string                     `json:"apiUrl"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	id := jmapAccountID(a)
+	if s.Username != a.Username || s.PrimaryAccounts[jmapMail] != id || s.PrimaryAccounts[jmapSubmission] != id || s.Accounts[id] == nil {
+		t.Errorf("session = %s", w.Body)
+	}
+	for _, c := range []string{jmapCore, jmapMail, jmapSubmission} {
+		if s.Capabilities[c] == nil {
+			t.Errorf("session doesn't have capability %s", c)
+		}
+	}
+	if !strings.HasSuffix(s.APIURL, "/jmap/api") {
+		t.Errorf("apiUrl = %q", s.APIURL)
+	}
+}
+
+func TestJMAPQueryAndGet(t *testing.T) {
+	a, _ := jmapTestAccount(t)
+	id := jmapAccountID(a)
+
+	res := jmapPost(t, a, []string{jmapCore, jmapMail},
+		[]interface{}{"Email/query", map[string]interface{}{"accountId": id, "filter": map[string]string{"inMailbox": jmapInbox}, "calculateTotal": true}, "all"},
+		[]interface{}{"Email/query", map[string]interface{}{"accountId": id, "filter": map[string]string{"text": "lunch"}}, "lunch"},
+		[]interface{}{"Email/get", map[string]interface{}{
+			"accountId":           id,
+			"#ids":                map[string]string{"resultOf": "all", "name": "Email/query", "path": "/ids"},
+			"properties":          []string{"from", "subject", "preview", "textBody", "bodyValues"},
+			"fetchTextBodyValues": true,
+		}, "get"},
+	)
+	var all, lunch struct {
+		IDs   []string `json:"ids"`
+		Total int      `json:"total"`
+	}
+	for i, q := range []interface{}{&all, &lunch} {
+		if err := json.Unmarshal(res[i][1], q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(all.IDs) != 2 || all.Total != 2 {
+		t.Fatalf("inbox query = %+v", all)
+	}
+	if len(lunch.IDs) != 1 || lunch.IDs[0] != all.IDs[0] {
+		t.Errorf("text query = %v; want the newest of %v", lunch.IDs, all.IDs)
+	}
+
+	var get struct {
+		List []struct {
+			ID   string `json:"id"`
+			From []struct {
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			} `json:"from"`
+			Preview  string `json:"preview"`
+			TextBody []struct {
+				PartID string `json:"partId"`
+			} `json:"textBody"`
+			BodyValues map[string]struct {
+				Value string `json:"value"`
+			} `json:"bodyValues"`
+		} `json:"list"`
+	}
+	jmapResult(t, res, "Email/get", &get)
+	if len(get.List) != 2 {
+		t.Fatalf("got %d emails; want 2", len(get.List))
+	}
+	for i, want := range []struct{ from, text string }{
+		{"carol.remote.example@eight22er.danga.com", "lunch today?"},
+		{"bob.remote.example@eight22er.danga.com", "hi alice"},
+	} {
+		e := get.List[i]
+		if e.ID != all.IDs[i] || len(e.From) != 1 || e.From[0].Email != want.from {
+			t.Errorf("email %d = %+v; want from %s", i, e, want.from)
+			continue
+		}
+		if len(e.TextBody) != 1 || strings.TrimSpace(e.BodyValues[e.TextBody[0].PartID].Value) != want.text || e.Preview != want.text {
+			t.Errorf("email %d text = %+v; want %q", i, e, want.text)
+		}
+	}
+}
+
+func TestJMAPSubmission(t *testing.T) {
+	a, f := jmapTestAccount(t)
+	id := jmapAccountID(a)
+
+	res := jmapPost(t, a, []string{jmapCore, jmapMail, jmapSubmission},
+		[]interface{}{"Email/set", map[string]interface{}{
+			"accountId": id,
+			"create": map[string]interface{}{"draft": map[string]interface{}{
+				"mailboxIds": map[string]bool{jmapDrafts: true},
+				"to":         []map[string]string{{"email": "bob.remote.example@eight22er.danga.com"}},
+				"subject":    "hello",
+				"textBody":   []map[string]string{{"partId": "1", "type": "text/plain"}},
+				"bodyValues": map[string]interface{}{"1": map[string]string{"value": "answer"}},
+			}},
+		}, "set"},
+		[]interface{}{"EmailSubmission/set", map[string]interface{}{
+			"accountId": id,
+			"create": map[string]interface{}{"send": map[string]string{
+				"identityId": jmapIdentity,
+				"emailId":    "#draft",
+			}},
+		}, "submit"},
+	)
+	var set struct {
+		Created    map[string]json.RawMessage `json:"created"`
+		NotCreated map[string]json.RawMessage `json:"notCreated"`
+	}
+	jmapResult(t, res, "EmailSubmission/set", &set)
+	if set.Created["send"] == nil {
+		t.Fatalf("submission wasn't created: %s", res)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var sent *fakeStatus
+	for _, st := range f.statuses {
+		if st.Account.Acct == "alice" {
+			sent = st
+		}
+	}
+	if sent == nil || sent.Visibility != "direct" || statusText(sent.Content) != "answer" {
+		t.Fatalf("posted status %+v", sent)
+	}
+	if len(sent.Mentions) != 1 || sent.Mentions[0].Acct != "bob@remote.example" {
+		t.Errorf("status mentions %+v; want bob", sent.Mentions)
+	}
+}
@@ -0,0 +1,2261 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/mail"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Mailbox Ids. Each conversation's mailbox is "c" and its ID, under
+// the Conversations mailbox, and its thread "t" and the same.
+const (
+	jmapInbox         = "inbox"
+	jmapDrafts        = "drafts"
+	jmapConversations = "conversations"
+)
+
+// jmapIdentity is the Id of an account's one Identity, the address
+// SMTP sends from.
+const jmapIdentity = "me"
+
+// jmapUTCDate is the format of RFC 8620's UTCDate.
+const jmapUTCDate = "2006-01-02T15:04:05Z"
+
+// A jmapMsg is an Email: a stored DM, or a draft.
+type jmapMsg struct {
+	id         string
+	dm         DM // for stored DMs
+	draft      *jmapDraft
+	threadID   string
+	mailboxIDs map[string]bool
+	received   time.Time
+
+	raw  string
+	part *mimePart
+}
+
+func jmapEmailID(id int64) string {
+	return "m" + strconv.FormatInt(id, 10)
+}
+
+// load reads the account's DMs and drafts, newest first, the first
+// time the request needs them.
+func (x *jmapReq) load() error {
+	if x.byID != nil {
+		return nil
+	}
+	dms, err := syncer.DMs(x.acct)
+	if err != nil {
+		return err
+	}
+	x.msgs, x.byID = nil, make(map[string]*jmapMsg)
+	for _, dm := range dms {
+		conv := dm.ConversationID(x.acct)
+		m := &jmapMsg{
+			id:         jmapEmailID(dm.ID),
+			dm:         dm,
+			threadID:   jmapID("t", conv),
+			mailboxIDs: map[string]bool{jmapInbox: true, jmapID("c", conv): true},
+			received:   dm.CreatedAt,
+		}
+		x.msgs = append(x.msgs, m)
+		x.byID[m.id] = m
+	}
+	x.ja.mu.Lock()
+	var drafts []*jmapMsg
+	for _, d := range x.ja.drafts {
+		drafts = append(drafts, &jmapMsg{
+			id:         d.id,
+			draft:      d,
+			threadID:   "T" + d.id,
+			mailboxIDs: map[string]bool{jmapDrafts: true},
+			received:   d.created,
+			raw:        d.raw,
+		})
+	}
+	x.ja.mu.Unlock()
+	for _, m := range drafts {
+		// A reply goes in the thread of the DM it replies to.
+		if sm := replyIDRx.FindStringSubmatch(x.parsed(m).header.Get("In-Reply-To")); sm != nil {
+			if orig, ok := x.byID["m"+sm[1]]; ok {
+				m.threadID = orig.threadID
+			}
+		}
+		x.msgs = append(x.msgs, m)
+		x.byID[m.id] = m
+	}
+	sort.SliceStable(x.msgs, func(i, j int) bool { return x.msgs[i].received.After(x.msgs[j].received) })
+	return nil
+}
+
+// invalidate makes the next load read the store again, after a
+// method changed it.
+func (x *jmapReq) invalidate() {
+	x.msgs, x.byID = nil, nil
+}
+
+func (x *jmapReq) raw(m *jmapMsg) string {
+	if m.raw == "" {
+		m.raw = renderDM(x.store, x.acct, m.dm)
+	}
+	return m.raw
+}
+
+func (x *jmapReq) parsed(m *jmapMsg) *mimePart {
+	if m.part == nil {
+		m.part = parseMIME(x.raw(m))
+	}
+	return m.part
+}
+
+// jmapKeywords maps JMAP's keywords for IMAP system flags to the
+// flags. Other keywords are the same in both.
+var jmapKeywords = map[string]string{
+	"$seen":     `\Seen`,
+	"$answered": `\Answered`,
+	"$flagged":  `\Flagged`,
+	"$draft":    `\Draft`,
+}
+
+func (x *jmapReq) keywords(m *jmapMsg) map[string]bool {
+	kw := make(map[string]bool)
+	if m.draft != nil {
+		x.ja.mu.Lock()
+		for k := range m.draft.keywords {
+			kw[k] = true
+		}
+		x.ja.mu.Unlock()
+		return kw
+	}
+	for _, f := range x.store.Flags(m.dm.ID) {
+		if !strings.HasPrefix(f, `\`) {
+			kw[strings.ToLower(f)] = true
+			continue
+		}
+		for k, sys := range jmapKeywords {
+			if strings.EqualFold(f, sys) {
+				kw[k] = true
+			}
+		}
+	}
+	return kw
+}
+
+// setKeywords stores m's keywords. For DMs they're IMAP flags, and
+// flags JMAP doesn't show, like \Deleted, are kept.
+func (x *jmapReq) setKeywords(m *jmapMsg, kw map[string]bool) error {
+	if m.draft != nil {
+		x.ja.mu.Lock()
+		m.draft.keywords = kw
+		x.ja.mu.Unlock()
+		return nil
+	}
+	var flags []string
+	for _, f := range x.store.Flags(m.dm.ID) {
+		if strings.HasPrefix(f, `\`) && jmapKeywords[strings.ToLower("$"+f[1:])] == "" {
+			flags = append(flags, f)
+		}
+	}
+	var keys []string
+	for k := range kw {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if sys, ok := jmapKeywords[k]; ok {
+			k = sys
+		}
+		flags = append(flags, k)
+	}
+	return x.store.SetFlags(m.dm.ID, flags)
+}
+
+// validKeyword reports whether k may be a keyword: printable ASCII
+// without the characters IMAP's flag-keyword excludes.
+func validKeyword(k string) bool {
+	if k == "" || len(k) > 255 {
+		return false
+	}
+	for i := 0; i < len(k); i++ {
+		if c := k[i]; c <= ' ' || c >= 0x7f || strings.IndexByte(`(){]%*"\`, c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// jmapKeywordSet lowercases keywords, checking them.
+func jmapKeywordSet(in map[string]bool) (map[string]bool, error) {
+	kw := make(map[string]bool)
+	for k, v := range in {
+		if !v || !validKeyword(k) {
+			return nil, jmapInvalid(fmt.Sprintf("bad keyword %q", k), "keywords")
+		}
+		kw[strings.ToLower(k)] = true
+	}
+	return kw, nil
+}
+
+// getIDs returns the Ids a get asks for, or all of them if it gave
+// none.
+func (x *jmapReq) getIDs(ids *[]string, all func() []string) ([]string, error) {
+	var out []string
+	if ids == nil {
+		out = all()
+	} else {
+		for _, id := range *ids {
+			out = append(out, x.ref(id))
+		}
+	}
+	if len(out) > jmapMaxObjects {
+		return nil, jmapErrorf("requestTooLarge", "more than %d objects", jmapMaxObjects)
+	}
+	return out, nil
+}
+
+// jmapPick returns obj with just the requested properties, or all
+// of them if none were requested. The id is always included.
+func jmapPick(obj map[string]interface{}, props []string) (map[string]interface{}, error) {
+	if props == nil {
+		return obj, nil
+	}
+	out := map[string]interface{}{"id": obj["id"]}
+	for _, p := range props {
+		v, ok := obj[p]
+		if !ok {
+			return nil, jmapErrorf("invalidArguments", "unknown property %q", p)
+		}
+		out[p] = v
+	}
+	return out, nil
+}
+
+// A jmapMailbox is one of IMAP's folders, as a Mailbox.
+type jmapMailbox struct {
+	id, name, parentID, role string
+	sortOrder                int
+}
+
+func (x *jmapReq) mailboxes() ([]jmapMailbox, error) {
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	var dms []DM
+	for _, m := range x.msgs {
+		if m.draft == nil {
+			dms = append(dms, m.dm)
+		}
+	}
+	boxes := []jmapMailbox{
+		{id: jmapInbox, name: "Inbox", role: "inbox", sortOrder: 1},
+		{id: jmapDrafts, name: "Drafts", role: "drafts", sortOrder: 2},
+		{id: jmapConversations, name: imapConvFolder, sortOrder: 3},
+	}
+	for _, f := range conversationFolders(x.acct, dms) {
+		boxes = append(boxes, jmapMailbox{id: jmapID("c", f.conv), name: f.name, parentID: jmapConversations, sortOrder: 10})
+	}
+	return boxes, nil
+}
+
+func (x *jmapReq) mailboxGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID  string    `json:"accountId"`
+		IDs        *[]string `json:"ids"`
+		Properties []string  `json:"properties"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	boxes, err := x.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := x.getIDs(args.IDs, func() []string {
+		var all []string
+		for _, mb := range boxes {
+			all = append(all, mb.id)
+		}
+		return all
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	total, unread := make(map[string]int), make(map[string]int)
+	threads, unreadThreads := make(map[string]map[string]bool), make(map[string]map[string]bool)
+	for _, m := range x.msgs {
+		seen := x.keywords(m)["$seen"]
+		for mb := range m.mailboxIDs {
+			total[mb]++
+			if threads[mb] == nil {
+				threads[mb], unreadThreads[mb] = make(map[string]bool), make(map[string]bool)
+			}
+			threads[mb][m.threadID] = true
+			if !seen {
+				unread[mb]++
+				unreadThreads[mb][m.threadID] = true
+			}
+		}
+	}
+	byID := make(map[string]jmapMailbox)
+	for _, mb := range boxes {
+		byID[mb.id] = mb
+	}
+	list, notFound := []interface{}{}, []string{}
+	for _, id := range ids {
+		mb, ok := byID[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		obj := map[string]interface{}{
+			"id":            mb.id,
+			"name":          mb.name,
+			"parentId":      nil,
+			"role":          nil,
+			"sortOrder":     mb.sortOrder,
+			"totalEmails":   total[mb.id],
+			"unreadEmails":  unread[mb.id],
+			"totalThreads":  len(threads[mb.id]),
+			"unreadThreads": len(unreadThreads[mb.id]),
+			"myRights": map[string]bool{
+				"mayReadItems":   true,
+				"mayAddItems":    mb.id == jmapDrafts,
+				"mayRemoveItems": mb.id != jmapConversations,
+				"maySetSeen":     true,
+				"maySetKeywords": true,
+				"mayCreateChild": false,
+				"mayRename":      false,
+				"mayDelete":      false,
+				"maySubmit":      true,
+			},
+			"isSubscribed": true,
+		}
+		if mb.parentID != "" {
+			obj["parentId"] = mb.parentID
+		}
+		if mb.role != "" {
+			obj["role"] = mb.role
+		}
+		picked, err := jmapPick(obj, args.Properties)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, picked)
+	}
+	return map[string]interface{}{
+		"accountId": x.accountID,
+		"state":     jmapState(x.acct.Username),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// noChanges answers /changes for types whose changes aren't kept:
+// with nothing if the client is up to date, and otherwise with
+// cannotCalculateChanges, so it gets them all again.
+func (x *jmapReq) noChanges(raw json.RawMessage, mailbox bool) (interface{}, error) {
+	var args struct {
+		AccountID  string `json:"accountId"`
+		SinceState string `json:"sinceState"`
+		MaxChanges *int   `json:"maxChanges"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	state := jmapState(x.acct.Username)
+	if args.SinceState != state {
+		return nil, jmapErrorf("cannotCalculateChanges", "changes to these aren't kept; fetch them again")
+	}
+	res := map[string]interface{}{
+		"accountId":      x.accountID,
+		"oldState":       state,
+		"newState":       state,
+		"hasMoreChanges": false,
+		"created":        []string{},
+		"updated":        []string{},
+		"destroyed":      []string{},
+	}
+	if mailbox {
+		res["updatedProperties"] = nil
+	}
+	return res, nil
+}
+
+func (x *jmapReq) mailboxChanges(raw json.RawMessage) (interface{}, error) {
+	return x.noChanges(raw, true)
+}
+
+func (x *jmapReq) threadChanges(raw json.RawMessage) (interface{}, error) {
+	return x.noChanges(raw, false)
+}
+
+type jmapComparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Collation   string `json:"collation"`
+}
+
+func (c jmapComparator) ascending() bool {
+	return c.IsAscending == nil || *c.IsAscending
+}
+
+// jmapWindow returns the part of a query's results the client asked
+// for, and where it starts.
+func jmapWindow(ids []string, position int, anchor *string, anchorOffset int, limit *int) ([]string, int, error) {
+	if anchor != nil {
+		i := 0
+		for i < len(ids) && ids[i] != *anchor {
+			i++
+		}
+		if i == len(ids) {
+			return nil, 0, jmapErrorf("anchorNotFound", "%s isn't in the results", *anchor)
+		}
+		position = i + anchorOffset
+	} else if position < 0 {
+		position += len(ids)
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(ids) {
+		position = len(ids)
+	}
+	out := ids[position:]
+	if limit != nil {
+		if *limit < 0 {
+			return nil, 0, jmapErrorf("invalidArguments", "negative limit")
+		}
+		if *limit < len(out) {
+			out = out[:*limit]
+		}
+	}
+	return out, position, nil
+}
+
+type jmapQueryArgs struct {
+	AccountID      string           `json:"accountId"`
+	Filter         json.RawMessage  `json:"filter"`
+	Sort           []jmapComparator `json:"sort"`
+	Position       int              `json:"position"`
+	Anchor         *string          `json:"anchor"`
+	AnchorOffset   int              `json:"anchorOffset"`
+	Limit          *int             `json:"limit"`
+	CalculateTotal bool             `json:"calculateTotal"`
+
+	SortAsTree      bool `json:"sortAsTree"`      // Mailbox/query
+	FilterAsTree    bool `json:"filterAsTree"`    // Mailbox/query
+	CollapseThreads bool `json:"collapseThreads"` // Email/query
+}
+
+// queryResult returns a /query response for the matching ids.
+func (x *jmapReq) queryResult(args *jmapQueryArgs, ids []string) (interface{}, error) {
+	window, pos, err := jmapWindow(ids, args.Position, args.Anchor, args.AnchorOffset, args.Limit)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]interface{}{
+		"accountId":           x.accountID,
+		"queryState":          jmapState(x.acct.Username),
+		"canCalculateChanges": false,
+		"position":            pos,
+		"ids":                 append([]string{}, window...),
+	}
+	if args.CalculateTotal {
+		res["total"] = len(ids)
+	}
+	return res, nil
+}
+
+func (x *jmapReq) mailboxQuery(raw json.RawMessage) (interface{}, error) {
+	var args jmapQueryArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	boxes, err := x.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	var filter map[string]json.RawMessage
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		if err := json.Unmarshal(args.Filter, &filter); err != nil {
+			return nil, jmapErrorf("invalidArguments", "bad filter")
+		}
+	}
+	match := func(mb jmapMailbox) (bool, error) {
+		for k, v := range filter {
+			var s *string
+			var b bool
+			switch k {
+			case "parentId", "role":
+				json.Unmarshal(v, &s)
+				got := mb.parentID
+				if k == "role" {
+					got = mb.role
+				}
+				if s == nil && got != "" || s != nil && *s != got {
+					return false, nil
+				}
+			case "name":
+				json.Unmarshal(v, &s)
+				if s != nil && !strings.Contains(strings.ToLower(mb.name), strings.ToLower(*s)) {
+					return false, nil
+				}
+			case "hasAnyRole":
+				json.Unmarshal(v, &b)
+				if b != (mb.role != "") {
+					return false, nil
+				}
+			case "isSubscribed":
+				json.Unmarshal(v, &b)
+				if !b {
+					return false, nil
+				}
+			default:
+				return false, jmapErrorf("unsupportedFilter", "can't filter mailboxes on %s", k)
+			}
+		}
+		return true, nil
+	}
+	var matched []jmapMailbox
+	for _, mb := range boxes {
+		ok, err := match(mb)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, mb)
+		}
+	}
+	for _, c := range args.Sort {
+		if c.Property != "name" && c.Property != "sortOrder" {
+			return nil, jmapErrorf("unsupportedSort", "can't sort mailboxes on %s", c.Property)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		for _, c := range args.Sort {
+			if c.Property == "name" && a.name != b.name {
+				return (a.name < b.name) == c.ascending()
+			}
+			if c.Property == "sortOrder" && a.sortOrder != b.sortOrder {
+				return (a.sortOrder < b.sortOrder) == c.ascending()
+			}
+		}
+		return false
+	})
+	var ids []string
+	for _, mb := range matched {
+		ids = append(ids, mb.id)
+	}
+	return x.queryResult(&args, ids)
+}
+
+func (x *jmapReq) threadGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID  string    `json:"accountId"`
+		IDs        *[]string `json:"ids"`
+		Properties []string  `json:"properties"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	threads := make(map[string][]string)
+	var all []string
+	for i := len(x.msgs) - 1; i >= 0; i-- {
+		m := x.msgs[i]
+		if threads[m.threadID] == nil {
+			all = append(all, m.threadID)
+		}
+		threads[m.threadID] = append(threads[m.threadID], m.id)
+	}
+	ids, err := x.getIDs(args.IDs, func() []string { return all })
+	if err != nil {
+		return nil, err
+	}
+	list, notFound := []interface{}{}, []string{}
+	for _, id := range ids {
+		emails, ok := threads[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		obj, err := jmapPick(map[string]interface{}{"id": id, "emailIds": emails}, args.Properties)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return map[string]interface{}{
+		"accountId": x.accountID,
+		"state":     jmapState(x.acct.Username),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// A jmapPart is an EmailBodyPart, numbered like IMAP's sections.
+type jmapPart struct {
+	id     string // empty for multiparts
+	blobID string
+	p      *mimePart
+	sub    []*jmapPart
+}
+
+func (x *jmapReq) structure(m *jmapMsg) *jmapPart {
+	var walk func(p *mimePart, id string) *jmapPart
+	walk = func(p *mimePart, id string) *jmapPart {
+		jp := &jmapPart{p: p}
+		if len(p.parts) == 0 {
+			if id == "" {
+				id = "1"
+			}
+			jp.id = id
+			jp.blobID = "B" + m.id + "_" + strings.Replace(id, ".", "-", -1)
+			return jp
+		}
+		for i, sub := range p.parts {
+			subID := strconv.Itoa(i + 1)
+			if id != "" {
+				subID = id + "." + subID
+			}
+			jp.sub = append(jp.sub, walk(sub, subID))
+		}
+		return jp
+	}
+	return walk(x.parsed(m), "")
+}
+
+func (jp *jmapPart) mediaType() string {
+	typ, subtype, _ := jp.p.mediaType()
+	return typ + "/" + subtype
+}
+
+func (jp *jmapPart) disposition() (string, map[string]string) {
+	d, params, err := mime.ParseMediaType(jp.p.header.Get("Content-Disposition"))
+	if err != nil {
+		return "", nil
+	}
+	return d, params
+}
+
+func (jp *jmapPart) name() string {
+	_, dparams := jp.disposition()
+	if name := dparams["filename"]; name != "" {
+		return name
+	}
+	_, _, params := jp.p.mediaType()
+	return params["name"]
+}
+
+func (jp *jmapPart) content() []byte {
+	data, _ := ioutil.ReadAll(transferDecoder(jp.p.header.Get("Content-Transfer-Encoding"), strings.NewReader(jp.p.body)))
+	return data
+}
+
+// text returns the part's content as text, with LF line endings,
+// and whether it wasn't valid UTF-8.
+func (jp *jmapPart) text() (string, bool) {
+	s := strings.Replace(string(jp.content()), "\r\n", "\n", -1)
+	if utf8.ValidString(s) {
+		return s, false
+	}
+	return strings.ToValidUTF8(s, "�"), true
+}
+
+// object returns the part as an EmailBodyPart with the given
+// properties, and with tree, its subParts.
+func (jp *jmapPart) object(props []string, tree bool) map[string]interface{} {
+	typ, _, params := jp.p.mediaType()
+	disp, _ := jp.disposition()
+	all := map[string]interface{}{
+		"partId":      nil,
+		"blobId":      nil,
+		"size":        0,
+		"headers":     jmapHeaders(jp.p.rawHeader),
+		"name":        nil,
+		"type":        jp.mediaType(),
+		"charset":     nil,
+		"disposition": nil,
+		"cid":         nil,
+		"language":    nil,
+		"location":    nil,
+	}
+	if jp.id != "" {
+		all["partId"], all["blobId"], all["size"] = jp.id, jp.blobID, len(jp.content())
+	}
+	if name := jp.name(); name != "" {
+		all["name"] = name
+	}
+	if typ == "text" {
+		cs := params["charset"]
+		if cs == "" {
+			cs = "us-ascii"
+		}
+		all["charset"] = cs
+	}
+	if disp != "" {
+		all["disposition"] = disp
+	}
+	if cid := strings.Trim(jp.p.header.Get("Content-Id"), "<> "); cid != "" {
+		all["cid"] = cid
+	}
+	out := make(map[string]interface{})
+	for _, p := range props {
+		if v, ok := all[p]; ok {
+			out[p] = v
+		}
+	}
+	if tree && jp.sub != nil {
+		var subs []interface{}
+		for _, sub := range jp.sub {
+			subs = append(subs, sub.object(props, true))
+		}
+		out["subParts"] = subs
+	}
+	return out
+}
+
+var jmapBodyProperties = []string{"partId", "blobId", "size", "name", "type", "charset", "disposition", "cid", "language", "location"}
+
+// jmapBodies sorts parts into the textBody, htmlBody and attachments
+// lists, following the algorithm in RFC 8621 section 4.1.4. A nil
+// text or html means that list isn't wanted at this level.
+func jmapBodies(parts []*jmapPart, multipartType string, inAlternative bool, text, html, atts *[]*jmapPart) {
+	textLen, htmlLen := -1, -1
+	if text != nil {
+		textLen = len(*text)
+	}
+	if html != nil {
+		htmlLen = len(*html)
+	}
+	for i, p := range parts {
+		mt := p.mediaType()
+		disp, _ := p.disposition()
+		isMedia := strings.HasPrefix(mt, "image/") || strings.HasPrefix(mt, "audio/") || strings.HasPrefix(mt, "video/")
+		isInline := disp != "attachment" &&
+			(mt == "text/plain" || mt == "text/html" || isMedia) &&
+			(i == 0 || multipartType != "related" && (isMedia || p.name() == ""))
+		switch {
+		case p.sub != nil:
+			subType := strings.TrimPrefix(mt, "multipart/")
+			jmapBodies(p.sub, subType, inAlternative || subType == "alternative", text, html, atts)
+		case isInline:
+			if multipartType == "alternative" {
+				switch {
+				case mt == "text/plain" && text != nil:
+					*text = append(*text, p)
+				case mt == "text/html" && html != nil:
+					*html = append(*html, p)
+				default:
+					*atts = append(*atts, p)
+				}
+				continue
+			}
+			if inAlternative {
+				if mt == "text/plain" {
+					html = nil
+				}
+				if mt == "text/html" {
+					text = nil
+				}
+			}
+			if text != nil {
+				*text = append(*text, p)
+			}
+			if html != nil {
+				*html = append(*html, p)
+			}
+			if (text == nil || html == nil) && isMedia {
+				*atts = append(*atts, p)
+			}
+		default:
+			*atts = append(*atts, p)
+		}
+	}
+	if multipartType == "alternative" && text != nil && html != nil {
+		if textLen == len(*text) && htmlLen != len(*html) {
+			*text = append(*text, (*html)[htmlLen:]...)
+		}
+		if htmlLen == len(*html) && textLen != len(*text) {
+			*html = append(*html, (*text)[textLen:]...)
+		}
+	}
+}
+
+// bodies returns m's structure and its textBody, htmlBody and
+// attachments.
+func (x *jmapReq) bodies(m *jmapMsg) (root *jmapPart, text, html, atts []*jmapPart) {
+	root = x.structure(m)
+	text, html, atts = []*jmapPart{}, []*jmapPart{}, []*jmapPart{}
+	jmapBodies([]*jmapPart{root}, "mixed", false, &text, &html, &atts)
+	return root, text, html, atts
+}
+
+// bodyText returns the text of m's textBody parts.
+func (x *jmapReq) bodyText(m *jmapMsg) string {
+	_, text, _, _ := x.bodies(m)
+	var buf bytes.Buffer
+	for _, p := range text {
+		if strings.HasPrefix(p.mediaType(), "text/") {
+			s, _ := p.text()
+			buf.WriteString(s)
+		}
+	}
+	return buf.String()
+}
+
+// A jmapHeader is an EmailHeader, with the value raw.
+type jmapHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// jmapHeaders returns the fields of a raw header in order, with
+// their values as they appear after the colon, folding and all.
+func jmapHeaders(raw string) []jmapHeader {
+	hs := []jmapHeader{}
+	for _, line := range strings.Split(strings.TrimSuffix(raw, "\r\n\r\n"), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(hs) > 0 {
+			hs[len(hs)-1].Value += "\r\n" + line
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			hs = append(hs, jmapHeader{line[:i], line[i+1:]})
+		}
+	}
+	return hs
+}
+
+// header returns the raw values of m's header fields with the given
+// name.
+func (x *jmapReq) header(m *jmapMsg, name string) []string {
+	var vs []string
+	for _, h := range jmapHeaders(x.parsed(m).rawHeader) {
+		if strings.EqualFold(h.Name, name) {
+			vs = append(vs, h.Value)
+		}
+	}
+	return vs
+}
+
+// lastHeader returns the last value of m's named header, or "".
+func (x *jmapReq) lastHeader(m *jmapMsg, name string) (string, bool) {
+	vs := x.header(m, name)
+	if len(vs) == 0 {
+		return "", false
+	}
+	return vs[len(vs)-1], true
+}
+
+func jmapUnfold(v string) string {
+	return strings.TrimSpace(strings.Replace(strings.Replace(v, "\r\n", "", -1), "\n", "", -1))
+}
+
+func jmapText(v string) string {
+	v = jmapUnfold(v)
+	if dec, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+		return dec
+	}
+	return v
+}
+
+// A jmapAddress is an EmailAddress.
+type jmapAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+func jmapAddresses(v string) []jmapAddress {
+	list, err := (&mail.AddressParser{WordDecoder: new(mime.WordDecoder)}).ParseList(jmapUnfold(v))
+	if err != nil {
+		return nil
+	}
+	out := []jmapAddress{}
+	for _, a := range list {
+		addr := jmapAddress{Email: a.Address}
+		if a.Name != "" {
+			name := a.Name
+			addr.Name = &name
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
+var jmapMsgIDRx = regexp.MustCompile(`<([^<>\s]+)>`)
+
+func jmapMessageIDs(v string) []string {
+	var ids []string
+	for _, sm := range jmapMsgIDRx.FindAllStringSubmatch(v, -1) {
+		ids = append(ids, sm[1])
+	}
+	return ids
+}
+
+func jmapDate(v string) interface{} {
+	t, err := mail.ParseDate(jmapUnfold(v))
+	if err != nil {
+		return nil
+	}
+	return t.Format(time.RFC3339)
+}
+
+// headerProperty returns a "header:" property: the last or, with
+// ":all", every instance of a header field, in one of RFC 8621's
+// parsed forms.
+func (x *jmapReq) headerProperty(m *jmapMsg, prop string) (interface{}, error) {
+	parts := strings.Split(strings.TrimPrefix(prop, "header:"), ":")
+	all := len(parts) > 1 && parts[len(parts)-1] == "all"
+	if all {
+		parts = parts[:len(parts)-1]
+	}
+	form := "asRaw"
+	if len(parts) == 2 {
+		form = parts[1]
+	}
+	if len(parts) > 2 || parts[0] == "" {
+		return nil, jmapErrorf("invalidArguments", "bad property %q", prop)
+	}
+	var parse func(v string) interface{}
+	switch form {
+	case "asRaw":
+		parse = func(v string) interface{} { return v }
+	case "asText":
+		parse = func(v string) interface{} { return jmapText(v) }
+	case "asAddresses":
+		parse = func(v string) interface{} {
+			if as := jmapAddresses(v); as != nil {
+				return as
+			}
+			return []jmapAddress{}
+		}
+	case "asMessageIds":
+		parse = func(v string) interface{} {
+			if ids := jmapMessageIDs(v); ids != nil {
+				return ids
+			}
+			return nil
+		}
+	case "asDate":
+		parse = jmapDate
+	default:
+		return nil, jmapErrorf("invalidArguments", "unsupported header form %q", form)
+	}
+	vs := x.header(m, parts[0])
+	if all {
+		out := []interface{}{}
+		for _, v := range vs {
+			out = append(out, parse(v))
+		}
+		return out, nil
+	}
+	if len(vs) == 0 {
+		return nil, nil
+	}
+	return parse(vs[len(vs)-1]), nil
+}
+
+var jmapEmailProperties = []string{
+	"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+	"receivedAt", "messageId", "inReplyTo", "references", "sender",
+	"from", "to", "cc", "bcc", "replyTo", "subject", "sentAt",
+	"hasAttachment", "preview", "bodyValues", "textBody", "htmlBody",
+	"attachments",
+}
+
+// jmapBodyOptions are Email/get's arguments for body parts.
+type jmapBodyOptions struct {
+	BodyProperties      []string `json:"bodyProperties"`
+	FetchTextBodyValues bool     `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool     `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool     `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int      `json:"maxBodyValueBytes"`
+}
+
+// preview returns the start of m's text, with whitespace collapsed,
+// for Email's preview.
+func (x *jmapReq) preview(m *jmapMsg) string {
+	s := strings.Join(strings.Fields(x.bodyText(m)), " ")
+	if utf8.RuneCountInString(s) > 256 {
+		s = string([]rune(s)[:256])
+	}
+	return s
+}
+
+func (x *jmapReq) emailObject(m *jmapMsg, props []string, opts *jmapBodyOptions) (map[string]interface{}, error) {
+	obj := map[string]interface{}{"id": m.id}
+	bodyProps := opts.BodyProperties
+	if bodyProps == nil {
+		bodyProps = jmapBodyProperties
+	}
+	partList := func(parts []*jmapPart) []interface{} {
+		out := []interface{}{}
+		for _, p := range parts {
+			out = append(out, p.object(bodyProps, false))
+		}
+		return out
+	}
+	for _, p := range props {
+		switch p {
+		case "id":
+		case "blobId":
+			obj[p] = "B" + m.id
+		case "threadId":
+			obj[p] = m.threadID
+		case "mailboxIds":
+			obj[p] = m.mailboxIDs
+		case "keywords":
+			obj[p] = x.keywords(m)
+		case "size":
+			obj[p] = len(x.raw(m))
+		case "receivedAt":
+			obj[p] = m.received.UTC().Format(jmapUTCDate)
+		case "messageId", "inReplyTo", "references":
+			name := map[string]string{"messageId": "Message-Id", "inReplyTo": "In-Reply-To", "references": "References"}[p]
+			obj[p] = nil
+			if v, ok := x.lastHeader(m, name); ok {
+				if ids := jmapMessageIDs(v); ids != nil {
+					obj[p] = ids
+				}
+			}
+		case "sender", "from", "to", "cc", "bcc", "replyTo":
+			name := p
+			if p == "replyTo" {
+				name = "Reply-To"
+			}
+			obj[p] = nil
+			if v, ok := x.lastHeader(m, name); ok {
+				obj[p] = jmapAddresses(v)
+			}
+		case "subject":
+			obj[p] = nil
+			if v, ok := x.lastHeader(m, "Subject"); ok {
+				obj[p] = jmapText(v)
+			}
+		case "sentAt":
+			obj[p] = nil
+			if v, ok := x.lastHeader(m, "Date"); ok {
+				obj[p] = jmapDate(v)
+			}
+		case "headers":
+			obj[p] = jmapHeaders(x.parsed(m).rawHeader)
+		case "hasAttachment":
+			_, _, _, atts := x.bodies(m)
+			obj[p] = len(atts) > 0
+		case "preview":
+			obj[p] = x.preview(m)
+		case "bodyStructure":
+			obj[p] = x.structure(m).object(bodyProps, true)
+		case "textBody":
+			_, text, _, _ := x.bodies(m)
+			obj[p] = partList(text)
+		case "htmlBody":
+			_, _, html, _ := x.bodies(m)
+			obj[p] = partList(html)
+		case "attachments":
+			_, _, _, atts := x.bodies(m)
+			obj[p] = partList(atts)
+		case "bodyValues":
+			obj[p] = x.bodyValues(m, opts)
+		default:
+			if !strings.HasPrefix(p, "header:") {
+				return nil, jmapErrorf("invalidArguments", "unknown property %q", p)
+			}
+			v, err := x.headerProperty(m, p)
+			if err != nil {
+				return nil, err
+			}
+			obj[p] = v
+		}
+	}
+	return obj, nil
+}
+
+func (x *jmapReq) bodyValues(m *jmapMsg, opts *jmapBodyOptions) map[string]interface{} {
+	root, text, html, _ := x.bodies(m)
+	var parts []*jmapPart
+	if opts.FetchAllBodyValues {
+		var walk func(jp *jmapPart)
+		walk = func(jp *jmapPart) {
+			if jp.id != "" && strings.HasPrefix(jp.mediaType(), "text/") {
+				parts = append(parts, jp)
+			}
+			for _, sub := range jp.sub {
+				walk(sub)
+			}
+		}
+		walk(root)
+	}
+	if opts.FetchTextBodyValues {
+		parts = append(parts, text...)
+	}
+	if opts.FetchHTMLBodyValues {
+		parts = append(parts, html...)
+	}
+	values := make(map[string]interface{})
+	for _, p := range parts {
+		if !strings.HasPrefix(p.mediaType(), "text/") {
+			continue
+		}
+		s, problem := p.text()
+		truncated := false
+		if max := opts.MaxBodyValueBytes; max > 0 && len(s) > max {
+			for max > 0 && !utf8.RuneStart(s[max]) {
+				max--
+			}
+			s, truncated = s[:max], true
+		}
+		values[p.id] = map[string]interface{}{
+			"value":             s,
+			"isEncodingProblem": problem,
+			"isTruncated":       truncated,
+		}
+	}
+	return values
+}
+
+func (x *jmapReq) emailGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID  string    `json:"accountId"`
+		IDs        *[]string `json:"ids"`
+		Properties []string  `json:"properties"`
+		jmapBodyOptions
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	ids, err := x.getIDs(args.IDs, func() []string {
+		var all []string
+		for _, m := range x.msgs {
+			all = append(all, m.id)
+		}
+		return all
+	})
+	if err != nil {
+		return nil, err
+	}
+	props := args.Properties
+	if props == nil {
+		props = jmapEmailProperties
+	}
+	list, notFound := []interface{}{}, []string{}
+	for _, id := range ids {
+		m, ok := x.byID[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		obj, err := x.emailObject(m, props, &args.jmapBodyOptions)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return map[string]interface{}{
+		"accountId": x.accountID,
+		"state":     jmapState(x.acct.Username),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// emailChanges reports the changes to stored DMs from the events
+// kept since sinceState. Drafts only live in memory and aren't
+// included.
+func (x *jmapReq) emailChanges(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID  string `json:"accountId"`
+		SinceState string `json:"sinceState"`
+		MaxChanges *int   `json:"maxChanges"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	since, ok := parseJMAPState(args.SinceState)
+	if !ok || !events.Kept(x.acct.Username, since) {
+		return nil, jmapErrorf("cannotCalculateChanges", "too long ago; fetch everything again")
+	}
+	max := -1
+	if args.MaxChanges != nil {
+		if *args.MaxChanges <= 0 {
+			return nil, jmapErrorf("invalidArguments", "maxChanges must be positive")
+		}
+		max = *args.MaxChanges
+	}
+	status := make(map[string]string) // Id -> "created", "updated", "destroyed" or "gone"
+	var order []string
+	newState, more := since, false
+	for _, ev := range events.Since(x.acct.Username, since) {
+		id := jmapEmailID(ev.ID)
+		if _, ok := status[id]; !ok {
+			if len(order) == max {
+				more = true
+				break
+			}
+			order = append(order, id)
+		}
+		switch ev.Type {
+		case "new":
+			if ev.DM != nil && x.acct.HideSent && ev.DM.Sent(x.acct) {
+				status[id] = "gone"
+			} else {
+				status[id] = "created"
+			}
+		case "flags":
+			if status[id] == "" {
+				status[id] = "updated"
+			}
+		case "delete":
+			if status[id] == "created" || status[id] == "gone" {
+				status[id] = "gone"
+			} else {
+				status[id] = "destroyed"
+			}
+		}
+		newState = ev.Seq
+	}
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, id := range order {
+		switch status[id] {
+		case "created":
+			created = append(created, id)
+		case "updated":
+			updated = append(updated, id)
+		case "destroyed":
+			destroyed = append(destroyed, id)
+		}
+	}
+	return map[string]interface{}{
+		"accountId":      x.accountID,
+		"oldState":       args.SinceState,
+		"newState":       jmapBoot + "-" + strconv.FormatInt(newState, 10),
+		"hasMoreChanges": more,
+		"created":        created,
+		"updated":        updated,
+		"destroyed":      destroyed,
+	}, nil
+}
+
+// emailFilter returns the test for an Email/query FilterOperator or
+// FilterCondition.
+func (x *jmapReq) emailFilter(raw json.RawMessage) (func(m *jmapMsg) bool, error) {
+	var f map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &f); err != nil {
+		return nil, jmapErrorf("invalidArguments", "bad filter")
+	}
+	if _, ok := f["operator"]; ok {
+		var op struct {
+			Operator   string            `json:"operator"`
+			Conditions []json.RawMessage `json:"conditions"`
+		}
+		if err := json.Unmarshal(raw, &op); err != nil {
+			return nil, jmapErrorf("invalidArguments", "bad filter")
+		}
+		var conds []func(m *jmapMsg) bool
+		for _, c := range op.Conditions {
+			t, err := x.emailFilter(c)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, t)
+		}
+		switch op.Operator {
+		case "AND", "OR", "NOT":
+		default:
+			return nil, jmapErrorf("unsupportedFilter", "unknown operator %q", op.Operator)
+		}
+		return func(m *jmapMsg) bool {
+			for _, t := range conds {
+				switch ok := t(m); {
+				case op.Operator == "AND" && !ok:
+					return false
+				case op.Operator == "OR" && ok:
+					return true
+				case op.Operator == "NOT" && ok:
+					return false
+				}
+			}
+			return op.Operator != "OR"
+		}, nil
+	}
+
+	contains := func(s, sub string) bool {
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+	headerHas := func(m *jmapMsg, name, sub string) bool {
+		for _, v := range x.header(m, name) {
+			if contains(jmapText(v), sub) {
+				return true
+			}
+		}
+		return false
+	}
+	var tests []func(m *jmapMsg) bool
+	for k, v := range f {
+		var s string
+		var ss []string
+		var n int
+		var b bool
+		var err error
+		switch k {
+		case "inMailbox", "hasKeyword", "notKeyword", "text", "from", "to", "cc", "bcc", "subject", "body", "before", "after":
+			err = json.Unmarshal(v, &s)
+		case "inMailboxOtherThan", "header":
+			err = json.Unmarshal(v, &ss)
+		case "minSize", "maxSize":
+			err = json.Unmarshal(v, &n)
+		case "hasAttachment":
+			err = json.Unmarshal(v, &b)
+		default:
+			return nil, jmapErrorf("unsupportedFilter", "can't filter emails on %s", k)
+		}
+		if err != nil {
+			return nil, jmapErrorf("invalidArguments", "bad %s in filter", k)
+		}
+		var t time.Time
+		if k == "before" || k == "after" {
+			if t, err = time.Parse(time.RFC3339, s); err != nil {
+				return nil, jmapErrorf("invalidArguments", "bad %s in filter", k)
+			}
+		}
+		k := k
+		switch k {
+		case "inMailbox":
+			tests = append(tests, func(m *jmapMsg) bool { return m.mailboxIDs[s] })
+		case "inMailboxOtherThan":
+			tests = append(tests, func(m *jmapMsg) bool {
+				for mb := range m.mailboxIDs {
+					other := true
+					for _, not := range ss {
+						if mb == not {
+							other = false
+						}
+					}
+					if other {
+						return true
+					}
+				}
+				return false
+			})
+		case "before":
+			tests = append(tests, func(m *jmapMsg) bool { return m.received.Before(t) })
+		case "after":
+			tests = append(tests, func(m *jmapMsg) bool { return !m.received.Before(t) })
+		case "minSize":
+			tests = append(tests, func(m *jmapMsg) bool { return len(x.raw(m)) >= n })
+		case "maxSize":
+			tests = append(tests, func(m *jmapMsg) bool { return len(x.raw(m)) < n })
+		case "hasKeyword":
+			tests = append(tests, func(m *jmapMsg) bool { return x.keywords(m)[strings.ToLower(s)] })
+		case "notKeyword":
+			tests = append(tests, func(m *jmapMsg) bool { return !x.keywords(m)[strings.ToLower(s)] })
+		case "hasAttachment":
+			tests = append(tests, func(m *jmapMsg) bool {
+				_, _, _, atts := x.bodies(m)
+				return (len(atts) > 0) == b
+			})
+		case "from", "to", "cc", "bcc", "subject":
+			name := k
+			tests = append(tests, func(m *jmapMsg) bool { return headerHas(m, name, s) })
+		case "body":
+			tests = append(tests, func(m *jmapMsg) bool { return contains(x.bodyText(m), s) })
+		case "text":
+			tests = append(tests, func(m *jmapMsg) bool {
+				for _, name := range []string{"From", "To", "Cc", "Bcc", "Subject"} {
+					if headerHas(m, name, s) {
+						return true
+					}
+				}
+				return contains(x.bodyText(m), s)
+			})
+		case "header":
+			if len(ss) < 1 || len(ss) > 2 {
+				return nil, jmapErrorf("invalidArguments", "header filter needs a name and optional value")
+			}
+			tests = append(tests, func(m *jmapMsg) bool {
+				if len(ss) == 1 {
+					return len(x.header(m, ss[0])) > 0
+				}
+				return headerHas(m, ss[0], ss[1])
+			})
+		}
+	}
+	return func(m *jmapMsg) bool {
+		for _, t := range tests {
+			if !t(m) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// sentAt returns the time in m's Date header, or when it was
+// received.
+func (x *jmapReq) sentAt(m *jmapMsg) time.Time {
+	if v, ok := x.lastHeader(m, "Date"); ok {
+		if t, err := mail.ParseDate(jmapUnfold(v)); err == nil {
+			return t
+		}
+	}
+	return m.received
+}
+
+func (x *jmapReq) emailQuery(raw json.RawMessage) (interface{}, error) {
+	var args jmapQueryArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	match := func(m *jmapMsg) bool { return true }
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		var err error
+		if match, err = x.emailFilter(args.Filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range args.Sort {
+		switch c.Property {
+		case "receivedAt", "sentAt", "size", "subject":
+		default:
+			return nil, jmapErrorf("unsupportedSort", "can't sort emails on %s", c.Property)
+		}
+	}
+	sorts := args.Sort
+	if len(sorts) == 0 {
+		no := false
+		sorts = []jmapComparator{{Property: "receivedAt", IsAscending: &no}}
+	}
+	var msgs []*jmapMsg
+	for _, m := range x.msgs {
+		if match(m) {
+			msgs = append(msgs, m)
+		}
+	}
+	less := func(a, b *jmapMsg, c jmapComparator) (bool, bool) {
+		switch c.Property {
+		case "receivedAt":
+			if !a.received.Equal(b.received) {
+				return a.received.Before(b.received) == c.ascending(), true
+			}
+		case "sentAt":
+			if ta, tb := x.sentAt(a), x.sentAt(b); !ta.Equal(tb) {
+				return ta.Before(tb) == c.ascending(), true
+			}
+		case "size":
+			if na, nb := len(x.raw(a)), len(x.raw(b)); na != nb {
+				return (na < nb) == c.ascending(), true
+			}
+		case "subject":
+			sa, _ := x.lastHeader(a, "Subject")
+			sb, _ := x.lastHeader(b, "Subject")
+			if sa, sb = strings.ToLower(jmapText(sa)), strings.ToLower(jmapText(sb)); sa != sb {
+				return (sa < sb) == c.ascending(), true
+			}
+		}
+		return false, false
+	}
+	sort.SliceStable(msgs, func(i, j int) bool {
+		for _, c := range sorts {
+			if l, decided := less(msgs[i], msgs[j], c); decided {
+				return l
+			}
+		}
+		return false
+	})
+	var ids []string
+	threads := make(map[string]bool)
+	for _, m := range msgs {
+		if args.CollapseThreads {
+			if threads[m.threadID] {
+				continue
+			}
+			threads[m.threadID] = true
+		}
+		ids = append(ids, m.id)
+	}
+	return x.queryResult(&args, ids)
+}
+
+func (x *jmapReq) emailQueryChanges(raw json.RawMessage) (interface{}, error) {
+	return nil, jmapErrorf("cannotCalculateChanges", "query changes aren't kept; query again")
+}
+
+// blob returns the contents and type of a blob: an upload, a whole
+// Email, or one of an Email's parts.
+func (x *jmapReq) blob(id string) ([]byte, string, bool) {
+	if b, ok := x.ja.blob(id); ok {
+		return b.data, b.typ, true
+	}
+	if !strings.HasPrefix(id, "B") || x.load() != nil {
+		return nil, "", false
+	}
+	emailID, part := id[1:], ""
+	if i := strings.IndexByte(emailID, '_'); i >= 0 {
+		emailID, part = emailID[:i], strings.Replace(emailID[i+1:], "-", ".", -1)
+	}
+	m, ok := x.byID[emailID]
+	if !ok {
+		return nil, "", false
+	}
+	if part == "" {
+		return []byte(x.raw(m)), "message/rfc822", true
+	}
+	var find func(jp *jmapPart) *jmapPart
+	find = func(jp *jmapPart) *jmapPart {
+		if jp.id == part {
+			return jp
+		}
+		for _, sub := range jp.sub {
+			if found := find(sub); found != nil {
+				return found
+			}
+		}
+		return nil
+	}
+	jp := find(x.structure(m))
+	if jp == nil {
+		return nil, "", false
+	}
+	return jp.content(), jp.mediaType(), true
+}
+
+// addDraft keeps a new draft message.
+func (x *jmapReq) addDraft(raw string, keywords map[string]bool, created time.Time) (*jmapMsg, error) {
+	x.ja.mu.Lock()
+	if len(x.ja.drafts) >= jmapMaxDrafts {
+		x.ja.mu.Unlock()
+		return nil, jmapErrorf("overQuota", "too many drafts; send or destroy some")
+	}
+	d := &jmapDraft{id: x.ja.newID("d"), raw: raw, keywords: keywords, created: created}
+	x.ja.drafts[d.id] = d
+	x.ja.mu.Unlock()
+	x.invalidate()
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	return x.byID[d.id], nil
+}
+
+// A jmapBodyPartIn is an EmailBodyPart in an Email/set create.
+type jmapBodyPartIn struct {
+	PartID string `json:"partId"`
+	BlobID string `json:"blobId"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+}
+
+// createDraft makes a draft from an Email/set create. It's rendered
+// as the mail message a mail client would have sent over SMTP, so
+// sending it takes the same path.
+func (x *jmapReq) createDraft(raw json.RawMessage) (*jmapMsg, error) {
+	var e struct {
+		MailboxIDs map[string]bool `json:"mailboxIds"`
+		Keywords   map[string]bool `json:"keywords"`
+		To         []jmapAddress   `json:"to"`
+		Cc         []jmapAddress   `json:"cc"`
+		Subject    string          `json:"subject"`
+		InReplyTo  []string        `json:"inReplyTo"`
+		References []string        `json:"references"`
+		BodyValues map[string]struct {
+			Value string `json:"value"`
+		} `json:"bodyValues"`
+		TextBody      []jmapBodyPartIn `json:"textBody"`
+		HTMLBody      []jmapBodyPartIn `json:"htmlBody"`
+		Attachments   []jmapBodyPartIn `json:"attachments"`
+		BodyStructure json.RawMessage  `json:"bodyStructure"`
+	}
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, jmapInvalid(err.Error())
+	}
+	if len(e.MailboxIDs) != 1 || !e.MailboxIDs[jmapDrafts] {
+		return nil, jmapInvalid("new emails can only go in Drafts", "mailboxIds")
+	}
+	if e.BodyStructure != nil {
+		return nil, jmapInvalid("give textBody and attachments instead", "bodyStructure")
+	}
+	kw, err := jmapKeywordSet(e.Keywords)
+	if err != nil {
+		return nil, err
+	}
+	var text string
+	switch {
+	case len(e.TextBody) == 1:
+		v, ok := e.BodyValues[e.TextBody[0].PartID]
+		if !ok || e.TextBody[0].Type != "" && e.TextBody[0].Type != "text/plain" {
+			return nil, jmapInvalid("textBody must be one text/plain part in bodyValues", "textBody")
+		}
+		text = v.Value
+	case len(e.TextBody) > 1:
+		return nil, jmapInvalid("textBody must be one text/plain part in bodyValues", "textBody")
+	case len(e.HTMLBody) > 0:
+		return nil, jmapInvalid("DMs are plain text; give a textBody", "htmlBody")
+	}
+	var files []attachment
+	size := len(text)
+	for _, a := range e.Attachments {
+		data, typ, ok := x.blob(x.ref(a.BlobID))
+		if !ok {
+			return nil, &jmapError{Type: "blobNotFound", Description: "no blob " + a.BlobID, NotFound: []string{a.BlobID}}
+		}
+		if a.Type != "" {
+			typ = a.Type
+		}
+		name := a.Name
+		if name == "" {
+			name = "attachment"
+		}
+		files = append(files, attachment{Filename: name, ContentType: typ, Data: data})
+		size += len(data)
+	}
+	if size > *smtpMaxBytes {
+		return nil, jmapErrorf("tooLarge", "larger than %d bytes", *smtpMaxBytes)
+	}
+
+	now := time.Now()
+	boundary := fmt.Sprintf("=_mix_%d", now.UnixNano())
+	var buf bytes.Buffer
+	writeHeader(&buf, "From", formatAddress("", x.acct.Username+"@eight22er.danga.com"))
+	for _, h := range []struct {
+		name  string
+		addrs []jmapAddress
+	}{{"To", e.To}, {"Cc", e.Cc}} {
+		if len(h.addrs) == 0 {
+			continue
+		}
+		var v []string
+		for _, a := range h.addrs {
+			name := ""
+			if a.Name != nil {
+				name = *a.Name
+			}
+			v = append(v, formatAddress(name, a.Email))
+		}
+		writeHeader(&buf, h.name, strings.Join(v, ", "))
+	}
+	if e.Subject != "" {
+		writeHeader(&buf, "Subject", encodeWord(e.Subject))
+	}
+	writeHeader(&buf, "Date", now.In(x.acct.Location()).Format(time.RFC1123Z))
+	if len(e.InReplyTo) > 0 {
+		writeHeader(&buf, "In-Reply-To", "<"+strings.Join(e.InReplyTo, "> <")+">")
+	}
+	if len(e.References) > 0 {
+		writeHeader(&buf, "References", "<"+strings.Join(e.References, "> <")+">")
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
+	if len(files) == 0 {
+		writeTextPart(&buf, "plain", text)
+	} else {
+		writeHeader(&buf, "Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", boundary))
+		fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+		writeTextPart(&buf, "plain", text)
+		io.WriteString(&buf, "\r\n")
+		for _, f := range files {
+			fmt.Fprintf(&buf, "--%s\r\n", boundary)
+			writeAttachment(&buf, f)
+		}
+		fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	}
+	return x.addDraft(buf.String(), kw, now)
+}
+
+// updateEmail applies an Email/set update's patch. Only keywords can
+// change: a DM's mailboxes follow from its conversation.
+func (x *jmapReq) updateEmail(id string, patch map[string]json.RawMessage) error {
+	m, ok := x.byID[id]
+	if !ok {
+		return jmapErrorf("notFound", "no such email")
+	}
+	kw := x.keywords(m)
+	for path, v := range patch {
+		switch {
+		case path == "keywords":
+			var set map[string]bool
+			if err := json.Unmarshal(v, &set); err != nil {
+				return jmapInvalid("keywords must be an object", path)
+			}
+			var err error
+			if kw, err = jmapKeywordSet(set); err != nil {
+				return err
+			}
+		case strings.HasPrefix(path, "keywords/"):
+			k := strings.ToLower(strings.Replace(strings.Replace(path[len("keywords/"):], "~1", "/", -1), "~0", "~", -1))
+			switch string(v) {
+			case "true":
+				if !validKeyword(k) {
+					return jmapInvalid(fmt.Sprintf("bad keyword %q", k), path)
+				}
+				kw[k] = true
+			case "null":
+				delete(kw, k)
+			default:
+				return jmapErrorf("invalidPatch", "%s must be true or null", path)
+			}
+		case path == "mailboxIds":
+			var set map[string]bool
+			if err := json.Unmarshal(v, &set); err != nil || len(set) != len(m.mailboxIDs) {
+				return jmapInvalid("emails can't be moved", path)
+			}
+			for mb := range set {
+				if !m.mailboxIDs[mb] {
+					return jmapInvalid("emails can't be moved", path)
+				}
+			}
+		case strings.HasPrefix(path, "mailboxIds/"):
+			if m.mailboxIDs[path[len("mailboxIds/"):]] != (string(v) == "true") {
+				return jmapInvalid("emails can't be moved", path)
+			}
+		default:
+			return jmapInvalid("can't change "+path, path)
+		}
+	}
+	return x.setKeywords(m, kw)
+}
+
+// destroyEmail drops a draft, or like IMAP's EXPUNGE, tombstones a
+// DM in the store, leaving it on the backend.
+func (x *jmapReq) destroyEmail(id string) error {
+	m, ok := x.byID[id]
+	if !ok {
+		return jmapErrorf("notFound", "no such email")
+	}
+	if m.draft != nil {
+		x.ja.mu.Lock()
+		delete(x.ja.drafts, m.id)
+		x.ja.mu.Unlock()
+		return nil
+	}
+	return x.store.Delete(m.dm.ID)
+}
+
+// jmapSetError returns err as a SetError.
+func (x *jmapReq) setError(err error) *jmapError {
+	if e, ok := err.(*jmapError); ok {
+		return e
+	}
+	log.Printf("JMAP: for %q: %v", x.acct.Username, err)
+	return jmapErrorf("serverFail", "%s", oneLine(err.Error()))
+}
+
+// setEmails does an Email/set, or the implicit one after an
+// EmailSubmission/set.
+func (x *jmapReq) setEmails(ifInState *string, create map[string]json.RawMessage, update map[string]map[string]json.RawMessage, destroy []string) (interface{}, error) {
+	oldState := jmapState(x.acct.Username)
+	if ifInState != nil && *ifInState != oldState {
+		return nil, jmapErrorf("stateMismatch", "state is %s", oldState)
+	}
+	if len(create)+len(update)+len(destroy) > jmapMaxObjects {
+		return nil, jmapErrorf("requestTooLarge", "more than %d objects", jmapMaxObjects)
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	var created, updated, notCreated, notUpdated, notDestroyed map[string]interface{}
+	var destroyed []string
+	add := func(m *map[string]interface{}, k string, v interface{}) {
+		if *m == nil {
+			*m = make(map[string]interface{})
+		}
+		(*m)[k] = v
+	}
+	for cid, raw := range create {
+		m, err := x.createDraft(raw)
+		if err != nil {
+			add(&notCreated, cid, x.setError(err))
+			continue
+		}
+		x.created[cid] = m.id
+		add(&created, cid, map[string]interface{}{
+			"id":       m.id,
+			"blobId":   "B" + m.id,
+			"threadId": m.threadID,
+			"size":     len(m.raw),
+		})
+	}
+	for id, patch := range update {
+		if err := x.updateEmail(x.ref(id), patch); err != nil {
+			add(&notUpdated, id, x.setError(err))
+			continue
+		}
+		add(&updated, x.ref(id), nil)
+	}
+	for _, id := range destroy {
+		if err := x.destroyEmail(x.ref(id)); err != nil {
+			add(&notDestroyed, id, x.setError(err))
+			continue
+		}
+		destroyed = append(destroyed, x.ref(id))
+	}
+	x.invalidate()
+	return map[string]interface{}{
+		"accountId":    x.accountID,
+		"oldState":     oldState,
+		"newState":     jmapState(x.acct.Username),
+		"created":      created,
+		"updated":      updated,
+		"destroyed":    destroyed,
+		"notCreated":   notCreated,
+		"notUpdated":   notUpdated,
+		"notDestroyed": notDestroyed,
+	}, nil
+}
+
+func (x *jmapReq) emailSet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID string                                `json:"accountId"`
+		IfInState *string                               `json:"ifInState"`
+		Create    map[string]json.RawMessage            `json:"create"`
+		Update    map[string]map[string]json.RawMessage `json:"update"`
+		Destroy   []string                              `json:"destroy"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	return x.setEmails(args.IfInState, args.Create, args.Update, args.Destroy)
+}
+
+// emailImport makes drafts of uploaded messages.
+func (x *jmapReq) emailImport(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID string  `json:"accountId"`
+		IfInState *string `json:"ifInState"`
+		Emails    map[string]struct {
+			BlobID     string          `json:"blobId"`
+			MailboxIDs map[string]bool `json:"mailboxIds"`
+			Keywords   map[string]bool `json:"keywords"`
+			ReceivedAt *time.Time      `json:"receivedAt"`
+		} `json:"emails"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	oldState := jmapState(x.acct.Username)
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, jmapErrorf("stateMismatch", "state is %s", oldState)
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	var created, notCreated map[string]interface{}
+	for cid, e := range args.Emails {
+		m, err := func() (*jmapMsg, error) {
+			if len(e.MailboxIDs) != 1 || !e.MailboxIDs[jmapDrafts] {
+				return nil, jmapInvalid("emails can only be imported into Drafts", "mailboxIds")
+			}
+			kw, err := jmapKeywordSet(e.Keywords)
+			if err != nil {
+				return nil, err
+			}
+			data, _, ok := x.blob(x.ref(e.BlobID))
+			if !ok {
+				return nil, &jmapError{Type: "blobNotFound", Description: "no blob " + e.BlobID, NotFound: []string{e.BlobID}}
+			}
+			if len(data) > *smtpMaxBytes {
+				return nil, jmapErrorf("tooLarge", "larger than %d bytes", *smtpMaxBytes)
+			}
+			if _, err := mail.ReadMessage(bytes.NewReader(data)); err != nil {
+				return nil, jmapErrorf("invalidEmail", "%v", err)
+			}
+			received := time.Now()
+			if e.ReceivedAt != nil {
+				received = *e.ReceivedAt
+			}
+			return x.addDraft(crlf(string(data)), kw, received)
+		}()
+		if err != nil {
+			if notCreated == nil {
+				notCreated = make(map[string]interface{})
+			}
+			notCreated[cid] = x.setError(err)
+			continue
+		}
+		x.created[cid] = m.id
+		if created == nil {
+			created = make(map[string]interface{})
+		}
+		created[cid] = map[string]interface{}{
+			"id":       m.id,
+			"blobId":   "B" + m.id,
+			"threadId": m.threadID,
+			"size":     len(m.raw),
+		}
+	}
+	return map[string]interface{}{
+		"accountId":  x.accountID,
+		"oldState":   oldState,
+		"newState":   jmapState(x.acct.Username),
+		"created":    created,
+		"notCreated": notCreated,
+	}, nil
+}
+
+func (x *jmapReq) identityGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID  string    `json:"accountId"`
+		IDs        *[]string `json:"ids"`
+		Properties []string  `json:"properties"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	ids, err := x.getIDs(args.IDs, func() []string { return []string{jmapIdentity} })
+	if err != nil {
+		return nil, err
+	}
+	list, notFound := []interface{}{}, []string{}
+	for _, id := range ids {
+		if id != jmapIdentity {
+			notFound = append(notFound, id)
+			continue
+		}
+		obj, err := jmapPick(map[string]interface{}{
+			"id":            jmapIdentity,
+			"name":          x.acct.Username,
+			"email":         x.acct.Username + "@eight22er.danga.com",
+			"replyTo":       nil,
+			"bcc":           nil,
+			"textSignature": "",
+			"htmlSignature": "",
+			"mayDelete":     false,
+		}, args.Properties)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, obj)
+	}
+	return map[string]interface{}{
+		"accountId": x.accountID,
+		"state":     jmapBoot,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// A jmapEmailSubmission is an EmailSubmission. DMs are sent at once, so
+// they're always final.
+type jmapEmailSubmission struct {
+	ID             string                  `json:"id"`
+	IdentityID     string                  `json:"identityId"`
+	EmailID        string                  `json:"emailId"`
+	ThreadID       string                  `json:"threadId"`
+	Envelope       *jmapEnvelope           `json:"envelope"`
+	SendAt         string                  `json:"sendAt"`
+	UndoStatus     string                  `json:"undoStatus"`
+	DeliveryStatus map[string]jmapDelivery `json:"deliveryStatus"`
+	DSNBlobIDs     []string                `json:"dsnBlobIds"`
+	MDNBlobIDs     []string                `json:"mdnBlobIds"`
+}
+
+type jmapEnvelope struct {
+	MailFrom jmapEnvelopeAddress   `json:"mailFrom"`
+	RcptTo   []jmapEnvelopeAddress `json:"rcptTo"`
+}
+
+type jmapEnvelopeAddress struct {
+	Email      string                 `json:"email"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
+type jmapDelivery struct {
+	SMTPReply string `json:"smtpReply"`
+	Delivered string `json:"delivered"`
+	Displayed string `json:"displayed"`
+}
+
+// submissionState is the state of the account's EmailSubmissions,
+// which only change when this process makes or drops one.
+func (x *jmapReq) submissionState() string {
+	x.ja.mu.Lock()
+	defer x.ja.mu.Unlock()
+	return jmapBoot + "-" + strconv.Itoa(x.ja.next)
+}
+
+func (x *jmapReq) submissionGet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID  string    `json:"accountId"`
+		IDs        *[]string `json:"ids"`
+		Properties []string  `json:"properties"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	x.ja.mu.Lock()
+	subs := append([]*jmapEmailSubmission(nil), x.ja.submissions...)
+	x.ja.mu.Unlock()
+	byID := make(map[string]*jmapEmailSubmission)
+	for _, s := range subs {
+		byID[s.ID] = s
+	}
+	ids, err := x.getIDs(args.IDs, func() []string {
+		var all []string
+		for _, s := range subs {
+			all = append(all, s.ID)
+		}
+		return all
+	})
+	if err != nil {
+		return nil, err
+	}
+	list, notFound := []interface{}{}, []string{}
+	for _, id := range ids {
+		s, ok := byID[id]
+		if !ok {
+			notFound = append(notFound, id)
+			continue
+		}
+		var obj map[string]interface{}
+		b, _ := json.Marshal(s)
+		json.Unmarshal(b, &obj)
+		picked, err := jmapPick(obj, args.Properties)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, picked)
+	}
+	return map[string]interface{}{
+		"accountId": x.accountID,
+		"state":     x.submissionState(),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// submit sends an Email as DMs to its recipients, the way SMTP would
+// have: the same parsing, recipient lookup and sendDMs.
+func (x *jmapReq) submit(raw json.RawMessage) (*jmapEmailSubmission, error) {
+	var s struct {
+		IdentityID string        `json:"identityId"`
+		EmailID    string        `json:"emailId"`
+		Envelope   *jmapEnvelope `json:"envelope"`
+	}
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, jmapInvalid(err.Error())
+	}
+	if s.IdentityID != jmapIdentity {
+		return nil, jmapInvalid("no such identity", "identityId")
+	}
+	if err := x.load(); err != nil {
+		return nil, err
+	}
+	m, ok := x.byID[x.ref(s.EmailID)]
+	if !ok {
+		return nil, jmapInvalid("no such email", "emailId")
+	}
+	msg := x.raw(m)
+	if len(msg) > *smtpMaxBytes {
+		return nil, jmapErrorf("tooLarge", "larger than %d bytes", *smtpMaxBytes)
+	}
+	from := x.acct.Username + "@eight22er.danga.com"
+	env := s.Envelope
+	if env == nil {
+		env = &jmapEnvelope{MailFrom: jmapEnvelopeAddress{Email: from}}
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			for _, v := range x.header(m, name) {
+				for _, a := range jmapAddresses(v) {
+					env.RcptTo = append(env.RcptTo, jmapEnvelopeAddress{Email: a.Email})
+				}
+			}
+		}
+	}
+	if !strings.EqualFold(env.MailFrom.Email, from) {
+		return nil, jmapErrorf("forbiddenMailFrom", "mail can only be sent from %s", from)
+	}
+	if len(env.RcptTo) == 0 {
+		return nil, jmapErrorf("noRecipients", "no recipients")
+	}
+	// As for SMTP, only a revoked or suspended account is refused
+	// here; other sync errors are left for Send to hit or not.
+	switch err := syncer.Err(x.acct.Username); err.(type) {
+	case *RevokedError, *SuspendedError:
+		typ, desc := jmapSendError(err)
+		return nil, jmapErrorf(typ, "%s", desc)
+	}
+
+	b := backendFor(x.acct)
+	var to []User
+	var bad []string
+	for _, rcpt := range env.RcptTo {
+		v := strings.SplitN(rcpt.Email, "@", 2)
+		if len(v) != 2 || !strings.EqualFold(v[1], "eight22er.danga.com") {
+			bad = append(bad, rcpt.Email)
+			continue
+		}
+		u, err := b.ResolveUser(x.acct, v[0])
+		switch {
+		case err == nil:
+			to = append(to, u)
+		case isNoSuchUser(err):
+			bad = append(bad, rcpt.Email)
+		default:
+			if _, ok := err.(*RejectedError); ok {
+				bad = append(bad, rcpt.Email)
+				continue
+			}
+			typ, desc := jmapSendError(err)
+			return nil, jmapErrorf(typ, "%s", desc)
+		}
+	}
+	if len(bad) > 0 {
+		return nil, &jmapError{Type: "invalidRecipients", Description: "mail can only be sent to people on " + b.Name() + " at @eight22er.danga.com", InvalidRecipients: bad}
+	}
+	text, inReplyTo, files, err := parseOutgoing([]byte(msg))
+	if err != nil {
+		return nil, jmapErrorf("invalidEmail", "can't parse message: %v", err)
+	}
+	if text == "" && len(files) == 0 {
+		return nil, jmapErrorf("invalidEmail", "message has no text/plain part to send")
+	}
+	if _, err := sendDMs("jmap", x.acct, &Outgoing{To: to, InReplyTo: inReplyTo, Text: text}, files); err != nil {
+		typ, desc := jmapSendError(err)
+		return nil, jmapErrorf(typ, "%s", desc)
+	}
+	x.invalidate()
+
+	sub := &jmapEmailSubmission{
+		IdentityID:     jmapIdentity,
+		EmailID:        m.id,
+		ThreadID:       m.threadID,
+		Envelope:       env,
+		SendAt:         time.Now().UTC().Format(jmapUTCDate),
+		UndoStatus:     "final",
+		DeliveryStatus: make(map[string]jmapDelivery),
+		DSNBlobIDs:     []string{},
+		MDNBlobIDs:     []string{},
+	}
+	for _, rcpt := range env.RcptTo {
+		sub.DeliveryStatus[rcpt.Email] = jmapDelivery{SMTPReply: "250 2.0.0 Sent as a DM", Delivered: "yes", Displayed: "unknown"}
+	}
+	x.ja.mu.Lock()
+	sub.ID = x.ja.newID("s")
+	x.ja.submissions = append(x.ja.submissions, sub)
+	if len(x.ja.submissions) > jmapMaxSubmissions {
+		x.ja.submissions = x.ja.submissions[len(x.ja.submissions)-jmapMaxSubmissions:]
+	}
+	x.ja.mu.Unlock()
+	return sub, nil
+}
+
+func (x *jmapReq) submissionSet(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID             string                                `json:"accountId"`
+		IfInState             *string                               `json:"ifInState"`
+		Create                map[string]json.RawMessage            `json:"create"`
+		Update                map[string]json.RawMessage            `json:"update"`
+		Destroy               []string                              `json:"destroy"`
+		OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+		OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+	}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	oldState := x.submissionState()
+	if args.IfInState != nil && *args.IfInState != oldState {
+		return nil, jmapErrorf("stateMismatch", "state is %s", oldState)
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjects {
+		return nil, jmapErrorf("requestTooLarge", "more than %d objects", jmapMaxObjects)
+	}
+	var created, updated, notCreated, notUpdated, notDestroyed map[string]interface{}
+	var destroyed []string
+	add := func(m *map[string]interface{}, k string, v interface{}) {
+		if *m == nil {
+			*m = make(map[string]interface{})
+		}
+		(*m)[k] = v
+	}
+	emails := make(map[string]string) // submission Id -> Email Id, for the onSuccess arguments
+	for cid, raw := range args.Create {
+		s, err := x.submit(raw)
+		if err != nil {
+			add(&notCreated, cid, x.setError(err))
+			continue
+		}
+		x.created[cid] = s.ID
+		emails[s.ID] = s.EmailID
+		add(&created, cid, map[string]interface{}{"id": s.ID, "sendAt": s.SendAt, "undoStatus": s.UndoStatus})
+	}
+
+	x.ja.mu.Lock()
+	find := func(id string) int {
+		for i, s := range x.ja.submissions {
+			if s.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	for id := range args.Update {
+		if find(x.ref(id)) < 0 {
+			add(&notUpdated, id, jmapErrorf("notFound", "no such submission"))
+		} else {
+			add(&notUpdated, id, jmapErrorf("cannotUnsend", "DMs are sent at once and can't be changed"))
+		}
+	}
+	for _, id := range args.Destroy {
+		i := find(x.ref(id))
+		if i < 0 {
+			add(&notDestroyed, id, jmapErrorf("notFound", "no such submission"))
+			continue
+		}
+		emails[x.ref(id)] = x.ja.submissions[i].EmailID
+		x.ja.submissions = append(x.ja.submissions[:i], x.ja.submissions[i+1:]...)
+		destroyed = append(destroyed, x.ref(id))
+	}
+	x.ja.mu.Unlock()
+
+	res := map[string]interface{}{
+		"accountId":    x.accountID,
+		"oldState":     oldState,
+		"newState":     x.submissionState(),
+		"created":      created,
+		"updated":      updated,
+		"destroyed":    destroyed,
+		"notCreated":   notCreated,
+		"notUpdated":   notUpdated,
+		"notDestroyed": notDestroyed,
+	}
+	update := make(map[string]map[string]json.RawMessage)
+	for id, patch := range args.OnSuccessUpdateEmail {
+		if email, ok := emails[x.ref(id)]; ok {
+			update[email] = patch
+		}
+	}
+	var destroy []string
+	for _, id := range args.OnSuccessDestroyEmail {
+		if email, ok := emails[x.ref(id)]; ok {
+			destroy = append(destroy, email)
+		}
+	}
+	if len(update) > 0 || len(destroy) > 0 {
+		emailRes, err := x.setEmails(nil, nil, update, destroy)
+		if err != nil {
+			return nil, err
+		}
+		x.also("Email/set", emailRes)
+	}
+	return res, nil
+}
@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// logStore is the default MessageStore. It keeps an account's data
+// in memory and appends every change to db/<user>.msglog, one
+// checksummed JSON record per line. Rendered messages stay on disk
+// and are read back on demand. The log is rewritten by Compact once
+// it's mostly superseded records.
+//
+// A crash can at worst leave a partial record at the end of the
+// log, which is dropped the next time the log is opened.
+//
+// Only one process may have a log open at a time; it holds an flock
+// on db/<user>.msglog.lock, which stays put when Compact renames a
+// new log into place.
+type logStore struct {
+	file string
+	lock *os.File
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	records  int // records in the log file
+	dms      map[int64]DM
+	deleted  map[int64]bool
+	flags    map[int64][]string
+	rendered map[int64]blobRef
+	cursors  map[string]SyncCursor
+	uids     map[int64]uint32
+	uidNext  uint32
+	validity uint32
+}
+
+// A blobRef locates a rendered message's record in the log.
+type blobRef struct {
+	key  string
+	off  int64
+	n    int
+	size int // of the message itself
+}
+
+type logRecord struct {
+	Op       string      `json:"op"` // "dm", "del", "flags", "render", "cursor" or "uids"
+	ID       int64       `json:"id,omitempty"`
+	DM       *DM         `json:"dm,omitempty"`
+	UID      uint32      `json:"uid,omitempty"`      // for "dm"; the next UID for "uids"
+	Validity uint32      `json:"validity,omitempty"` // for "uids"
+	Flags    []string    `json:"flags,omitempty"`
+	Key      string      `json:"key,omitempty"`
+	Blob     []byte      `json:"blob,omitempty"`
+	Stream   string      `json:"stream,omitempty"`
+	Cursor   *SyncCursor `json:"cursor,omitempty"`
+}
+
+func logStoreFile(user string) string {
+	return fmt.Sprintf("db/%s.msglog", strings.ToLower(user))
+}
+
+// encodeRecord returns rec as a log line: the CRC-32 of the JSON in
+// hex, a space, the JSON, and a newline.
+func encodeRecord(rec *logRecord) ([]byte, error) {
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(js), js)), nil
+}
+
+var errBadRecord = errors.New("bad checksum or truncated record")
+
+func decodeRecord(line []byte) (*logRecord, error) {
+	line = bytes.TrimRight(line, "\n")
+	if len(line) < 10 || line[8] != ' ' {
+		return nil, errBadRecord
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE(line[9:]) {
+		return nil, errBadRecord
+	}
+	rec := new(logRecord)
+	if err := json.Unmarshal(line[9:], rec); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// errStoreLocked is returned when opening a log another process
+// has open, such as a running server.
+var errStoreLocked = errors.New("message store is in use by another process; is the server running?")
+
+func openLogStore(user string) (MessageStore, error) {
+	s := &logStore{file: logStoreFile(user)}
+	s.reset()
+	lock, err := os.OpenFile(s.file+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errStoreLocked
+		}
+		return nil, err
+	}
+	s.lock = lock
+	f, err := os.OpenFile(s.file, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	s.f = f
+	if err := s.load(); err != nil {
+		f.Close()
+		lock.Close()
+		return nil, err
+	}
+	if s.records == 0 {
+		if err := s.importLegacy(user); err != nil {
+			log.Printf("store: importing old DMs for %q: %v", user, err)
+		}
+	}
+	if s.validity == 0 {
+		// A new store, or one from before UIDs, whose DMs
+		// were numbered in log order as it loaded.
+		rec := &logRecord{Op: "uids", UID: s.uidNext, Validity: uint32(time.Now().Unix())}
+		if err := s.appendLocked(rec); err != nil {
+			f.Close()
+			lock.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *logStore) reset() {
+	s.size, s.records = 0, 0
+	s.dms = make(map[int64]DM)
+	s.deleted = make(map[int64]bool)
+	s.flags = make(map[int64][]string)
+	s.rendered = make(map[int64]blobRef)
+	s.cursors = make(map[string]SyncCursor)
+	s.uids = make(map[int64]uint32)
+	s.uidNext, s.validity = 1, 0
+}
+
+// load replays the log into memory. A bad record at the very end is
+// the remains of an interrupted write and is truncated away; a bad
+// record anywhere else is skipped, and reported by Check.
+func (s *logStore) load() error {
+	if _, err := s.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	br := bufio.NewReader(s.f)
+	var off int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		rec, derr := decodeRecord(line)
+		if derr != nil {
+			if _, perr := br.Peek(1); perr == io.EOF {
+				log.Printf("store: truncating partial record at end of %s", s.file)
+				if err := s.f.Truncate(off); err != nil {
+					return err
+				}
+				break
+			}
+			log.Printf("store: skipping bad record at offset %d of %s: %v", off, s.file, derr)
+		} else {
+			s.apply(rec, off, len(line))
+		}
+		s.records++
+		off += int64(len(line))
+	}
+	s.size = off
+	_, err := s.f.Seek(off, io.SeekStart)
+	return err
+}
+
+func (s *logStore) apply(rec *logRecord, off int64, n int) {
+	switch rec.Op {
+	case "dm":
+		if rec.DM != nil && !s.deleted[rec.DM.ID] {
+			s.dms[rec.DM.ID] = *rec.DM
+			uid := rec.UID
+			if uid == 0 {
+				uid = s.uidNext
+			}
+			s.uids[rec.DM.ID] = uid
+			if uid >= s.uidNext {
+				s.uidNext = uid + 1
+			}
+		}
+	case "del":
+		s.deleted[rec.ID] = true
+		delete(s.dms, rec.ID)
+		delete(s.uids, rec.ID)
+		delete(s.flags, rec.ID)
+		delete(s.rendered, rec.ID)
+	case "flags":
+		if len(rec.Flags) == 0 {
+			delete(s.flags, rec.ID)
+		} else {
+			s.flags[rec.ID] = rec.Flags
+		}
+	case "render":
+		s.rendered[rec.ID] = blobRef{key: rec.Key, off: off, n: n, size: len(rec.Blob)}
+	case "cursor":
+		if rec.Cursor != nil {
+			s.cursors[rec.Stream] = *rec.Cursor
+		}
+	case "uids":
+		s.validity = rec.Validity
+		if rec.UID > s.uidNext {
+			s.uidNext = rec.UID
+		}
+	}
+}
+
+// appendLocked writes recs to the end of the log and syncs it to
+// disk before applying them in memory.
+func (s *logStore) appendLocked(recs ...*logRecord) error {
+	return s.writeLocked(true, recs...)
+}
+
+// writeLocked is appendLocked, but only syncs the log to disk if
+// sync is set.
+func (s *logStore) writeLocked(sync bool, recs ...*logRecord) error {
+	var buf bytes.Buffer
+	var offs []int64
+	var lens []int
+	for _, rec := range recs {
+		line, err := encodeRecord(rec)
+		if err != nil {
+			return err
+		}
+		offs = append(offs, s.size+int64(buf.Len()))
+		lens = append(lens, len(line))
+		buf.Write(line)
+	}
+	if _, err := s.f.Write(buf.Bytes()); err != nil {
+		// Don't leave a partial write where the next
+		// append would follow it.
+		s.f.Truncate(s.size)
+		s.f.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if sync {
+		if err := s.f.Sync(); err != nil {
+			return err
+		}
+	}
+	s.size += int64(buf.Len())
+	for i, rec := range recs {
+		s.apply(rec, offs[i], lens[i])
+		s.records++
+	}
+	if s.records > 1000 && s.records > 4*s.liveRecordsLocked() {
+		if err := s.compactLocked(); err != nil {
+			log.Printf("store: compacting %s: %v", s.file, err)
+		}
+	}
+	return nil
+}
+
+func (s *logStore) liveRecordsLocked() int {
+	return len(s.dms) + len(s.deleted) + len(s.flags) + len(s.rendered) + len(s.cursors) + 1
+}
+
+func (s *logStore) Add(dms []DM) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var recs []*logRecord
+	seen := make(map[int64]bool)
+	for i := range dms {
+		id := dms[i].ID
+		if _, ok := s.dms[id]; ok || s.deleted[id] || seen[id] {
+			continue
+		}
+		seen[id] = true
+		recs = append(recs, &logRecord{Op: "dm", DM: &dms[i]})
+	}
+	if len(recs) == 0 {
+		return 0, nil
+	}
+	// Number them oldest first, so mail clients sorting by UID
+	// show them in order.
+	sort.Slice(recs, func(i, j int) bool { return recs[i].DM.ID < recs[j].DM.ID })
+	for i, rec := range recs {
+		rec.UID = s.uidNext + uint32(i)
+	}
+	return len(recs), s.appendLocked(recs...)
+}
+
+func (s *logStore) DMs() []DM {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]DM, 0, len(s.dms))
+	for _, dm := range s.dms {
+		list = append(list, dm)
+	}
+	sort.Sort(dmsByNewest(list))
+	return list
+}
+
+func (s *logStore) Get(id int64) (DM, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dm, ok := s.dms[id]
+	return dm, ok
+}
+
+func (s *logStore) Delete(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleted[id] {
+		return nil
+	}
+	return s.appendLocked(&logRecord{Op: "del", ID: id})
+}
+
+func (s *logStore) UID(id int64) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uids[id]
+}
+
+func (s *logStore) UIDNext() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uidNext
+}
+
+func (s *logStore) UIDValidity() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.validity
+}
+
+func (s *logStore) Flags(id int64) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.flags[id]...)
+}
+
+func (s *logStore) SetFlags(id int64, flags []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dms[id]; !ok {
+		return fmt.Errorf("no message %d", id)
+	}
+	return s.appendLocked(&logRecord{Op: "flags", ID: id, Flags: flags})
+}
+
+func (s *logStore) Rendered(id int64, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.rendered[id]
+	if !ok || ref.key != key {
+		return nil, false
+	}
+	line := make([]byte, ref.n)
+	if _, err := s.f.ReadAt(line, ref.off); err != nil {
+		log.Printf("store: reading rendered message %d: %v", id, err)
+		return nil, false
+	}
+	rec, err := decodeRecord(line)
+	if err != nil || rec.ID != id {
+		log.Printf("store: bad rendered message record for %d in %s", id, s.file)
+		return nil, false
+	}
+	return rec.Blob, true
+}
+
+func (s *logStore) RenderedSize(id int64, key string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ref, ok := s.rendered[id]
+	if !ok || ref.key != key {
+		return 0, false
+	}
+	return ref.size, true
+}
+
+// SetRendered doesn't sync the log to disk: rendered messages are
+// only a cache, and one lost in a crash is rendered again.
+func (s *logStore) SetRendered(id int64, key string, msg []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.dms[id]; !ok {
+		return fmt.Errorf("no message %d", id)
+	}
+	return s.writeLocked(false, &logRecord{Op: "render", ID: id, Key: key, Blob: msg})
+}
+
+func (s *logStore) Cursor(stream string) SyncCursor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cursors[stream].clone()
+}
+
+func (s *logStore) SetCursor(stream string, c SyncCursor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if reflect.DeepEqual(s.cursors[stream], c) {
+		return nil
+	}
+	c = c.clone()
+	return s.appendLocked(&logRecord{Op: "cursor", Stream: stream, Cursor: &c})
+}
+
+func (s *logStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compactLocked()
+}
+
+// compactLocked writes the live state to a new log and renames it
+// over the old one, so a crash leaves one or the other intact.
+func (s *logStore) compactLocked() error {
+	// The uids record keeps the next UID from going back down
+	// if the newest DMs were deleted.
+	recs := []*logRecord{{Op: "uids", UID: s.uidNext, Validity: s.validity}}
+	for id := range s.deleted {
+		recs = append(recs, &logRecord{Op: "del", ID: id})
+	}
+	for id := range s.dms {
+		dm := s.dms[id]
+		recs = append(recs, &logRecord{Op: "dm", DM: &dm, UID: s.uids[id]})
+	}
+	for id, flags := range s.flags {
+		recs = append(recs, &logRecord{Op: "flags", ID: id, Flags: flags})
+	}
+	for stream, c := range s.cursors {
+		c := c
+		recs = append(recs, &logRecord{Op: "cursor", Stream: stream, Cursor: &c})
+	}
+	for id, ref := range s.rendered {
+		line := make([]byte, ref.n)
+		if _, err := s.f.ReadAt(line, ref.off); err != nil {
+			return err
+		}
+		rec, err := decodeRecord(line)
+		if err != nil {
+			continue // just re-render it later
+		}
+		rec.ID = id
+		recs = append(recs, rec)
+	}
+
+	tmp := s.file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	for _, rec := range recs {
+		line, err := encodeRecord(rec)
+		if err == nil {
+			_, err = bw.Write(line)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(s.file)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	s.f.Close()
+	s.f = f
+	s.reset()
+	return s.load()
+}
+
+// Check re-reads the whole log and reports corrupt records and
+// records that refer to messages the log doesn't contain.
+func (s *logStore) Check() []error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var problems []error
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, s.size))
+	known := make(map[int64]bool)
+	var off int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) == 0 {
+			if err != io.EOF {
+				problems = append(problems, err)
+			}
+			break
+		}
+		rec, err := decodeRecord(line)
+		switch {
+		case err != nil:
+			problems = append(problems, fmt.Errorf("%s: offset %d: %v", s.file, off, err))
+		case rec.Op == "dm" && (rec.DM == nil || rec.DM.ID == 0):
+			problems = append(problems, fmt.Errorf("%s: offset %d: DM record without a DM ID", s.file, off))
+		case rec.Op == "dm":
+			known[rec.DM.ID] = true
+		case rec.Op == "flags" || rec.Op == "render":
+			if !known[rec.ID] {
+				problems = append(problems, fmt.Errorf("%s: offset %d: %s record for unknown message %d", s.file, off, rec.Op, rec.ID))
+			}
+		case rec.Op == "del", rec.Op == "cursor", rec.Op == "uids":
+		default:
+			problems = append(problems, fmt.Errorf("%s: offset %d: unknown record type %q", s.file, off, rec.Op))
+		}
+		off += int64(len(line))
+	}
+	byUID := make(map[uint32]int64)
+	for id, dm := range s.dms {
+		if dm.ID != id {
+			problems = append(problems, fmt.Errorf("%s: message %d stored under ID %d", s.file, dm.ID, id))
+		}
+		uid := s.uids[id]
+		if other, ok := byUID[uid]; ok {
+			problems = append(problems, fmt.Errorf("%s: messages %d and %d share UID %d", s.file, other, id, uid))
+		}
+		byUID[uid] = id
+	}
+	return problems
+}
+
+func (s *logStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.f.Close()
+	s.lock.Close() // releasing the flock
+	return err
+}
+
+// importLegacy loads DMs from the JSON file older versions kept in
+// db/<user>.dms, and renames it out of the way once they're in the
+// log.
+func (s *logStore) importLegacy(user string) error {
+	old := fmt.Sprintf("db/%s.dms", strings.ToLower(user))
+	f, err := os.Open(old)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dms, err := parseDMs(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if _, err := s.Add(dms); err != nil {
+		return err
+	}
+	return os.Rename(old, old+".imported")
+}
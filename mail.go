@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+// maxHeaderLine is the column at which header lines are folded, per
+// RFC 5322 section 2.1.1.
+const maxHeaderLine = 78
+
+// encodeWord returns s as an RFC 2047 encoded-word if it contains
+// anything other than printable ASCII, or s unchanged otherwise.
+func encodeWord(s string) string {
+	return mime.QEncoding.Encode("utf-8", s)
+}
+
+// formatAddress formats a mailbox with a display name, encoding
+// the name if needed.
+func formatAddress(name, addr string) string {
+	return (&mail.Address{Name: name, Address: addr}).String()
+}
+
+// writeHeader writes "key: value" to w, folding the line at
+// whitespace so it stays within maxHeaderLine columns where
+// possible.
+func writeHeader(w io.Writer, key, value string) {
+	var buf bytes.Buffer
+	buf.WriteString(key)
+	buf.WriteString(":")
+	lineLen := buf.Len()
+	for i, word := range strings.Split(strings.TrimSpace(value), " ") {
+		if i > 0 && lineLen+1+len(word) > maxHeaderLine {
+			buf.WriteString("\r\n")
+			lineLen = 0
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(word)
+		lineLen += 1 + len(word)
+	}
+	buf.WriteString("\r\n")
+	w.Write(buf.Bytes())
+}
+
+// needsQP reports whether text can't be sent as plain 7bit.
+func needsQP(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if len(line) > 998 {
+			return true
+		}
+	}
+	if strings.Contains(text, "=_") {
+		// Might collide with one of our multipart boundaries.
+		return true
+	}
+	for i := 0; i < len(text); i++ {
+		if c := text[i]; c >= 0x80 || (c < ' ' && c != '\n' && c != '\r' && c != '\t') {
+			return true
+		}
+	}
+	return false
+}
+
+// crlf converts bare LF line endings in s to CRLF.
+func crlf(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Replace(s, "\n", "\r\n", -1)
+}
+
+// writeTextPart writes the MIME headers for a UTF-8 text part of
+// the given subtype ("plain" or "html"), the blank separator line,
+// and the encoded text itself.
+func writeTextPart(w io.Writer, subtype, text string) {
+	writeHeader(w, "Content-Type", "text/"+subtype+"; charset=utf-8")
+	if !needsQP(text) {
+		writeHeader(w, "Content-Transfer-Encoding", "7bit")
+		io.WriteString(w, "\r\n")
+		io.WriteString(w, crlf(text))
+		return
+	}
+	writeHeader(w, "Content-Transfer-Encoding", "quoted-printable")
+	io.WriteString(w, "\r\n")
+	qw := quotedprintable.NewWriter(w)
+	io.WriteString(qw, text)
+	qw.Close()
+}
+
+// writeAlternative writes a multipart/alternative body with plain
+// text and HTML versions of the same content. The boundary must be
+// stable for a given message so its size doesn't change between
+// LIST and RETR; it begins with "=_", which never appears in our
+// encoded parts.
+func writeAlternative(w io.Writer, boundary, text, html string) {
+	writeHeader(w, "Content-Type", fmt.Sprintf("multipart/alternative; boundary=%q", boundary))
+	io.WriteString(w, "\r\n")
+	fmt.Fprintf(w, "--%s\r\n", boundary)
+	writeTextPart(w, "plain", text)
+	fmt.Fprintf(w, "\r\n--%s\r\n", boundary)
+	writeTextPart(w, "html", html)
+	fmt.Fprintf(w, "\r\n--%s--\r\n", boundary)
+}
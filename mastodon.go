@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// mastodonBackend is the Backend for direct-visibility statuses on
+// Mastodon and compatible servers. Each account is on the instance
+// in its Instance field. Its username is the Mastodon username and
+// the instance's host name joined by a dot, which can't collide with
+// a Twitter screen name, and other users' mail addresses are built
+// the same way from their handles.
+type mastodonBackend struct{}
+
+const (
+	mastodonScopes   = "read write"
+	mastodonAppsFile = "db/mastodon-apps.json"
+)
+
+func (mastodonBackend) Name() string { return "mastodon" }
+
+func (mastodonBackend) Host(a *Account) string {
+	if a != nil {
+		if u, err := url.Parse(a.Instance); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return "mastodon"
+}
+
+// normalizeInstance turns what a user typed for their instance into
+// a base URL, defaulting to HTTPS. Instances on our own machine or
+// network are refused; publicClient won't connect to them anyway.
+func normalizeInstance(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("bad Mastodon instance %q", s)
+	}
+	if err := checkPublicHost(u.Host); err != nil {
+		return "", fmt.Errorf("bad Mastodon instance %q: %v", s, err)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// A mastodonApp is eight22er's OAuth2 client registration on one
+// instance.
+type mastodonApp struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+}
+
+var mastodonAppsMu sync.Mutex
+
+// mastodonAppFor returns our app on instance for the given
+// redirect URI, registering it with the instance the first time.
+func mastodonAppFor(instance, redirect string) (*mastodonApp, error) {
+	mastodonAppsMu.Lock()
+	defer mastodonAppsMu.Unlock()
+	apps := make(map[string]*mastodonApp) // by instance + " " + redirect
+	if bs, err := ioutil.ReadFile(mastodonAppsFile); err == nil {
+		if err := json.Unmarshal(bs, &apps); err != nil {
+			return nil, fmt.Errorf("%s: %v", mastodonAppsFile, err)
+		}
+	}
+	key := instance + " " + redirect
+	if app, ok := apps[key]; ok {
+		return app, nil
+	}
+
+	form := make(url.Values)
+	form.Set("client_name", "eight22er")
+	form.Set("redirect_uris", redirect)
+	form.Set("scopes", mastodonScopes)
+	form.Set("website", "https://eight22er.danga.com/")
+	res, err := publicClient.PostForm(instance+"/api/v1/apps", form)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(res); err != nil {
+		return nil, mastodonError(err)
+	}
+	defer res.Body.Close()
+	app := new(mastodonApp)
+	if err := json.NewDecoder(res.Body).Decode(app); err != nil || app.ClientID == "" {
+		return nil, fmt.Errorf("bad app registration response from %s: %v", instance, err)
+	}
+	apps[key] = app
+	bs, err := json.MarshalIndent(apps, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return app, ioutil.WriteFile(mastodonAppsFile, bs, 0600)
+}
+
+// mastodonCallback adds the instance to the sign-in callback, so
+// FinishLogin knows which instance the code is for.
+func mastodonCallback(callback, instance string) string {
+	return callback + "&instance=" + url.QueryEscape(instance)
+}
+
+func (mastodonBackend) StartLogin(r *http.Request, callback string) (string, error) {
+	instance, err := normalizeInstance(r.FormValue("instance"))
+	if err != nil {
+		return "", err
+	}
+	redirect := mastodonCallback(callback, instance)
+	app, err := mastodonAppFor(instance, redirect)
+	if err != nil {
+		return "", err
+	}
+	v := make(url.Values)
+	v.Set("client_id", app.ClientID)
+	v.Set("redirect_uri", redirect)
+	v.Set("response_type", "code")
+	v.Set("scope", mastodonScopes)
+	return instance + "/oauth/authorize?" + v.Encode(), nil
+}
+
+func (m mastodonBackend) FinishLogin(r *http.Request, callback string) (*Account, error) {
+	instance, err := normalizeInstance(r.FormValue("instance"))
+	if err != nil {
+		return nil, err
+	}
+	code := r.FormValue("code")
+	if code == "" {
+		return nil, errors.New("no authorization code in callback")
+	}
+	redirect := mastodonCallback(callback, instance)
+	app, err := mastodonAppFor(instance, redirect)
+	if err != nil {
+		return nil, err
+	}
+
+	form := make(url.Values)
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("client_id", app.ClientID)
+	form.Set("client_secret", app.ClientSecret)
+	form.Set("redirect_uri", redirect)
+	form.Set("scope", mastodonScopes)
+	res, err := publicClient.PostForm(instance+"/oauth/token", form)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkResponse(res); err != nil {
+		return nil, mastodonError(err)
+	}
+	defer res.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tok); err != nil || tok.AccessToken == "" {
+		return nil, fmt.Errorf("bad token response from %s: %v", instance, err)
+	}
+
+	a := &Account{Token: tok.AccessToken, Instance: instance}
+	self, err := m.self(a)
+	if err != nil {
+		return nil, err
+	}
+	a.Username = self.Username + "." + instanceHost(a)
+	return a, nil
+}
+
+// instanceHost returns the host name of a's instance, without any
+// port. It's the domain in the handles of the instance's own users.
+func instanceHost(a *Account) string {
+	u, err := url.Parse(a.Instance)
+	if err != nil {
+		return ""
+	}
+	host := u.Host
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return host
+}
+
+// mastodonError labels the typed errors from checkResponse as
+// Mastodon's, for the messages users see.
+func mastodonError(err error) error {
+	if e := asAPIError(err); e != nil {
+		e.Service = "Mastodon"
+	}
+	return err
+}
+
+// call does an authorized request to a's instance and returns the
+// response body. params go in the query string, except for POSTs
+// without a body, where they're form-encoded.
+func (mastodonBackend) call(a *Account, method, path string, params url.Values, contentType string, body []byte) ([]byte, error) {
+	u := strings.TrimRight(a.Instance, "/") + path
+	var r io.Reader
+	switch {
+	case body != nil:
+		r = bytes.NewReader(body)
+		if len(params) > 0 {
+			u += "?" + params.Encode()
+		}
+	case method == "POST":
+		r = strings.NewReader(params.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	case len(params) > 0:
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	bs, err := api.DoPublicRequest(a, req, 0)
+	return bs, mastodonError(err)
+}
+
+func (m mastodonBackend) get(a *Account, path string, params url.Values, v interface{}) error {
+	body, err := m.call(a, "GET", path, params, "", nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return nil
+}
+
+type mastoAccount struct {
+	ID          string `json:"id"`
+	Username    string `json:"username"`
+	Acct        string `json:"acct"` // without a domain for users on the same instance
+	DisplayName string `json:"display_name"`
+}
+
+// user returns the account as a User, whose Handle always includes
+// the domain.
+func (ma mastoAccount) user(a *Account) User {
+	handle := ma.Acct
+	if !strings.Contains(handle, "@") {
+		handle += "@" + instanceHost(a)
+	}
+	name := ma.DisplayName
+	if name == "" {
+		name = ma.Username
+	}
+	return User{Handle: handle, Name: name}
+}
+
+type mastoStatus struct {
+	ID          string         `json:"id"`
+	CreatedAt   string         `json:"created_at"`
+	Content     string         `json:"content"` // HTML
+	Visibility  string         `json:"visibility"`
+	InReplyToID string         `json:"in_reply_to_id"`
+	Account     mastoAccount   `json:"account"`
+	Mentions    []mastoAccount `json:"mentions"`
+	Media       []struct {
+		Type string `json:"type"` // "image", "gifv", "video" or "audio"
+		URL  string `json:"url"`
+	} `json:"media_attachments"`
+}
+
+var (
+	mastoBreakRx    = regexp.MustCompile(`(?i)<br\s*/?>`)
+	mastoParaRx     = regexp.MustCompile(`(?i)</p>\s*<p[^>]*>`)
+	mastoTagRx      = regexp.MustCompile(`<[^>]*>`)
+	mastoMentionsRx = regexp.MustCompile(`^(@[\w.\-]+(@[\w.\-]+)?\s+)+`)
+)
+
+// statusText turns a status's HTML content into plain text, without
+// the mentions that address it.
+func statusText(content string) string {
+	s := mastoBreakRx.ReplaceAllString(content, "\n")
+	s = mastoParaRx.ReplaceAllString(s, "\n\n")
+	s = html.UnescapeString(mastoTagRx.ReplaceAllString(s, ""))
+	return strings.TrimSpace(mastoMentionsRx.ReplaceAllString(strings.TrimSpace(s), ""))
+}
+
+// dm converts a direct status to a DM. Statuses that mention more
+// than one other user get a Conversation naming everyone in it.
+// Status IDs are opaque strings: Mastodon's are numbers, but
+// Pleroma's and Akkoma's aren't, so the DM's ID is made from the
+// time and the status ID is its Ref.
+func (st *mastoStatus) dm(a *Account) (DM, error) {
+	if st.ID == "" {
+		return DM{}, errors.New("status without an id")
+	}
+	t, err := time.Parse(time.RFC3339, st.CreatedAt)
+	if err != nil {
+		return DM{}, fmt.Errorf("status %s: bad created_at %q", st.ID, st.CreatedAt)
+	}
+	dm := DM{
+		ID:        timeID(t, st.ID),
+		Ref:       st.ID,
+		Text:      statusText(st.Content),
+		CreatedAt: t,
+		Sender:    st.Account.user(a),
+	}
+	others := make(map[string]bool)
+	if !a.is(dm.Sender) {
+		others[strings.ToLower(dm.Sender.Handle)] = true
+	}
+	for _, m := range st.Mentions {
+		u := m.user(a)
+		if strings.EqualFold(u.Handle, dm.Sender.Handle) {
+			continue
+		}
+		if dm.Recipient.Handle == "" {
+			dm.Recipient = u
+		}
+		if !a.is(u) {
+			others[strings.ToLower(u.Handle)] = true
+		}
+	}
+	if len(others) > 1 {
+		var list []string
+		for h := range others {
+			list = append(list, h)
+		}
+		sort.Strings(list)
+		dm.Conversation = strings.Join(list, ",")
+	}
+	for _, m := range st.Media {
+		kind := m.Type
+		switch kind {
+		case "image":
+			kind = "photo"
+		case "gifv":
+			kind = "animated_gif"
+		}
+		dm.Entities.Media = append(dm.Entities.Media, MediaEntity{Type: kind, MediaURLHTTPS: m.URL})
+	}
+	return dm, nil
+}
+
+var (
+	mastodonSelfMu sync.Mutex
+	mastodonSelf   = make(map[string]mastoAccount) // by access token
+)
+
+// self returns the account's own Mastodon account.
+func (m mastodonBackend) self(a *Account) (mastoAccount, error) {
+	mastodonSelfMu.Lock()
+	ma, ok := mastodonSelf[a.Token]
+	mastodonSelfMu.Unlock()
+	if ok {
+		return ma, nil
+	}
+	if err := m.get(a, "/api/v1/accounts/verify_credentials", nil, &ma); err != nil {
+		return ma, err
+	}
+	mastodonSelfMu.Lock()
+	mastodonSelf[a.Token] = ma
+	mastodonSelfMu.Unlock()
+	return ma, nil
+}
+
+// Streams are the direct statuses mentioning the account, found
+// through its mention notifications, and the direct statuses it
+// posted.
+func (mastodonBackend) Streams(a *Account) []string {
+	if a.HideSent {
+		return []string{"received"}
+	}
+	return []string{"received", "sent"}
+}
+
+func (m mastodonBackend) Sync(a *Account, stream string, c *SyncCursor) ([]DM, error) {
+	return syncStream(m, a, stream, c)
+}
+
+// page implements pageSource. Page tokens are max_id values, which
+// Mastodon treats as exclusive; for the received stream they're
+// notification IDs, not status IDs.
+func (m mastodonBackend) page(a *Account, stream string, count int, sinceID int64, token string) ([]DM, string, error) {
+	if count > 40 {
+		count = 40
+	}
+	params := make(url.Values)
+	params.Set("limit", strconv.Itoa(count))
+	if token != "" {
+		params.Set("max_id", token)
+	}
+
+	var statuses []*mastoStatus
+	var next string
+	switch stream {
+	case "received":
+		params.Add("types[]", "mention")
+		var notes []struct {
+			ID     string       `json:"id"`
+			Type   string       `json:"type"`
+			Status *mastoStatus `json:"status"`
+		}
+		if err := m.get(a, "/api/v1/notifications", params, &notes); err != nil {
+			return nil, "", err
+		}
+		for _, n := range notes {
+			if n.Type == "mention" && n.Status != nil {
+				statuses = append(statuses, n.Status)
+			}
+		}
+		if len(notes) > 0 {
+			next = notes[len(notes)-1].ID
+		}
+	case "sent":
+		self, err := m.self(a)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := m.get(a, "/api/v1/accounts/"+url.QueryEscape(self.ID)+"/statuses", params, &statuses); err != nil {
+			return nil, "", err
+		}
+		if len(statuses) > 0 {
+			next = statuses[len(statuses)-1].ID
+		}
+	default:
+		return nil, "", fmt.Errorf("unknown Mastodon stream %q", stream)
+	}
+
+	var dms []DM
+	for _, st := range statuses {
+		if st.Visibility != "direct" {
+			continue
+		}
+		dm, err := st.dm(a)
+		if err != nil {
+			return nil, "", err
+		}
+		dms = append(dms, dm)
+	}
+	return dms, next, nil
+}
+
+func (mastodonBackend) tokenBefore(id int64) string { return "" }
+
+func (m mastodonBackend) Conversations(a *Account) ([]Conversation, error) {
+	var list []struct {
+		ID         string         `json:"id"`
+		Accounts   []mastoAccount `json:"accounts"`
+		LastStatus *mastoStatus   `json:"last_status"`
+	}
+	if err := m.get(a, "/api/v1/conversations", url.Values{"limit": {"40"}}, &list); err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	for _, c := range list {
+		if c.LastStatus == nil {
+			continue
+		}
+		latest, err := c.LastStatus.dm(a)
+		if err != nil {
+			return nil, err
+		}
+		conv := Conversation{ID: latest.ConversationID(a), Latest: latest}
+		for _, ma := range c.Accounts {
+			conv.Participants = append(conv.Participants, ma.user(a))
+		}
+		convs = append(convs, conv)
+	}
+	return convs, nil
+}
+
+// Messages finds the conversation's latest status and returns the
+// direct statuses in its thread.
+func (m mastodonBackend) Messages(a *Account, conv string, n int) ([]DM, error) {
+	convs, err := m.Conversations(a)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range convs {
+		if c.ID != conv {
+			continue
+		}
+		var ctx struct {
+			Ancestors   []*mastoStatus `json:"ancestors"`
+			Descendants []*mastoStatus `json:"descendants"`
+		}
+		path := "/api/v1/statuses/" + url.PathEscape(c.Latest.Ref) + "/context"
+		if err := m.get(a, path, nil, &ctx); err != nil {
+			return nil, err
+		}
+		dms := []DM{c.Latest}
+		for _, st := range append(ctx.Ancestors, ctx.Descendants...) {
+			if st.Visibility != "direct" {
+				continue
+			}
+			dm, err := st.dm(a)
+			if err != nil {
+				return nil, err
+			}
+			dms = append(dms, dm)
+		}
+		sort.Sort(dmsByNewest(dms))
+		if n > 0 && len(dms) > n {
+			dms = dms[:n]
+		}
+		return dms, nil
+	}
+	return nil, nil
+}
+
+// Send posts one direct status mentioning every recipient.
+func (m mastodonBackend) Send(a *Account, out *Outgoing) ([]DM, error) {
+	if strings.TrimSpace(out.Text) == "" && len(out.MediaIDs) == 0 {
+		return nil, &RejectedError{"empty message"}
+	}
+	var mentions []string
+	for _, to := range out.To {
+		mentions = append(mentions, "@"+to.Handle)
+	}
+	params := make(url.Values)
+	params.Set("status", strings.Join(mentions, " ")+" "+out.Text)
+	params.Set("visibility", "direct")
+	if orig, ok := storedDM(a, out.InReplyTo); ok && out.InReplyTo != 0 {
+		params.Set("in_reply_to_id", orig.Ref)
+	}
+	for _, id := range out.MediaIDs {
+		params.Add("media_ids[]", id)
+	}
+	body, err := m.call(a, "POST", "/api/v1/statuses", params, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	var st mastoStatus
+	if err := json.Unmarshal(body, &st); err != nil {
+		return nil, fmt.Errorf("decoding posted status: %v", err)
+	}
+	dm, err := st.dm(a)
+	if err != nil {
+		return nil, err
+	}
+	return []DM{dm}, nil
+}
+
+func (m mastodonBackend) Delete(a *Account, id int64) error {
+	dm, ok := storedDM(a, id)
+	if !ok {
+		return fmt.Errorf("no Mastodon status for message %d", id)
+	}
+	_, err := m.call(a, "DELETE", "/api/v1/statuses/"+url.PathEscape(dm.Ref), nil, "", nil)
+	return err
+}
+
+func (m mastodonBackend) UploadMedia(a *Account, filename string, data []byte) (string, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return "", err
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	res, err := m.call(a, "POST", "/api/v2/media", nil, mw.FormDataContentType(), body.Bytes())
+	if err != nil {
+		return "", err
+	}
+	var att struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(res, &att); err != nil || att.ID == "" {
+		return "", fmt.Errorf("bad media upload response: %q", res)
+	}
+	return att.ID, nil
+}
+
+// ResolveUser turns "user.example.org" back into @user@example.org
+// and looks them up, asking the instance to fetch remote accounts
+// it hasn't seen yet.
+func (m mastodonBackend) ResolveUser(a *Account, localpart string) (User, error) {
+	i := strings.Index(localpart, ".")
+	if i <= 0 || i == len(localpart)-1 {
+		return User{}, &RejectedError{fmt.Sprintf("%q isn't a Mastodon user; use user.instance", localpart)}
+	}
+	acct := localpart[:i] + "@" + localpart[i+1:]
+
+	var ma mastoAccount
+	err := m.get(a, "/api/v1/accounts/lookup", url.Values{"acct": {acct}}, &ma)
+	if e := asAPIError(err); e != nil && e.StatusCode == 404 {
+		var res struct {
+			Accounts []mastoAccount `json:"accounts"`
+		}
+		params := url.Values{"q": {"@" + acct}, "type": {"accounts"}, "resolve": {"true"}, "limit": {"1"}}
+		if err = m.get(a, "/api/v2/search", params, &res); err == nil {
+			if len(res.Accounts) == 0 {
+				return User{}, &APIError{StatusCode: 404, Message: "no such user " + acct, Service: "Mastodon"}
+			}
+			ma = res.Accounts[0]
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+	return ma.user(a), nil
+}
+
+func (mastodonBackend) MailAddress(u User) string {
+	return strings.Replace(u.Handle, "@", ".", 1) + "@eight22er.danga.com"
+}
+
+// FetchMedia downloads without the account's token, since media is
+// public and often served from another host.
+func (mastodonBackend) FetchMedia(a *Account, u string, maxBytes int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	bs, err := api.DoPublicRequest(a, req, maxBytes)
+	if err == errBodyTooBig {
+		return nil, errMediaTooBig
+	}
+	return bs, err
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMastodon is just enough of a Mastodon instance for eight22er.
+// Its status IDs are Pleroma-style flake IDs, which aren't numbers.
+type fakeMastodon struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	me       mastoAccount
+	accounts map[string]mastoAccount // by acct
+	statuses []*fakeStatus           // oldest first
+	seq      int
+}
+
+type fakeStatus struct {
+	mastoStatus
+	InReplyTo string
+}
+
+const fakeMastodonToken = "fake-token"
+
+func newFakeMastodon(t *testing.T) *fakeMastodon {
+	f := &fakeMastodon{
+		me:       mastoAccount{ID: "A1ice", Username: "alice", Acct: "alice", DisplayName: "Alice"},
+		accounts: make(map[string]mastoAccount),
+	}
+	f.accounts["alice"] = f.me
+	f.accounts["bob@remote.example"] = mastoAccount{ID: "B0b", Username: "bob", Acct: "bob@remote.example", DisplayName: "Bob"}
+	f.accounts["carol@remote.example"] = mastoAccount{ID: "Car0l", Username: "carol", Acct: "carol@remote.example"}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// post adds a status from the account with acct, mentioning the
+// others, and returns its ID.
+func (f *fakeMastodon) post(from, visibility, text string, at time.Time, mentions ...string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.postLocked(from, visibility, text, "", at, mentions)
+}
+
+func (f *fakeMastodon) postLocked(from, visibility, text, replyTo string, at time.Time, mentions []string) string {
+	f.seq++
+	st := &fakeStatus{InReplyTo: replyTo}
+	st.ID = fmt.Sprintf("AbCdEf%03dxYz", f.seq)
+	st.CreatedAt = at.UTC().Format(time.RFC3339)
+	st.Visibility = visibility
+	st.Account = f.accounts[from]
+	st.InReplyToID = replyTo
+	var html []string
+	for _, m := range mentions {
+		st.Mentions = append(st.Mentions, f.accounts[m])
+		html = append(html, `<span class="h-card"><a href="#">@<span>`+m+`</span></a></span>`)
+	}
+	st.Content = "<p>" + strings.Join(append(html, text), " ") + "</p>"
+	f.statuses = append(f.statuses, st)
+	return st.ID
+}
+
+func (f *fakeMastodon) status(id string) *fakeStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, st := range f.statuses {
+		if st.ID == id {
+			return st
+		}
+	}
+	return nil
+}
+
+func (f *fakeMastodon) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(code int, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/apps":
+		reply(mastodonApp{ClientID: "fake-client", ClientSecret: "fake-secret"})
+		return
+	case "/oauth/authorize":
+		redirect, err := url.Parse(r.FormValue("redirect_uri"))
+		if err != nil || r.FormValue("client_id") != "fake-client" {
+			fail(400, "bad client")
+			return
+		}
+		q := redirect.Query()
+		q.Set("code", "fake-code")
+		redirect.RawQuery = q.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+		return
+	case "/oauth/token":
+		if r.FormValue("code") != "fake-code" || r.FormValue("client_secret") != "fake-secret" {
+			fail(401, "bad code")
+			return
+		}
+		reply(map[string]string{"access_token": fakeMastodonToken})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeMastodonToken {
+		fail(401, "The access token is invalid")
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	page := func(list []*fakeStatus, id func(*fakeStatus) string) []*fakeStatus {
+		// Newest first, starting after max_id.
+		var out []*fakeStatus
+		started := r.FormValue("max_id") == ""
+		for i := len(list) - 1; i >= 0; i-- {
+			if !started {
+				started = id(list[i]) == r.FormValue("max_id")
+				continue
+			}
+			if limit > 0 && len(out) == limit {
+				break
+			}
+			out = append(out, list[i])
+		}
+		return out
+	}
+
+	switch {
+	case r.URL.Path == "/api/v1/accounts/verify_credentials":
+		reply(f.me)
+	case r.URL.Path == "/api/v1/notifications":
+		var mentions []*fakeStatus
+		for _, st := range f.statuses {
+			for _, m := range st.Mentions {
+				if m.ID == f.me.ID {
+					mentions = append(mentions, st)
+				}
+			}
+		}
+		type note struct {
+			ID     string       `json:"id"`
+			Type   string       `json:"type"`
+			Status *mastoStatus `json:"status"`
+		}
+		notes := []note{}
+		for _, st := range page(mentions, func(st *fakeStatus) string { return "N" + st.ID }) {
+			notes = append(notes, note{"N" + st.ID, "mention", &st.mastoStatus})
+		}
+		reply(notes)
+	case r.URL.Path == "/api/v1/accounts/"+f.me.ID+"/statuses":
+		var mine []*fakeStatus
+		for _, st := range f.statuses {
+			if st.Account.ID == f.me.ID {
+				mine = append(mine, st)
+			}
+		}
+		list := []*mastoStatus{}
+		for _, st := range page(mine, func(st *fakeStatus) string { return st.ID }) {
+			list = append(list, &st.mastoStatus)
+		}
+		reply(list)
+	case r.URL.Path == "/api/v1/statuses" && r.Method == "POST":
+		words := strings.Fields(r.FormValue("status"))
+		var mentions []string
+		for len(words) > 0 && strings.HasPrefix(words[0], "@") {
+			mentions = append(mentions, words[0][1:])
+			words = words[1:]
+		}
+		f.postLocked("alice", r.FormValue("visibility"), strings.Join(words, " "), r.FormValue("in_reply_to_id"), time.Now(), mentions)
+		reply(&f.statuses[len(f.statuses)-1].mastoStatus)
+	case strings.HasPrefix(r.URL.Path, "/api/v1/statuses/") && r.Method == "DELETE":
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/statuses/")
+		for i, st := range f.statuses {
+			if st.ID == id {
+				f.statuses = append(f.statuses[:i], f.statuses[i+1:]...)
+				reply(&st.mastoStatus)
+				return
+			}
+		}
+		fail(404, "Record not found")
+	case r.URL.Path == "/api/v1/accounts/lookup":
+		ma, ok := f.accounts[strings.TrimSuffix(r.FormValue("acct"), "@"+r.Host)]
+		if !ok {
+			fail(404, "Record not found")
+			return
+		}
+		reply(ma)
+	case r.URL.Path == "/api/v2/media":
+		reply(map[string]string{"id": "M3dia"})
+	default:
+		fail(404, "no such endpoint "+r.URL.Path)
+	}
+}
+
+// mastodonLogin signs in to f through the web handlers, as a user
+// would, and returns the saved account.
+func mastodonLogin(t *testing.T, f *fakeMastodon) *Account {
+	w := httptest.NewRecorder()
+	loginFunc(w, httptest.NewRequest("GET", "/login?backend=mastodon&instance="+url.QueryEscape(f.URL), nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	authURL := w.Header().Get("Location")
+	if !strings.HasPrefix(authURL, f.URL+"/oauth/authorize?") {
+		t.Fatalf("login redirected to %q", authURL)
+	}
+
+	res, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}).Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	cb, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || cb.Query().Get("code") == "" {
+		t.Fatalf("authorize redirected to %q", res.Header.Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	cbFunc(w, httptest.NewRequest("GET", "/cb?"+cb.RawQuery, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	a := GetAccountNoAuth("alice.127.0.0.1")
+	if a.Backend != "mastodon" || a.Token != fakeMastodonToken || a.Instance != f.URL {
+		t.Fatalf("saved account = %+v", a)
+	}
+	return a
+}
+
+func TestMastodonLoginAndSync(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+	defer func(n int) { *dmPageSize = n }(*dmPageSize)
+	*dmPageSize = 2
+
+	f := newFakeMastodon(t)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	f.post("bob@remote.example", "direct", "hi alice", start, "alice")
+	f.post("bob@remote.example", "public", "not a DM", start.Add(time.Minute), "alice")
+	f.post("alice", "direct", "hi bob", start.Add(2*time.Minute), "bob@remote.example")
+	f.post("carol@remote.example", "direct", "hi both", start.Add(3*time.Minute), "alice", "bob@remote.example")
+
+	a := mastodonLogin(t, f)
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &syncWorker{user: a.Username, store: store}
+	if n, err := w.syncOnce(); err != nil || n != 3 {
+		t.Fatalf("first sync = %d, %v; want 3 DMs", n, err)
+	}
+	dms := store.DMs()
+	var got []string
+	for _, dm := range dms {
+		got = append(got, fmt.Sprintf("%s>%s %q %s", dm.Sender.Handle, dm.Recipient.Handle, dm.Text, dm.Ref))
+	}
+	want := []string{
+		`carol@remote.example>alice@127.0.0.1 "hi both" AbCdEf004xYz`,
+		`alice@127.0.0.1>bob@remote.example "hi bob" AbCdEf003xYz`,
+		`bob@remote.example>alice@127.0.0.1 "hi alice" AbCdEf001xYz`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("synced:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if c := dms[0].Conversation; c != "bob@remote.example,carol@remote.example" {
+		t.Errorf("group DM conversation = %q", c)
+	}
+
+	f.post("bob@remote.example", "direct", "again", start.Add(time.Hour), "alice")
+	if n, err := w.syncOnce(); err != nil || n != 1 {
+		t.Fatalf("second sync = %d, %v; want 1 DM", n, err)
+	}
+	for _, stream := range []string{"received", "sent"} {
+		if c := store.Cursor(stream); !c.Complete {
+			t.Errorf("%s cursor = %+v; want complete", stream, c)
+		}
+	}
+}
+
+func TestMastodonSendReplyDelete(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+
+	f := newFakeMastodon(t)
+	orig := f.post("bob@remote.example", "direct", "question?", time.Now().Add(-time.Hour), "alice")
+	a := mastodonLogin(t, f)
+	store, _ := syncer.Store(a.Username)
+	if _, err := (&syncWorker{user: a.Username, store: store}).syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	stored := store.DMs()
+	if len(stored) != 1 || stored[0].Ref != orig {
+		t.Fatalf("stored %+v", stored)
+	}
+
+	b := mastodonBackend{}
+	bob, err := b.ResolveUser(a, "bob.remote.example")
+	if err != nil || bob.Handle != "bob@remote.example" {
+		t.Fatalf("ResolveUser = %+v, %v", bob, err)
+	}
+	sent, err := b.Send(a, &Outgoing{To: []User{bob}, Text: "answer", InReplyTo: stored[0].ID})
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("Send = %+v, %v", sent, err)
+	}
+	st := f.status(sent[0].Ref)
+	if st == nil || st.Visibility != "direct" || st.InReplyTo != orig || statusText(st.Content) != "answer" {
+		t.Fatalf("posted status %+v", st)
+	}
+	if sent[0].ID != timeID(sent[0].CreatedAt, sent[0].Ref) {
+		t.Errorf("sent DM ID %d isn't its timeID", sent[0].ID)
+	}
+
+	if _, err := store.Add(sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(a, sent[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if f.status(sent[0].Ref) != nil {
+		t.Errorf("status %s wasn't deleted", sent[0].Ref)
+	}
+}
+
+func TestMastodonRefusesPrivateInstances(t *testing.T) {
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = false
+	for _, in := range []string{
+		"127.0.0.1",
+		"localhost:3000",
+		"http://10.1.2.3",
+		"192.168.0.1",
+		"169.254.169.254",
+		"[::1]",
+		"[fe80::1]:443",
+		"0.0.0.0",
+	} {
+		if u, err := normalizeInstance(in); err == nil {
+			t.Errorf("normalizeInstance(%q) = %q; want an error", in, u)
+		}
+	}
+	if u, err := normalizeInstance("ftp://mastodon.example"); err == nil {
+		t.Errorf("normalizeInstance accepted ftp: %q", u)
+	}
+
+	// And at dial time, for names that resolve somewhere private
+	// only after they're checked, and redirects.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+	if _, err := publicClient.Get(srv.URL); err == nil || !strings.Contains(err.Error(), errPrivateHost.Error()) {
+		t.Errorf("publicClient reached %s: %v", srv.URL, err)
+	}
+}
@@ -0,0 +1,878 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var matrixMaxMembers = flag.Int("matrix_max_members", 10, "Largest Matrix room, in members, to proxy as mail")
+
+// matrixBackend is the Backend for Matrix rooms, through the
+// client-server API of the homeserver in the account's Instance
+// field. Each room small enough for -matrix_max_members is a
+// conversation and its m.room.message events are the messages.
+// Encrypted rooms aren't supported: their messages are never seen
+// and sending to them is refused.
+//
+// Matrix user IDs like @alice:example.org are Handles, and their
+// mail addresses are alice.example.org@, as for Mastodon. Event IDs
+// aren't numbers, so DM IDs come from timeID and the event ID
+// itself is the DM's Ref.
+type matrixBackend struct{}
+
+const matrixClientAPI = "/_matrix/client/v3"
+
+func (matrixBackend) Name() string { return "matrix" }
+
+func (matrixBackend) Host(a *Account) string {
+	if a != nil {
+		if u, err := url.Parse(a.Instance); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	return "matrix"
+}
+
+// matrixHomeserver returns the client API base URL for what a user
+// typed as their homeserver, following the server's
+// .well-known/matrix/client delegation if it has one. Like Mastodon
+// instances, homeservers on our own network are refused, and so are
+// delegations to them.
+func matrixHomeserver(s string) (string, error) {
+	base, err := normalizeInstance(s)
+	if err != nil {
+		return "", err
+	}
+	res, err := publicClient.Get(base + "/.well-known/matrix/client")
+	if err != nil {
+		return base, nil
+	}
+	defer res.Body.Close()
+	var wk struct {
+		Homeserver struct {
+			BaseURL string `json:"base_url"`
+		} `json:"m.homeserver"`
+	}
+	if res.StatusCode != 200 || json.NewDecoder(res.Body).Decode(&wk) != nil || wk.Homeserver.BaseURL == "" {
+		return base, nil
+	}
+	u, err := url.Parse(wk.Homeserver.BaseURL)
+	if err != nil || u.Host == "" || u.Scheme != "https" && u.Scheme != "http" {
+		return "", fmt.Errorf("bad Matrix homeserver %q in %s's .well-known", wk.Homeserver.BaseURL, base)
+	}
+	if err := checkPublicHost(u.Host); err != nil {
+		return "", fmt.Errorf("bad Matrix homeserver %q: %v", wk.Homeserver.BaseURL, err)
+	}
+	return strings.TrimRight(wk.Homeserver.BaseURL, "/"), nil
+}
+
+// matrixServes reports whether hs is the homeserver for the server
+// name server, either directly or by delegation from the server's
+// .well-known. Any homeserver can say its token is for any user, so
+// without this it could sign in as someone else's account here.
+func matrixServes(server, hs string) bool {
+	u, err := url.Parse(hs)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, server) {
+		return true
+	}
+	res, err := publicClient.Get("https://" + server + "/.well-known/matrix/client")
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	var wk struct {
+		Homeserver struct {
+			BaseURL string `json:"base_url"`
+		} `json:"m.homeserver"`
+	}
+	if res.StatusCode != 200 || json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&wk) != nil {
+		return false
+	}
+	return strings.TrimRight(wk.Homeserver.BaseURL, "/") == hs
+}
+
+// StartLogin checks an access token pasted from the user's Matrix
+// client, since there's no OAuth flow we can count on. The token is
+// only taken from a POST body, never the URL.
+func (m matrixBackend) StartLogin(r *http.Request, callback string) (string, error) {
+	hs, err := matrixHomeserver(r.FormValue("homeserver"))
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(r.PostFormValue("access_token"))
+	if token == "" {
+		return "", errors.New("no Matrix access token given")
+	}
+	a := &Account{Token: token, Instance: hs}
+	self, err := m.whoami(a)
+	if err != nil {
+		return "", err
+	}
+	server := self[strings.Index(self, ":")+1:]
+	if !matrixServes(server, hs) {
+		return "", &RejectedError{fmt.Sprintf("%s says it's %s, but isn't that server's homeserver", hs, self)}
+	}
+	a.Username = strings.SplitN(m.MailAddress(User{Handle: self}), "@", 2)[0]
+	if !userRx.MatchString(a.Username) {
+		return "", fmt.Errorf("can't make a mail address for Matrix user %s", self)
+	}
+
+	return parkLogin(a, callback)
+}
+
+func (matrixBackend) FinishLogin(r *http.Request, callback string) (*Account, error) {
+	return claimLogin(r)
+}
+
+// call does an authorized request to a's homeserver and returns the
+// response body. in, if not nil, is sent as JSON.
+func (matrixBackend) call(a *Account, method, path string, params url.Values, in interface{}) ([]byte, error) {
+	u := strings.TrimRight(a.Instance, "/") + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	bs, err := api.DoPublicRequest(a, req, 0)
+	if e := asAPIError(err); e != nil {
+		e.Service = "Matrix"
+	}
+	return bs, err
+}
+
+// callJSON is call with the response decoded into out.
+func (m matrixBackend) callJSON(a *Account, method, path string, params url.Values, in, out interface{}) error {
+	body, err := m.call(a, method, path, params, in)
+	if err != nil {
+		return err
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("decoding %s: %v", path, err)
+	}
+	return nil
+}
+
+// roomPath returns the client API path for something in a room.
+func roomPath(room string, parts ...string) string {
+	p := matrixClientAPI + "/rooms/" + url.PathEscape(room)
+	for _, part := range parts {
+		p += "/" + url.PathEscape(part)
+	}
+	return p
+}
+
+var matrixTxn int64
+
+// txnID returns a new transaction ID for sending an event, so the
+// homeserver can tell a retry from a second message.
+func txnID() string {
+	return fmt.Sprintf("eight22er.%d.%d", time.Now().UnixNano(), atomic.AddInt64(&matrixTxn, 1))
+}
+
+var (
+	matrixSelfMu sync.Mutex
+	matrixSelf   = make(map[string]string) // user ID by access token
+)
+
+// whoami returns the account's Matrix user ID.
+func (m matrixBackend) whoami(a *Account) (string, error) {
+	matrixSelfMu.Lock()
+	id, ok := matrixSelf[a.Token]
+	matrixSelfMu.Unlock()
+	if ok {
+		return id, nil
+	}
+	var res struct {
+		UserID string `json:"user_id"`
+	}
+	if err := m.callJSON(a, "GET", matrixClientAPI+"/account/whoami", nil, nil, &res); err != nil {
+		return "", err
+	}
+	if res.UserID == "" {
+		return "", errors.New("no user_id in Matrix whoami response")
+	}
+	matrixSelfMu.Lock()
+	matrixSelf[a.Token] = res.UserID
+	matrixSelfMu.Unlock()
+	return res.UserID, nil
+}
+
+var (
+	matrixMembersMu sync.Mutex
+	matrixMembers   = make(map[string]map[string]string) // by token + " " + room
+)
+
+// members returns the joined and invited members of a room, mapped
+// to their display names. They're cached until a sync sees the
+// room's membership change.
+func (m matrixBackend) members(a *Account, room string) (map[string]string, error) {
+	key := a.Token + " " + room
+	matrixMembersMu.Lock()
+	mem, ok := matrixMembers[key]
+	matrixMembersMu.Unlock()
+	if ok {
+		return mem, nil
+	}
+	var res struct {
+		Chunk []matrixEvent `json:"chunk"`
+	}
+	if err := m.callJSON(a, "GET", roomPath(room, "members"), nil, nil, &res); err != nil {
+		return nil, err
+	}
+	mem = make(map[string]string)
+	for _, ev := range res.Chunk {
+		var c struct {
+			Membership  string `json:"membership"`
+			DisplayName string `json:"displayname"`
+		}
+		json.Unmarshal(ev.Content, &c)
+		if ev.StateKey != nil && (c.Membership == "join" || c.Membership == "invite") {
+			mem[*ev.StateKey] = c.DisplayName
+		}
+	}
+	matrixMembersMu.Lock()
+	matrixMembers[key] = mem
+	matrixMembersMu.Unlock()
+	return mem, nil
+}
+
+func forgetMembers(a *Account, room string) {
+	matrixMembersMu.Lock()
+	delete(matrixMembers, a.Token+" "+room)
+	matrixMembersMu.Unlock()
+}
+
+type matrixEvent struct {
+	Type     string          `json:"type"`
+	EventID  string          `json:"event_id"`
+	Sender   string          `json:"sender"`
+	TS       int64           `json:"origin_server_ts"` // Unix milliseconds
+	StateKey *string         `json:"state_key"`
+	Content  json.RawMessage `json:"content"`
+}
+
+type matrixMessage struct {
+	MsgType   string          `json:"msgtype"`
+	Body      string          `json:"body"`
+	URL       string          `json:"url,omitempty"` // mxc:// URI of an attached file
+	Info      *matrixFileInfo `json:"info,omitempty"`
+	RelatesTo *matrixRelation `json:"m.relates_to,omitempty"`
+}
+
+type matrixFileInfo struct {
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+type matrixRelation struct {
+	RelType   string          `json:"rel_type,omitempty"`
+	InReplyTo *matrixEventRef `json:"m.in_reply_to,omitempty"`
+}
+
+type matrixEventRef struct {
+	EventID string `json:"event_id"`
+}
+
+// matrixUser returns the User for a Matrix ID, named by its display
+// name in members.
+func matrixUser(id string, members map[string]string) User {
+	name := members[id]
+	if name == "" {
+		name = strings.SplitN(strings.TrimPrefix(id, "@"), ":", 2)[0]
+	}
+	return User{Handle: id, Name: name}
+}
+
+// dm converts an m.room.message event in room to a DM. It reports
+// false for other events, edits and redacted messages.
+func (matrixBackend) dm(self, room string, members map[string]string, ev matrixEvent) (DM, bool) {
+	if ev.Type != "m.room.message" {
+		return DM{}, false
+	}
+	var msg matrixMessage
+	if json.Unmarshal(ev.Content, &msg) != nil || msg.MsgType == "" {
+		return DM{}, false
+	}
+	if msg.RelatesTo != nil && msg.RelatesTo.RelType == "m.replace" {
+		return DM{}, false
+	}
+	created := time.Unix(0, ev.TS*int64(time.Millisecond))
+	dm := DM{
+		ID:           timeID(created, ev.EventID),
+		Text:         msg.Body,
+		CreatedAt:    created,
+		Sender:       matrixUser(ev.Sender, members),
+		Conversation: room,
+		Ref:          ev.EventID,
+	}
+	if msg.RelatesTo != nil && msg.RelatesTo.InReplyTo != nil {
+		dm.Text = stripReplyFallback(dm.Text)
+	}
+	switch msg.MsgType {
+	case "m.emote":
+		dm.Text = "* " + dm.Sender.Name + " " + dm.Text
+	case "m.image", "m.video", "m.audio", "m.file":
+		kind := "file"
+		switch msg.MsgType {
+		case "m.image":
+			kind = "photo"
+		case "m.video":
+			kind = "video"
+		}
+		if msg.URL != "" {
+			dm.Entities.Media = append(dm.Entities.Media, MediaEntity{Type: kind, MediaURLHTTPS: msg.URL})
+		}
+	}
+
+	if ev.Sender != self {
+		dm.Recipient = matrixUser(self, members)
+		return dm, true
+	}
+	var others []string
+	for id := range members {
+		if id != self {
+			others = append(others, id)
+		}
+	}
+	sort.Strings(others)
+	if len(others) > 0 {
+		dm.Recipient = matrixUser(others[0], members)
+	}
+	return dm, true
+}
+
+// stripReplyFallback removes the quote of the original message that
+// clients put at the start of a reply's body.
+func stripReplyFallback(body string) string {
+	lines := strings.Split(body, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i == 0 {
+		return body
+	}
+	return strings.TrimSpace(strings.Join(lines[i:], "\n"))
+}
+
+// Streams is just the one: /sync returns everything in every room.
+func (matrixBackend) Streams(a *Account) []string {
+	return []string{"rooms"}
+}
+
+// Sync does an incremental /sync from the next_batch token saved in
+// c.Token. The first sync takes only the most recent messages in
+// each room and leaves the rest of each room's history to be walked
+// back through in later syncs, from the tokens in c.Backfill. When a
+// room has had more messages since the last sync than fit in its
+// timeline, the gap is filled in from the room's history.
+func (m matrixBackend) Sync(a *Account, stream string, c *SyncCursor) ([]DM, error) {
+	self, err := m.whoami(a)
+	if err != nil {
+		return nil, err
+	}
+	limit := *dmPageSize
+	if limit > 100 {
+		limit = 100
+	}
+	params := make(url.Values)
+	params.Set("timeout", "0")
+	params.Set("filter", fmt.Sprintf(`{"room":{"timeline":{"limit":%d}},"presence":{"not_types":["*"]},"account_data":{"not_types":["*"]}}`, limit))
+	if c.Token != "" {
+		params.Set("since", c.Token)
+	}
+	var res struct {
+		NextBatch string `json:"next_batch"`
+		Rooms     struct {
+			Join map[string]struct {
+				Timeline struct {
+					Events    []matrixEvent `json:"events"`
+					Limited   bool          `json:"limited"`
+					PrevBatch string        `json:"prev_batch"`
+				} `json:"timeline"`
+				State struct {
+					Events []matrixEvent `json:"events"`
+				} `json:"state"`
+			} `json:"join"`
+		} `json:"rooms"`
+	}
+	if err := m.callJSON(a, "GET", matrixClientAPI+"/sync", params, nil, &res); err != nil {
+		return nil, err
+	}
+	if res.NextBatch == "" {
+		return nil, errors.New("no next_batch in Matrix sync response")
+	}
+
+	var got []DM
+	for room, r := range res.Rooms.Join {
+		for _, ev := range append(r.State.Events, r.Timeline.Events...) {
+			if ev.Type == "m.room.member" {
+				forgetMembers(a, room)
+				break
+			}
+		}
+		members, err := m.members(a, room)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) > *matrixMaxMembers {
+			continue
+		}
+		for _, ev := range r.Timeline.Events {
+			if dm, ok := m.dm(self, room, members, ev); ok {
+				got = append(got, dm)
+			}
+		}
+		if !r.Timeline.Limited || r.Timeline.PrevBatch == "" {
+			continue
+		}
+		if c.Token == "" {
+			if c.Backfill == nil {
+				c.Backfill = make(map[string]string)
+			}
+			c.Backfill[room] = r.Timeline.PrevBatch
+			continue
+		}
+		older, _, err := m.roomDMs(a, self, room, members, r.Timeline.PrevBatch, c.NewestID, 0)
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, older...)
+	}
+	dms := keepSynced(a, c, got)
+	c.Token = res.NextBatch
+
+	older, err := m.backfill(a, self, c)
+	dms = append(dms, keepSynced(a, c, older)...)
+	sort.Sort(dmsByNewest(dms))
+	c.Complete = len(c.Backfill) == 0
+	return dms, err
+}
+
+// backfill walks back through the history of each room in
+// c.Backfill, as far as -dm_max_pages pages a room, and returns the
+// messages it found. Rooms whose start it reaches, or that have
+// grown too big to proxy, are dropped from c.Backfill; the rest
+// are left to continue from where this walk stopped.
+func (m matrixBackend) backfill(a *Account, self string, c *SyncCursor) ([]DM, error) {
+	var rooms []string
+	for room := range c.Backfill {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	var got []DM
+	for _, room := range rooms {
+		members, err := m.members(a, room)
+		if err != nil {
+			return got, err
+		}
+		if len(members) > *matrixMaxMembers {
+			delete(c.Backfill, room)
+			continue
+		}
+		dms, next, err := m.roomDMs(a, self, room, members, c.Backfill[room], 0, 0)
+		if err != nil {
+			return got, err
+		}
+		got = append(got, dms...)
+		if next == "" {
+			delete(c.Backfill, room)
+		} else {
+			c.Backfill[room] = next
+		}
+	}
+	return got, nil
+}
+
+// roomDMs pages back through a room's history from the token from
+// ("" for the newest message) and returns its messages newer than
+// after, newest first: up to n of them, or if n is 0, as many as
+// -dm_max_pages pages hold. If it stopped at -dm_max_pages, it also
+// returns the token to continue from.
+func (m matrixBackend) roomDMs(a *Account, self, room string, members map[string]string, from string, after int64, n int) ([]DM, string, error) {
+	var dms []DM
+	for pages := 0; *dmMaxPages == 0 || pages < *dmMaxPages; pages++ {
+		params := make(url.Values)
+		params.Set("dir", "b")
+		params.Set("limit", "100")
+		params.Set("filter", `{"types":["m.room.message"]}`)
+		if from != "" {
+			params.Set("from", from)
+		}
+		var res struct {
+			Chunk []matrixEvent `json:"chunk"`
+			End   string        `json:"end"`
+		}
+		if err := m.callJSON(a, "GET", roomPath(room, "messages"), params, nil, &res); err != nil {
+			return nil, "", err
+		}
+		for _, ev := range res.Chunk {
+			dm, ok := m.dm(self, room, members, ev)
+			if !ok {
+				continue
+			}
+			if dm.ID <= after {
+				return dms, "", nil
+			}
+			dms = append(dms, dm)
+			if n > 0 && len(dms) >= n {
+				return dms, "", nil
+			}
+		}
+		if len(res.Chunk) == 0 || res.End == "" {
+			return dms, "", nil
+		}
+		from = res.End
+	}
+	return dms, from, nil
+}
+
+// rooms returns the IDs of the rooms a has joined that are small
+// enough to proxy, with their members.
+func (m matrixBackend) rooms(a *Account) (map[string]map[string]string, error) {
+	var res struct {
+		JoinedRooms []string `json:"joined_rooms"`
+	}
+	if err := m.callJSON(a, "GET", matrixClientAPI+"/joined_rooms", nil, nil, &res); err != nil {
+		return nil, err
+	}
+	rooms := make(map[string]map[string]string)
+	for _, room := range res.JoinedRooms {
+		members, err := m.members(a, room)
+		if err != nil {
+			return nil, err
+		}
+		if len(members) <= *matrixMaxMembers {
+			rooms[room] = members
+		}
+	}
+	return rooms, nil
+}
+
+type convsByNewest []Conversation
+
+func (s convsByNewest) Len() int           { return len(s) }
+func (s convsByNewest) Less(i, j int) bool { return s[i].Latest.ID > s[j].Latest.ID }
+func (s convsByNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+func (m matrixBackend) Conversations(a *Account) ([]Conversation, error) {
+	self, err := m.whoami(a)
+	if err != nil {
+		return nil, err
+	}
+	rooms, err := m.rooms(a)
+	if err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	for room, members := range rooms {
+		latest, _, err := m.roomDMs(a, self, room, members, "", 0, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(latest) == 0 {
+			continue
+		}
+		conv := Conversation{ID: room, Latest: latest[0]}
+		for id := range members {
+			if id != self {
+				conv.Participants = append(conv.Participants, matrixUser(id, members))
+			}
+		}
+		convs = append(convs, conv)
+	}
+	sort.Sort(convsByNewest(convs))
+	return convs, nil
+}
+
+func (m matrixBackend) Messages(a *Account, conv string, n int) ([]DM, error) {
+	self, err := m.whoami(a)
+	if err != nil {
+		return nil, err
+	}
+	members, err := m.members(a, conv)
+	if err != nil {
+		return nil, err
+	}
+	dms, _, err := m.roomDMs(a, self, conv, members, "", 0, n)
+	return dms, err
+}
+
+// Send posts the message in the room it replies to if every
+// recipient is in that room, and otherwise in the room with exactly
+// the recipients, creating one if there isn't one. Attached files
+// follow the text as messages of their own.
+func (m matrixBackend) Send(a *Account, out *Outgoing) ([]DM, error) {
+	if strings.TrimSpace(out.Text) == "" && len(out.MediaIDs) == 0 {
+		return nil, &RejectedError{"empty message"}
+	}
+	self, err := m.whoami(a)
+	if err != nil {
+		return nil, err
+	}
+	var room, replyTo string
+	if orig, ok := storedDM(a, out.InReplyTo); ok && out.InReplyTo != 0 && orig.Conversation != "" {
+		members, err := m.members(a, orig.Conversation)
+		if err != nil {
+			return nil, err
+		}
+		room, replyTo = orig.Conversation, orig.Ref
+		for _, to := range out.To {
+			if _, ok := members[to.Handle]; !ok {
+				room, replyTo = "", ""
+			}
+		}
+	}
+	if room == "" {
+		if room, err = m.roomWith(a, self, out.To); err != nil {
+			return nil, err
+		}
+	}
+	err = m.callJSON(a, "GET", roomPath(room, "state", "m.room.encryption", ""), nil, nil, nil)
+	if err == nil {
+		return nil, &RejectedError{"can't send to an encrypted Matrix room"}
+	}
+	if e := asAPIError(err); e == nil || e.StatusCode != 404 {
+		return nil, err
+	}
+
+	var msgs []matrixMessage
+	if strings.TrimSpace(out.Text) != "" {
+		msg := matrixMessage{MsgType: "m.text", Body: out.Text}
+		if replyTo != "" {
+			msg.RelatesTo = &matrixRelation{InReplyTo: &matrixEventRef{replyTo}}
+		}
+		msgs = append(msgs, msg)
+	}
+	for _, mxc := range out.MediaIDs {
+		msgs = append(msgs, uploadedMessage(mxc))
+	}
+
+	members, err := m.members(a, room)
+	if err != nil {
+		return nil, err
+	}
+	var sent []DM
+	for _, msg := range msgs {
+		var res struct {
+			EventID string `json:"event_id"`
+		}
+		if err := m.callJSON(a, "PUT", roomPath(room, "send", "m.room.message", txnID()), nil, msg, &res); err != nil {
+			return sent, err
+		}
+		// Fetch the event back for the server's timestamp, which
+		// the DM's ID is made from.
+		var ev matrixEvent
+		if err := m.callJSON(a, "GET", roomPath(room, "event", res.EventID), nil, nil, &ev); err != nil {
+			return sent, err
+		}
+		if dm, ok := m.dm(self, room, members, ev); ok {
+			sent = append(sent, dm)
+		}
+	}
+	return sent, nil
+}
+
+// roomWith returns the room whose other members are exactly to,
+// creating it and inviting them if there isn't one.
+func (m matrixBackend) roomWith(a *Account, self string, to []User) (string, error) {
+	want := make(map[string]bool)
+	for _, u := range to {
+		want[u.Handle] = true
+	}
+	rooms, err := m.rooms(a)
+	if err != nil {
+		return "", err
+	}
+	var candidates []string
+	for room, members := range rooms {
+		if len(members) != len(want)+1 {
+			continue
+		}
+		match := true
+		for id := range members {
+			if id != self && !want[id] {
+				match = false
+			}
+		}
+		if match {
+			candidates = append(candidates, room)
+		}
+	}
+	if len(candidates) > 0 {
+		sort.Strings(candidates)
+		return candidates[0], nil
+	}
+
+	create := struct {
+		Preset   string   `json:"preset"`
+		IsDirect bool     `json:"is_direct"`
+		Invite   []string `json:"invite"`
+	}{Preset: "trusted_private_chat", IsDirect: len(to) == 1}
+	for _, u := range to {
+		create.Invite = append(create.Invite, u.Handle)
+	}
+	var res struct {
+		RoomID string `json:"room_id"`
+	}
+	if err := m.callJSON(a, "POST", matrixClientAPI+"/createRoom", nil, create, &res); err != nil {
+		return "", err
+	}
+	return res.RoomID, nil
+}
+
+func (m matrixBackend) Delete(a *Account, id int64) error {
+	dm, ok := storedDM(a, id)
+	if !ok || dm.Ref == "" || dm.Conversation == "" {
+		return fmt.Errorf("no Matrix event for message %d", id)
+	}
+	return m.callJSON(a, "PUT", roomPath(dm.Conversation, "redact", dm.Ref, txnID()), nil, struct{}{}, nil)
+}
+
+// matrixUploads remembers the name and type of files uploaded for
+// messages about to be sent, by mxc:// URI, since Send only gets
+// the URIs.
+var matrixUploads = struct {
+	sync.Mutex
+	m map[string]attachment // without Data
+}{m: make(map[string]attachment)}
+
+func (m matrixBackend) UploadMedia(a *Account, filename string, data []byte) (string, error) {
+	ct := http.DetectContentType(data)
+	u := strings.TrimRight(a.Instance, "/") + "/_matrix/media/v3/upload?" + url.Values{"filename": {filename}}.Encode()
+	req, err := http.NewRequest("POST", u, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.Token)
+	req.Header.Set("Content-Type", ct)
+	body, err := api.DoPublicRequest(a, req, 0)
+	if e := asAPIError(err); e != nil {
+		e.Service = "Matrix"
+	}
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		ContentURI string `json:"content_uri"`
+	}
+	if err := json.Unmarshal(body, &res); err != nil || res.ContentURI == "" {
+		return "", fmt.Errorf("bad Matrix upload response: %q", body)
+	}
+	matrixUploads.Lock()
+	matrixUploads.m[res.ContentURI] = attachment{Filename: filename, ContentType: ct}
+	matrixUploads.Unlock()
+	return res.ContentURI, nil
+}
+
+// uploadedMessage returns the message that sends an uploaded file.
+func uploadedMessage(mxc string) matrixMessage {
+	matrixUploads.Lock()
+	att, ok := matrixUploads.m[mxc]
+	delete(matrixUploads.m, mxc)
+	matrixUploads.Unlock()
+	if !ok {
+		att = attachment{Filename: "attachment", ContentType: "application/octet-stream"}
+	}
+	msg := matrixMessage{MsgType: "m.file", Body: att.Filename, URL: mxc}
+	switch {
+	case strings.HasPrefix(att.ContentType, "image/"):
+		msg.MsgType = "m.image"
+	case strings.HasPrefix(att.ContentType, "video/"):
+		msg.MsgType = "m.video"
+	case strings.HasPrefix(att.ContentType, "audio/"):
+		msg.MsgType = "m.audio"
+	}
+	msg.Info = &matrixFileInfo{MimeType: att.ContentType}
+	return msg
+}
+
+// ResolveUser turns "alice.example.org" back into
+// @alice:example.org. User IDs can have dots before the server name
+// too, so each split is tried in turn until the server knows the
+// user.
+func (m matrixBackend) ResolveUser(a *Account, localpart string) (User, error) {
+	if !strings.Contains(localpart, ".") {
+		return User{}, &RejectedError{fmt.Sprintf("%q isn't a Matrix user; use user.server", localpart)}
+	}
+	for i := strings.Index(localpart, "."); i >= 0; {
+		id := "@" + localpart[:i] + ":" + localpart[i+1:]
+		var res struct {
+			DisplayName string `json:"displayname"`
+		}
+		err := m.callJSON(a, "GET", matrixClientAPI+"/profile/"+url.PathEscape(id), nil, nil, &res)
+		if err == nil {
+			return matrixUser(id, map[string]string{id: res.DisplayName}), nil
+		}
+		if e := asAPIError(err); e == nil || e.StatusCode != 404 {
+			return User{}, err
+		}
+		j := strings.Index(localpart[i+1:], ".")
+		if j < 0 {
+			break
+		}
+		i += j + 1
+	}
+	return User{}, &APIError{StatusCode: 404, Message: "no such user " + localpart, Service: "Matrix"}
+}
+
+func (matrixBackend) MailAddress(u User) string {
+	return strings.Replace(strings.TrimPrefix(u.Handle, "@"), ":", ".", 1) + "@eight22er.danga.com"
+}
+
+// FetchMedia downloads an mxc:// URI through the homeserver's
+// authenticated media API, falling back to the old unauthenticated
+// one for servers without it.
+func (m matrixBackend) FetchMedia(a *Account, u string, maxBytes int64) ([]byte, error) {
+	if !strings.HasPrefix(u, "mxc://") {
+		return nil, fmt.Errorf("not a Matrix media URI: %q", u)
+	}
+	base := strings.TrimRight(a.Instance, "/")
+	var bs []byte
+	var err error
+	for _, prefix := range []string{"/_matrix/client/v1/media/download/", "/_matrix/media/v3/download/"} {
+		var req *http.Request
+		req, err = http.NewRequest("GET", base+prefix+strings.TrimPrefix(u, "mxc://"), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		bs, err = api.DoPublicRequest(a, req, maxBytes)
+		if e := asAPIError(err); e == nil || e.StatusCode != 404 {
+			break
+		}
+	}
+	if err == errBodyTooBig {
+		return nil, errMediaTooBig
+	}
+	return bs, err
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHomeserver is just enough of a Matrix homeserver for
+// eight22er. Its sync tokens are "s" and a count of events, and its
+// history tokens are "t" and the index in the room's timeline to
+// page back from. It returns at most three events a page, as servers
+// may, so history walks take several pages.
+type fakeHomeserver struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	rooms  map[string]*fakeRoom
+	events int // in every room; the next sync token
+}
+
+type fakeRoom struct {
+	members  []string
+	timeline []matrixEvent // oldest first
+	seq      []int         // f.events after each event in timeline
+}
+
+const (
+	fakeMatrixToken = "fake-matrix-token"
+	fakeMatrixSelf  = "@alice:example.org"
+	fakeMatrixPage  = 3
+)
+
+func newFakeHomeserver(t *testing.T) *fakeHomeserver {
+	f := &fakeHomeserver{rooms: make(map[string]*fakeRoom)}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	serveHost(t, "example.org", f.Server)
+	return f
+}
+
+func (f *fakeHomeserver) addRoom(id string, members ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rooms[id] = &fakeRoom{members: members}
+}
+
+// say adds a text message from sender to room and returns its
+// event ID.
+func (f *fakeHomeserver) say(room, sender, text string, at time.Time) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sayLocked(room, sender, matrixMessage{MsgType: "m.text", Body: text}, at)
+}
+
+func (f *fakeHomeserver) sayLocked(room, sender string, msg matrixMessage, at time.Time) string {
+	r := f.rooms[room]
+	f.events++
+	content, _ := json.Marshal(msg)
+	ev := matrixEvent{
+		Type:    "m.room.message",
+		EventID: fmt.Sprintf("$ev%d", f.events),
+		Sender:  sender,
+		TS:      at.UnixNano() / int64(time.Millisecond),
+		Content: content,
+	}
+	r.timeline = append(r.timeline, ev)
+	r.seq = append(r.seq, f.events)
+	return ev.EventID
+}
+
+func (f *fakeHomeserver) event(room, id string) (matrixEvent, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ev := range f.rooms[room].timeline {
+		if ev.EventID == id {
+			return ev, true
+		}
+	}
+	return matrixEvent{}, false
+}
+
+func (f *fakeHomeserver) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reply := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+	fail := func(code int, errcode, msg string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(map[string]string{"errcode": errcode, "error": msg})
+	}
+	if r.URL.Path == "/.well-known/matrix/client" {
+		// example.org, the server name in the fake's user IDs,
+		// delegates to it; the fake itself delegates nowhere.
+		if r.Host != "example.org" {
+			fail(404, "M_NOT_FOUND", "no delegation")
+			return
+		}
+		reply(map[string]interface{}{"m.homeserver": map[string]string{"base_url": f.URL}})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer "+fakeMatrixToken {
+		fail(401, "M_UNKNOWN_TOKEN", "Invalid access token")
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.EscapedPath(), matrixClientAPI)
+	var parts []string
+	for _, p := range strings.Split(strings.Trim(path, "/"), "/") {
+		p, _ = url.PathUnescape(p)
+		parts = append(parts, p)
+	}
+	var room *fakeRoom
+	if len(parts) >= 3 && parts[0] == "rooms" {
+		if room = f.rooms[parts[1]]; room == nil {
+			fail(403, "M_FORBIDDEN", "not in room")
+			return
+		}
+	}
+
+	switch {
+	case path == "/account/whoami":
+		reply(map[string]string{"user_id": fakeMatrixSelf})
+	case path == "/joined_rooms":
+		ids := []string{}
+		for id := range f.rooms {
+			ids = append(ids, id)
+		}
+		reply(map[string][]string{"joined_rooms": ids})
+	case path == "/sync":
+		var filter struct {
+			Room struct {
+				Timeline struct {
+					Limit int `json:"limit"`
+				} `json:"timeline"`
+			} `json:"room"`
+		}
+		json.Unmarshal([]byte(r.FormValue("filter")), &filter)
+		since, _ := strconv.Atoi(strings.TrimPrefix(r.FormValue("since"), "s"))
+		type timeline struct {
+			Events    []matrixEvent `json:"events"`
+			Limited   bool          `json:"limited"`
+			PrevBatch string        `json:"prev_batch"`
+		}
+		join := make(map[string]interface{})
+		for id, rm := range f.rooms {
+			start := len(rm.timeline)
+			for start > 0 && rm.seq[start-1] > since {
+				start--
+			}
+			if start == len(rm.timeline) {
+				continue
+			}
+			tl := timeline{Events: rm.timeline[start:]}
+			if n := filter.Room.Timeline.Limit; n > 0 && len(tl.Events) > n {
+				start = len(rm.timeline) - n
+				tl.Events, tl.Limited = rm.timeline[start:], true
+			}
+			tl.PrevBatch = fmt.Sprintf("t%d", start)
+			join[id] = map[string]interface{}{"timeline": tl}
+		}
+		reply(map[string]interface{}{
+			"next_batch": fmt.Sprintf("s%d", f.events),
+			"rooms":      map[string]interface{}{"join": join},
+		})
+	case room != nil && parts[2] == "members":
+		var chunk []matrixEvent
+		for _, m := range room.members {
+			m := m
+			chunk = append(chunk, matrixEvent{Type: "m.room.member", StateKey: &m, Content: json.RawMessage(`{"membership":"join"}`)})
+		}
+		reply(map[string][]matrixEvent{"chunk": chunk})
+	case room != nil && parts[2] == "messages":
+		from := len(room.timeline)
+		if t := r.FormValue("from"); t != "" {
+			from, _ = strconv.Atoi(strings.TrimPrefix(t, "t"))
+		}
+		chunk := []matrixEvent{}
+		i := from - 1
+		for ; i >= 0 && len(chunk) < fakeMatrixPage; i-- {
+			chunk = append(chunk, room.timeline[i])
+		}
+		res := map[string]interface{}{"start": fmt.Sprintf("t%d", from), "chunk": chunk}
+		if i >= 0 {
+			res["end"] = fmt.Sprintf("t%d", i+1)
+		}
+		reply(res)
+	case room != nil && parts[2] == "state":
+		fail(404, "M_NOT_FOUND", "Event not found")
+	case room != nil && parts[2] == "send" && r.Method == "PUT":
+		var msg matrixMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		reply(map[string]string{"event_id": f.sayLocked(parts[1], fakeMatrixSelf, msg, time.Now())})
+	case room != nil && parts[2] == "event" && len(parts) == 4:
+		for _, ev := range room.timeline {
+			if ev.EventID == parts[3] {
+				reply(ev)
+				return
+			}
+		}
+		fail(404, "M_NOT_FOUND", "Event not found")
+	case room != nil && parts[2] == "redact" && r.Method == "PUT":
+		for i, ev := range room.timeline {
+			if ev.EventID == parts[3] {
+				room.timeline[i].Content = json.RawMessage(`{}`)
+				reply(map[string]string{"event_id": "$redaction"})
+				return
+			}
+		}
+		fail(404, "M_NOT_FOUND", "Event not found")
+	case len(parts) == 2 && parts[0] == "profile":
+		for _, rm := range f.rooms {
+			for _, m := range rm.members {
+				if m == parts[1] {
+					reply(map[string]string{"displayname": strings.ToUpper(m[1:2]) + m[2:strings.Index(m, ":")]})
+					return
+				}
+			}
+		}
+		fail(404, "M_NOT_FOUND", "Profile was not found")
+	default:
+		fail(404, "M_UNRECOGNIZED", "no such endpoint "+r.URL.Path)
+	}
+}
+
+// matrixLogin signs in to f through the web handlers, as a user
+// would, and returns the saved account.
+func matrixLogin(t *testing.T, f *fakeHomeserver) *Account {
+	form := url.Values{"backend": {"matrix"}, "homeserver": {f.URL}, "access_token": {fakeMatrixToken}}
+	w := httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	cb, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || cb.Query().Get("state") == "" {
+		t.Fatalf("login redirected to %q", w.Header().Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	cbFunc(w, httptest.NewRequest("GET", "/cb?"+cb.RawQuery, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	a := GetAccountNoAuth("alice.example.org")
+	if a.Backend != "matrix" || a.Token != fakeMatrixToken || a.Instance != f.URL || a.Password == "" || a.Password == a.Token {
+		t.Fatalf("saved account = %+v", a)
+	}
+	if loc := w.Header().Get("Location"); strings.Contains(loc, a.Password) {
+		t.Errorf("callback put the password in %q", loc)
+	}
+	var secrets url.Values
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "config" {
+			secrets, _ = url.ParseQuery(c.Value)
+		}
+	}
+	if secrets.Get("password") != a.Password {
+		t.Errorf("config cookie has %v; want the account's password", secrets)
+	}
+	return a
+}
+
+func TestMatrixSyncBackfillsHistory(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+	defer func(n int) { *dmPageSize = n }(*dmPageSize)
+	*dmPageSize = 2
+	defer func(n int) { *dmMaxPages = n }(*dmMaxPages)
+	*dmMaxPages = 1
+
+	f := newFakeHomeserver(t)
+	const dm, big = "!dm:example.org", "!big:example.org"
+	f.addRoom(dm, fakeMatrixSelf, "@bob:example.org")
+	crowd := []string{fakeMatrixSelf}
+	for i := 0; i < *matrixMaxMembers; i++ {
+		crowd = append(crowd, fmt.Sprintf("@user%d:example.org", i))
+	}
+	f.addRoom(big, crowd...)
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		from := "@bob:example.org"
+		if i%2 == 1 {
+			from = fakeMatrixSelf
+		}
+		f.say(dm, from, fmt.Sprintf("message %d", i), start.Add(time.Duration(i)*time.Minute))
+	}
+	f.say(big, "@user0:example.org", "hello everyone", start)
+
+	a := matrixLogin(t, f)
+	store, err := syncer.Store(a.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &syncWorker{user: a.Username, store: store}
+
+	// The newest two from the timeline, then one page of history.
+	if n, err := w.syncOnce(); err != nil || n != 5 {
+		t.Fatalf("first sync = %d, %v; want 5 DMs", n, err)
+	}
+	c := store.Cursor("rooms")
+	if c.Complete || c.Backfill[dm] != "t3" || len(c.Backfill) != 1 {
+		t.Fatalf("cursor after first sync = %+v; want to continue %s from t3", c, dm)
+	}
+	if n, err := w.syncOnce(); err != nil || n != 3 {
+		t.Fatalf("second sync = %d, %v; want 3 DMs", n, err)
+	}
+	if c := store.Cursor("rooms"); !c.Complete || len(c.Backfill) != 0 {
+		t.Fatalf("cursor after second sync = %+v; want complete", c)
+	}
+
+	dms := store.DMs()
+	var got []string
+	for _, dm := range dms {
+		got = append(got, fmt.Sprintf("%s>%s %q", dm.Sender.Handle, dm.Recipient.Handle, dm.Text))
+	}
+	var want []string
+	for i := 7; i >= 0; i-- {
+		if i%2 == 1 {
+			want = append(want, fmt.Sprintf("@alice:example.org>@bob:example.org \"message %d\"", i))
+		} else {
+			want = append(want, fmt.Sprintf("@bob:example.org>@alice:example.org \"message %d\"", i))
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("synced:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	f.say(dm, "@bob:example.org", "again", start.Add(time.Hour))
+	if n, err := w.syncOnce(); err != nil || n != 1 {
+		t.Fatalf("third sync = %d, %v; want 1 DM", n, err)
+	}
+}
+
+func TestMatrixSendReplyDelete(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+
+	f := newFakeHomeserver(t)
+	const room = "!dm:example.org"
+	f.addRoom(room, fakeMatrixSelf, "@bob:example.org")
+	orig := f.say(room, "@bob:example.org", "question?", time.Now().Add(-time.Hour))
+	a := matrixLogin(t, f)
+	store, _ := syncer.Store(a.Username)
+	if _, err := (&syncWorker{user: a.Username, store: store}).syncOnce(); err != nil {
+		t.Fatal(err)
+	}
+	stored := store.DMs()
+	if len(stored) != 1 || stored[0].Ref != orig {
+		t.Fatalf("stored %+v", stored)
+	}
+
+	b := matrixBackend{}
+	bob, err := b.ResolveUser(a, "bob.example.org")
+	if err != nil || bob.Handle != "@bob:example.org" || bob.Name != "Bob" {
+		t.Fatalf("ResolveUser = %+v, %v", bob, err)
+	}
+	sent, err := b.Send(a, &Outgoing{To: []User{bob}, Text: "answer", InReplyTo: stored[0].ID})
+	if err != nil || len(sent) != 1 {
+		t.Fatalf("Send = %+v, %v", sent, err)
+	}
+	ev, ok := f.event(room, sent[0].Ref)
+	var msg matrixMessage
+	if ok {
+		json.Unmarshal(ev.Content, &msg)
+	}
+	if !ok || msg.Body != "answer" || msg.RelatesTo == nil || msg.RelatesTo.InReplyTo == nil || msg.RelatesTo.InReplyTo.EventID != orig {
+		t.Fatalf("sent event %+v", ev)
+	}
+	if sent[0].Recipient.Handle != "@bob:example.org" || sent[0].Conversation != room {
+		t.Errorf("sent DM = %+v", sent[0])
+	}
+
+	if _, err := store.Add(sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete(a, sent[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if ev, _ := f.event(room, sent[0].Ref); string(ev.Content) != "{}" {
+		t.Errorf("event %s wasn't redacted", sent[0].Ref)
+	}
+}
+
+func TestMatrixLoginChecksServerName(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	*allowPrivateHosts = true
+
+	newFakeHomeserver(t) // example.org's real homeserver
+	evil := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != matrixClientAPI+"/account/whoami" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"user_id": fakeMatrixSelf})
+	}))
+	defer evil.Close()
+
+	form := url.Values{"backend": {"matrix"}, "homeserver": {evil.URL}, "access_token": {"anything"}}
+	w := httptest.NewRecorder()
+	loginFunc(w, postForm("/login", form))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("login through a homeserver that isn't example.org's: %d %s", w.Code, w.Header().Get("Location"))
+	}
+}
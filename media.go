@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	maxMediaBytes = flag.Int("max_media_bytes", 5<<20, "Largest DM photo or video to attach to a message; bigger ones are left as links")
+	mediaRetry    = flag.Duration("media_retry", time.Hour, "How long to wait before trying again to download DM media that couldn't be fetched")
+)
+
+const mediaCacheDir = "db/media"
+
+// A mediaRef is a photo or video attached to a DM.
+type mediaRef struct {
+	URL  string // where to download it from
+	Kind string // "photo", "video" or "animated_gif"
+}
+
+// media returns the photos and videos attached to the DM.
+func (d DM) media() []mediaRef {
+	var refs []mediaRef
+	seen := map[string]bool{}
+	for _, m := range d.Entities.Media {
+		u := m.MediaURLHTTPS
+		if m.Type == "video" || m.Type == "animated_gif" {
+			if vu := bestVideoVariant(m); vu != "" {
+				u = vu
+			}
+		}
+		if u == "" || seen[u] {
+			continue
+		}
+		seen[u] = true
+		refs = append(refs, mediaRef{URL: u, Kind: m.Type})
+	}
+	return refs
+}
+
+// bestVideoVariant returns the URL of the highest bitrate MP4
+// variant of a video media entity.
+func bestVideoVariant(m MediaEntity) string {
+	best, bestRate := "", -1
+	for _, v := range m.VideoInfo.Variants {
+		if v.ContentType == "video/mp4" && v.URL != "" && v.Bitrate > bestRate {
+			best, bestRate = v.URL, v.Bitrate
+		}
+	}
+	return best
+}
+
+var errMediaTooBig = errors.New("media too large")
+
+func mediaCacheFile(u string) string {
+	return filepath.Join(mediaCacheDir, fmt.Sprintf("%x", sha1.Sum([]byte(u))))
+}
+
+// accountMediaFile is where media for URL u that came from user
+// rather than from their service, as files in an uploaded archive
+// do, is kept. Nothing vouches that it's what u serves, so only
+// user's own messages use it.
+func accountMediaFile(user, u string) string {
+	return filepath.Join(mediaCacheDir, strings.ToLower(user), fmt.Sprintf("%x", sha1.Sum([]byte(u))))
+}
+
+// A media URL that couldn't be attached has a marker file next to
+// where it would be cached, so it isn't downloaded again on every
+// render, and a message's size stays the same between POP's LIST and
+// RETR. The marker is "too big <max_media_bytes>", which holds until
+// the limit is raised, or "unavailable: <error>", which holds for
+// -media_retry.
+func mediaMarkerFile(u string) string {
+	return mediaCacheFile(u) + ".none"
+}
+
+// mediaMarker returns the error the marker for u records, or nil if
+// there's no marker or it no longer applies.
+func mediaMarker(u string) error {
+	file := mediaMarkerFile(u)
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	marker := strings.TrimSpace(string(bs))
+	if strings.HasPrefix(marker, "too big ") {
+		limit, err := strconv.Atoi(strings.TrimPrefix(marker, "too big "))
+		if err == nil && *maxMediaBytes <= limit {
+			return errMediaTooBig
+		}
+		return nil
+	}
+	if time.Since(fi.ModTime()) < *mediaRetry {
+		return errors.New(marker)
+	}
+	return nil
+}
+
+func setMediaMarker(u string, err error) {
+	marker := "unavailable: " + oneLine(err.Error())
+	if err == errMediaTooBig {
+		marker = fmt.Sprintf("too big %d", *maxMediaBytes)
+	}
+	if err := os.MkdirAll(mediaCacheDir, 0700); err != nil {
+		log.Printf("media cache: %v", err)
+	} else if err := ioutil.WriteFile(mediaMarkerFile(u), []byte(marker+"\n"), 0600); err != nil {
+		log.Printf("media cache: %v", err)
+	}
+}
+
+// mediaPending reports whether any of the DM's media couldn't be
+// fetched for a reason that may go away, so its rendering shouldn't
+// be cached for good.
+func (d DM) mediaPending(a *Account) bool {
+	if a == nil || a.NoMedia {
+		return false
+	}
+	for _, m := range d.media() {
+		if _, err := os.Stat(accountMediaFile(a.Username, m.URL)); err == nil {
+			continue
+		}
+		if err := mediaMarker(m.URL); err != nil && err != errMediaTooBig {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchMedia returns the contents of a DM's media URL, downloading
+// it through the account's backend if it isn't already cached on
+// disk, for everyone or for a alone. Failures are cached too; see
+// mediaMarkerFile.
+func (a *Account) fetchMedia(u string) ([]byte, error) {
+	if bs, err := ioutil.ReadFile(accountMediaFile(a.Username, u)); err == nil {
+		return bs, nil
+	}
+	cacheFile := mediaCacheFile(u)
+	if bs, err := ioutil.ReadFile(cacheFile); err == nil {
+		return bs, nil
+	}
+	if err := mediaMarker(u); err != nil {
+		return nil, err
+	}
+	bs, err := backendFor(a).FetchMedia(a, u, int64(*maxMediaBytes))
+	if err != nil {
+		setMediaMarker(u, err)
+		return nil, err
+	}
+	if err := os.MkdirAll(mediaCacheDir, 0700); err != nil {
+		log.Printf("media cache: %v", err)
+	} else if err := ioutil.WriteFile(cacheFile, bs, 0600); err != nil {
+		log.Printf("media cache: %v", err)
+	} else {
+		os.Remove(mediaMarkerFile(u))
+	}
+	return bs, nil
+}
+
+// An attachment is a downloaded media file ready to be embedded in
+// a message.
+type attachment struct {
+	Filename    string
+	ContentType string
+	Inline      bool
+	Data        []byte
+}
+
+// attachments downloads the DM's media for a. Media that can't be
+// fetched or is too large is skipped; its t.co link is still in the
+// text.
+func (d DM) attachments(a *Account) []attachment {
+	if a == nil || a.NoMedia {
+		return nil
+	}
+	var atts []attachment
+	for _, m := range d.media() {
+		bs, err := a.fetchMedia(m.URL)
+		if err != nil {
+			log.Printf("Skipping media %s of DM %d: %v", m.URL, d.ID, err)
+			continue
+		}
+		name := path.Base(m.URL)
+		if pu, err := url.Parse(m.URL); err == nil {
+			name = path.Base(pu.Path)
+		}
+		atts = append(atts, attachment{
+			Filename:    name,
+			ContentType: http.DetectContentType(bs),
+			Inline:      m.Kind == "photo",
+			Data:        bs,
+		})
+	}
+	return atts
+}
+
+// writeAttachment writes a base64-encoded MIME part for att.
+func writeAttachment(w io.Writer, att attachment) {
+	disposition := "attachment"
+	if att.Inline {
+		disposition = "inline"
+	}
+	writeHeader(w, "Content-Type", att.ContentType)
+	writeHeader(w, "Content-Transfer-Encoding", "base64")
+	writeHeader(w, "Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, strings.Replace(att.Filename, `"`, "", -1)))
+	io.WriteString(w, "\r\n")
+	enc := base64.StdEncoding.EncodeToString(att.Data)
+	for len(enc) > 76 {
+		io.WriteString(w, enc[:76]+"\r\n")
+		enc = enc[76:]
+	}
+	io.WriteString(w, enc+"\r\n")
+}
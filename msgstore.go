@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var storeType = flag.String("store", "log", "Message store implementation to keep synced DMs in")
+
+// A MessageStore persists everything we know about one account's
+// messages: the DMs themselves, their rendered mail form, which ones
+// were deleted, per-message flags, and how far each DM stream has
+// been synced.
+type MessageStore interface {
+	// Add stores the DMs that aren't already present and returns
+	// how many were new. Deleted DMs are not re-added.
+	Add(dms []DM) (int, error)
+
+	// DMs returns all stored, undeleted DMs, newest first.
+	DMs() []DM
+
+	// Get returns a stored, undeleted DM by ID.
+	Get(id int64) (DM, bool)
+
+	// Delete leaves a tombstone for the DM so it's hidden and
+	// never synced again.
+	Delete(id int64) error
+
+	// UID returns the DM's IMAP UID, or 0 if it isn't stored. UIDs
+	// are assigned as DMs are added, so later DMs always have
+	// higher ones, and are never reused.
+	UID(id int64) uint32
+
+	// UIDNext returns the UID the next DM added will get, and
+	// UIDValidity the IMAP UIDVALIDITY that goes with the store's
+	// UIDs.
+	UIDNext() uint32
+	UIDValidity() uint32
+
+	// Flags returns the DM's flags, such as IMAP's \Seen.
+	Flags(id int64) []string
+	SetFlags(id int64, flags []string) error
+
+	// Rendered returns the DM's cached mail message, if one was
+	// stored with the same render key.
+	Rendered(id int64, key string) ([]byte, bool)
+	SetRendered(id int64, key string, msg []byte) error
+
+	// RenderedSize returns the size of the DM's cached mail
+	// message, like Rendered but without reading it.
+	RenderedSize(id int64, key string) (int, bool)
+
+	// Cursor returns how far the named DM stream has been synced.
+	Cursor(stream string) SyncCursor
+	SetCursor(stream string, c SyncCursor) error
+
+	// Compact rewrites the store without superseded data.
+	Compact() error
+
+	// Check verifies the store's on-disk data and returns the
+	// problems it finds.
+	Check() []error
+
+	Close() error
+}
+
+// messageStores maps -store values to the function that opens an
+// account's store of that type.
+var messageStores = map[string]func(user string) (MessageStore, error){
+	"log": openLogStore,
+}
+
+func openMessageStore(user string) (MessageStore, error) {
+	open, ok := messageStores[*storeType]
+	if !ok {
+		return nil, fmt.Errorf("unknown -store type %q", *storeType)
+	}
+	return open(user)
+}
+
+// renderKey identifies the account settings that affect how DMs are
+// rendered, so cached messages are re-rendered when they change.
+// Bump the version when the rendering itself changes.
+func (a *Account) renderKey() string {
+	return fmt.Sprintf("v2 tz=%s media=%v", a.TimeZone, !a.NoMedia)
+}
+
+// renderDM returns dm as a mail message for a, using and filling
+// the store's cache of rendered messages. Messages missing media
+// that may yet be fetched aren't cached.
+func renderDM(s MessageStore, a *Account, dm DM) string {
+	key := a.renderKey()
+	if msg, ok := s.Rendered(dm.ID, key); ok {
+		return string(msg)
+	}
+	msg := dm.RFC822(a)
+	if !dm.mediaPending(a) {
+		s.SetRendered(dm.ID, key, []byte(msg))
+	}
+	return msg
+}
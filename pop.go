@@ -3,17 +3,25 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/textproto"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
+var popHistory = flag.Int("pop_history", 0, "Number of most recent synced DMs to offer over POP; 0 for all of them")
+
 type pop3State int
 
 const (
@@ -21,20 +29,32 @@ const (
 	txState
 )
 
+// popAuthCommands and popTxCommands are the commands allowed in
+// the AUTHORIZATION and TRANSACTION states. CAPA and QUIT work in
+// both.
+var (
+	popAuthCommands = map[string]bool{"USER": true, "PASS": true, "APOP": true, "AUTH": true, "STLS": true, "CAPA": true, "QUIT": true}
+	popTxCommands   = map[string]bool{"STAT": true, "LIST": true, "UIDL": true, "RETR": true, "TOP": true, "DELE": true, "RSET": true, "NOOP": true, "CAPA": true, "QUIT": true}
+)
+
+// popIdleTimeout is RFC 1939's autologout timer.
+const popIdleTimeout = 10 * time.Minute
+
 func splitPOP3Line(s string) (cmd, params string) {
 	v := strings.SplitN(s, " ", 2)
 	if len(v) < 2 {
-		return v[0], ""
+		return strings.ToUpper(v[0]), ""
 	}
-	return strings.TrimSpace(v[0]), strings.TrimSpace(v[1])
+	return strings.ToUpper(strings.TrimSpace(v[0])), strings.TrimSpace(v[1])
 }
 
 type POPServer struct {
-	ln net.Listener
+	ln  net.Listener
+	tls *tls.Config // for STLS on connections that aren't TLS already; nil to not offer it
 }
 
-func NewPOPServer(ln net.Listener) *POPServer {
-	return &POPServer{ln: ln}
+func NewPOPServer(ln net.Listener, config *tls.Config) *POPServer {
+	return &POPServer{ln: ln, tls: config}
 }
 
 func (s *POPServer) run() {
@@ -49,15 +69,9 @@ func (s *POPServer) run() {
 }
 
 func (s *POPServer) newConn(c net.Conn) *Conn {
-	br := bufio.NewReader(c)
-	bw := bufio.NewWriter(c)
-	return &Conn{
-		s:    s,
-		Conn: c,
-		br:   br,
-		bw:   bw,
-		tr:   textproto.NewReader(br),
-	}
+	conn := &Conn{s: s}
+	conn.setConn(c)
+	return conn
 }
 
 type Conn struct {
@@ -66,17 +80,56 @@ type Conn struct {
 	br        *bufio.Reader
 	bw        *bufio.Writer
 	tr        *textproto.Reader
+	state     pop3State
+	stamp     string // APOP timestamp from the greeting
+	user      string // from USER, awaiting PASS
 	acct      *Account
 	dmsCached []DM
+	deleted   map[int]bool // message numbers marked by DELE
+}
+
+// setConn makes c talk over nc, as it does again after STLS.
+func (c *Conn) setConn(nc net.Conn) {
+	c.Conn = nc
+	c.br = bufio.NewReader(nc)
+	c.bw = bufio.NewWriter(nc)
+	c.tr = textproto.NewReader(c.br)
 }
 
 func (c *Conn) dms() ([]DM, error) {
 	if c.dmsCached != nil {
 		return c.dmsCached, nil
 	}
-	var err error
-	c.dmsCached, err = c.acct.GetDMs(50)
-	return c.dmsCached, err
+	dms, err := syncer.DMs(c.acct)
+	if err != nil {
+		return nil, err
+	}
+	if *popHistory > 0 && len(dms) > *popHistory {
+		dms = dms[:*popHistory]
+	}
+	c.dmsCached = dms
+	return dms, nil
+}
+
+// message returns dm rendered as a mail message for the logged-in
+// account.
+func (c *Conn) message(dm DM) string {
+	store, err := syncer.Store(c.acct.Username)
+	if err != nil {
+		return dm.RFC822(c.acct)
+	}
+	return renderDM(store, c.acct, dm)
+}
+
+// size returns the size of dm's message, from the render cache if
+// it's there.
+func (c *Conn) size(dm DM) int {
+	if store, err := syncer.Store(c.acct.Username); err == nil {
+		if n, ok := store.RenderedSize(dm.ID, c.acct.renderKey()); ok {
+			return n
+		}
+	}
+	return len(c.message(dm))
 }
 
 func (c *Conn) send(s string) {
@@ -92,9 +145,22 @@ func (c *Conn) err(s string) {
 	c.send(fmt.Sprintf("-ERR %s", s))
 }
 
-func (c *Conn) disconnect(s string) error {
-	c.send(fmt.Sprintf("-ERR %s", s))
-	return errors.New("Client error: " + s)
+// sendMulti sends a multi-line response: the status line, then
+// body dot-stuffed per RFC 1939 section 3, then the terminating ".".
+func (c *Conn) sendMulti(status, body string) {
+	var buf bytes.Buffer
+	buf.WriteString(status + "\r\n")
+	for _, line := range strings.SplitAfter(body, "\r\n") {
+		if strings.HasPrefix(line, ".") {
+			buf.WriteByte('.')
+		}
+		buf.WriteString(line)
+	}
+	if body != "" && !strings.HasSuffix(body, "\r\n") {
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString(".\r\n")
+	c.send(buf.String())
 }
 
 func (c *Conn) serve() error {
@@ -110,141 +176,330 @@ func (c *Conn) serve() error {
 		log.Printf("New raw connnection from %q", c.RemoteAddr())
 	}
 
-	c.send("+OK POP3 eight22er here, ready to proxy your DMs, yo")
+	c.stamp = fmt.Sprintf("<%d.%d@eight22er.danga.com>", os.Getpid(), time.Now().UnixNano())
+	c.send("+OK POP3 eight22er here, ready to proxy your DMs, yo " + c.stamp)
 
-	state := authState
-	var user string
 	for {
+		c.SetReadDeadline(time.Now().Add(popIdleTimeout))
 		line, err := c.tr.ReadLine()
 		if err != nil {
 			log.Printf("Error reading from connection: %v", err)
 			return err
 		}
 		cmd, params := splitPOP3Line(line)
-		log.Printf("Got line: %q, cmd %q, params %q", line, cmd, params)
+		if cmd == "PASS" || cmd == "APOP" || cmd == "AUTH" {
+			log.Printf("Got cmd %q", cmd)
+		} else {
+			log.Printf("Got line: %q, cmd %q, params %q", line, cmd, params)
+		}
+		allowed := popAuthCommands
+		if c.state == txState {
+			allowed = popTxCommands
+		}
+		if !allowed[cmd] {
+			if popAuthCommands[cmd] || popTxCommands[cmd] {
+				c.err(fmt.Sprintf("%s isn't allowed in this state", cmd))
+			} else {
+				log.Printf("UNHANDLED COMMAND %q, params %q", cmd, params)
+				c.err("unknown command")
+			}
+			continue
+		}
 		switch cmd {
-		case "AUTH", "CAPA":
-			if state != authState {
-				return c.disconnect(fmt.Sprintf("Bogus %s command in wrong state", cmd))
+		case "CAPA":
+			c.capa()
+		case "STLS":
+			if err := c.stls(); err != nil {
+				return err
 			}
-			log.Printf("Auth line: %q", line)
-			c.err(fmt.Sprintf("let's pretend I don't know the %s extension", cmd))
 		case "USER":
-			if state != authState {
-				return c.disconnect(fmt.Sprintf("Bogus %s command in wrong state", cmd))
-			}
-			user = params
-			c.send("+OK")
-		case "PASS":
-			if state != authState {
-				return c.disconnect(fmt.Sprintf("Bogus %s command in wrong state", cmd))
-			}
-			password := params
-			acct, err := GetAccount(user, password)
-			if err != nil || acct.Password == "" {
-				time.Sleep(time.Second)
-				c.err("nope")
+			if params == "" {
+				c.err("USER needs a name")
 				continue
 			}
+			c.user = params
 			c.send("+OK")
-			c.acct = acct
-			state = txState
-		case "STAT":
-			if state != txState {
-				return c.disconnect("wrong state yo")
-			}
-			dms, err := c.dms()
-			if err != nil {
-				c.err(err.Error())
-				continue
-			}
-			octets := 0
-			for _, dm := range dms {
-				octets += dm.Octets()
-			}
-			c.send(fmt.Sprintf("+OK %d %d\r\n", len(dms), octets))
-		case "LIST":
-			if state != txState {
-				return c.disconnect("wrong state yo")
-			}
-			if params != "" {
-				c.err("TODO: support LIST with an argument")
-				continue
-			}
-			dms, err := c.dms()
-			if err != nil {
-				c.err(err.Error())
+		case "PASS":
+			if c.user == "" {
+				c.err("USER first")
 				continue
 			}
-			var buf bytes.Buffer
-			fmt.Fprintf(&buf, "+OK %d messages\r\n", len(dms))
-			for n, dm := range dms {
-				fmt.Fprintf(&buf, "%d %d\r\n", n+1, dm.Octets())
-			}
-			fmt.Fprintf(&buf, ".\r\n")
-			c.send(buf.String())
-		case "UIDL":
-			if state != txState {
-				return c.disconnect("wrong state yo")
-			}
-			if params != "" {
-				c.err("TODO: support UIDL with an argument")
-				continue
+			user := c.user
+			c.user = ""
+			acct, err := GetAccount(user, params)
+			c.login(acct, err)
+		case "APOP":
+			c.apop(params)
+		case "AUTH":
+			if err := c.auth(params); err != nil {
+				return err
 			}
+		case "STAT":
 			dms, err := c.dms()
 			if err != nil {
-				c.err(err.Error())
+				c.err(popError(err))
 				continue
 			}
-			var buf bytes.Buffer
-			fmt.Fprintf(&buf, "+OK %d messages\r\n", len(dms))
-			for n, dm := range dms {
-				fmt.Fprintf(&buf, "%d twdmid%d\r\n", n+1, dm.ID())
-			}
-			fmt.Fprintf(&buf, ".\r\n")
-			c.send(buf.String())
-		case "RETR", "TOP":
-			if state != txState {
-				return c.disconnect("wrong state yo")
-			}
-			// We're lazy and treat TOP like RETR, since
-			// there's always like 1 line anyway.  So
-			// ignore TOP's n value.
-			ps := strings.Split(params, " ")
-			if len(ps) < 1 {
-				c.err("bad params")
-				continue
-			}
-			n, err := strconv.Atoi(ps[0])
-			if err != nil {
-				c.err("bad number")
-				continue
+			n, octets := 0, 0
+			for i, dm := range dms {
+				if !c.deleted[i+1] {
+					n++
+					octets += c.size(dm)
+				}
 			}
-			dms, _ := c.dms()
-			if n > len(dms) {
-				c.err("bad index")
+			c.send(fmt.Sprintf("+OK %d %d", n, octets))
+		case "LIST", "UIDL":
+			c.listing(cmd, params)
+		case "RETR":
+			_, dm, ok := c.msgArg(params)
+			if !ok {
 				continue
 			}
-			dm := dms[n-1]
-			msg := dm.RFC822()
-			c.send(fmt.Sprintf("+OK %d octets\r\n%s\r\n.\r\n", len(msg), msg))
+			msg := c.message(dm)
+			c.sendMulti(fmt.Sprintf("+OK %d octets", len(msg)), msg)
+		case "TOP":
+			c.top(params)
 		case "DELE":
-			if state != txState {
-				return c.disconnect("wrong state yo")
-			}
-			n, err := strconv.Atoi(params)
-			if err != nil {
-				c.err("bad number")
+			n, _, ok := c.msgArg(params)
+			if !ok {
 				continue
 			}
-			log.Printf("client wants to delete message %d", n)
+			c.deleted[n] = true
+			c.send(fmt.Sprintf("+OK message %d deleted", n))
+		case "RSET":
+			c.deleted = make(map[int]bool)
 			c.send("+OK")
-		case "QUIT":
+		case "NOOP":
 			c.send("+OK")
-			break
-		default:
-			log.Printf("UNHANDLED COMMAND %q, params %q", cmd, params)
+		case "QUIT":
+			c.quit()
+			return nil
 		}
 	}
+}
+
+// capa lists our RFC 2449 capabilities. Those for logging in are
+// only listed before logging in.
+func (c *Conn) capa() {
+	caps := []string{"TOP", "UIDL", "RESP-CODES", "AUTH-RESP-CODE", "PIPELINING", "EXPIRE NEVER"}
+	if c.state == authState {
+		caps = append(caps, "USER", "SASL PLAIN")
+		if c.canSTLS() {
+			caps = append(caps, "STLS")
+		}
+	}
+	caps = append(caps, "IMPLEMENTATION eight22er")
+	c.sendMulti("+OK capability list follows", strings.Join(caps, "\r\n"))
+}
+
+func (c *Conn) canSTLS() bool {
+	_, isTLS := c.Conn.(*tls.Conn)
+	return c.s.tls != nil && !isTLS
+}
+
+// stls upgrades the connection to TLS, per RFC 2595. A non-nil
+// error means the connection is unusable.
+func (c *Conn) stls() error {
+	if !c.canSTLS() {
+		c.err("STLS not available")
+		return nil
+	}
+	if c.br.Buffered() > 0 {
+		// Anything pipelined after STLS arrived in the clear
+		// and mustn't be treated as if it came over TLS.
+		c.err("STLS must be the last command sent in the clear")
+		return errors.New("client pipelined after STLS")
+	}
+	c.send("+OK begin TLS negotiation")
+	tlsConn := tls.Server(c.Conn, c.s.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("STLS handshake error from %q: %v", c.RemoteAddr(), err)
+		return err
+	}
+	c.setConn(tlsConn)
+	c.user = ""
 	return nil
 }
+
+// apop logs in with RFC 1939's APOP: params are the user name and
+// the MD5 digest of the greeting's timestamp and the password.
+func (c *Conn) apop(params string) {
+	v := strings.Fields(params)
+	if len(v) != 2 {
+		c.err("APOP needs a name and a digest")
+		return
+	}
+	acct := GetAccountNoAuth(v[0])
+	sum := md5.Sum([]byte(c.stamp + acct.Password))
+	if acct.Password == "" || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(v[1]))) != 1 {
+		c.login(nil, errAuthFailure)
+		return
+	}
+	c.login(acct, nil)
+}
+
+// auth logs in with SASL PLAIN, per RFC 5034, with the initial
+// response either on the AUTH line or after a "+" continuation.
+// A non-nil error means the connection is unusable.
+func (c *Conn) auth(params string) error {
+	if params == "" {
+		c.sendMulti("+OK", "PLAIN")
+		return nil
+	}
+	mech, resp := splitPOP3Line(params)
+	if mech != "PLAIN" {
+		c.err("unsupported SASL mechanism")
+		return nil
+	}
+	if resp == "" {
+		c.send("+ ")
+		line, err := c.tr.ReadLine()
+		if err != nil {
+			return err
+		}
+		resp = strings.TrimSpace(line)
+	}
+	if resp == "*" {
+		c.err("AUTH cancelled")
+		return nil
+	}
+	dec, err := base64.StdEncoding.DecodeString(resp)
+	v := strings.Split(string(dec), "\x00")
+	if err != nil || len(v) != 3 || (v[0] != "" && v[0] != v[1]) {
+		c.err("bad SASL PLAIN response")
+		return nil
+	}
+	acct, err := GetAccount(v[1], v[2])
+	c.login(acct, err)
+	return nil
+}
+
+// login finishes logging in to acct, whose credentials were
+// checked with the result err, and enters the TRANSACTION state.
+func (c *Conn) login(acct *Account, err error) {
+	if err != nil || acct.Password == "" {
+		time.Sleep(time.Second)
+		c.err("[AUTH] bad user name or password")
+		return
+	}
+	switch err := syncer.Err(acct.Username); err.(type) {
+	case *RevokedError, *SuspendedError:
+		// Tell the user now rather than leave them
+		// looking at a mailbox that never changes.
+		syncer.Touch(acct)
+		c.err(popError(err))
+		return
+	}
+	c.send("+OK")
+	c.acct = acct
+	c.deleted = make(map[int]bool)
+	syncer.Touch(acct)
+	c.state = txState
+}
+
+// msgArg returns the message numbered by arg, or sends an error and
+// returns false if there's no such message or it's been deleted.
+func (c *Conn) msgArg(arg string) (int, DM, bool) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 1 {
+		c.err("bad message number")
+		return 0, DM{}, false
+	}
+	dms, err := c.dms()
+	if err != nil {
+		c.err(popError(err))
+		return 0, DM{}, false
+	}
+	if n > len(dms) {
+		c.err(fmt.Sprintf("no message %d", n))
+		return 0, DM{}, false
+	}
+	if c.deleted[n] {
+		c.err(fmt.Sprintf("message %d is deleted", n))
+		return 0, DM{}, false
+	}
+	return n, dms[n-1], true
+}
+
+// listing handles LIST and UIDL, for one message or all of them.
+func (c *Conn) listing(cmd, params string) {
+	info := func(dm DM) string {
+		if cmd == "UIDL" {
+			return dm.UIDL()
+		}
+		return strconv.Itoa(c.size(dm))
+	}
+	if params != "" {
+		n, dm, ok := c.msgArg(params)
+		if ok {
+			c.send(fmt.Sprintf("+OK %d %s", n, info(dm)))
+		}
+		return
+	}
+	dms, err := c.dms()
+	if err != nil {
+		c.err(popError(err))
+		return
+	}
+	var buf bytes.Buffer
+	for n, dm := range dms {
+		if !c.deleted[n+1] {
+			fmt.Fprintf(&buf, "%d %s\r\n", n+1, info(dm))
+		}
+	}
+	c.sendMulti(fmt.Sprintf("+OK %d messages", len(dms)-len(c.deleted)), buf.String())
+}
+
+// top sends a message's header and the first n lines of its body.
+func (c *Conn) top(params string) {
+	ps := strings.Fields(params)
+	if len(ps) != 2 {
+		c.err("TOP needs a message number and a line count")
+		return
+	}
+	lines, err := strconv.Atoi(ps[1])
+	if err != nil || lines < 0 {
+		c.err("bad line count")
+		return
+	}
+	_, dm, ok := c.msgArg(ps[0])
+	if !ok {
+		return
+	}
+	msg := c.message(dm)
+	head, body := msg, ""
+	if i := strings.Index(msg, "\r\n\r\n"); i >= 0 {
+		head, body = msg[:i+2], msg[i+4:]
+	}
+	bodyLines := strings.SplitAfter(body, "\r\n")
+	if lines < len(bodyLines) {
+		bodyLines = bodyLines[:lines]
+	}
+	c.sendMulti("+OK top of message follows", head+"\r\n"+strings.Join(bodyLines, ""))
+}
+
+// quit ends the session. After logging in, it enters the UPDATE
+// state and removes the messages marked by DELE from the maildrop.
+// They're only tombstoned in our store; the DMs themselves stay on
+// the backend.
+func (c *Conn) quit() {
+	if c.state != txState || len(c.deleted) == 0 {
+		c.send("+OK bye")
+		return
+	}
+	dms, _ := c.dms()
+	store, err := syncer.Store(c.acct.Username)
+	if err == nil {
+		for n := range c.deleted {
+			if err = store.Delete(dms[n-1].ID); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("POP: deleting messages for %q: %v", c.acct.Username, err)
+		c.err("[SYS/TEMP] some deleted messages not removed")
+		return
+	}
+	c.send(fmt.Sprintf("+OK bye, %d messages left", len(dms)-len(c.deleted)))
+}
@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/eight22er/faketwitter"
+)
+
+// The POP3 conformance scripts below check a POP server against
+// RFC 1939, RFC 2449 (CAPA) and RFC 2595 (STLS and SASL PLAIN).
+// "eight22er popcheck" runs them against an in-process POPServer
+// whose account is on a fake Twitter, or against a deployed server
+// as a smoke test.
+
+// A popScript is one POP3 session: the commands a client sends,
+// each with the reply it must get.
+type popScript struct {
+	name      string
+	steps     []popStep
+	pipelined bool // send every command before reading any reply
+
+	// destructive scripts change the maildrop, so they're only
+	// run against a deployed server with -destructive.
+	destructive bool
+
+	// skip returns why the script can't run against the server
+	// described by s, or "" if it can.
+	skip func(s *popSession) string
+}
+
+// A popStep is one command and the reply it must get.
+type popStep struct {
+	// send is the command line, without CRLF. {user} and {pass}
+	// are the account's credentials, {last} is the number of the
+	// last message and {past} the number after it, {apop} and
+	// {plain} are APOP and SASL PLAIN credentials, and {badplain}
+	// is a PLAIN response with the wrong password. A step with
+	// {each} is repeated for each message, up to popCheckMaxEach.
+	// The pseudo-command "reconnect" starts a new connection.
+	send string
+
+	want  string // "+OK", "-ERR" or "+" (a SASL continuation)
+	multi bool   // a +OK reply has more lines, up to "."
+
+	// check, if set, does further checks on a reply with the
+	// wanted status.
+	check func(s *popSession, r *popReply) error
+}
+
+// popCheckMaxEach is the most messages an {each} step is repeated
+// for.
+const popCheckMaxEach = 20
+
+// A popReply is a server response.
+type popReply struct {
+	cmd    string   // the expanded command it answers
+	status string   // the first line
+	lines  []string // the lines of a multi-line reply, un-dot-stuffed, without CRLF
+	octets int      // the size of lines with CRLFs, as LIST counts it
+}
+
+// A popSession is what the harness knows about the server and its
+// maildrop. Scripts' checks record what they see in it, so later
+// steps can compare.
+type popSession struct {
+	addr     string
+	implicit bool        // TLS from the start
+	tls      *tls.Config // for STLS or implicit TLS
+	user     string
+	pass     string
+	fixture  bool // the maildrop is popCheckFixture on the fake Twitter
+
+	count    int             // messages in the maildrop, from the probe
+	octets   int             // their total size
+	caps     map[string]bool // CAPA keywords, from the probe
+	stamp    string          // APOP timestamp from the latest greeting
+	stat     [2]int          // count and size from the latest STAT
+	sizes    map[int]int     // message sizes from LIST
+	uids     map[int]string  // unique IDs from UIDL
+	messages map[int]string  // messages from RETR
+	dotLines int             // lines starting with "." seen in RETR replies
+
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// popLogin is the start of every script that logs in.
+var popLogin = []popStep{
+	{send: "USER {user}", want: "+OK"},
+	{send: "PASS {pass}", want: "+OK"},
+}
+
+func loggedIn(steps ...popStep) []popStep {
+	return append(append([]popStep(nil), popLogin...), steps...)
+}
+
+func needMessages(n int) func(*popSession) string {
+	return func(s *popSession) string {
+		if s.count < n {
+			return fmt.Sprintf("needs %d messages; the maildrop has %d", n, s.count)
+		}
+		return ""
+	}
+}
+
+func needCapability(c string) func(*popSession) string {
+	return func(s *popSession) string {
+		if !s.caps[c] {
+			return "server doesn't advertise " + c
+		}
+		return ""
+	}
+}
+
+func needFixture(s *popSession) string {
+	if !s.fixture {
+		return "only runs against the fake backend"
+	}
+	return ""
+}
+
+// popScripts are the conformance scripts, in the order they run.
+var popScripts = []popScript{
+	{
+		name: "capa before login",
+		steps: []popStep{
+			{send: "CAPA", want: "+OK", multi: true, check: checkCapa("USER", "TOP", "UIDL", "PIPELINING", "RESP-CODES", "AUTH-RESP-CODE", "SASL PLAIN")},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name:  "capa after login",
+		steps: loggedIn(popStep{send: "CAPA", want: "+OK", multi: true, check: checkCapa("TOP", "UIDL", "!USER", "!STLS")}, popStep{send: "QUIT", want: "+OK"}),
+	},
+	{
+		name: "commands are case-insensitive",
+		steps: []popStep{
+			{send: "user {user}", want: "+OK"},
+			{send: "Pass {pass}", want: "+OK"},
+			{send: "sTaT", want: "+OK"},
+			{send: "quit", want: "+OK"},
+		},
+	},
+	{
+		name: "USER and PASS",
+		steps: loggedIn(
+			popStep{send: "STAT", want: "+OK", check: checkStat},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "bad password leaves the AUTHORIZATION state",
+		steps: []popStep{
+			{send: "USER {user}", want: "+OK"},
+			{send: "PASS {pass}-wrong", want: "-ERR", check: checkCode("AUTH")},
+			{send: "STAT", want: "-ERR"},
+			{send: "PASS {pass}", want: "-ERR"}, // USER must be sent again
+			{send: "USER {user}", want: "+OK"},
+			{send: "PASS {pass}", want: "+OK"},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "PASS without USER",
+		steps: []popStep{
+			{send: "PASS {pass}", want: "-ERR"},
+			{send: "USER", want: "-ERR"},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "APOP",
+		skip: func(s *popSession) string {
+			if s.stamp == "" {
+				return "greeting has no APOP timestamp"
+			}
+			return ""
+		},
+		steps: []popStep{
+			{send: "APOP {user} 0123456789abcdef0123456789abcdef", want: "-ERR", check: checkCode("AUTH")},
+			{send: "APOP {user}", want: "-ERR"},
+			{send: "APOP {user} {apop}", want: "+OK"},
+			{send: "STAT", want: "+OK", check: checkStat},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "AUTH PLAIN",
+		skip: needCapability("SASL"),
+		steps: []popStep{
+			{send: "AUTH", want: "+OK", multi: true},
+			{send: "AUTH CRAM-MD5", want: "-ERR"},
+			{send: "AUTH PLAIN {badplain}", want: "-ERR", check: checkCode("AUTH")},
+			{send: "AUTH PLAIN", want: "+"},
+			{send: "*", want: "-ERR"},
+			{send: "AUTH PLAIN", want: "+"},
+			{send: "{plain}", want: "+OK"},
+			{send: "STAT", want: "+OK"},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "AUTH PLAIN with an initial response",
+		skip: needCapability("SASL"),
+		steps: []popStep{
+			{send: "AUTH PLAIN {plain}", want: "+OK"},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "STLS",
+		skip: needCapability("STLS"),
+		steps: []popStep{
+			{send: "STLS", want: "+OK"},
+			{send: "CAPA", want: "+OK", multi: true, check: checkCapa("USER", "!STLS")},
+			{send: "STLS", want: "-ERR"},
+			{send: "USER {user}", want: "+OK"},
+			{send: "PASS {pass}", want: "+OK"},
+			{send: "STAT", want: "+OK"},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "TRANSACTION commands before login",
+		steps: []popStep{
+			{send: "STAT", want: "-ERR"},
+			{send: "LIST", want: "-ERR"},
+			{send: "UIDL", want: "-ERR"},
+			{send: "RETR 1", want: "-ERR"},
+			{send: "TOP 1 0", want: "-ERR"},
+			{send: "DELE 1", want: "-ERR"},
+			{send: "RSET", want: "-ERR"},
+			{send: "NOOP", want: "-ERR"},
+			{send: "XYZZY", want: "-ERR"},
+			{send: "QUIT", want: "+OK"},
+		},
+	},
+	{
+		name: "AUTHORIZATION commands after login",
+		steps: loggedIn(
+			popStep{send: "USER {user}", want: "-ERR"},
+			popStep{send: "PASS {pass}", want: "-ERR"},
+			popStep{send: "APOP {user} {apop}", want: "-ERR"},
+			popStep{send: "AUTH PLAIN {plain}", want: "-ERR"},
+			popStep{send: "STLS", want: "-ERR"},
+			popStep{send: "XYZZY", want: "-ERR"},
+			popStep{send: "NOOP", want: "+OK"},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "STAT, LIST and UIDL agree",
+		steps: loggedIn(
+			popStep{send: "STAT", want: "+OK", check: checkStat},
+			popStep{send: "LIST", want: "+OK", multi: true, check: checkList},
+			popStep{send: "UIDL", want: "+OK", multi: true, check: checkUIDL},
+			popStep{send: "LIST {each}", want: "+OK", check: checkListOne},
+			popStep{send: "UIDL {each}", want: "+OK", check: checkUIDLOne},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "bad message numbers",
+		steps: loggedIn(
+			popStep{send: "LIST 0", want: "-ERR"},
+			popStep{send: "LIST {past}", want: "-ERR"},
+			popStep{send: "LIST one", want: "-ERR"},
+			popStep{send: "UIDL 0", want: "-ERR"},
+			popStep{send: "UIDL {past}", want: "-ERR"},
+			popStep{send: "RETR", want: "-ERR"},
+			popStep{send: "RETR 0", want: "-ERR"},
+			popStep{send: "RETR -1", want: "-ERR"},
+			popStep{send: "RETR {past}", want: "-ERR"},
+			popStep{send: "TOP {past} 0", want: "-ERR"},
+			popStep{send: "TOP 1", want: "-ERR"},
+			popStep{send: "TOP 1 -1", want: "-ERR"},
+			popStep{send: "DELE 0", want: "-ERR"},
+			popStep{send: "DELE {past}", want: "-ERR"},
+			popStep{send: "NOOP", want: "+OK"},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "RETR octet counts match LIST",
+		skip: needMessages(1),
+		steps: loggedIn(
+			popStep{send: "LIST", want: "+OK", multi: true, check: checkList},
+			popStep{send: "RETR {each}", want: "+OK", multi: true, check: checkRetr},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "TOP",
+		skip: needMessages(1),
+		steps: loggedIn(
+			popStep{send: "RETR 1", want: "+OK", multi: true, check: checkRetr},
+			popStep{send: "TOP 1 0", want: "+OK", multi: true, check: checkTop(0)},
+			popStep{send: "TOP 1 3", want: "+OK", multi: true, check: checkTop(3)},
+			popStep{send: "TOP 1 100000", want: "+OK", multi: true, check: checkTop(100000)},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "dot-stuffing",
+		skip: needFixture,
+		steps: loggedIn(
+			popStep{send: "LIST", want: "+OK", multi: true, check: checkList},
+			popStep{send: "RETR {each}", want: "+OK", multi: true, check: checkRetr},
+			popStep{send: "QUIT", want: "+OK", check: func(s *popSession, r *popReply) error {
+				if s.dotLines == 0 {
+					return errors.New("no message had a line starting with a dot")
+				}
+				return nil
+			}},
+		),
+	},
+	{
+		name: "DELE and RSET",
+		skip: needMessages(2),
+		steps: loggedIn(
+			popStep{send: "LIST", want: "+OK", multi: true, check: checkList},
+			popStep{send: "DELE 1", want: "+OK"},
+			popStep{send: "DELE 1", want: "-ERR"},
+			popStep{send: "RETR 1", want: "-ERR"},
+			popStep{send: "TOP 1 0", want: "-ERR"},
+			popStep{send: "LIST 1", want: "-ERR"},
+			popStep{send: "UIDL 1", want: "-ERR"},
+			popStep{send: "STAT", want: "+OK", check: checkStatAfterDele(1)},
+			popStep{send: "LIST", want: "+OK", multi: true, check: checkListLacks(1)},
+			popStep{send: "RSET", want: "+OK"},
+			popStep{send: "STAT", want: "+OK", check: checkStatAfterDele(0)},
+			popStep{send: "RETR 1", want: "+OK", multi: true},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+	{
+		name: "pipelining",
+		skip: needCapability("PIPELINING"),
+		steps: loggedIn(
+			popStep{send: "STAT", want: "+OK", check: checkStat},
+			popStep{send: "LIST", want: "+OK", multi: true, check: checkList},
+			popStep{send: "UIDL", want: "+OK", multi: true, check: checkUIDL},
+			popStep{send: "RETR {each}", want: "+OK", multi: true, check: checkRetr},
+			popStep{send: "NOOP", want: "+OK"},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+		pipelined: true,
+	},
+	{
+		name:        "QUIT removes deleted messages",
+		destructive: true,
+		skip:        needMessages(2),
+		steps: loggedIn(
+			popStep{send: "UIDL", want: "+OK", multi: true, check: checkUIDL},
+			popStep{send: "DELE {last}", want: "+OK"},
+			popStep{send: "QUIT", want: "+OK"},
+			popStep{send: "reconnect"},
+			popStep{send: "USER {user}", want: "+OK"},
+			popStep{send: "PASS {pass}", want: "+OK"},
+			popStep{send: "STAT", want: "+OK", check: checkStatAfterDele(1)},
+			popStep{send: "UIDL", want: "+OK", multi: true, check: checkUIDLAfterDele},
+			popStep{send: "QUIT", want: "+OK"},
+		),
+	},
+}
+
+func checkCapa(want ...string) func(*popSession, *popReply) error {
+	return func(s *popSession, r *popReply) error {
+		caps := make(map[string]bool)
+		for _, line := range r.lines {
+			if f := strings.Fields(line); len(f) > 0 {
+				caps[strings.ToUpper(f[0])] = true
+			}
+			caps[strings.ToUpper(line)] = true
+		}
+		for _, c := range want {
+			if strings.HasPrefix(c, "!") && caps[c[1:]] {
+				return fmt.Errorf("CAPA lists %s", c[1:])
+			}
+			if !strings.HasPrefix(c, "!") && !caps[c] {
+				return fmt.Errorf("CAPA doesn't list %s", c)
+			}
+		}
+		return nil
+	}
+}
+
+// checkCode checks that an -ERR reply starts with the RFC 2449
+// response code.
+func checkCode(code string) func(*popSession, *popReply) error {
+	return func(s *popSession, r *popReply) error {
+		if !strings.HasPrefix(r.status, "-ERR ["+code) {
+			return fmt.Errorf("reply has no [%s] response code", code)
+		}
+		return nil
+	}
+}
+
+func checkStat(s *popSession, r *popReply) error {
+	f := strings.Fields(r.status)
+	if len(f) < 3 {
+		return errors.New("STAT reply lacks a count and size")
+	}
+	n, err1 := strconv.Atoi(f[1])
+	octets, err2 := strconv.Atoi(f[2])
+	if err1 != nil || err2 != nil || n < 0 || octets < 0 {
+		return errors.New("bad STAT count or size")
+	}
+	s.stat = [2]int{n, octets}
+	if n != s.count {
+		return fmt.Errorf("STAT says %d messages; expected %d", n, s.count)
+	}
+	return nil
+}
+
+func checkStatAfterDele(deleted int) func(*popSession, *popReply) error {
+	return func(s *popSession, r *popReply) error {
+		f := strings.Fields(r.status)
+		if len(f) < 3 {
+			return errors.New("STAT reply lacks a count and size")
+		}
+		if want := strconv.Itoa(s.count - deleted); f[1] != want {
+			return fmt.Errorf("STAT says %s messages; expected %s", f[1], want)
+		}
+		return nil
+	}
+}
+
+var scanListingRx = regexp.MustCompile(`^([1-9][0-9]*) ([0-9]+)$`)
+
+func checkList(s *popSession, r *popReply) error {
+	s.sizes = make(map[int]int)
+	total := 0
+	for _, line := range r.lines {
+		m := scanListingRx.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("bad scan listing %q", line)
+		}
+		n, _ := strconv.Atoi(m[1])
+		size, _ := strconv.Atoi(m[2])
+		if _, dup := s.sizes[n]; dup {
+			return fmt.Errorf("message %d listed twice", n)
+		}
+		s.sizes[n] = size
+		total += size
+	}
+	if len(s.sizes) != s.count {
+		return fmt.Errorf("LIST has %d messages; expected %d", len(s.sizes), s.count)
+	}
+	if s.stat[0] == s.count && s.stat[1] != 0 && total != s.stat[1] {
+		return fmt.Errorf("LIST sizes add up to %d; STAT said %d", total, s.stat[1])
+	}
+	return nil
+}
+
+func checkListLacks(n int) func(*popSession, *popReply) error {
+	return func(s *popSession, r *popReply) error {
+		for _, line := range r.lines {
+			if strings.HasPrefix(line, strconv.Itoa(n)+" ") {
+				return fmt.Errorf("deleted message %d is listed", n)
+			}
+		}
+		if len(r.lines) != s.count-1 {
+			return fmt.Errorf("LIST has %d messages; expected %d", len(r.lines), s.count-1)
+		}
+		return nil
+	}
+}
+
+func checkListOne(s *popSession, r *popReply) error {
+	n := cmdArg(r.cmd)
+	if want := fmt.Sprintf("+OK %d %d", n, s.sizes[n]); r.status != want {
+		return fmt.Errorf("got %q; LIST said %q", r.status, want)
+	}
+	return nil
+}
+
+// checkUIDL checks unique IDs are unique and made of the characters
+// RFC 1939 section 7 allows.
+func checkUIDL(s *popSession, r *popReply) error {
+	s.uids = make(map[int]string)
+	seen := make(map[string]bool)
+	for _, line := range r.lines {
+		f := strings.Fields(line)
+		if len(f) != 2 {
+			return fmt.Errorf("bad unique-id listing %q", line)
+		}
+		n, err := strconv.Atoi(f[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("bad message number in %q", line)
+		}
+		uid := f[1]
+		if len(uid) > 70 {
+			return fmt.Errorf("unique-id %q is over 70 characters", uid)
+		}
+		for i := 0; i < len(uid); i++ {
+			if uid[i] < 0x21 || uid[i] > 0x7e {
+				return fmt.Errorf("unique-id %q has a bad character", uid)
+			}
+		}
+		if seen[uid] {
+			return fmt.Errorf("unique-id %q used twice", uid)
+		}
+		seen[uid] = true
+		s.uids[n] = uid
+	}
+	if len(s.uids) != s.count {
+		return fmt.Errorf("UIDL has %d messages; expected %d", len(s.uids), s.count)
+	}
+	return nil
+}
+
+func checkUIDLOne(s *popSession, r *popReply) error {
+	n := cmdArg(r.cmd)
+	if want := fmt.Sprintf("+OK %d %s", n, s.uids[n]); r.status != want {
+		return fmt.Errorf("got %q; UIDL said %q", r.status, want)
+	}
+	return nil
+}
+
+// checkUIDLAfterDele checks that the last message from the earlier
+// UIDL is gone and the others are still there.
+func checkUIDLAfterDele(s *popSession, r *popReply) error {
+	now := make(map[string]bool)
+	for _, line := range r.lines {
+		if f := strings.Fields(line); len(f) == 2 {
+			now[f[1]] = true
+		}
+	}
+	for n, uid := range s.uids {
+		if n == s.count && now[uid] {
+			return fmt.Errorf("deleted message %s is still there", uid)
+		}
+		if n != s.count && !now[uid] {
+			return fmt.Errorf("message %s went missing", uid)
+		}
+	}
+	return nil
+}
+
+// checkRetr checks a message's size matches LIST and that it looks
+// like a message.
+func checkRetr(s *popSession, r *popReply) error {
+	n := cmdArg(r.cmd)
+	if size, ok := s.sizes[n]; ok && size != r.octets {
+		return fmt.Errorf("message %d is %d octets; LIST said %d", n, r.octets, size)
+	}
+	msg := strings.Join(r.lines, "\r\n") + "\r\n"
+	if !strings.Contains(msg, "\r\n\r\n") {
+		return fmt.Errorf("message %d has no blank line after its header", n)
+	}
+	for _, line := range r.lines {
+		if strings.HasPrefix(line, ".") {
+			s.dotLines++
+		}
+	}
+	if s.messages == nil {
+		s.messages = make(map[int]string)
+	}
+	s.messages[n] = msg
+	return nil
+}
+
+// checkTop checks TOP's reply is the header RETR returned, and the
+// first lines of its body.
+func checkTop(lines int) func(*popSession, *popReply) error {
+	return func(s *popSession, r *popReply) error {
+		n := cmdArg(r.cmd)
+		msg, ok := s.messages[n]
+		if !ok {
+			return fmt.Errorf("message %d wasn't retrieved first", n)
+		}
+		i := strings.Index(msg, "\r\n\r\n")
+		head, body := msg[:i+4], strings.SplitAfter(msg[i+4:], "\r\n")
+		if lines < len(body) {
+			body = body[:lines]
+		}
+		want := head + strings.Join(body, "")
+		if got := strings.Join(r.lines, "\r\n") + "\r\n"; got != want {
+			return fmt.Errorf("TOP %d %d returned %d octets; expected %d from RETR", n, lines, len(got), len(want))
+		}
+		return nil
+	}
+}
+
+// cmdArg returns the first argument of cmd as a number.
+func cmdArg(cmd string) int {
+	f := strings.Fields(cmd)
+	if len(f) < 2 {
+		return 0
+	}
+	n, _ := strconv.Atoi(f[1])
+	return n
+}
+
+// expand fills in a step's placeholders, returning one command per
+// message for {each}.
+func (s *popSession) expand(send string) []string {
+	plain := func(pass string) string {
+		return base64.StdEncoding.EncodeToString([]byte("\x00" + s.user + "\x00" + pass))
+	}
+	sum := md5.Sum([]byte(s.stamp + s.pass))
+	r := strings.NewReplacer(
+		"{user}", s.user,
+		"{pass}", s.pass,
+		"{last}", strconv.Itoa(s.count),
+		"{past}", strconv.Itoa(s.count+1),
+		"{apop}", hex.EncodeToString(sum[:]),
+		"{plain}", plain(s.pass),
+		"{badplain}", plain(s.pass+"-wrong"),
+	)
+	send = r.Replace(send)
+	if !strings.Contains(send, "{each}") {
+		return []string{send}
+	}
+	var cmds []string
+	for n := 1; n <= s.count && n <= popCheckMaxEach; n++ {
+		cmds = append(cmds, strings.Replace(send, "{each}", strconv.Itoa(n), -1))
+	}
+	return cmds
+}
+
+// connect opens a connection and reads the greeting.
+func (s *popSession) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	c, err := net.DialTimeout("tcp", s.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	if s.implicit {
+		c = tls.Client(c, s.tls)
+	}
+	c.SetDeadline(time.Now().Add(time.Minute))
+	s.conn, s.br = c, bufio.NewReader(c)
+	greeting, err := s.readLine()
+	if err != nil {
+		return fmt.Errorf("reading greeting: %v", err)
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return fmt.Errorf("greeting %q isn't +OK", greeting)
+	}
+	s.stamp = ""
+	if i, j := strings.Index(greeting, "<"), strings.LastIndex(greeting, ">"); i >= 0 && j > i {
+		s.stamp = greeting[i : j+1]
+	}
+	return nil
+}
+
+// readLine reads a CRLF-terminated line and returns it without the
+// CRLF.
+func (s *popSession) readLine() (string, error) {
+	line, err := s.br.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", fmt.Errorf("line %q doesn't end in CRLF", line)
+	}
+	line = line[:len(line)-2]
+	if strings.ContainsAny(line, "\r\n") {
+		return "", fmt.Errorf("line %q has a bare CR or LF", line)
+	}
+	return line, nil
+}
+
+func (s *popSession) readReply(cmd string, multi bool) (*popReply, error) {
+	status, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	r := &popReply{cmd: cmd, status: status}
+	if !multi || !strings.HasPrefix(status, "+OK") {
+		return r, nil
+	}
+	for {
+		line, err := s.readLine()
+		if err != nil {
+			return nil, fmt.Errorf("reading multi-line reply: %v", err)
+		}
+		if line == "." {
+			return r, nil
+		}
+		if strings.HasPrefix(line, ".") {
+			line = line[1:]
+		}
+		r.lines = append(r.lines, line)
+		r.octets += len(line) + 2
+	}
+}
+
+// upgrade starts TLS on the connection after STLS.
+func (s *popSession) upgrade() error {
+	if s.br.Buffered() > 0 {
+		return errors.New("server sent more after its STLS reply")
+	}
+	tc := tls.Client(s.conn, s.tls)
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake after STLS: %v", err)
+	}
+	s.conn, s.br = tc, bufio.NewReader(tc)
+	return nil
+}
+
+// run runs one script on a new connection.
+func (s *popSession) run(sc popScript) error {
+	s.stat, s.sizes, s.uids, s.messages, s.dotLines = [2]int{}, nil, nil, nil, 0
+	if err := s.connect(); err != nil {
+		return err
+	}
+	defer func() {
+		s.conn.Close()
+		s.conn = nil
+	}()
+
+	type sent struct {
+		step popStep
+		cmd  string
+	}
+	var pending []sent
+	finish := func() error {
+		for _, p := range pending {
+			if err := s.expect(p.step, p.cmd); err != nil {
+				return fmt.Errorf("%s: %v", p.cmd, err)
+			}
+		}
+		pending = nil
+		return nil
+	}
+	for _, step := range sc.steps {
+		if step.send == "reconnect" {
+			if err := finish(); err != nil {
+				return err
+			}
+			if err := s.connect(); err != nil {
+				return err
+			}
+			continue
+		}
+		for _, cmd := range s.expand(step.send) {
+			if _, err := io.WriteString(s.conn, cmd+"\r\n"); err != nil {
+				return fmt.Errorf("%s: %v", cmd, err)
+			}
+			pending = append(pending, sent{step, cmd})
+			if !sc.pipelined {
+				if err := finish(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return finish()
+}
+
+// expect reads the reply to cmd and checks it against step.
+func (s *popSession) expect(step popStep, cmd string) error {
+	r, err := s.readReply(cmd, step.multi)
+	if err != nil {
+		return err
+	}
+	switch {
+	case step.want == "+" && (r.status == "+" || strings.HasPrefix(r.status, "+ ")):
+	case step.want != "+" && strings.HasPrefix(r.status+" ", step.want+" "):
+	default:
+		return fmt.Errorf("got %q; want %s", r.status, step.want)
+	}
+	if step.check != nil {
+		if err := step.check(s, r); err != nil {
+			return err
+		}
+	}
+	verb := strings.ToUpper(strings.Fields(cmd + " x")[0])
+	switch {
+	case verb == "STLS" && step.want == "+OK":
+		return s.upgrade()
+	case verb == "QUIT":
+		s.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := s.br.ReadByte(); err != io.EOF {
+			return errors.New("server didn't close the connection after QUIT")
+		}
+	}
+	return nil
+}
+
+// probe logs in to learn the server's capabilities and how many
+// messages the maildrop has.
+func (s *popSession) probe() error {
+	if err := s.connect(); err != nil {
+		return err
+	}
+	defer func() {
+		s.conn.Close()
+		s.conn = nil
+	}()
+	s.caps = make(map[string]bool)
+	io.WriteString(s.conn, "CAPA\r\n")
+	if r, err := s.readReply("CAPA", true); err == nil && strings.HasPrefix(r.status, "+OK") {
+		for _, line := range r.lines {
+			if f := strings.Fields(line); len(f) > 0 {
+				s.caps[strings.ToUpper(f[0])] = true
+			}
+		}
+	}
+	for _, cmd := range []string{"USER " + s.user, "PASS " + s.pass, "STAT"} {
+		io.WriteString(s.conn, cmd+"\r\n")
+		r, err := s.readReply(cmd, false)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(r.status, "+OK") {
+			return fmt.Errorf("%s: %s", strings.Fields(cmd)[0], r.status)
+		}
+		if cmd == "STAT" {
+			f := strings.Fields(r.status)
+			if len(f) < 3 {
+				return fmt.Errorf("bad STAT reply %q", r.status)
+			}
+			s.count, _ = strconv.Atoi(f[1])
+			s.octets, _ = strconv.Atoi(f[2])
+		}
+	}
+	io.WriteString(s.conn, "QUIT\r\n")
+	return nil
+}
+
+// runScripts runs every script and reports on each to w, returning
+// an error if any failed.
+func (s *popSession) runScripts(w io.Writer, destructive bool) error {
+	if err := s.probe(); err != nil {
+		return fmt.Errorf("can't log in to %s: %v", s.addr, err)
+	}
+	fmt.Fprintf(w, "%s: %d messages, %d octets\n", s.addr, s.count, s.octets)
+	failed := 0
+	for _, sc := range popScripts {
+		reason := ""
+		if sc.skip != nil {
+			reason = sc.skip(s)
+		}
+		if sc.destructive && !destructive {
+			reason = "changes the maildrop; run with -destructive"
+		}
+		if reason != "" {
+			fmt.Fprintf(w, "skip  %s: %s\n", sc.name, reason)
+			continue
+		}
+		if err := s.run(sc); err != nil {
+			fmt.Fprintf(w, "FAIL  %s: %v\n", sc.name, err)
+			failed++
+		} else {
+			fmt.Fprintf(w, "ok    %s\n", sc.name)
+		}
+		if sc.destructive {
+			if err := s.probe(); err != nil {
+				return err
+			}
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d scripts failed", failed, len(popScripts))
+	}
+	return nil
+}
+
+// popCheckFixture is the maildrop the scripts run against on the
+// fake backend. The lines starting with dots must be dot-stuffed.
+var popCheckFixture = []struct{ from, text string }{
+	{"friend", "hey, are you around?"},
+	{"popcheck", "yep"},
+	{"friend", ".\n..two dots\n.one dot\nand a final line"},
+	{"friend", "café ☕ and a snowman ☃"},
+	{"friend", strings.Repeat("a very long line ", 80)},
+	{"popcheck", ". starts with a dot\n.\n"},
+}
+
+func popCheckCommand(args []string) error {
+	fs := flag.NewFlagSet("popcheck", flag.ContinueOnError)
+	implicitTLS := fs.Bool("tls", false, "Connect with TLS from the start, as for port 995")
+	insecure := fs.Bool("insecure", false, "Don't verify the server's certificate")
+	destructive := fs.Bool("destructive", false, "Also run scripts that delete messages from the maildrop")
+	verbose := fs.Bool("v", false, "Log the server's side too, when running against the fake backend")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: popcheck [flags] [host:port user password]\n\nWith no address, checks an in-process server on a fake Twitter.\n\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch fs.NArg() {
+	case 0:
+		if !*verbose {
+			log.SetOutput(ioutil.Discard)
+			defer log.SetOutput(os.Stderr)
+		}
+		return popCheckFake(os.Stdout)
+	case 3:
+		host, _, err := net.SplitHostPort(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		s := &popSession{
+			addr:     fs.Arg(0),
+			implicit: *implicitTLS,
+			tls:      &tls.Config{ServerName: host, InsecureSkipVerify: *insecure},
+			user:     fs.Arg(1),
+			pass:     fs.Arg(2),
+		}
+		return s.runScripts(os.Stdout, *destructive)
+	}
+	fs.Usage()
+	return errors.New("wrong number of arguments")
+}
+
+// popCheckFake runs the scripts against a POPServer on a loopback
+// port, with a fresh account on a fake Twitter in a temporary
+// directory, and reports on each to w.
+func popCheckFake(w io.Writer) error {
+	dir, err := ioutil.TempDir("", "popcheck")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir+"/db", 0700); err != nil {
+		return err
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	defer os.Chdir(wd)
+
+	ft := faketwitter.NewServer()
+	defer ft.Close()
+	*twitterAPIBase = ft.URL
+	*twitterUploadBase = ft.URL
+	*twitterConsumerKey = faketwitter.ConsumerKey
+	*twitterConsumerSecret = faketwitter.ConsumerSecret
+	u := ft.AddUser("popcheck", "Pop Check")
+	ft.AddUser("friend", "A Friend")
+	t := time.Date(2012, 3, 1, 10, 0, 0, 0, time.UTC)
+	for i, dm := range popCheckFixture {
+		to := "popcheck"
+		if dm.from == to {
+			to = "friend"
+		}
+		ft.AddDMAt(dm.from, to, dm.text, t.Add(time.Duration(i)*time.Minute))
+	}
+
+	acct := &Account{Username: u.ScreenName, Password: "popcheck-password", Token: u.Token, TokenSecret: u.TokenSecret}
+	if err := acct.Save(); err != nil {
+		return err
+	}
+	store, err := syncer.Store(acct.Username)
+	if err != nil {
+		return err
+	}
+	if _, err := (&syncWorker{user: acct.Username, store: store}).syncOnce(); err != nil {
+		return fmt.Errorf("syncing from the fake Twitter: %v", err)
+	}
+
+	cert, err := selfSignedCert("localhost")
+	if err != nil {
+		return err
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	ps := NewPOPServer(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ps.newConn(c).serve()
+		}
+	}()
+
+	s := &popSession{
+		addr:    ln.Addr().String(),
+		tls:     &tls.Config{InsecureSkipVerify: true},
+		user:    acct.Username,
+		pass:    acct.Password,
+		fixture: true,
+	}
+	return s.runScripts(w, true)
+}
+
+// selfSignedCert returns a throwaway certificate for host.
+func selfSignedCert(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestPOPConformance runs popcheck's scripts against the fake
+// backend, as "eight22er popcheck" with no address does. It leaves
+// the Twitter flags pointing at popCheckFake's server, which is gone
+// by then; tests that use Twitter point them at their own.
+func TestPOPConformance(t *testing.T) {
+	testDB(t)
+	var out bytes.Buffer
+	if err := popCheckFake(&out); err != nil {
+		t.Fatalf("%v\n%s", err, out.String())
+	}
+	for _, sc := range popScripts {
+		if !strings.Contains(out.String(), "\nok    "+sc.name+"\n") {
+			t.Errorf("script %q didn't pass:\n%s", sc.name, out.String())
+		}
+	}
+}
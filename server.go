@@ -7,19 +7,16 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"time"
 
-	"github.com/bradfitz/eight22er/oauth"
-	"github.com/bradfitz/go-smtpd/smtpd"
 	"github.com/bradfitz/runsit/listen"
 )
 
@@ -27,6 +24,7 @@ var (
 	dev        = flag.Bool("dev", false, "Development mode; use localhost and stuff")
 	doSSL      = flag.Bool("ssl", false, "Do SSL")
 	popPort    = listen.NewFlag("pop_port", "1100", "POP3")
+	imapPort   = listen.NewFlag("imap_port", "1430", "IMAP")
 	smtpPort   = listen.NewFlag("smtp_port", "5870", "SMTP")
 	webPort    = listen.NewFlag("web_port", "8000", "HTTP")
 	webSSLPort = listen.NewFlag("web_ssl_port", "4430", "HTTPS")
@@ -35,6 +33,12 @@ var (
 func main() {
 
 	flag.Parse()
+	if _, ok := dmAPIs[*dmAPIVersion]; !ok {
+		log.Fatalf("unknown -dm_api version %q", *dmAPIVersion)
+	}
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 	var (
 		cert   tls.Certificate
 		err    error
@@ -68,43 +72,45 @@ func main() {
 	if *doSSL {
 		pln = tls.NewListener(pln, config)
 	}
-	pop := NewPOPServer(pln)
+	pop := NewPOPServer(pln, config)
 	go pop.run()
 
+	// IMAP Listener
+	iln, err := imapPort.Listen()
+	check(err)
+	if *doSSL {
+		iln = tls.NewListener(iln, config)
+	}
+	imap := NewIMAPServer(iln, config)
+	go imap.run()
+
 	// SMTP Listener
 	sln, err := smtpPort.Listen()
 	check(err)
 	if *doSSL {
 		sln = tls.NewListener(sln, config)
 	}
-	ss := &smtpd.Server{
-		Hostname:  "eight22er.danga.com",
-		PlainAuth: true,
-		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress) (smtpd.Envelope, error) {
-			return nil, errors.New("TODO: we haven't finished sending direct messasges via SMTP yet")
-		},
-	}
-	go ss.Serve(sln)
+	smtp := NewSMTPServer(sln, config)
+	go smtp.run()
 
-	select {}
-}
+	go runWebhooks()
 
-func oauthClient() *oauth.Client {
-	return &oauth.Client{
-		Credentials: oauth.Credentials{
-			Token:  slurpFile("config-consumerkey"),
-			Secret: slurpFile("config-consumersecret"),
-		},
-		TemporaryCredentialRequestURI: "https://api.twitter.com/oauth/request_token",
-		ResourceOwnerAuthorizationURI: "https://api.twitter.com/oauth/authorize",
-		TokenRequestURI:               "https://api.twitter.com/oauth/access_token",
-	}
+	select {}
 }
 
 type Account struct {
-	Username           string // on twitter
+	Backend            string // name of the service the account is on; see backends
+	Username           string // on the backend
 	Password           string // for local service
 	Token, TokenSecret string
+	Instance           string   // URL of the account's server, for backends with more than one
+	Channels           []string // IRC channels to join for highlights
+	TimeZone           string   // IANA zone name for Date headers; empty means UTC
+	NoMedia            bool     // don't attach DM photos and videos
+	HideSent           bool     // only show received DMs, not the user's own
+	Webhook            string   // URL to POST events to; see webhook.go
+	WebhookSecret      string   // signs the webhook's requests
+	FeedToken          string   // in the Atom feed's URL; empty means no feed
 }
 
 var errAuthFailure = errors.New("Auth failure")
@@ -131,12 +137,14 @@ func GetAccountNoAuth(user string) *Account {
 	if len(v) < 3 {
 		return &Account{Username: user}
 	}
-	return &Account{
+	a := &Account{
 		Username:    user,
 		Password:    v[0],
 		Token:       strings.TrimSpace(v[1]),
 		TokenSecret: strings.TrimSpace(v[2]),
 	}
+	a.parseOptions(v[3:])
+	return a
 }
 
 func GetAccount(user, pass string) (*Account, error) {
@@ -159,10 +167,55 @@ func GetAccount(user, pass string) (*Account, error) {
 		Token:       strings.TrimSpace(v[1]),
 		TokenSecret: strings.TrimSpace(v[2]),
 	}
+	a.parseOptions(v[3:])
 	return a, nil
 }
 
-var userRx = regexp.MustCompile(`^[a-zA-Z0-9\.\-]+$`)
+// parseOptions reads the optional "key=value" lines that follow the
+// password and token lines in an account file.
+func (a *Account) parseOptions(lines []string) {
+	for _, line := range lines {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "backend":
+			a.Backend = kv[1]
+		case "instance":
+			a.Instance = kv[1]
+		case "channels":
+			a.Channels = strings.Split(kv[1], ",")
+		case "tz":
+			a.TimeZone = kv[1]
+		case "media":
+			a.NoMedia = kv[1] == "off"
+		case "sent":
+			a.HideSent = kv[1] == "hide"
+		case "webhook":
+			a.Webhook = kv[1]
+		case "webhook_secret":
+			a.WebhookSecret = kv[1]
+		case "feed_token":
+			a.FeedToken = kv[1]
+		}
+	}
+}
+
+// Location returns the time zone the account wants its message
+// dates displayed in, defaulting to UTC.
+func (a *Account) Location() *time.Location {
+	if a == nil || a.TimeZone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(a.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+var userRx = regexp.MustCompile(`^[a-zA-Z0-9_\.\-]+$`)
 
 func (a *Account) Save() error {
 	if !userRx.MatchString(a.Username) {
@@ -170,161 +223,348 @@ func (a *Account) Save() error {
 	}
 	pw := strings.Replace(a.Password, "\n", "", -1)
 	content := fmt.Sprintf("%s\n%s\n%s\n", pw, a.Token, a.TokenSecret)
+	if a.Backend != "" {
+		content += fmt.Sprintf("backend=%s\n", a.Backend)
+	}
+	if a.Instance != "" {
+		content += fmt.Sprintf("instance=%s\n", a.Instance)
+	}
+	if len(a.Channels) > 0 {
+		content += fmt.Sprintf("channels=%s\n", strings.Join(a.Channels, ","))
+	}
+	if tz := strings.TrimSpace(a.TimeZone); tz != "" {
+		content += fmt.Sprintf("tz=%s\n", tz)
+	}
+	if a.NoMedia {
+		content += "media=off\n"
+	}
+	if a.HideSent {
+		content += "sent=hide\n"
+	}
+	if a.Webhook != "" {
+		content += fmt.Sprintf("webhook=%s\nwebhook_secret=%s\n", a.Webhook, a.WebhookSecret)
+	}
+	if a.FeedToken != "" {
+		content += fmt.Sprintf("feed_token=%s\n", a.FeedToken)
+	}
 	return ioutil.WriteFile(accountFile(a.Username), []byte(content), 0700)
 }
 
-type DM map[string]interface{}
-type User map[string]interface{}
-
-func (d DM) Sender() User {
-	if m, ok := d["sender"].(map[string]interface{}); ok {
-		return User(m)
-	}
-	return User(nil)
+// A DM is a direct message from an account's backend. Its shape
+// follows Twitter's, the first backend.
+type DM struct {
+	ID           int64
+	Text         string
+	CreatedAt    time.Time
+	Sender       User
+	Recipient    User
+	Entities     Entities
+	Conversation string // backend's conversation ID; empty for the one-to-one conversation with the partner
+	Ref          string // backend's own ID for the message, for backends whose IDs aren't numbers
 }
 
-func (d DM) Text() string {
-	if s, ok := d["text"].(string); ok {
-		return s
-	}
-	return ""
+// A User is the sender or recipient of a DM.
+type User struct {
+	ID     int64
+	Handle string // name on the backend, e.g. a Twitter screen name
+	Name   string
 }
 
-func (d DM) CreatedAt() string {
-	if s, ok := d["created_at"].(string); ok {
-		return s
-	}
-	return ""
+// Entities are the parts of a DM's text that Twitter annotated.
+// Indices are rune offsets into the text.
+type Entities struct {
+	URLs     []URLEntity     `json:"urls"`
+	Mentions []MentionEntity `json:"user_mentions"`
+	Hashtags []HashtagEntity `json:"hashtags"`
+	Media    []MediaEntity   `json:"media"`
 }
 
-func (d DM) ID() int64 {
-	if id, ok := d["id"].(float64); ok {
-		return int64(id)
-	}
-	return 0
+type URLEntity struct {
+	URL         string `json:"url"`
+	ExpandedURL string `json:"expanded_url"`
+	DisplayURL  string `json:"display_url"`
+	Indices     [2]int `json:"indices"`
 }
 
-func (d DM) Subject() string {
-	t := d.Text()
-	t = strings.Replace(t, "\n", " / ", -1)
-	t = strings.Replace(t, "\r", "", -1)
-	return t
+type MentionEntity struct {
+	ScreenName string `json:"screen_name"`
+	Name       string `json:"name"`
+	Indices    [2]int `json:"indices"`
 }
 
-func (d DM) Octets() int {
-	return len(d.RFC822())
+type HashtagEntity struct {
+	Text    string `json:"text"`
+	Indices [2]int `json:"indices"`
 }
 
-func (d DM) RFC822() string {
-	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "From: %s@eight22er.danga.com (%s)\r\n", d.Sender().ScreenName(), d.Sender().Name())
-	fmt.Fprintf(&buf, "Subject: %s\r\n", d.Subject())
-	fmt.Fprintf(&buf, "Date: %s\r\n", d.CreatedAt())
-	fmt.Fprintf(&buf, "Message-Id: <%d@eight22er.danga.com>\r\n", d.ID())
-	fmt.Fprintf(&buf, "\r\n%s", d.Text())
-	return buf.String()
+// A MediaEntity is a photo, video or animated GIF attached to a DM.
+type MediaEntity struct {
+	Type          string `json:"type"` // "photo", "video" or "animated_gif"
+	URL           string `json:"url"`
+	MediaURLHTTPS string `json:"media_url_https"`
+	Indices       [2]int `json:"indices"`
+	VideoInfo     struct {
+		Variants []VideoVariant `json:"variants"`
+	} `json:"video_info"`
 }
 
-func (u User) ScreenName() string {
-	if s, ok := u["screen_name"].(string); ok {
-		return s
-	}
-	return ""
+type VideoVariant struct {
+	ContentType string `json:"content_type"`
+	Bitrate     int    `json:"bitrate"`
+	URL         string `json:"url"`
 }
 
-func (u User) Name() string {
-	if s, ok := u["name"].(string); ok {
-		return s
+// twitterTimeLayout is the format of Twitter's created_at fields.
+const twitterTimeLayout = time.RubyDate
+
+// parseID returns a Twitter ID, preferring the exact id_str form
+// over the numeric one.
+func parseID(idStr string, id json.Number) (int64, error) {
+	if idStr == "" {
+		idStr = id.String()
+	}
+	if idStr == "" {
+		return 0, nil
 	}
-	return ""
+	return strconv.ParseInt(idStr, 10, 64)
 }
 
-func check(err error) {
+func (d *DM) UnmarshalJSON(b []byte) error {
+	var w struct {
+		ID               json.Number `json:"id"`
+		IDStr            string      `json:"id_str"`
+		Text             string      `json:"text"`
+		CreatedAt        string      `json:"created_at"`
+		Sender           User        `json:"sender"`
+		Recipient        User        `json:"recipient"`
+		Entities         Entities    `json:"entities"`
+		ExtendedEntities Entities    `json:"extended_entities"`
+		Conversation     string      `json:"dm_conversation_id"`
+		Ref              string      `json:"eight22er_ref"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&w); err != nil {
+		return err
+	}
+	id, err := parseID(w.IDStr, w.ID)
 	if err != nil {
-		log.Fatal(err)
+		return fmt.Errorf("bad DM id: %v", err)
 	}
+	t, err := time.Parse(twitterTimeLayout, w.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("bad created_at for DM %d: %v", id, err)
+	}
+	*d = DM{
+		ID:           id,
+		Text:         w.Text,
+		CreatedAt:    t,
+		Sender:       w.Sender,
+		Recipient:    w.Recipient,
+		Entities:     w.Entities,
+		Conversation: w.Conversation,
+		Ref:          w.Ref,
+	}
+	if len(w.ExtendedEntities.Media) > 0 {
+		// extended_entities lists every attachment, entities
+		// only the first.
+		d.Entities.Media = w.ExtendedEntities.Media
+	}
+	return nil
 }
 
-func parseDMs(r io.Reader) ([]DM, error) {
-	var dms interface{}
-	err := json.NewDecoder(r).Decode(&dms)
-	if err != nil {
-		return nil, err
+func (u *User) UnmarshalJSON(b []byte) error {
+	var w struct {
+		ID         json.Number `json:"id"`
+		IDStr      string      `json:"id_str"`
+		ScreenName string      `json:"screen_name"`
+		Name       string      `json:"name"`
 	}
-	dmList, ok := dms.([]interface{})
-	if !ok {
-		return nil, fmt.Errorf("DM response not a list, got a %T", dms)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	if err := dec.Decode(&w); err != nil {
+		return err
 	}
-	ret := []DM{}
-	for _, v := range dmList {
-		dmj, ok := v.(map[string]interface{})
-		if ok {
-			ret = append(ret, DM(dmj))
-		}
+	id, err := parseID(w.IDStr, w.ID)
+	if err != nil {
+		return fmt.Errorf("bad user id: %v", err)
 	}
-	return ret, nil
+	*u = User{ID: id, Handle: w.ScreenName, Name: w.Name}
+	return nil
 }
 
-func buildAuthHeader(vals url.Values) string {
-	var buf bytes.Buffer
-	if _, ok := vals["oauth_version"]; !ok {
-		vals.Set("oauth_version", "1.0")
+// MarshalJSON encodes the DM in the same shape Twitter's API uses,
+// so it can be read back with UnmarshalJSON.
+func (d DM) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		IDStr        string   `json:"id_str"`
+		Text         string   `json:"text"`
+		CreatedAt    string   `json:"created_at"`
+		Sender       User     `json:"sender"`
+		Recipient    User     `json:"recipient"`
+		Entities     Entities `json:"entities"`
+		Conversation string   `json:"dm_conversation_id,omitempty"`
+		Ref          string   `json:"eight22er_ref,omitempty"`
+	}{
+		IDStr:        strconv.FormatInt(d.ID, 10),
+		Text:         d.Text,
+		CreatedAt:    d.CreatedAt.Format(twitterTimeLayout),
+		Sender:       d.Sender,
+		Recipient:    d.Recipient,
+		Entities:     d.Entities,
+		Conversation: d.Conversation,
+		Ref:          d.Ref,
+	})
+}
+
+func (u User) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		IDStr      string `json:"id_str"`
+		ScreenName string `json:"screen_name"`
+		Name       string `json:"name"`
+	}{strconv.FormatInt(u.ID, 10), u.Handle, u.Name})
+}
+
+// Sent reports whether the DM was sent by a rather than to a.
+func (d DM) Sent(a *Account) bool {
+	return a != nil && a.is(d.Sender)
+}
+
+// is reports whether u is the account's own user on its backend,
+// whose mail address has the account's username as its local part.
+func (a *Account) is(u User) bool {
+	local := strings.SplitN(backendFor(a).MailAddress(u), "@", 2)[0]
+	return strings.EqualFold(local, a.Username)
+}
+
+// Partner returns the other person in the conversation the DM
+// belongs to, from a's point of view.
+func (d DM) Partner(a *Account) User {
+	if d.Sent(a) {
+		return d.Recipient
 	}
-	fmt.Fprintf(&buf, "OAuth")
-	remove := []string{}
-	for k := range vals {
-		if !strings.HasPrefix(k, "oauth_") {
-			continue
-		}
-		remove = append(remove, k)
+	return d.Sender
+}
+
+// ConversationID returns the ID of the conversation the DM belongs
+// to: the backend's, or for one-to-one conversations without one,
+// the partner's lowercased handle.
+func (d DM) ConversationID(a *Account) string {
+	if d.Conversation != "" {
+		return d.Conversation
 	}
-	sort.Strings(remove)
-	for n, k := range remove {
-		if n > 0 {
-			buf.WriteByte(',')
-		}
-		v := vals.Get(k)
-		if k == "oauth_signature" {
-			v = url.QueryEscape(v)
+	return strings.ToLower(d.Partner(a).Handle)
+}
+
+// ThreadID returns a Message-Id shared by every DM in the same
+// conversation, so mail clients thread them together.
+func (d DM) ThreadID(a *Account) string {
+	return fmt.Sprintf("<conv.%s@eight22er.danga.com>", msgIDSafe(d.ConversationID(a)))
+}
+
+// msgIDSafe escapes the characters of s that can't appear in the
+// left half of a Message-Id, such as the "@" in Mastodon handles.
+func msgIDSafe(s string) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9', b == '.', b == '-', b == '_':
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "=%02X", b)
 		}
-		fmt.Fprintf(&buf, " %s=%q", k, v)
-		delete(vals, k)
 	}
 	return buf.String()
 }
 
-func (a *Account) GetDMs(n int) ([]DM, error) {
-	oc := oauthClient()
-	cred := &oauth.Credentials{
-		Token:  a.Token,
-		Secret: a.TokenSecret,
-	}
+func (d DM) Subject() string {
+	t := html.UnescapeString(d.Text)
+	t = strings.Replace(t, "\n", " / ", -1)
+	t = strings.Replace(t, "\r", "", -1)
+	return t
+}
+
+// UIDL returns the DM's unique ID for POP's UIDL, which the Atom feed
+// uses too.
+func (d DM) UIDL() string {
+	return fmt.Sprintf("twdmid%d", d.ID)
+}
 
-	urlBase := "https://api.twitter.com/1/direct_messages.json"
-	params := make(url.Values)
-	params.Set("count", strconv.Itoa(n))
-	oc.SignParam(cred, "GET", urlBase, map[string][]string(params))
+func (d DM) Octets(a *Account) int {
+	return len(d.RFC822(a))
+}
 
-	authHeader := buildAuthHeader(params)
-	reqURL := fmt.Sprintf("%s?%s", urlBase, params.Encode())
+// RFC822 renders the DM as a mail message, with dates shown in a's
+// time zone. a may be nil.
+func (d DM) RFC822(a *Account) string {
+	date := d.CreatedAt.In(a.Location()).Format(time.RFC1123Z)
 
-	log.Printf("Req URL: %s", reqURL)
-	log.Printf("Authorization: %s", authHeader)
+	var buf bytes.Buffer
+	b := backendFor(a)
+	writeHeader(&buf, "Received", fmt.Sprintf("from %s by eight22er.danga.com with HTTPS id %s; %s", b.Host(a), d.UIDL(), date))
+	writeHeader(&buf, "Delivery-Date", date)
+	writeHeader(&buf, "From", formatAddress(d.Sender.Name, b.MailAddress(d.Sender)))
+	if to := d.Recipient; to.Handle != "" {
+		writeHeader(&buf, "To", formatAddress(to.Name, b.MailAddress(to)))
+	}
+	writeHeader(&buf, "Subject", encodeWord(d.Subject()))
+	writeHeader(&buf, "Date", date)
+	writeHeader(&buf, "Message-Id", fmt.Sprintf("<%d@eight22er.danga.com>", d.ID))
+	if a != nil {
+		writeHeader(&buf, "In-Reply-To", d.ThreadID(a))
+		writeHeader(&buf, "References", d.ThreadID(a))
+	}
+	if d.Sent(a) {
+		writeHeader(&buf, "X-Eight22er-Direction", "sent")
+	} else {
+		writeHeader(&buf, "X-Eight22er-Direction", "received")
+	}
+	writeHeader(&buf, "MIME-Version", "1.0")
 
-	req, _ := http.NewRequest("GET", reqURL, nil)
-	req.Header.Add("Authorization", authHeader)
+	atts := d.attachments(a)
+	if len(atts) == 0 {
+		writeAlternative(&buf, fmt.Sprintf("=_alt_%d", d.ID), d.ExpandedText(), d.HTML())
+		return buf.String()
+	}
+	mixed := fmt.Sprintf("=_mix_%d", d.ID)
+	writeHeader(&buf, "Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", mixed))
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", mixed)
+	writeAlternative(&buf, fmt.Sprintf("=_alt_%d", d.ID), d.ExpandedText(), d.HTML())
+	for _, att := range atts {
+		fmt.Fprintf(&buf, "--%s\r\n", mixed)
+		writeAttachment(&buf, att)
+	}
+	fmt.Fprintf(&buf, "--%s--\r\n", mixed)
+	return buf.String()
+}
 
-	res, err := http.DefaultClient.Do(req)
+func check(err error) {
 	if err != nil {
-		return nil, err
+		log.Fatal(err)
 	}
-	dms, err := parseDMs(res.Body)
+}
+
+func parseDMs(r io.Reader) ([]DM, error) {
+	var list []json.RawMessage
+	err := json.NewDecoder(r).Decode(&list)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("DM response not a list: %v", err)
+	}
+	ret := make([]DM, len(list))
+	for i, raw := range list {
+		if err := json.Unmarshal(raw, &ret[i]); err != nil {
+			return nil, fmt.Errorf("decoding DM %d of %d: %v", i+1, len(list), err)
+		}
 	}
-	return dms, nil
+	return ret, nil
 }
 
+type dmsByNewest []DM
+
+func (s dmsByNewest) Len() int           { return len(s) }
+func (s dmsByNewest) Less(i, j int) bool { return s[i].ID > s[j].ID }
+func (s dmsByNewest) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 func slurpFile(file string) string {
 	f, err := os.Open(file)
 	if err != nil {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDB runs the test in a fresh directory with an empty db, and
+// closes the message stores it opened when it's done.
+func testDB(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("db", 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		syncer.mu.Lock()
+		defer syncer.mu.Unlock()
+		for key, s := range syncer.stores {
+			s.Close()
+			delete(syncer.stores, key)
+		}
+		// Workers that logins started stop when they next wake.
+		for key, w := range syncer.workers {
+			w.mu.Lock()
+			w.lastActive = time.Time{}
+			w.mu.Unlock()
+			delete(syncer.workers, key)
+		}
+	})
+}
+
+// serveHost sends publicClient's requests for host, by either
+// scheme, to srv for the rest of the test, with host still in their
+// Host header. It's for names like example.org that tests can't
+// resolve to their fakes.
+func serveHost(t *testing.T, host string, srv *httptest.Server) {
+	target, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := publicClient.Transport
+	publicClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == host {
+			r = r.Clone(r.Context())
+			r.URL.Scheme, r.URL.Host, r.Host = target.Scheme, target.Host, host
+		}
+		return orig.RoundTrip(r)
+	})
+	t.Cleanup(func() { publicClient.Transport = orig })
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// postForm returns a request POSTing form to path, as a browser
+// submitting one of our forms would.
+func postForm(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
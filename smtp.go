@@ -0,0 +1,585 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var smtpMaxBytes = flag.Int("smtp_max_bytes", 10<<20, "Largest mail message SMTP accepts to send as DMs")
+
+// smtpIdleTimeout is how long the SMTP server waits for a command,
+// as RFC 5321 section 4.5.3.2 suggests.
+const smtpIdleTimeout = 5 * time.Minute
+
+// An smtpReply is an error that's sent to the SMTP client as is: a
+// reply code, an RFC 3463 enhanced status code, and text.
+type smtpReply string
+
+func (e smtpReply) Error() string { return string(e) }
+
+// SMTPServer is the submission server that sends mail as DMs. Mail
+// is only accepted after AUTH with an account's username and
+// password, over TLS, and is always sent from that account.
+type SMTPServer struct {
+	ln  net.Listener
+	tls *tls.Config // for STARTTLS on connections that aren't TLS already; nil to not offer it
+}
+
+func NewSMTPServer(ln net.Listener, config *tls.Config) *SMTPServer {
+	return &SMTPServer{ln: ln, tls: config}
+}
+
+func (s *SMTPServer) run() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			log.Fatalf("SMTP accept error, shutting down: %v", err)
+			return
+		}
+		go s.newConn(c).serve()
+	}
+}
+
+func (s *SMTPServer) newConn(c net.Conn) *smtpConn {
+	conn := &smtpConn{s: s}
+	conn.setConn(c)
+	return conn
+}
+
+type smtpConn struct {
+	net.Conn
+	s    *SMTPServer
+	br   *bufio.Reader
+	bw   *bufio.Writer
+	tr   *textproto.Reader
+	helo string   // from EHLO or HELO
+	acct *Account // from AUTH
+	box  *outbox  // from MAIL
+}
+
+// setConn makes c talk over nc, as it does again after STARTTLS.
+func (c *smtpConn) setConn(nc net.Conn) {
+	c.Conn = nc
+	c.br = bufio.NewReader(nc)
+	c.bw = bufio.NewWriter(nc)
+	c.tr = textproto.NewReader(c.br)
+}
+
+func (c *smtpConn) send(s string) {
+	c.bw.WriteString(s + "\r\n")
+	c.bw.Flush()
+}
+
+// reply sends err if it's an smtpReply, or else a temporary failure.
+func (c *smtpConn) reply(err error) {
+	if r, ok := err.(smtpReply); ok {
+		c.send(string(r))
+		return
+	}
+	c.send("451 4.3.0 " + oneLine(err.Error()))
+}
+
+func (c *smtpConn) isTLS() bool {
+	_, ok := c.Conn.(*tls.Conn)
+	return ok
+}
+
+// canAuth reports whether AUTH is allowed yet: only over TLS, so
+// passwords aren't sent in the clear, except in -dev mode.
+func (c *smtpConn) canAuth() bool {
+	return c.isTLS() || *dev
+}
+
+func (c *smtpConn) serve() error {
+	defer c.Close()
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Printf("SMTP: TLS handshake error from %q: %v", c.RemoteAddr(), err)
+			return err
+		}
+	}
+	c.send("220 eight22er.danga.com ESMTP eight22er")
+	for {
+		c.SetReadDeadline(time.Now().Add(smtpIdleTimeout))
+		line, err := c.tr.ReadLine()
+		if err != nil {
+			return err
+		}
+		cmd, params := splitPOP3Line(line)
+		switch cmd {
+		case "EHLO", "HELO":
+			if params == "" {
+				c.send("501 5.5.4 " + cmd + " needs a domain")
+				continue
+			}
+			c.helo = params
+			c.box = nil
+			if cmd == "HELO" {
+				c.send("250 eight22er.danga.com")
+				continue
+			}
+			exts := []string{"eight22er.danga.com", "8BITMIME", "ENHANCEDSTATUSCODES", fmt.Sprintf("SIZE %d", *smtpMaxBytes)}
+			if c.s.tls != nil && !c.isTLS() {
+				exts = append(exts, "STARTTLS")
+			}
+			if c.canAuth() {
+				exts = append(exts, "AUTH PLAIN LOGIN")
+			}
+			for i, ext := range exts {
+				sep := "-"
+				if i == len(exts)-1 {
+					sep = " "
+				}
+				c.send("250" + sep + ext)
+			}
+		case "STARTTLS":
+			if err := c.starttls(); err != nil {
+				return err
+			}
+		case "AUTH":
+			if err := c.auth(params); err != nil {
+				return err
+			}
+		case "MAIL":
+			c.mail(params)
+		case "RCPT":
+			c.rcpt(params)
+		case "DATA":
+			if err := c.data(); err != nil {
+				return err
+			}
+		case "RSET":
+			c.box = nil
+			c.send("250 2.0.0 OK")
+		case "NOOP":
+			c.send("250 2.0.0 OK")
+		case "VRFY":
+			c.send("252 2.5.0 Send some mail and see")
+		case "QUIT":
+			c.send("221 2.0.0 bye")
+			return nil
+		default:
+			c.send("500 5.5.2 unknown command")
+		}
+	}
+}
+
+// starttls upgrades the connection to TLS, per RFC 3207. A non-nil
+// error means the connection is unusable.
+func (c *smtpConn) starttls() error {
+	if c.s.tls == nil || c.isTLS() {
+		c.send("502 5.5.1 STARTTLS not available")
+		return nil
+	}
+	if c.br.Buffered() > 0 {
+		c.send("501 5.5.4 STARTTLS must be the last command sent in the clear")
+		return errors.New("client pipelined after STARTTLS")
+	}
+	c.send("220 2.0.0 begin TLS negotiation")
+	tlsConn := tls.Server(c.Conn, c.s.tls)
+	if err := tlsConn.Handshake(); err != nil {
+		log.Printf("SMTP: STARTTLS handshake error from %q: %v", c.RemoteAddr(), err)
+		return err
+	}
+	c.setConn(tlsConn)
+	c.helo, c.acct, c.box = "", nil, nil
+	return nil
+}
+
+// auth logs in with SASL PLAIN or LOGIN, per RFC 4954. A non-nil
+// error means the connection is unusable.
+func (c *smtpConn) auth(params string) error {
+	switch {
+	case c.acct != nil:
+		c.send("503 5.5.1 Already authenticated")
+		return nil
+	case c.box != nil:
+		c.send("503 5.5.1 AUTH isn't allowed during a mail transaction")
+		return nil
+	case !c.canAuth():
+		c.send("538 5.7.11 Encryption required; use SSL/TLS or STARTTLS")
+		return nil
+	}
+	mech, resp := splitPOP3Line(params)
+	// challenge sends prompt, base64-encoded, and returns the
+	// client's decoded answer.
+	challenge := func(prompt string) (string, error) {
+		c.send("334 " + base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := c.tr.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if line == "*" {
+			return "", smtpReply("501 5.0.0 AUTH cancelled")
+		}
+		dec, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+		if err != nil {
+			return "", smtpReply("501 5.5.2 Can't decode base64")
+		}
+		return string(dec), nil
+	}
+	decode := func(s string) (string, error) {
+		if s == "=" {
+			return "", nil
+		}
+		dec, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return "", smtpReply("501 5.5.2 Can't decode base64")
+		}
+		return string(dec), nil
+	}
+
+	var user, pass string
+	var err error
+	switch mech {
+	case "PLAIN":
+		var plain string
+		if resp == "" {
+			plain, err = challenge("")
+		} else {
+			plain, err = decode(resp)
+		}
+		if err == nil {
+			v := strings.Split(plain, "\x00")
+			if len(v) != 3 || (v[0] != "" && v[0] != v[1]) {
+				err = smtpReply("501 5.5.2 Bad SASL PLAIN response")
+			} else {
+				user, pass = v[1], v[2]
+			}
+		}
+	case "LOGIN":
+		if resp == "" {
+			user, err = challenge("Username:")
+		} else {
+			user, err = decode(resp)
+		}
+		if err == nil {
+			pass, err = challenge("Password:")
+		}
+	default:
+		c.send("504 5.5.4 Unsupported SASL mechanism")
+		return nil
+	}
+	if _, ok := err.(smtpReply); ok {
+		c.reply(err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	acct, err := GetAccount(user, pass)
+	if err != nil || acct.Password == "" {
+		time.Sleep(time.Second)
+		c.send("535 5.7.8 Bad username or password")
+		return nil
+	}
+	c.acct = acct
+	c.send("235 2.7.0 Authenticated")
+	return nil
+}
+
+// smtpPath returns the address in a MAIL FROM or RCPT TO
+// parameter, which follows prefix, and the parameters after it.
+func smtpPath(params, prefix string) (addr, rest string, ok bool) {
+	if len(params) < len(prefix) || !strings.EqualFold(params[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	params = strings.TrimSpace(params[len(prefix):])
+	if !strings.HasPrefix(params, "<") {
+		return "", "", false
+	}
+	i := strings.Index(params, ">")
+	if i < 0 {
+		return "", "", false
+	}
+	return params[1:i], strings.TrimSpace(params[i+1:]), true
+}
+
+// mail starts sending a message. It must be from the account that
+// logged in with AUTH.
+func (c *smtpConn) mail(params string) {
+	switch {
+	case c.acct == nil:
+		c.send("530 5.7.0 Authentication required")
+		return
+	case c.box != nil:
+		c.send("503 5.5.1 Already sending a message")
+		return
+	}
+	from, rest, ok := smtpPath(params, "FROM:")
+	if !ok {
+		c.send("501 5.5.4 Syntax: MAIL FROM:<address>")
+		return
+	}
+	v := strings.SplitN(from, "@", 2)
+	if len(v) != 2 || !strings.EqualFold(v[0], c.acct.Username) || !strings.EqualFold(v[1], "eight22er.danga.com") {
+		c.send(fmt.Sprintf("553 5.7.1 You can only send as %s@eight22er.danga.com", c.acct.Username))
+		return
+	}
+	for _, p := range strings.Fields(rest) {
+		kv := strings.SplitN(p, "=", 2)
+		if strings.EqualFold(kv[0], "SIZE") && len(kv) == 2 {
+			if n, err := strconv.Atoi(kv[1]); err == nil && n > *smtpMaxBytes {
+				c.send("552 5.3.4 Message too big")
+				return
+			}
+		}
+	}
+	// A failed sync only stops sending if the account can't send
+	// either; anything else may have cleared up, and Send will say.
+	switch err := syncer.Err(c.acct.Username); err.(type) {
+	case *RevokedError, *SuspendedError:
+		c.reply(smtpError(err))
+		return
+	}
+	c.box = &outbox{acct: c.acct}
+	c.send("250 2.1.0 OK")
+}
+
+func (c *smtpConn) rcpt(params string) {
+	if c.box == nil {
+		c.send("503 5.5.1 MAIL first")
+		return
+	}
+	to, _, ok := smtpPath(params, "TO:")
+	if !ok {
+		c.send("501 5.5.4 Syntax: RCPT TO:<address>")
+		return
+	}
+	if err := c.box.AddRecipient(to); err != nil {
+		c.reply(err)
+		return
+	}
+	c.send("250 2.1.5 OK")
+}
+
+// data reads the message and sends it. A non-nil error means the
+// connection is unusable.
+func (c *smtpConn) data() error {
+	if c.box == nil {
+		c.send("503 5.5.1 MAIL first")
+		return nil
+	}
+	box := c.box
+	c.box = nil
+	if len(box.to) == 0 {
+		c.send("554 5.5.1 No valid recipients")
+		return nil
+	}
+	c.send("354 Go ahead; end with <CRLF>.<CRLF>")
+	dr := c.tr.DotReader()
+	data, err := ioutil.ReadAll(io.LimitReader(dr, int64(*smtpMaxBytes)+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > *smtpMaxBytes {
+		// Read the rest, so its lines aren't taken for
+		// commands.
+		if _, err := io.Copy(ioutil.Discard, dr); err != nil {
+			return err
+		}
+		c.send("552 5.3.4 Message too big")
+		return nil
+	}
+	if err := box.send(data); err != nil {
+		c.reply(err)
+		return nil
+	}
+	c.send("250 2.0.0 Sent")
+	return nil
+}
+
+// An outbox is a mail message being sent as DMs from acct.
+type outbox struct {
+	acct *Account
+	to   []User
+}
+
+// AddRecipient adds the user a recipient's address refers to.
+func (o *outbox) AddRecipient(addr string) error {
+	v := strings.SplitN(addr, "@", 2)
+	if len(v) != 2 || !strings.EqualFold(v[1], "eight22er.danga.com") {
+		return smtpReply("550 5.1.2 Mail can only be sent to @eight22er.danga.com addresses")
+	}
+	localpart := v[0]
+	u, err := backendFor(o.acct).ResolveUser(o.acct, localpart)
+	switch e := err.(type) {
+	case nil:
+	case *RejectedError:
+		return smtpReply("553 5.1.3 " + oneLine(e.Reason))
+	case *APIError:
+		if isNoSuchUser(err) {
+			return smtpReply(fmt.Sprintf("550 5.1.1 No such user %q", localpart))
+		}
+		return smtpError(err)
+	default:
+		return smtpError(err)
+	}
+	o.to = append(o.to, u)
+	return nil
+}
+
+// isNoSuchUser reports whether err is a backend saying a recipient
+// doesn't exist.
+func isNoSuchUser(err error) bool {
+	e, ok := err.(*APIError)
+	return ok && (e.StatusCode == 404 || e.Code == twCodeNoUser || e.Code == twCodeUserNotFound)
+}
+
+// send sends the DMs in data, a mail message.
+func (o *outbox) send(data []byte) error {
+	text, inReplyTo, files, err := parseOutgoing(data)
+	if err != nil {
+		return smtpReply("554 5.6.0 Can't parse message: " + oneLine(err.Error()))
+	}
+	if text == "" && len(files) == 0 {
+		return smtpReply("554 5.6.0 Message has no text/plain part to send")
+	}
+	m := &Outgoing{To: o.to, InReplyTo: inReplyTo, Text: text}
+	if _, err := sendDMs("smtp", o.acct, m, files); err != nil {
+		return smtpError(err)
+	}
+	return nil
+}
+
+// sendDMs uploads files and sends m from acct, storing whatever was
+// sent even if sending it to every recipient failed. Mail sent over
+// SMTP and JMAP both goes through here; via names which, for the log.
+func sendDMs(via string, acct *Account, m *Outgoing, files []attachment) ([]DM, error) {
+	b := backendFor(acct)
+	for _, f := range files {
+		id, err := b.UploadMedia(acct, f.Filename, f.Data)
+		if err != nil {
+			return nil, err
+		}
+		m.MediaIDs = append(m.MediaIDs, id)
+	}
+	sent, err := b.Send(acct, m)
+	if store, serr := syncer.Store(acct.Username); serr == nil {
+		store.Add(sent)
+	}
+	for _, dm := range sent {
+		log.Printf("%s: %q sent DM %d", via, acct.Username, dm.ID)
+	}
+	if err != nil {
+		return sent, err
+	}
+	syncer.Touch(acct)
+	return sent, nil
+}
+
+// parseOutgoing returns the text to send from a mail message, with
+// quoted replies and signatures removed, the ID of the DM it
+// replies to, if any, and its attached files.
+func parseOutgoing(raw []byte) (text string, inReplyTo int64, files []attachment, err error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if err := walkPart(textproto.MIMEHeader(m.Header), m.Body, &text, &files); err != nil {
+		return "", 0, nil, err
+	}
+	if sm := replyIDRx.FindStringSubmatch(m.Header.Get("In-Reply-To")); sm != nil {
+		inReplyTo, _ = strconv.ParseInt(sm[1], 10, 64)
+	}
+	return replyText(text), inReplyTo, files, nil
+}
+
+// replyIDRx matches the Message-Id of a DM rendered by RFC822.
+var replyIDRx = regexp.MustCompile(`<(\d+)@eight22er\.danga\.com>`)
+
+// walkPart finds the first text/plain part and any attachments in
+// a MIME part and its children.
+func walkPart(h textproto.MIMEHeader, body io.Reader, text *string, files *[]attachment) error {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mediaType, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := walkPart(p.Header, p, text, files); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(transferDecoder(h.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	switch {
+	case mediaType == "text/plain" && disposition != "attachment" && *text == "":
+		*text = string(data)
+	case disposition == "attachment" || strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/"):
+		name := dparams["filename"]
+		if name == "" {
+			name = params["name"]
+		}
+		if name == "" {
+			name = "attachment"
+		}
+		*files = append(*files, attachment{Filename: name, ContentType: mediaType, Data: data})
+	}
+	return nil
+}
+
+func transferDecoder(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+var attributionRx = regexp.MustCompile(`^On .* wrote:$`)
+
+// replyText strips the parts of a reply that shouldn't be in the DM:
+// quoted lines, the "On ... wrote:" line before them, and the
+// signature.
+func replyText(s string) string {
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	var keep []string
+	for _, line := range strings.Split(s, "\n") {
+		if line == "-- " || attributionRx.MatchString(strings.TrimSpace(line)) {
+			break
+		}
+		if strings.HasPrefix(line, ">") {
+			continue
+		}
+		keep = append(keep, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(keep, "\n"))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestSMTPDataTooBig(t *testing.T) {
+	testDB(t)
+	defer func(v bool) { *dev = v }(*dev)
+	*dev = true
+	defer func(n int) { *smtpMaxBytes = n }(*smtpMaxBytes)
+	*smtpMaxBytes = 100
+
+	acct := &Account{Username: "alice.irc.example", Password: "pw", Token: "t", Backend: "irc", Instance: "ircs://irc.example:6697"}
+	if err := acct.Save(); err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() { done <- NewSMTPServer(nil, nil).newConn(server).serve() }()
+
+	c := textproto.NewConn(client)
+	step := func(code int, format string, args ...interface{}) {
+		t.Helper()
+		if format != "" {
+			if err := c.PrintfLine(format, args...); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, msg, err := c.ReadResponse(code); err != nil {
+			t.Fatalf("after %q: %v %s", format, err, msg)
+		}
+	}
+	step(220, "")
+	step(250, "EHLO test")
+	step(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00alice.irc.example\x00pw")))
+	step(250, "MAIL FROM:<alice.irc.example@eight22er.danga.com>")
+	step(250, "RCPT TO:<bob.irc.example@eight22er.danga.com>")
+	step(354, "DATA")
+	for i := 0; i < 10; i++ {
+		if err := c.PrintfLine("%s", strings.Repeat("x", 50)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step(552, ".")
+	step(221, "QUIT")
+	if err := <-done; err != nil {
+		t.Errorf("serve: %v", err)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	syncInterval    = flag.Duration("sync_interval", 2*time.Minute, "How often to sync DMs for an account that's getting new ones")
+	syncMaxInterval = flag.Duration("sync_max_interval", 30*time.Minute, "Longest sync interval for quiet accounts or after API errors")
+	syncIdle        = flag.Duration("sync_idle", 7*24*time.Hour, "Stop background syncing for accounts that haven't logged in for this long")
+)
+
+// syncer runs a background sync worker for each active account.
+var syncer = &syncManager{
+	workers: make(map[string]*syncWorker),
+	stores:  make(map[string]MessageStore),
+}
+
+type syncManager struct {
+	mu      sync.Mutex
+	workers map[string]*syncWorker  // by lowercase username
+	stores  map[string]MessageStore // by lowercase username
+}
+
+// A syncWorker periodically fetches new DMs for one account into its
+// MessageStore. The interval grows while no new DMs show up, doubles
+// while the API is failing, and resets once new DMs arrive.
+type syncWorker struct {
+	user  string
+	store MessageStore
+	kick  chan bool
+
+	mu         sync.Mutex
+	lastActive time.Time
+	interval   time.Duration
+	err        error // from the last sync
+}
+
+// Store returns the account's message store, opening it on first
+// use. Its changes are published on the events bus.
+func (m *syncManager) Store(user string) (MessageStore, error) {
+	key := strings.ToLower(user)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.stores[key]; ok {
+		return s, nil
+	}
+	s, err := openMessageStore(user)
+	if err != nil {
+		return nil, err
+	}
+	ps := &publishingStore{MessageStore: s, user: user}
+	m.stores[key] = ps
+	return ps, nil
+}
+
+// Touch marks the account as active, starting its sync worker if
+// it isn't running and asking for a sync soon.
+func (m *syncManager) Touch(a *Account) {
+	store, err := m.Store(a.Username)
+	if err != nil {
+		log.Printf("sync: can't open store for %q: %v", a.Username, err)
+		return
+	}
+	key := strings.ToLower(a.Username)
+	m.mu.Lock()
+	w, ok := m.workers[key]
+	if !ok {
+		w = &syncWorker{
+			user:     a.Username,
+			store:    store,
+			kick:     make(chan bool, 1),
+			interval: *syncInterval,
+		}
+		m.workers[key] = w
+	}
+	m.mu.Unlock()
+
+	w.mu.Lock()
+	w.lastActive = time.Now()
+	w.mu.Unlock()
+	if !ok {
+		go w.run()
+		return
+	}
+	select {
+	case w.kick <- true:
+	default:
+	}
+}
+
+// DMs returns the account's stored DMs, newest first, leaving out
+// sent ones if the account hides them.
+func (m *syncManager) DMs(a *Account) ([]DM, error) {
+	store, err := m.Store(a.Username)
+	if err != nil {
+		return nil, err
+	}
+	all := store.DMs()
+	if !a.HideSent {
+		return all, nil
+	}
+	var dms []DM
+	for _, dm := range all {
+		if !dm.Sent(a) {
+			dms = append(dms, dm)
+		}
+	}
+	return dms, nil
+}
+
+// Err returns the error from the account's most recent background
+// sync, or nil if it succeeded or the account isn't being synced.
+func (m *syncManager) Err(user string) error {
+	m.mu.Lock()
+	w, ok := m.workers[strings.ToLower(user)]
+	m.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (m *syncManager) remove(w *syncWorker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.workers, strings.ToLower(w.user))
+}
+
+func (w *syncWorker) run() {
+	for {
+		w.mu.Lock()
+		idle := time.Since(w.lastActive) > *syncIdle
+		interval := w.interval
+		w.mu.Unlock()
+		if idle {
+			log.Printf("sync: %q idle, stopping", w.user)
+			syncer.remove(w)
+			return
+		}
+
+		added, err := w.syncOnce()
+		w.prerender()
+		lastSync := time.Now()
+		w.mu.Lock()
+		w.err = err
+		if err != nil {
+			log.Printf("sync: %q: %v", w.user, err)
+		}
+		switch e := err.(type) {
+		case nil:
+			if added > 0 {
+				w.interval = *syncInterval
+			} else {
+				w.interval = w.interval * 3 / 2
+			}
+		case *RateLimitError:
+			w.interval = e.Reset.Sub(time.Now())
+		case *RevokedError, *SuspendedError:
+			// Nothing will work until the user does
+			// something about it.
+			w.interval = *syncMaxInterval
+		default:
+			w.interval *= 2
+		}
+		if w.interval < *syncInterval {
+			w.interval = *syncInterval
+		}
+		if _, limited := err.(*RateLimitError); w.interval > *syncMaxInterval && !limited {
+			w.interval = *syncMaxInterval
+		}
+		interval = w.interval
+		w.mu.Unlock()
+
+		select {
+		case <-w.kick:
+			// A client logged in; sync now, but no more
+			// often than -sync_interval, and not at all while
+			// rate limited.
+			if _, limited := err.(*RateLimitError); limited {
+				time.Sleep(interval - time.Since(lastSync))
+			} else {
+				time.Sleep(*syncInterval - time.Since(lastSync))
+			}
+		case <-time.After(interval):
+		}
+	}
+}
+
+// prerender renders the account's DMs that aren't in the render
+// cache, so POP's STAT and LIST find their sizes there rather than
+// render every message while the client waits.
+func (w *syncWorker) prerender() {
+	a := GetAccountNoAuth(w.user)
+	key := a.renderKey()
+	for _, dm := range w.store.DMs() {
+		if _, ok := w.store.RenderedSize(dm.ID, key); !ok {
+			renderDM(w.store, a, dm)
+		}
+	}
+}
+
+// syncOnce fetches new DMs for every stream the account wants and
+// adds them to the store, returning how many were new.
+func (w *syncWorker) syncOnce() (int, error) {
+	a := GetAccountNoAuth(w.user)
+	if a.Token == "" {
+		return 0, errAuthFailure
+	}
+	b := backendFor(a)
+	added := 0
+	var firstErr error
+	for _, stream := range b.Streams(a) {
+		c := w.store.Cursor(stream)
+		dms, err := b.Sync(a, stream, &c)
+		n, serr := w.store.Add(dms)
+		added += n
+		if serr == nil {
+			// Only move the cursor past DMs we stored.
+			serr = w.store.SetCursor(stream, c)
+		}
+		if err == nil {
+			err = serr
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if added > 0 {
+		log.Printf("sync: %q: %d new DMs", w.user, added)
+	}
+	return added, firstErr
+}
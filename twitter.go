@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bradfitz/eight22er/oauth"
+)
+
+var (
+	twitterUploadBase     = flag.String("twitter_upload_base", "https://upload.twitter.com", "Base URL of Twitter's media upload API")
+	twitterConsumerKey    = flag.String("twitter_consumer_key", "", "Twitter app consumer key; if empty, it's read from the config-consumerkey file")
+	twitterConsumerSecret = flag.String("twitter_consumer_secret", "", "Twitter app consumer secret; if empty, it's read from the config-consumersecret file")
+)
+
+// twitterBackend is the Backend for Twitter DMs, through whichever
+// API version -dm_api selects.
+type twitterBackend struct{}
+
+func (twitterBackend) Name() string { return "twitter" }
+
+func (twitterBackend) Host(a *Account) string {
+	if u, err := url.Parse(*twitterAPIBase); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "api.twitter.com"
+}
+
+func oauthClient() *oauth.Client {
+	return &oauth.Client{
+		Credentials: oauth.Credentials{
+			Token:  flagOrFile(*twitterConsumerKey, "config-consumerkey"),
+			Secret: flagOrFile(*twitterConsumerSecret, "config-consumersecret"),
+		},
+		TemporaryCredentialRequestURI: apiURL("/oauth/request_token"),
+		ResourceOwnerAuthorizationURI: apiURL("/oauth/authorize"),
+		TokenRequestURI:               apiURL("/oauth/access_token"),
+	}
+}
+
+// flagOrFile returns v, or if it's empty, the contents of file.
+func flagOrFile(v, file string) string {
+	if v != "" {
+		return v
+	}
+	return slurpFile(file)
+}
+
+func (twitterBackend) StartLogin(r *http.Request, callback string) (string, error) {
+	oc := oauthClient()
+	cred, err := oc.RequestTemporaryCredentials(http.DefaultClient, callback)
+	if err != nil {
+		return "", err
+	}
+	return oc.AuthorizationURL(cred), nil
+}
+
+func (twitterBackend) FinishLogin(r *http.Request, callback string) (*Account, error) {
+	oauthToken := r.FormValue("oauth_token")
+	verifier := r.FormValue("oauth_verifier")
+	log.Printf("Got callback token=%q, verifier=%q", oauthToken, verifier)
+	oc := oauthClient()
+
+	tcred := &oauth.Credentials{
+		Token:  oauthToken,
+		Secret: oc.Credentials.Secret, // consumer secret
+	}
+
+	cred, m, err := oc.RequestToken(http.DefaultClient, tcred, verifier)
+	if err != nil {
+		return nil, err
+	}
+	if m["screen_name"] == "" {
+		return nil, errors.New("no screen_name in access token response")
+	}
+	return &Account{
+		Username:    m["screen_name"],
+		Token:       cred.Token,
+		TokenSecret: cred.Secret,
+	}, nil
+}
+
+func (twitterBackend) Streams(a *Account) []string {
+	return a.streamNames()
+}
+
+func (twitterBackend) Sync(a *Account, stream string, c *SyncCursor) ([]DM, error) {
+	return a.SyncStream(stream, c)
+}
+
+// Conversations groups the DMs on the newest page of each stream by
+// partner, since Twitter has no API to list conversations.
+func (twitterBackend) Conversations(a *Account) ([]Conversation, error) {
+	dms, err := a.GetDMs(*dmPageSize)
+	if err != nil {
+		return nil, err
+	}
+	var convs []Conversation
+	seen := make(map[string]bool)
+	for _, dm := range dms {
+		id := dm.ConversationID(a)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		convs = append(convs, Conversation{
+			ID:           id,
+			Participants: []User{dm.Partner(a)},
+			Latest:       dm,
+		})
+	}
+	return convs, nil
+}
+
+// Messages pages back through a's DMs, as far as -dm_max_pages
+// allows, for those with the partner conv.
+func (twitterBackend) Messages(a *Account, conv string, n int) ([]DM, error) {
+	var dms []DM
+	for _, stream := range a.streamNames() {
+		p := a.Pager(stream)
+		got := 0
+		for n == 0 || got < n {
+			page, err := p.Next()
+			if err != nil {
+				return nil, err
+			}
+			if len(page) == 0 {
+				break
+			}
+			for _, dm := range page {
+				if dm.ConversationID(a) == conv && (n == 0 || got < n) {
+					dms = append(dms, dm)
+					got++
+				}
+			}
+		}
+	}
+	sort.Sort(dmsByNewest(dms))
+	if n > 0 && len(dms) > n {
+		dms = dms[:n]
+	}
+	return dms, nil
+}
+
+// Send sends a separate DM to each recipient, since Twitter has no
+// group DMs we can start.
+func (twitterBackend) Send(a *Account, m *Outgoing) ([]DM, error) {
+	if strings.TrimSpace(m.Text) == "" && len(m.MediaIDs) == 0 {
+		return nil, &RejectedError{"empty message"}
+	}
+	var sent []DM
+	for _, to := range m.To {
+		dm, err := currentDMAPI().send(a, to, m.Text, m.MediaIDs)
+		if err != nil {
+			return sent, err
+		}
+		if dm.ID != 0 {
+			sent = append(sent, dm)
+		}
+	}
+	return sent, nil
+}
+
+func (twitterBackend) Delete(a *Account, id int64) error {
+	return currentDMAPI().destroy(a, id)
+}
+
+// UploadMedia uploads a photo or GIF with the simple, one-request
+// form of media/upload. Videos need the chunked form and
+// server-side processing, which we don't do.
+func (twitterBackend) UploadMedia(a *Account, filename string, data []byte) (string, error) {
+	category := "dm_image"
+	switch ct := http.DetectContentType(data); {
+	case ct == "image/gif":
+		category = "dm_gif"
+	case strings.HasPrefix(ct, "image/"):
+	default:
+		return "", &RejectedError{fmt.Sprintf("can't attach %s (%s) to a Twitter DM; only photos and GIFs", filename, ct)}
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("media", filename)
+	if err != nil {
+		return "", err
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	params := make(url.Values)
+	params.Set("media_category", category)
+	urlBase := strings.TrimRight(*twitterUploadBase, "/") + "/1.1/media/upload.json"
+	res, err := api.Do(a, "POST", urlBase, params, mw.FormDataContentType(), body.Bytes())
+	if err != nil {
+		return "", err
+	}
+	var up struct {
+		MediaID string `json:"media_id_string"`
+	}
+	if err := json.Unmarshal(res, &up); err != nil || up.MediaID == "" {
+		return "", fmt.Errorf("bad media/upload response: %q", res)
+	}
+	return up.MediaID, nil
+}
+
+var screenNameRx = regexp.MustCompile(`^[A-Za-z0-9_]{1,15}$`)
+
+func (twitterBackend) ResolveUser(a *Account, localpart string) (User, error) {
+	if !screenNameRx.MatchString(localpart) {
+		return User{}, &RejectedError{fmt.Sprintf("%q isn't a Twitter screen name", localpart)}
+	}
+	return currentDMAPI().user(a, localpart)
+}
+
+func (twitterBackend) MailAddress(u User) string {
+	return u.Handle + "@eight22er.danga.com"
+}
+
+// twitterMediaHosts are the hosts Twitter serves DM photos and
+// videos from. FetchMedia signs its requests with the account's
+// token, so it sends them nowhere else.
+var twitterMediaHosts = map[string]bool{
+	"ton.twitter.com": true,
+	"pbs.twimg.com":   true,
+	"video.twimg.com": true,
+}
+
+// isTwitterMediaURL reports whether u is an HTTPS URL on one of
+// twitterMediaHosts.
+func isTwitterMediaURL(u string) bool {
+	pu, err := url.Parse(u)
+	return err == nil && pu.Scheme == "https" && twitterMediaHosts[strings.ToLower(pu.Host)]
+}
+
+// FetchMedia only fetches from twitterMediaHosts, and from
+// -twitter_api_base's host, where a test server serves media.
+func (twitterBackend) FetchMedia(a *Account, u string, maxBytes int64) ([]byte, error) {
+	pu, err := url.Parse(u)
+	base, _ := url.Parse(*twitterAPIBase)
+	testHost := err == nil && base != nil && pu.Scheme == base.Scheme && strings.EqualFold(pu.Host, base.Host)
+	if !isTwitterMediaURL(u) && !testHost {
+		return nil, fmt.Errorf("%q isn't a Twitter media URL", u)
+	}
+	bs, err := api.Get(a, u, make(url.Values), maxBytes)
+	if err == errBodyTooBig {
+		return nil, errMediaTooBig
+	}
+	return bs, err
+}
+
+// GetDMs returns up to n of the account's most recent DMs from each
+// of its streams, newest first. If n is 0, it pages back through as
+// much history as the -dm_max_pages flag allows.
+func (a *Account) GetDMs(n int) ([]DM, error) {
+	var dms []DM
+	for _, stream := range a.streamNames() {
+		p := a.Pager(stream)
+		if n > 0 && n < p.PageSize {
+			p.PageSize = n
+		}
+		got := 0
+		for n == 0 || got < n {
+			page, err := p.Next()
+			if err != nil {
+				return nil, err
+			}
+			if len(page) == 0 {
+				break
+			}
+			if n > 0 && got+len(page) > n {
+				page = page[:n-got]
+			}
+			dms = append(dms, page...)
+			got += len(page)
+		}
+	}
+	sort.Sort(dmsByNewest(dms))
+	return dms, nil
+}
+
+func buildAuthHeader(vals url.Values) string {
+	var buf bytes.Buffer
+	if _, ok := vals["oauth_version"]; !ok {
+		vals.Set("oauth_version", "1.0")
+	}
+	fmt.Fprintf(&buf, "OAuth")
+	remove := []string{}
+	for k := range vals {
+		if !strings.HasPrefix(k, "oauth_") {
+			continue
+		}
+		remove = append(remove, k)
+	}
+	sort.Strings(remove)
+	for n, k := range remove {
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		v := vals.Get(k)
+		if k == "oauth_signature" {
+			v = url.QueryEscape(v)
+		}
+		fmt.Fprintf(&buf, " %s=%q", k, v)
+		delete(vals, k)
+	}
+	return buf.String()
+}
+
+// signedGet does an OAuth-signed GET of urlBase with params on
+// behalf of the account. Everything but apiClient should use
+// api.Get instead, so rate limits are tracked.
+func (a *Account) signedGet(urlBase string, params url.Values) (*http.Response, error) {
+	return a.signedRequest("GET", urlBase, params, "", nil)
+}
+
+// signedRequest is signedGet for any method. See apiClient.Do for
+// where params and body go.
+func (a *Account) signedRequest(method, urlBase string, params url.Values, contentType string, body []byte) (*http.Response, error) {
+	oc := oauthClient()
+	cred := &oauth.Credentials{
+		Token:  a.Token,
+		Secret: a.TokenSecret,
+	}
+	oc.SignParam(cred, method, urlBase, map[string][]string(params))
+
+	// Only the path is logged: the query has the OAuth parameters
+	// and the user's own.
+	if u, err := url.Parse(urlBase); err == nil {
+		log.Printf("Req: %s %s", method, u.Path)
+	}
+	authHeader := buildAuthHeader(params)
+	var req *http.Request
+	if body == nil && method == "POST" {
+		req, _ = http.NewRequest(method, urlBase, strings.NewReader(params.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		reqURL := urlBase
+		if len(params) > 0 {
+			reqURL += "?" + params.Encode()
+		}
+		req, _ = http.NewRequest(method, reqURL, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+	}
+	req.Header.Add("Authorization", authHeader)
+	return http.DefaultClient.Do(req)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/eight22er/faketwitter"
+)
+
+// newFakeTwitter starts a faketwitter server with alice, bob and
+// carol, and points the Twitter flags at it for the test.
+func newFakeTwitter(t *testing.T) *faketwitter.Server {
+	f := faketwitter.NewServer()
+	t.Cleanup(f.Close)
+	for _, p := range []*string{twitterAPIBase, twitterUploadBase, twitterConsumerKey, twitterConsumerSecret} {
+		p, v := p, *p
+		t.Cleanup(func() { *p = v })
+	}
+	*twitterAPIBase, *twitterUploadBase = f.URL, f.URL
+	*twitterConsumerKey, *twitterConsumerSecret = faketwitter.ConsumerKey, faketwitter.ConsumerSecret
+	f.AddUser("alice", "Alice")
+	f.AddUser("bob", "Bob")
+	f.AddUser("carol", "Carol")
+	return f
+}
+
+// twitterLogin signs in to f as alice through loginFunc, f's
+// authorize page and cbFunc, and returns the saved account.
+func twitterLogin(t *testing.T, f *faketwitter.Server) *Account {
+	w := httptest.NewRecorder()
+	loginFunc(w, httptest.NewRequest("GET", "/login?backend=twitter", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: %d %s", w.Code, w.Body)
+	}
+	authURL := w.Header().Get("Location")
+	if !strings.HasPrefix(authURL, f.URL+"/oauth/authorize?") {
+		t.Fatalf("login redirected to %q", authURL)
+	}
+
+	res, err := (&http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}).Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	cb, err := url.Parse(res.Header.Get("Location"))
+	if err != nil || cb.Path != "/cb" || cb.Query().Get("oauth_verifier") == "" {
+		t.Fatalf("authorize redirected to %q", res.Header.Get("Location"))
+	}
+
+	w = httptest.NewRecorder()
+	cbFunc(w, httptest.NewRequest("GET", "/cb?"+cb.RawQuery, nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	alice, _ := f.User("alice")
+	a := GetAccountNoAuth("alice")
+	if a.Backend != "twitter" || a.Token != alice.Token || a.TokenSecret != alice.TokenSecret {
+		t.Fatalf("saved account = %+v; want alice's access token", a)
+	}
+	if a.Password == "" || a.Password == a.Token {
+		t.Errorf("account password %q; want a new secret", a.Password)
+	}
+	return a
+}
+
+func TestTwitterLoginAndDMs(t *testing.T) {
+	for _, version := range []string{"1", "1.1", "2"} {
+		t.Run("dm_api="+version, func(t *testing.T) {
+			testDB(t)
+			defer func(v string) { *dmAPIVersion = v }(*dmAPIVersion)
+			*dmAPIVersion = version
+			defer func(n int) { *dmPageSize = n }(*dmPageSize)
+			*dmPageSize = 2
+
+			f := newFakeTwitter(t)
+			start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			f.AddDMAt("bob", "alice", "hi alice", start)
+			f.AddDMAt("alice", "bob", "hi bob", start.Add(time.Minute))
+			f.AddDMAt("carol", "alice", "lunch?", start.Add(2*time.Minute))
+			f.AddDMAt("bob", "carol", "not alice's", start.Add(3*time.Minute))
+
+			a := twitterLogin(t, f)
+			dms, err := a.GetDMs(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, dm := range dms {
+				got = append(got, dm.Sender.Handle+">"+dm.Recipient.Handle+": "+dm.Text)
+			}
+			want := []string{"carol>alice: lunch?", "alice>bob: hi bob", "bob>alice: hi alice"}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("GetDMs =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+
+			if dms, err := a.GetDMs(1); err != nil || len(dms) == 0 || dms[0].Text != "lunch?" {
+				t.Errorf("GetDMs(1) = %v, %v; want the newest", dms, err)
+			}
+		})
+	}
+}
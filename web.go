@@ -1,13 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-
-	"github.com/bradfitz/eight22er/oauth"
+	"strings"
+	"time"
 )
 
 func runWebServer(ln net.Listener) {
@@ -16,6 +17,17 @@ func runWebServer(ln net.Listener) {
 	mux.HandleFunc("/login", loginFunc)
 	mux.HandleFunc("/setconfig", configFunc)
 	mux.HandleFunc("/cb", cbFunc)
+	mux.HandleFunc("/ratelimits", rateLimitsFunc)
+	mux.HandleFunc("/events", eventsFunc)
+	mux.HandleFunc("/export", exportFunc)
+	mux.HandleFunc("/import", importFunc)
+	mux.HandleFunc("/feed", feedFunc)
+	mux.HandleFunc("/metrics", metricsFunc)
+	mux.HandleFunc("/.well-known/jmap", jmapSessionFunc)
+	mux.HandleFunc("/jmap/api", jmapAPIFunc)
+	mux.HandleFunc("/jmap/eventsource", jmapEventSourceFunc)
+	mux.HandleFunc("/jmap/upload/", jmapUploadFunc)
+	mux.HandleFunc("/jmap/download/", jmapDownloadFunc)
 	mux.Handle("/", http.FileServer(http.Dir("static")))
 	s := &http.Server{Handler: mux}
 	s.Serve(ln)
@@ -29,45 +41,113 @@ func runSSLRedirector(ln net.Listener) {
 	s.Serve(ln)
 }
 
-func loginFunc(w http.ResponseWriter, r *http.Request) {
-	oc := oauthClient()
+// baseURL returns the URL of the web server the request came to.
+func baseURL(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// requestBackend returns the backend named by the request's
+// "backend" parameter, defaulting to Twitter.
+func requestBackend(r *http.Request) (Backend, bool) {
+	name := r.FormValue("backend")
+	if name == "" {
+		name = defaultBackend
+	}
+	b, ok := backends[name]
+	return b, ok
+}
+
+// loginCallback returns the URL a backend's sign-in flow should
+// return to.
+func loginCallback(b Backend) string {
 	callback := "https://eight22er.danga.com/cb"
 	if *dev {
-		callback = fmt.Sprintf("http://localhost:%d/cb", *webPort)
+		callback = "http://" + net.JoinHostPort("localhost", webPortString()) + "/cb"
+	}
+	return callback + "?backend=" + url.QueryEscape(b.Name())
+}
+
+// webPortString returns the port of -web_port, which may be given
+// as just a port or as a host and port.
+func webPortString() string {
+	s := webPort.String()
+	if _, port, err := net.SplitHostPort(s); err == nil {
+		return port
+	}
+	return s
+}
+
+func loginFunc(w http.ResponseWriter, r *http.Request) {
+	b, ok := requestBackend(r)
+	if !ok {
+		http.Error(w, "unknown backend", http.StatusBadRequest)
+		return
+	}
+	authURL, err := b.StartLogin(r, loginCallback(b))
+	if err != nil {
+		log.Printf("Starting %s login failed: %v", b.Name(), err)
+		http.Error(w, "couldn't start signing in", http.StatusBadGateway)
+		return
 	}
-	cred, err := oc.RequestTemporaryCredentials(http.DefaultClient, callback)
-	check(err)
-	authURL := oc.AuthorizationURL(cred)
 	println("AUTH URL: " + authURL)
 	http.Redirect(w, r, authURL, http.StatusFound)
 }
 
 func cbFunc(w http.ResponseWriter, r *http.Request) {
-	oauthToken := r.FormValue("oauth_token")
-	verifier := r.FormValue("oauth_verifier")
-	log.Printf("Got callback token=%q, verifier=%q", oauthToken, verifier)
-	oc := oauthClient()
-
-	tcred := &oauth.Credentials{
-		Token:  oauthToken,
-		Secret: oc.Credentials.Secret, // consumer secret
+	b, ok := requestBackend(r)
+	if !ok {
+		http.Error(w, "unknown backend", http.StatusBadRequest)
+		return
 	}
-
-	cred, m, err := oc.RequestToken(http.DefaultClient, tcred, verifier)
+	login, err := b.FinishLogin(r, loginCallback(b))
 	if err != nil {
 		fmt.Fprintf(w, "RequestToken failed: %q", err)
 		return
 	}
 
-	acct := GetAccountNoAuth(m["screen_name"])
-	acct.Token = cred.Token
-	acct.TokenSecret = cred.Secret
-	if acct.Password == "" {
-		acct.Password = cred.Token
+	acct := GetAccountNoAuth(login.Username)
+	if acct.Token != "" && backendFor(acct).Name() != b.Name() {
+		// Mastodon and Matrix usernames look alike.
+		fmt.Fprintf(w, "The eight22er account %q is already signed in to %s", acct.Username, backendFor(acct).Name())
+		return
 	}
+	// Accounts used to get their service token as their password.
+	if acct.Password == "" || acct.Password == acct.Token {
+		acct.Password = newSecret()
+	}
+	acct.Backend = b.Name()
+	acct.Token = login.Token
+	acct.TokenSecret = login.TokenSecret
+	acct.Instance = login.Instance
+	acct.Channels = login.Channels
 	acct.Save()
 
-	configURL := fmt.Sprintf("/config.html?user=%v&password=%v", m["screen_name"], url.QueryEscape(acct.Password))
+	configURL := fmt.Sprintf("/config.html?user=%v&tz=%v&nomedia=%v&hidesent=%v%s", acct.Username, url.QueryEscape(acct.TimeZone), acct.NoMedia, acct.HideSent, webhookParams(acct))
+	showConfig(w, r, configURL, acct.Password, acct)
+}
+
+// showConfig redirects to configURL on the config page, passing it
+// the account's password and other secrets in a short-lived cookie,
+// since URLs end up in browser history, logs and Referer headers.
+func showConfig(w http.ResponseWriter, r *http.Request, configURL, password string, acct *Account) {
+	secrets := url.Values{"password": {password}}
+	if acct.Webhook != "" {
+		secrets.Set("webhooksecret", acct.WebhookSecret)
+	}
+	if acct.FeedToken != "" {
+		secrets.Set("feedtoken", acct.FeedToken)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "config",
+		Value:    secrets.Encode(),
+		Path:     "/config.html",
+		MaxAge:   600,
+		Secure:   !*dev,
+		SameSite: http.SameSiteStrictMode,
+	})
 	http.Redirect(w, r, configURL, http.StatusFound)
 }
 
@@ -75,18 +155,102 @@ func configFunc(w http.ResponseWriter, r *http.Request) {
 	username := r.FormValue("username")
 	password := r.FormValue("password")
 	newPassword := r.FormValue("newPassword")
+	timeZone := strings.TrimSpace(r.FormValue("timezone"))
 
 	acct, err := GetAccount(username, password)
 	if err != nil {
 		log.Printf("Getting account %q failed: %v", username, err)
-		configURL := fmt.Sprintf("/config.html?user=%v&password=%v&wrongpw=1", username, password)
-		http.Redirect(w, r, configURL, http.StatusFound)
+		showConfig(w, r, "/config.html?user="+url.QueryEscape(username)+"&wrongpw=1", password, &Account{})
 		return
 	}
 
+	if _, err := time.LoadLocation(timeZone); err != nil {
+		log.Printf("Bogus time zone %q for %q: %v", timeZone, username, err)
+		timeZone = acct.TimeZone
+	}
+
 	acct.Password = newPassword
+	acct.TimeZone = timeZone
+	acct.NoMedia = r.FormValue("nomedia") != ""
+	acct.HideSent = r.FormValue("hidesent") != ""
+	switch webhook := strings.TrimSpace(r.FormValue("webhook")); {
+	case webhook == "":
+		acct.Webhook, acct.WebhookSecret = "", ""
+	case validWebhook(webhook):
+		acct.Webhook = webhook
+		if acct.WebhookSecret == "" {
+			acct.WebhookSecret = newSecret()
+		}
+	default:
+		log.Printf("Bogus webhook URL %q for %q", webhook, username)
+	}
+	switch {
+	case r.FormValue("feed") == "":
+		acct.FeedToken = ""
+	case acct.FeedToken == "":
+		acct.FeedToken = newSecret()
+	}
 	acct.Save()
 
-	configURL := fmt.Sprintf("/config.html?user=%v&password=%v&setpw=1", username, newPassword)
-	http.Redirect(w, r, configURL, http.StatusFound)
+	configURL := fmt.Sprintf("/config.html?user=%v&tz=%v&nomedia=%v&hidesent=%v%s&setpw=1", username, url.QueryEscape(timeZone), acct.NoMedia, acct.HideSent, webhookParams(acct))
+	showConfig(w, r, configURL, newPassword, acct)
+}
+
+// webhookParams returns the query parameter that shows the config
+// page the account's webhook URL. Its secret goes in showConfig's
+// cookie.
+func webhookParams(acct *Account) string {
+	if acct.Webhook == "" {
+		return ""
+	}
+	return "&webhook=" + url.QueryEscape(acct.Webhook)
+}
+
+// requestAccount returns the account r signs in as, with HTTP Basic
+// auth or the username and password fields of a POSTed form. A
+// password in the URL isn't taken, since URLs end up in logs and
+// browser history.
+func requestAccount(r *http.Request) (*Account, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		if r.Method != "POST" {
+			return nil, errAuthFailure
+		}
+		user, pass = r.PostFormValue("username"), r.PostFormValue("password")
+	}
+	return GetAccount(user, pass)
+}
+
+// rateLimitsFunc reports the account's remaining Twitter API budget
+// as JSON, for the config page.
+func rateLimitsFunc(w http.ResponseWriter, r *http.Request) {
+	acct, err := requestAccount(r)
+	if err != nil {
+		http.Error(w, "bad username or password", http.StatusForbidden)
+		return
+	}
+	type limit struct {
+		Endpoint  string `json:"endpoint"`
+		Limit     int    `json:"limit"`
+		Remaining int    `json:"remaining"`
+		Reset     int64  `json:"reset"`
+	}
+	limits := []limit{}
+	for _, rl := range api.Limits(acct.Username) {
+		limits = append(limits, limit{rl.Endpoint, rl.Limit, rl.Remaining, rl.Reset.Unix()})
+	}
+	var syncErr string
+	if err := syncer.Err(acct.Username); err != nil {
+		syncErr = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"limits":    limits,
+		"syncError": syncErr,
+	})
+}
+
+func metricsFunc(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	api.writeMetrics(w)
 }
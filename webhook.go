@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	webhookTimeout  = flag.Duration("webhook_timeout", 10*time.Second, "How long a webhook POST may take")
+	webhookAttempts = flag.Int("webhook_attempts", 3, "How many times to try delivering an event to a webhook that's failing")
+)
+
+// webhookQueueLen is how many events may wait for one account's
+// webhook before new ones are dropped.
+const webhookQueueLen = 256
+
+// webhookIdle is how long an account's webhook worker waits for
+// another event before exiting.
+const webhookIdle = 10 * time.Minute
+
+// webhooks delivers events to the accounts' webhooks, one worker per
+// account so a slow endpoint only holds up its own events, which it
+// gets in order.
+var webhooks = struct {
+	sync.Mutex
+	queues map[string]chan Event // by lowercase username
+}{queues: make(map[string]chan Event)}
+
+// runWebhooks posts every published event to its account's webhook,
+// if it has one.
+func runWebhooks() {
+	sub := events.Subscribe("", 1024)
+	for ev := range sub.C {
+		if GetAccountNoAuth(ev.User).Webhook == "" {
+			continue
+		}
+		key := strings.ToLower(ev.User)
+		webhooks.Lock()
+		q, ok := webhooks.queues[key]
+		if !ok {
+			q = make(chan Event, webhookQueueLen)
+			webhooks.queues[key] = q
+			go webhookWorker(key, q)
+		}
+		select {
+		case q <- ev:
+		default:
+			log.Printf("webhook: queue for %q full, dropping event %d", ev.User, ev.Seq)
+		}
+		webhooks.Unlock()
+	}
+}
+
+func webhookWorker(key string, q chan Event) {
+	for {
+		select {
+		case ev := <-q:
+			// Re-read the account each time, in case the
+			// webhook was changed or removed.
+			a := GetAccountNoAuth(ev.User)
+			if a.Webhook == "" {
+				continue
+			}
+			if err := deliverWebhook(a, ev); err != nil {
+				log.Printf("webhook: event %d for %q: %v", ev.Seq, ev.User, err)
+			}
+		case <-time.After(webhookIdle):
+			webhooks.Lock()
+			if len(q) == 0 {
+				delete(webhooks.queues, key)
+				webhooks.Unlock()
+				return
+			}
+			webhooks.Unlock()
+		}
+	}
+}
+
+// deliverWebhook POSTs ev as JSON to a's webhook, retrying with
+// backoff on network errors and 5xx responses. The body is signed
+// with the account's webhook secret in X-Eight22er-Signature, as
+// "sha256=" and the hex HMAC-SHA256. Webhooks are URLs users give
+// us, so they're reached the same way as publicClient.
+func deliverWebhook(a *Account, ev Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(a.WebhookSecret))
+	mac.Write(body)
+	sig := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	client := &http.Client{Transport: publicClient.Transport, Timeout: *webhookTimeout}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("POST", a.Webhook, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "eight22er")
+		req.Header.Set("X-Eight22er-Event", ev.Type)
+		req.Header.Set("X-Eight22er-Signature", sig)
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			switch {
+			case res.StatusCode < 300:
+				return nil
+			case res.StatusCode < 500:
+				return fmt.Errorf("%s: %s", a.Webhook, res.Status)
+			}
+			err = fmt.Errorf("%s: %s", a.Webhook, res.Status)
+		}
+		if attempt >= *webhookAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 4
+	}
+}
+
+// validWebhook reports whether u is a URL we'll POST events to.
+func validWebhook(u string) bool {
+	p, err := url.Parse(u)
+	if err != nil || p.Host == "" {
+		return false
+	}
+	return p.Scheme == "https" || p.Scheme == "http" && *dev
+}
+
+// newSecret returns a random secret, for signing an account's
+// webhook requests or in its feed URL.
+func newSecret() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDeliverWebhook(t *testing.T) {
+	defer func(v bool) { *allowPrivateHosts = v }(*allowPrivateHosts)
+	defer func(n int) { *webhookAttempts = n }(*webhookAttempts)
+	*webhookAttempts = 1
+
+	var got Event
+	var sig string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &got)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		sig = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		if r.Header.Get("X-Eight22er-Signature") != sig || r.Header.Get("X-Eight22er-Event") != "new" {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+	a := &Account{Username: "alice", Webhook: srv.URL + "/hook", WebhookSecret: "s3cret"}
+	ev := Event{Seq: 7, Type: "new", User: "alice", ID: 42}
+
+	*allowPrivateHosts = false
+	if err := deliverWebhook(a, ev); err == nil || !strings.Contains(err.Error(), errPrivateHost.Error()) {
+		t.Fatalf("delivered to %s: %v", srv.URL, err)
+	}
+	if sig != "" {
+		t.Fatal("webhook on loopback was reached")
+	}
+
+	*allowPrivateHosts = true
+	if err := deliverWebhook(a, ev); err != nil {
+		t.Fatal(err)
+	}
+	if got.Seq != 7 || got.ID != 42 || got.Type != "new" {
+		t.Errorf("webhook got %+v", got)
+	}
+}
+
+func TestEventsAuth(t *testing.T) {
+	a, _ := jmapTestAccount(t)
+	a.FeedToken = "feedtoken"
+	if err := a.Save(); err != nil {
+		t.Fatal(err)
+	}
+	q := func(kv ...string) string {
+		v := url.Values{"wait": {"0"}}
+		for i := 0; i+1 < len(kv); i += 2 {
+			v.Set(kv[i], kv[i+1])
+		}
+		return "/events?" + v.Encode()
+	}
+	basic := httptest.NewRequest("GET", q(), nil)
+	basic.SetBasicAuth(a.Username, a.Password)
+	post := httptest.NewRequest("POST", q(), strings.NewReader(url.Values{"username": {a.Username}, "password": {a.Password}}.Encode()))
+	post.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, tt := range []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"password in the URL", httptest.NewRequest("GET", q("username", a.Username, "password", a.Password), nil), http.StatusForbidden},
+		{"Basic auth", basic, http.StatusOK},
+		{"POST", post, http.StatusOK},
+		{"feed token", httptest.NewRequest("GET", q("user", a.Username, "token", "feedtoken"), nil), http.StatusOK},
+		{"wrong feed token", httptest.NewRequest("GET", q("user", a.Username, "token", "nope"), nil), http.StatusForbidden},
+	} {
+		w := httptest.NewRecorder()
+		eventsFunc(w, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: %d %s; want %d", tt.name, w.Code, w.Body, tt.want)
+		}
+	}
+}